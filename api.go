@@ -3,34 +3,127 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/itswisdomagain/remindme/client"
 	"go.etcd.io/bbolt"
 )
 
 type apiServer struct {
-	db *bbolt.DB
+	db         *bbolt.DB
+	webhooks   *webhookDispatcher
+	digests    *digestScheduler
+	variants   *variantGenerator
+	links      *linkPreviewer
+	authTokens map[[sha256.Size]byte]string
+	admins     map[string]bool
+	metrics    *serverMetrics
+	limits     *rateLimiter
+	// trashRetention is how long deleted items and categories are kept in
+	// the trash.
+	trashRetention time.Duration
+	// maxUploadBytes is the largest item content accepted.
+	maxUploadBytes int64
+	// userQuota and categoryQuota limit the storage used by each user and
+	// category, if not 0.
+	userQuota, categoryQuota int64
 }
 
 func (api *apiServer) Start(ctx context.Context) error {
 	// Create an HTTP router.
 	mux := chi.NewRouter()
+	mux.Use(middleware.RequestID, logRequests, compressResponses)
+
+	mux.Get("/healthz", api.healthz)
+	mux.Get("/readyz", api.readyz)
+	// Metrics are read with the same credentials and limits as the API, as
+	// they reveal the size of the library and how it is used.
+	mux.With(api.limits.middleware, api.authenticate, api.limits.users).Get("/metrics", api.serveMetrics)
 
 	// Mount api endpoints.
 	mux.Route("/api", func(r chi.Router) {
-		r.Get("/items", api.allItems)
-		r.Post("/items", api.storeItem)
+		r.Use(api.metrics.middleware)
+		r.Use(api.limits.middleware)
+		r.Use(api.authenticate)
+		r.Use(api.limits.users)
+
+		r.With(api.limits.expensive).Get("/items", api.allItems)
+		r.With(api.limits.expensive).Post("/items", api.storeItem)
+
+		r.Get("/categories", api.listCategories)
+		r.Route("/categories/{category}", func(r chi.Router) {
+			r.Delete("/", api.deleteCategory)
+			r.Get("/items", api.listCategoryItems)
+			r.With(api.limits.expensive).Post("/items", api.bulkUpload)
+			r.Put("/order", api.reorderItems)
+			r.Get("/items/{item}", api.getItem)
+			r.Delete("/items/{item}", api.deleteItem)
+			r.Get("/items/{item}/content", api.itemContent)
+			r.Get("/items/{item}/original", api.itemOriginal)
+			r.Get("/items/{item}/revisions", api.listRevisions)
+			r.Get("/items/{item}/revisions/{revision}/content", api.revisionContent)
+			r.Get("/items/{item}/revisions/{revision}/diff", api.revisionDiff)
+			r.Post("/items/{item}/revisions/{revision}/restore", api.restoreRevision)
+			r.Get("/settings", api.getSettings)
+			r.Put("/settings", api.saveSettings)
+		})
+
+		r.Get("/changes", api.listChanges)
+		r.Get("/audit", api.listAudit)
+		r.Get("/search", api.searchItems)
+		r.Get("/usage", api.getUsage)
+
+		r.Get("/progress", api.listProgress)
+		r.Put("/progress/{category}", api.saveProgress)
+		r.Delete("/progress/{category}", api.deleteProgress)
+
+		r.Get("/checklists/stats", api.checklistStats)
+		r.Put("/checklists/{category}/{item}/runs", api.reportChecklistRun)
+
+		r.Get("/responses", api.listResponses)
+		r.Put("/responses/{category}/{item}", api.saveResponse)
+
+		r.Route("/trash", func(r chi.Router) {
+			r.Get("/", api.listTrash)
+			r.Post("/{id}/restore", api.restoreTrash)
+			r.Delete("/{id}", api.purgeTrash)
+		})
+
+		r.Route("/webhooks", func(r chi.Router) {
+			r.Get("/", api.listWebhooks)
+			r.Post("/", api.createWebhook)
+			r.Delete("/{id}", api.deleteWebhook)
+			r.Post("/{id}/ping", api.pingWebhook)
+			r.Get("/{id}/deliveries", api.webhookDeliveries)
+		})
+
+		r.Route("/digests", func(r chi.Router) {
+			r.Get("/", api.listDigests)
+			r.Post("/", api.createDigest)
+			r.Delete("/{id}", api.deleteDigest)
+			r.Post("/{id}/send", api.sendDigest)
+			r.Get("/{id}/history", api.digestHistory)
+		})
 	})
 
+	// Serve the web admin and player for all other paths.
+	mux.Handle("/*", webHandler())
+
 	// Get ready to serve the API.
 	listenAddr := "0.0.0.0:17778"
 	listener, err := net.Listen("tcp", listenAddr)
@@ -45,7 +138,7 @@ func (api *apiServer) Start(ctx context.Context) error {
 	go func() {
 		<-ctx.Done()
 		if err := httpServer.Shutdown(context.Background()); err != nil {
-			fmt.Fprintf(os.Stderr, "api server shutdown error: %v\n", err)
+			srvLog.Errorf("api server shutdown error: %v", err)
 			os.Exit(1)
 		}
 	}()
@@ -61,7 +154,7 @@ func (api *apiServer) Start(ctx context.Context) error {
 		}
 	}()
 
-	fmt.Printf("API live on http://%s\n", listenAddr)
+	srvLog.Infof("API live on http://%s", listenAddr)
 	wg.Wait()
 
 	return err
@@ -70,136 +163,509 @@ func (api *apiServer) Start(ctx context.Context) error {
 var (
 	itemContentKey = []byte("content")
 	itemTypeKey    = []byte("type")
+	itemOrderKey   = []byte("order")
 )
 
-type Item struct {
-	Name    string `json:"name"`
-	Type    string `json:"type"`
-	Content []byte `json:"Content"`
+type Item = client.Item
+
+// uploadFormBytes is how much of an item upload may be taken by the form
+// fields other than the content and by the multipart encoding.
+const uploadFormBytes = 64 << 10
+
+// errBodyTooLarge is the error returned when reading past the limit of
+// http.MaxBytesReader.
+const errBodyTooLarge = "http: request body too large"
+
+// uploadTooLarge is returned when the content of an upload is over the
+// server's limit.
+type uploadTooLarge struct {
+	limit int64
 }
 
-const maxFileBytes = 10_000_000 // 10mb
+func (e *uploadTooLarge) Error() string {
+	return fmt.Sprintf("upload is larger than the limit of %d bytes", e.limit)
+}
 
-func (api *apiServer) storeItem(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(maxFileBytes)
-
-	category := r.FormValue("category")
-	itemName := r.FormValue("item.name")
-	itemType := strings.ToLower(r.FormValue("item.type"))
-	itemContent := r.FormValue("item.content")
-
-	var content []byte
-	var hasAttachment bool
-	f, h, err := r.FormFile("item.attachment")
-	if err != nil && !errors.Is(err, http.ErrMissingFile) {
-		fmt.Fprintf(os.Stderr, "Error reading file attachment: %v\n", err)
-		http.Error(w, "error reading file attachment", http.StatusInternalServerError)
+// metadataFieldPrefix starts the names of upload form fields that hold item
+// metadata, e.g. item.metadata.author.
+const metadataFieldPrefix = "item.metadata."
+
+// itemUpload is an item uploaded to storeItem.
+type itemUpload struct {
+	category string
+	item     *Item
+	// attachmentType is the content type of the uploaded file, or empty if
+	// the content was given in the item.content field.
+	attachmentType string
+	// attachment holds the uploaded file until readAttachment reads it into
+	// the item content. It is removed by close.
+	attachment     *os.File
+	attachmentSize int64
+	// version is the version field, the item version the upload replaces.
+	version string
+}
+
+// readAttachment reads the uploaded file into the item content, if it has
+// not been read yet.
+func (upload *itemUpload) readAttachment() error {
+	if upload.attachment == nil || upload.item.Content != nil {
+		return nil
+	}
+	if _, err := upload.attachment.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	content := make([]byte, upload.attachmentSize)
+	if _, err := io.ReadFull(upload.attachment, content); err != nil {
+		return fmt.Errorf("failed to read uploaded file: %w", err)
+	}
+	upload.item.Content = content
+	return nil
+}
+
+// close removes the uploaded file.
+func (upload *itemUpload) close() {
+	if upload.attachment == nil {
 		return
 	}
-	if f != nil {
-		hasAttachment = true
-		buf := bytes.NewBuffer(nil)
-		_, err = io.Copy(buf, f)
+	upload.attachment.Close()
+	if err := os.Remove(upload.attachment.Name()); err != nil {
+		apiLog.Errorf("Error removing uploaded file: %v", err)
+	}
+}
+
+// readItemUpload reads an item upload form. Multipart forms are read as
+// they arrive. The attachment is written to a temporary file as it is
+// received, rather than held in memory, and the upload is rejected as soon
+// as the attachment is over the size limit or, if the category and item
+// name came before it, over the quotas of the category and user. It is only
+// read into memory to be stored, see storeItem. An *uploadTooLarge or
+// *quotaExceeded error is returned if the content does not fit. The upload
+// must be closed to remove the file.
+func (api *apiServer) readItemUpload(w http.ResponseWriter, r *http.Request) (_ *itemUpload, err error) {
+	r.Body = http.MaxBytesReader(w, r.Body, api.maxUploadBytes+uploadFormBytes)
+	fields := make(map[string]string)
+	upload := &itemUpload{item: new(Item)}
+	defer func() {
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "file bytes copy error: %v\n", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			upload.close()
+		}
+		if err != nil && strings.Contains(err.Error(), errBodyTooLarge) {
+			err = &uploadTooLarge{api.maxUploadBytes}
+		}
+	}()
+
+	mr, err := r.MultipartReader()
+	if errors.Is(err, http.ErrNotMultipart) {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
 		}
-		content = buf.Bytes()
-	} else {
-		content = []byte(itemContent)
+		for name := range r.PostForm {
+			fields[name] = r.PostForm.Get(name)
+		}
+	} else if err != nil {
+		return nil, err
 	}
+	for mr != nil {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := part.FormName()
+		if name == "item.attachment" {
+			if upload.attachment != nil {
+				return nil, errors.New("only one attachment can be uploaded")
+			}
+			upload.attachmentType = strings.ToLower(part.Header.Get("Content-Type"))
+			if upload.attachmentType == "" {
+				upload.attachmentType = "application/octet-stream"
+			}
+			if err = api.spoolAttachment(upload, part, fields, requestActor(r)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		limit := int64(uploadFormBytes)
+		if name == "item.content" {
+			limit = api.maxUploadBytes
+		}
+		value, err := readUploadPart(part, limit, r.ContentLength)
+		if errors.Is(err, errPartTooLarge) && limit == api.maxUploadBytes {
+			return nil, &uploadTooLarge{api.maxUploadBytes}
+		}
+		if errors.Is(err, errPartTooLarge) {
+			return nil, fmt.Errorf("form field %s is too long", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = string(value)
+	}
+
+	upload.category = fields["category"]
+	upload.item.Name = fields["item.name"]
+	upload.item.Type = strings.ToLower(fields["item.type"])
+	upload.version = fields["version"]
+	for name, value := range fields {
+		if field := strings.TrimPrefix(name, metadataFieldPrefix); field != name {
+			if upload.item.Metadata == nil {
+				upload.item.Metadata = make(map[string]string)
+			}
+			upload.item.Metadata[field] = value
+		}
+	}
+	if upload.attachment == nil {
+		upload.item.Content = []byte(fields["item.content"])
+		if int64(len(upload.item.Content)) > api.maxUploadBytes {
+			return nil, &uploadTooLarge{api.maxUploadBytes}
+		}
+	}
+	return upload, nil
+}
+
+// spoolAttachment writes the attachment part of an upload to a temporary
+// file. The size of the attachment is checked against the upload limit as
+// it is written and, if the fields read so far name the category and item,
+// against the space left to who in the category.
+func (api *apiServer) spoolAttachment(upload *itemUpload, part io.Reader, fields map[string]string, who actor) error {
+	limit := api.maxUploadBytes
+	category, itemName := fields["category"], fields["item.name"]
+	quotas := api.quotas()
+	if quotas.enabled() && category != "" && itemName != "" {
+		err := api.db.View(func(tx *bbolt.Tx) error {
+			allowed, err := quotas.allowance(tx, category, itemName, who)
+			if err == nil && allowed < limit {
+				limit = allowed
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := ioutil.TempFile("", "remindme-upload-")
+	if err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+	upload.attachment = f
+	n, err := io.Copy(f, io.LimitReader(part, limit+1))
+	if err != nil {
+		return err
+	}
+	upload.attachmentSize = n
+	if n <= limit {
+		return nil
+	}
+	if limit == api.maxUploadBytes {
+		return &uploadTooLarge{api.maxUploadBytes}
+	}
+	return &quotaExceeded{fmt.Sprintf("upload is larger than the %d bytes left within the storage quotas", limit)}
+}
+
+// errPartTooLarge is returned by readUploadPart if a part is over its limit.
+var errPartTooLarge = errors.New("form part is too large")
+
+// readUploadPart reads up to limit bytes of a form part. contentLength is the
+// length of the request, if known, used to size the buffer up front.
+func readUploadPart(part io.Reader, limit, contentLength int64) ([]byte, error) {
+	size := int64(bytes.MinRead)
+	if contentLength > 0 && contentLength < limit {
+		size = contentLength + bytes.MinRead
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	n, err := buf.ReadFrom(io.LimitReader(part, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errPartTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// storeItem adds an item to a category, or replaces it, from a multipart or
+// URL encoded form. Uploads over the size limit are rejected with 413 and
+// those that would exceed a storage quota with 507. Images are stripped of
+// metadata, and items are checked against their type.
+//
+// Attachments are read from their temporary file in the write transaction,
+// so that only one is held in memory at a time however many are uploaded at
+// once, unless they have to be read before to be stripped or checked.
+func (api *apiServer) storeItem(w http.ResponseWriter, r *http.Request) {
+	upload, err := api.readItemUpload(w, r)
+	var tooLarge *uploadTooLarge
+	if errors.As(err, &tooLarge) {
+		writeError(w, tooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var overQuota *quotaExceeded
+	if errors.As(err, &overQuota) {
+		writeError(w, overQuota.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		writeError(w, "invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer upload.close()
+	category, item := upload.category, upload.item
+	hasAttachment := upload.attachmentType != ""
 
 	switch hasAttachment {
 	case true:
-		fileType := strings.ToLower(h.Header.Get("Content-Type"))
-		if !strings.HasPrefix(fileType, itemType) {
-			http.Error(w, "invalid attachment for "+itemType, http.StatusBadRequest)
+		if !strings.HasPrefix(upload.attachmentType, item.Type) {
+			writeError(w, "invalid attachment for "+item.Type, http.StatusBadRequest)
 			return
 		}
 
 	case false:
-		if itemType == "video" || itemType == "image" {
-			http.Error(w, "video or image requires attachment", http.StatusBadRequest)
+		if item.Type == "video" || item.Type == "image" {
+			writeError(w, "video or image requires attachment", http.StatusBadRequest)
+			return
+		}
+	}
+	if t := itemTypes[item.Type]; item.Type == client.TypeImage || t != nil && t.check != nil {
+		if err = upload.readAttachment(); err != nil {
+			reqLog(r).Errorf("Error reading upload: %v", err)
+			writeError(w, "error saving item", http.StatusInternalServerError)
 			return
 		}
 	}
+	original, err := stripUpload(item)
+	if err == nil {
+		err = validateItem(item)
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	cond, err := requestCondition(r, upload.version)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	who := requestActor(r)
 	err = api.db.Update(func(tx *bbolt.Tx) error {
-		catBucket, err := tx.CreateBucketIfNotExists([]byte(category))
-		if err != nil {
-			return fmt.Errorf("failed to open db record for %s", category)
+		if err := cond.check(itemBucket(tx, category, item.Name)); err != nil {
+			return err
 		}
-		itemBucket, err := catBucket.CreateBucketIfNotExists([]byte(itemName))
-		if err != nil {
-			return fmt.Errorf("failed to open db record for %s", itemName)
+		if err := upload.readAttachment(); err != nil {
+			return err
 		}
-		if err = itemBucket.Put(itemTypeKey, []byte(itemType)); err != nil {
+		if err := api.quotas().reserve(tx, category, item, who); err != nil {
 			return err
 		}
-		if err = itemBucket.Put(itemContentKey, content); err != nil {
+		if _, err := putItem(tx, category, item, cond, who); err != nil {
 			return err
 		}
-		return nil
+		if err = keepOriginal(tx, category, item, original); err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventCategoryUpdated, category, nil)
 	})
+	var conflict *versionConflict
+	if errors.As(err, &conflict) {
+		writeVersionConflict(w, conflict)
+		return
+	}
+	if errors.As(err, &overQuota) {
+		writeError(w, overQuota.Error(), http.StatusInsufficientStorage)
+		return
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving item with attachment (%v): %v\n", hasAttachment, err)
-		http.Error(w, "error saving item", http.StatusInternalServerError)
+		reqLog(r).Errorf("Error saving item with attachment (%v): %v", hasAttachment, err)
+		writeError(w, "error saving item", http.StatusInternalServerError)
 		return
 	}
 
+	api.webhooks.wake()
+	api.variants.wake()
+	api.links.wake()
+
+	w.Header().Set("ETag", itemETag(item.Version))
 	api.allItems(w, r)
 }
 
-type Category struct {
-	Name  string  `json:"name"`
-	Items []*Item `json:"items"`
+// putItem adds an item to a category, creating the category if needed, or
+// replaces the item with the same name if cond allows. The change is
+// recorded and webhooks are notified of the item, but not of the category
+// update, which callers storing several items should report once. It
+// returns the change operation, client.OpItemCreated or
+// client.OpItemUpdated, and sets the item's new version. The new content is
+// kept in the item's revision history and the write in the audit log, as
+// made by who. A *versionConflict is returned if cond does not hold.
+func putItem(tx *bbolt.Tx, category string, item *Item, cond itemCondition, who actor) (string, error) {
+	catsBucket, err := tx.CreateBucketIfNotExists(categoriesBkt)
+	if err != nil {
+		return "", fmt.Errorf("failed to open db record for all categories")
+	}
+	catBucket, err := catsBucket.CreateBucketIfNotExists([]byte(category))
+	if err != nil {
+		return "", fmt.Errorf("failed to open db record for %s", category)
+	}
+	existing := catBucket.Bucket([]byte(item.Name))
+	if err = cond.check(existing); err != nil {
+		return "", err
+	}
+	event, version := eventItemCreated, uint64(1)
+	var before string
+	if existing != nil {
+		event, version = eventItemUpdated, itemVersion(existing)+1
+		before = contentHash(existing.Get(itemContentKey))
+		if err = countItemUsage(tx, category, item.Name, existing, -1); err != nil {
+			return "", err
+		}
+		if err = keepLegacyRevision(tx, category, item.Name, existing); err != nil {
+			return "", err
+		}
+	}
+	itemBucket, err := catBucket.CreateBucketIfNotExists([]byte(item.Name))
+	if err != nil {
+		return "", fmt.Errorf("failed to open db record for %s", item.Name)
+	}
+	if err = itemBucket.Put(itemVersionKey, uint64Bytes(version)); err != nil {
+		return "", err
+	}
+	item.Version = version
+	if event == eventItemCreated {
+		// New items are listed after existing items.
+		order, err := catBucket.NextSequence()
+		if err != nil {
+			return "", err
+		}
+		if err = itemBucket.Put(itemOrderKey, uint64Bytes(order)); err != nil {
+			return "", err
+		}
+	}
+	if err = itemBucket.Put(itemTypeKey, []byte(item.Type)); err != nil {
+		return "", err
+	}
+	if err = itemBucket.Put(itemContentKey, item.Content); err != nil {
+		return "", err
+	}
+	if err = putItemMetadata(itemBucket, item.Metadata); err != nil {
+		return "", err
+	}
+	if err = carryLinkPreview(tx, category, item); err != nil {
+		return "", err
+	}
+
+	if err = recordRevision(tx, category, item, who.user, time.Now().UTC()); err != nil {
+		return "", err
+	}
+	if err = countItemUsage(tx, category, item.Name, itemBucket, 1); err != nil {
+		return "", err
+	}
+	err = recordAudit(tx, who, &auditEntry{
+		Action:   event,
+		Category: category,
+		Item:     item.Name,
+		Before:   before,
+		After:    contentHash(item.Content),
+		Version:  version,
+	})
+	if err != nil {
+		return "", err
+	}
+	if err = recordChange(tx, event, category, item.Name); err != nil {
+		return "", err
+	}
+	return event, queueWebhookEvent(tx, event, category, item)
 }
 
+type Category = client.Category
+
+// allItems lists the library: all categories with all their items. Without
+// pagination parameters the library is streamed as one array, otherwise a
+// page of it is listed. The variant query parameter lists a smaller variant
+// of images, thumb or display, instead of the original, and the types query
+// parameter lists the item types the client knows; items of other types are
+// listed as legacy types.
 func (api *apiServer) allItems(w http.ResponseWriter, r *http.Request) {
-	categoriesWithItems := make([]*Category, 0)
-
-	err := api.db.View(func(tx *bbolt.Tx) error {
-		categories := tx.Cursor()
-		for categoryB, _ := categories.First(); categoryB != nil; categoryB, _ = categories.Next() {
-			category := string(categoryB)
-			categoryBkt := tx.Bucket(categoryB)
-			if categoryBkt == nil {
-				fmt.Fprintf(os.Stderr, "category %s not a db bucket\n", category)
-				continue
-			}
+	start, limit, paged, err := listPage(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	variant := r.URL.Query().Get("variant")
+	if variant != "" && !validVariant(variant) {
+		writeError(w, "variant must be thumb or display", http.StatusBadRequest)
+		return
+	}
+	types := knownTypes(r)
+	if paged {
+		api.libraryPage(w, r, start, limit, variant, types)
+		return
+	}
+	api.streamLibrary(w, r, variant, types)
+}
 
-			categoryItems := categoryBkt.Cursor()
-			items := make([]*Item, 0)
-			for itemB, _ := categoryItems.First(); itemB != nil; itemB, _ = categoryItems.Next() {
-				itemName := string(itemB)
-				itemBkt := categoryBkt.Bucket(itemB)
-				if itemBkt == nil {
-					fmt.Fprintf(os.Stderr, "item %s not a nested db bucket in %s\n", itemName, category)
-					continue
-				}
-				itemType := itemBkt.Get(itemTypeKey)
-				items = append(items, &Item{
-					Name:    itemName,
-					Type:    string(itemType),
-					Content: itemBkt.Get(itemContentKey),
-				})
-			}
+// categoryBucket returns the db bucket for the category, or nil if the
+// category does not exist.
+func categoryBucket(tx *bbolt.Tx, category string) *bbolt.Bucket {
+	catsBucket := tx.Bucket(categoriesBkt)
+	if catsBucket == nil {
+		return nil
+	}
+	return catsBucket.Bucket([]byte(category))
+}
 
-			categoriesWithItems = append(categoriesWithItems, &Category{
-				Name:  category,
-				Items: items,
-			})
-		}
+// itemBucket returns the db bucket for an item, or nil if the item does not
+// exist.
+func itemBucket(tx *bbolt.Tx, category, itemName string) *bbolt.Bucket {
+	catBucket := categoryBucket(tx, category)
+	if catBucket == nil {
 		return nil
-	})
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error fetching items from db: %v\n", err)
-		http.Error(w, "error fetching items", http.StatusInternalServerError)
-		return
 	}
+	return catBucket.Bucket([]byte(itemName))
+}
 
-	writeJSON(w, categoriesWithItems)
+// readCategoryItems reads all items stored in a category bucket, in listing
+// order. The returned content is only valid for the life of the transaction.
+func readCategoryItems(category string, categoryBkt *bbolt.Bucket) []*Item {
+	categoryItems := categoryBkt.Cursor()
+	items := make([]*Item, 0)
+	order := make(map[*Item]uint64)
+	for itemB, _ := categoryItems.First(); itemB != nil; itemB, _ = categoryItems.Next() {
+		itemName := string(itemB)
+		itemBkt := categoryBkt.Bucket(itemB)
+		if itemBkt == nil {
+			apiLog.Warnf("item %s not a nested db bucket in %s", itemName, category)
+			continue
+		}
+		itemType := itemBkt.Get(itemTypeKey)
+		metadata, err := itemMetadata(itemBkt)
+		if err != nil {
+			apiLog.Warnf("item %s in %s: %v", itemName, category, err)
+		}
+		item := &Item{
+			Name:     itemName,
+			Type:     string(itemType),
+			Content:  itemBkt.Get(itemContentKey),
+			Version:  itemVersion(itemBkt),
+			Metadata: metadata,
+		}
+		items = append(items, item)
+		order[item] = itemOrder(itemBkt)
+	}
+	// Items are listed in the order they were added or last arranged in,
+	// items saved before ordering was supported come first by name.
+	sort.SliceStable(items, func(i, j int) bool {
+		return order[items[i]] < order[items[j]]
+	})
+	return items
+}
+
+func itemOrder(itemBkt *bbolt.Bucket) uint64 {
+	if v := itemBkt.Get(itemOrderKey); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
 }
 
 // writeJSON marshals the provided interface and writes the bytes to the
@@ -215,12 +681,46 @@ func writeJSONWithStatus(w http.ResponseWriter, thing interface{}, code int) {
 	b, err := json.Marshal(thing)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(os.Stderr, "JSON encode error: %v\n", err)
+		apiLog.Errorf("JSON encode error: %v", err)
 		return
 	}
 	w.WriteHeader(code)
 	_, err = w.Write(append(b, byte('\n')))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Write error: %v\n", err)
+		apiLog.Errorf("Write error: %v", err)
+	}
+}
+
+// errorCodes are the codes of error responses with each status.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            client.CodeBadRequest,
+	http.StatusUnauthorized:          client.CodeUnauthorized,
+	http.StatusForbidden:             client.CodeForbidden,
+	http.StatusNotFound:              client.CodeNotFound,
+	http.StatusConflict:              client.CodeConflict,
+	http.StatusTooManyRequests:       client.CodeRateLimited,
+	http.StatusPreconditionRequired:  client.CodePreconditionRequired,
+	http.StatusGone:                  client.CodeGone,
+	http.StatusRequestEntityTooLarge: client.CodeTooLarge,
+	http.StatusInsufficientStorage:   client.CodeQuotaExceeded,
+	http.StatusInternalServerError:   client.CodeInternal,
+	http.StatusServiceUnavailable:    client.CodeUnavailable,
+	http.StatusBadGateway:            client.CodeUpstream,
+}
+
+// writeError writes a JSON error response with the specified message and
+// response code, in place of http.Error's plain text response.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	// Errors are not cached, nor are they a version of the resource.
+	for _, header := range []string{"ETag", "Last-Modified", "Cache-Control"} {
+		w.Header().Del(header)
+	}
+	errCode, ok := errorCodes[code]
+	if !ok {
+		errCode = strings.ToLower(strings.ReplaceAll(http.StatusText(code), " ", "_"))
 	}
+	writeJSONWithStatus(w, &client.Error{
+		Code:    errCode,
+		Message: msg,
+	}, code)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+func newTestAPI(t *testing.T) *apiServer {
+	t.Helper()
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	return &apiServer{
+		db:             db,
+		webhooks:       newWebhookDispatcher(db),
+		variants:       newVariantGenerator(db),
+		links:          newLinkPreviewer(db, linkPreviewsOff),
+		metrics:        newServerMetrics(),
+		maxUploadBytes: defaultMaxUploadBytes,
+	}
+}
+
+// uploadRequest makes a multipart item upload whose attachment of size bytes
+// comes after the other fields.
+func uploadRequest(t *testing.T, category, itemName string, size int) *http.Request {
+	t.Helper()
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("category", category)
+	form.WriteField("item.name", itemName)
+	form.WriteField("item.type", "video")
+	part, err := form.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="item.attachment"; filename="clip.mp4"`},
+		"Content-Type":        {"video/mp4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.CopyN(part, rand.Reader, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	form.Close()
+	r := httptest.NewRequest(http.MethodPost, "/api/items", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestReadItemUploadSpoolsAttachment(t *testing.T) {
+	api := newTestAPI(t)
+	r := uploadRequest(t, "clips", "clip", 1000)
+	upload, err := api.readItemUpload(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.item.Content != nil || upload.attachment == nil || upload.attachmentSize != 1000 {
+		t.Fatalf("attachment of %d bytes read into memory (%d bytes) or not kept", upload.attachmentSize, len(upload.item.Content))
+	}
+	if err = upload.readAttachment(); err != nil || len(upload.item.Content) != 1000 {
+		t.Fatalf("reading attachment: %d bytes, %v", len(upload.item.Content), err)
+	}
+	path := upload.attachment.Name()
+	upload.close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("uploaded file not removed: %v", err)
+	}
+}
+
+func TestStoreItemLimits(t *testing.T) {
+	api := newTestAPI(t)
+	api.maxUploadBytes = 4000
+	api.userQuota = 6000
+
+	tests := []struct {
+		name    string
+		size    int
+		replace bool
+		status  int
+	}{
+		{"too-large", 5000, false, http.StatusRequestEntityTooLarge},
+		{"first", 3000, false, http.StatusOK},
+		{"over-quota", 3500, false, http.StatusInsufficientStorage},
+		// Replacing an item of the same user frees its space.
+		{"first", 3500, true, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := uploadRequest(t, "clips", test.name, test.size)
+		if test.replace {
+			r.Header.Set("If-Match", "*")
+		}
+		r = r.WithContext(context.WithValue(r.Context(), userCtxKey, "ann"))
+		w := httptest.NewRecorder()
+		api.storeItem(w, r)
+		if w.Code != test.status {
+			t.Errorf("uploading %d bytes as %s: got status %d, want %d: %s", test.size, test.name, w.Code, test.status, w.Body)
+		}
+	}
+
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		usage, err := readUsage(tx, userUsageBkt, "ann")
+		if err != nil {
+			return err
+		}
+		if usage.Bytes != 3500 || usage.Items != 1 {
+			t.Errorf("ann uses %d bytes in %d items, want 3500 bytes in 1 item", usage.Bytes, usage.Items)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"image"
 	"net/url"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/itswisdomagain/remindme/client"
 	"go.etcd.io/bbolt"
 
 	"fyne.io/fyne"
@@ -34,26 +36,46 @@ var (
 
 	categoryEntry      *widget.Select
 	activeRemindersBox *fyne.Container
+
+	api *client.Client
 )
 
 func main() {
+	serverURL := flag.String("server", "http://64.225.13.138:17778", "url of the RemindMe server to download reminders from")
+	token := flag.String("token", os.Getenv("REMINDME_TOKEN"), "API token for the RemindMe server, if it requires one (default $REMINDME_TOKEN)")
+	logLevel := flag.String("loglevel", "info", "log level (debug, info, warn, error or off), optionally followed by subsystem levels, e.g. info,sync=debug")
+	flag.Parse()
+
+	var err error
+	api, err = client.New(*serverURL, client.WithToken(*token))
+	if err != nil {
+		appLog.Errorf("invalid -server: %v", err)
+		os.Exit(1)
+	}
+
 	appDataDir := dcrutil.AppDataDir("remindme", false)
-	err := os.MkdirAll(appDataDir, 0700)
+	err = os.MkdirAll(appDataDir, 0700)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create app data directory: %v\n", err)
+		appLog.Errorf("failed to create app data directory: %v", err)
 		os.Exit(1)
 	}
 
+	if err = initLogging(*logLevel, appDataDir); err != nil {
+		appLog.Errorf("failed to set up logging: %v", err)
+		os.Exit(1)
+	}
+	defer logBackend.Close()
+
 	dbPath := filepath.Join(appDataDir, "app.db")
 	db, err = bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to open database: %v\n", err)
+		appLog.Errorf("failed to open database: %v", err)
 		os.Exit(1)
 	}
 
 	categories, err := categoriesFromDB()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to fetch categories: %v\n", err)
+		appLog.Errorf("failed to fetch categories: %v", err)
 		os.Exit(1)
 	}
 
@@ -63,11 +85,11 @@ func main() {
 	// before starting the api server. On interrupt, kill the
 	// ctx associated with the api server to signal the api
 	// server to stop.
-	killChan := make(chan os.Signal)
+	killChan := make(chan os.Signal, 1)
 	signal.Notify(killChan, os.Interrupt)
 	go func() {
 		for range killChan {
-			fmt.Println("shutting down...")
+			appLog.Infof("shutting down...")
 			cancel()
 			a.Quit()
 			return
@@ -88,8 +110,9 @@ func main() {
 		errorLabel.SetText("Refreshing...")
 		errorLabel.Show()
 
-		categories, err := downloadFromAPI()
+		categories, err := downloadFromAPI(api)
 		if err != nil {
+			syncLog.Errorf("failed to download library: %v", err)
 			errorLabel.SetText(err.Error())
 			return
 		}
@@ -103,6 +126,8 @@ func main() {
 			activeReminders[category] = items
 		}
 		errorLabel.Hide()
+		go reportChecklistRuns()
+		go syncResponses()
 	}
 	refreshCategories()
 
@@ -148,13 +173,13 @@ func main() {
 
 	lastRunStatuses, err = lastRuns()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to fetch last runs: %v\n", err)
+		appLog.Errorf("failed to fetch last runs: %v", err)
 		lastRunStatuses = make(map[string]int)
 	}
 	for category := range lastRunStatuses {
 		items, err := categoryItems(category)
 		if err != nil {
-			fmt.Println("failed to fetch items for resumed category ", category, err.Error())
+			appLog.Errorf("failed to fetch items for resumed category %s: %v", category, err)
 			delete(lastRunStatuses, category)
 			continue
 		}
@@ -189,7 +214,7 @@ func startTimer(immediateDisplay bool, category string, mainCtx context.Context)
 		delete(activeReminders, category)
 		delete(lastRunStatuses, category)
 		if err := deleteLastRun(category); err != nil {
-			fmt.Println("error deleting last run for ", category, err.Error())
+			appLog.Errorf("error deleting last run for %s: %v", category, err)
 		}
 	}
 
@@ -238,7 +263,7 @@ func showReminder(category string, catLabel *widget.Label) bool {
 
 	lastRunStatuses[category] = nextIndex
 	if err := saveLastRun(category, nextIndex); err != nil {
-		fmt.Println("error saving last run record for", category, err.Error())
+		appLog.Errorf("error saving last run record for %s: %v", category, err)
 	}
 	nextItem := items[nextIndex]
 
@@ -252,22 +277,47 @@ func showReminder(category string, catLabel *widget.Label) bool {
 		itemUI = label
 
 	case "image":
+		// Images are downloaded at a display size, the original is
+		// downloaded on demand.
 		imgReader := bytes.NewReader(nextItem.Content)
 		img, _, err := image.Decode(imgReader)
 		if err != nil {
-			println(err.Error())
+			appLog.Errorf("failed to decode image %s: %v", nextItem.Name, err)
 			itemUI = widget.NewLabelWithStyle("Error displaying image: "+nextItem.Name, fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
 		} else {
-			itemUI = canvas.NewImageFromImage(img)
+			imgUI := canvas.NewImageFromImage(img)
+			imgUI.FillMode = canvas.ImageFillContain
+			itemName := nextItem.Name
+			originalButton := widget.NewButton("View original", func() {
+				go showOriginal(category, itemName)
+			})
+			itemUI = fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, originalButton, nil, nil), originalButton, imgUI)
 			imgSize = img.Bounds().Size()
 		}
 
+	case "quote":
+		itemUI = quoteCard(nextItem)
+
+	case "markdown":
+		itemUI = renderMarkdown(nextItem.Content, items)
+
+	case "flashcard":
+		itemUI = flashcardCard(nextItem, items)
+
+	case "checklist":
+		itemUI = checklistCard(category, nextItem)
+
+	case "prompt":
+		itemUI = promptCard(category, nextItem)
+
 	case "link":
 		text := string(nextItem.Content)
 		link, err := url.Parse(text)
 		if err != nil {
-			println(err.Error())
+			appLog.Errorf("invalid link %s: %v", nextItem.Name, err)
 			itemUI = widget.NewLabel(text)
+		} else if nextItem.Preview != nil {
+			itemUI = linkCard(link, nextItem.Preview)
 		} else {
 			itemUI = widget.NewHyperlink(text, link)
 		}
@@ -276,6 +326,12 @@ func showReminder(category string, catLabel *widget.Label) bool {
 		itemUI = widget.NewLabelWithStyle("This is a/an "+nextItem.Type, fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
 	}
 
+	if note := nextItem.Metadata[client.MetaNote]; note != "" {
+		noteLabel := widget.NewLabelWithStyle(note, fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+		noteLabel.Wrapping = fyne.TextWrapWord
+		itemUI = fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, noteLabel, nil, nil), noteLabel, itemUI)
+	}
+
 	w := a.NewWindow(category + ": " + nextItem.Name)
 	w.SetContent(itemUI)
 	winSize := w.Canvas().Size()
@@ -299,3 +355,95 @@ func showReminder(category string, catLabel *widget.Label) bool {
 	catLabel.SetText(fmt.Sprintf("%s (%d)", category, remaining))
 	return remaining > 0 // only return true if there's more to show
 }
+
+// quoteCard shows a quote with its attribution, which links to where the
+// quote can be found if the quote has a URL.
+func quoteCard(item *Item) fyne.CanvasObject {
+	text := widget.NewLabelWithStyle("“"+string(item.Content)+"”", fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+	text.Wrapping = fyne.TextWrapWord
+	card := widget.NewVBox(text)
+
+	var attribution []string
+	for _, field := range []string{client.MetaAuthor, client.MetaSource} {
+		if v := item.Metadata[field]; v != "" {
+			attribution = append(attribution, v)
+		}
+	}
+	link, err := url.Parse(item.Metadata[client.MetaURL])
+	if err != nil || link.Host == "" {
+		link = nil
+	}
+	switch {
+	case len(attribution) > 0 && link != nil:
+		card.Append(widget.NewHBox(layout.NewSpacer(), widget.NewLabel("—"),
+			widget.NewHyperlink(strings.Join(attribution, ", "), link)))
+	case len(attribution) > 0:
+		card.Append(widget.NewLabelWithStyle("— "+strings.Join(attribution, ", "), fyne.TextAlignTrailing, fyne.TextStyle{}))
+	case link != nil:
+		card.Append(widget.NewHBox(layout.NewSpacer(), widget.NewHyperlink(link.String(), link)))
+	}
+	return card
+}
+
+// linkCard shows a link with the preview of its page: the page's image,
+// title, site and description.
+func linkCard(link *url.URL, preview *client.LinkPreview) fyne.CanvasObject {
+	title := preview.Title
+	if title == "" {
+		title = link.String()
+	}
+	card := widget.NewVBox(widget.NewHyperlink(title, link))
+	if preview.SiteName != "" {
+		card.Append(widget.NewLabelWithStyle(preview.SiteName, fyne.TextAlignLeading, fyne.TextStyle{Italic: true}))
+	}
+	if preview.Description != "" {
+		description := widget.NewLabel(preview.Description)
+		description.Wrapping = fyne.TextWrapWord
+		card.Append(description)
+	}
+	if len(preview.Image) == 0 {
+		return card
+	}
+	img, _, err := image.Decode(bytes.NewReader(preview.Image))
+	if err != nil {
+		appLog.Debugf("failed to decode preview image of %s: %v", link, err)
+		return card
+	}
+	imgUI := canvas.NewImageFromImage(img)
+	imgUI.FillMode = canvas.ImageFillContain
+	imgUI.SetMinSize(fyne.NewSize(200, 120))
+	return fyne.NewContainerWithLayout(layout.NewBorderLayout(imgUI, nil, nil, nil), imgUI, card)
+}
+
+// showOriginal downloads the original of an image item and shows it in a new
+// window, scrolled if it is larger than the window.
+func showOriginal(category, itemName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+	content, _, err := api.ItemContent(ctx, category, itemName)
+	if err != nil {
+		appLog.Errorf("failed to download original of %s: %v", itemName, err)
+		return
+	}
+	defer content.Close()
+	img, _, err := image.Decode(content)
+	if err != nil {
+		appLog.Errorf("failed to decode original of %s: %v", itemName, err)
+		return
+	}
+
+	imgSize := img.Bounds().Size()
+	imgUI := canvas.NewImageFromImage(img)
+	imgUI.SetMinSize(fyne.NewSize(imgSize.X, imgSize.Y))
+	w := a.NewWindow(category + ": " + itemName + " (original)")
+	w.SetContent(widget.NewScrollContainer(imgUI))
+	winSize := fyne.NewSize(imgSize.X, imgSize.Y)
+	if winSize.Width > 1200 {
+		winSize.Width = 1200
+	}
+	if winSize.Height > 800 {
+		winSize.Height = 800
+	}
+	w.Resize(winSize)
+	w.Show()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/widget"
+)
+
+// reportMtx keeps checklist runs from being reported twice at once.
+var reportMtx sync.Mutex
+
+// checklistCard shows the entries of a checklist with check boxes. Each
+// showing is a new run of the checklist, which is saved as entries are
+// checked and reported to the server.
+func checklistCard(category string, item *Item) fyne.CanvasObject {
+	entries := client.ChecklistEntries(item.Content)
+	run, err := startChecklistRun(category, item.Name, len(entries))
+	if err != nil {
+		appLog.Errorf("failed to save checklist run of %s: %v", item.Name, err)
+	}
+	if run != nil {
+		go reportChecklistRuns()
+	}
+
+	box := widget.NewVBox()
+	for i, entry := range entries {
+		i := i
+		box.Append(widget.NewCheck(entry, func(checked bool) {
+			if run == nil {
+				return
+			}
+			run.Checked[i] = checked
+			run.CompletedAt = nil
+			if allChecked(run.Checked) {
+				now := time.Now().UTC()
+				run.CompletedAt = &now
+			}
+			if err := saveChecklistRun(run); err != nil {
+				appLog.Errorf("failed to save checklist run of %s: %v", item.Name, err)
+				return
+			}
+			go reportChecklistRuns()
+		}))
+	}
+	return widget.NewVScrollContainer(box)
+}
+
+func allChecked(checked []bool) bool {
+	for _, c := range checked {
+		if !c {
+			return false
+		}
+	}
+	return true
+}
+
+// reportChecklistRuns sends the server the state of checklist runs it does
+// not have. Runs that fail to send are sent again the next time runs are
+// reported, and runs of checklists that no longer exist are dropped.
+func reportChecklistRuns() {
+	reportMtx.Lock()
+	defer reportMtx.Unlock()
+	runs, err := unreportedChecklistRuns()
+	if err != nil {
+		syncLog.Errorf("failed to read checklist runs: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+	for _, run := range runs {
+		checked := 0
+		for _, c := range run.Checked {
+			if c {
+				checked++
+			}
+		}
+		_, err := api.ReportChecklistRun(ctx, run.Category, run.Item, &client.ChecklistRun{
+			ShownAt:     run.ShownAt,
+			Entries:     len(run.Checked),
+			Checked:     checked,
+			CompletedAt: run.CompletedAt,
+		})
+		var apiErr *client.Error
+		switch {
+		case errors.Is(err, client.ErrNotFound),
+			errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest:
+			syncLog.Warnf("dropping checklist run of %s in %s: %v", run.Item, run.Category, err)
+		case err != nil:
+			syncLog.Debugf("failed to report checklist run of %s in %s: %v", run.Item, run.Category, err)
+			return
+		}
+		if err = markChecklistRunReported(run); err != nil {
+			syncLog.Errorf("failed to save checklist run: %v", err)
+		}
+	}
+}
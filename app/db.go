@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"os"
+	"math"
+	"sort"
 	"strconv"
+	"time"
 
+	"github.com/itswisdomagain/remindme/client"
 	"go.etcd.io/bbolt"
 )
 
@@ -17,39 +22,104 @@ var (
 	categoriesBkt = []byte("categories")
 	lastRunBktKey = []byte("last_run")
 
-	itemContentKey = []byte("content")
-	itemTypeKey    = []byte("type")
+	itemContentKey  = []byte("content")
+	itemTypeKey     = []byte("type")
+	itemOrderKey    = []byte("order")
+	itemPreviewKey  = []byte("preview")
+	itemMetadataKey = []byte("metadata")
 )
 
-type Category struct {
-	Name  string  `json:"name"`
-	Items []*Item `json:"items"`
-}
+type Item = client.Item
 
-type Item struct {
-	Name    string `json:"name"`
-	Type    string `json:"type"`
-	Content []byte `json:"Content"`
-}
+const downloadTimeout = time.Minute
+
+var (
+	syncBktKey         = []byte("sync")
+	libraryRevisionKey = []byte("library_revision")
+	libraryETagKey     = []byte("library_etag")
+)
 
-func downloadFromAPI() ([]string, error) {
-	resp, err := http.Get("http://64.225.13.138:17778/api/items")
+// downloadFromAPI updates the local copy of the library. Items and
+// categories deleted on the server since the last download are removed
+// using the tombstones in the server's change log. If the changes are no
+// longer available, the local copy is replaced. If there were no changes,
+// the library is only downloaded if the server says it differs from the
+// local copy. Images are downloaded as their display variant, which is
+// smaller than the original for large images.
+func downloadFromAPI(api *client.Client) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+
+	since, etag, err := lastSync()
 	if err != nil {
 		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	var tombstones []*client.Change
+	replace := since == 0
+	revision := since
+	for !replace {
+		changes, err := api.Changes(ctx, revision, 0)
+		if errors.Is(err, client.ErrGone) {
+			replace = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes.Changes {
+			if change.Op == client.OpItemDeleted || change.Op == client.OpCategoryDeleted {
+				tombstones = append(tombstones, change)
+			}
+			revision = change.Revision
+		}
+		if !changes.More {
+			revision = changes.Revision
+			break
+		}
+	}
+	if replace {
+		syncLog.Debugf("replacing the local library")
+		// The library is downloaded after the current revision is read, so
+		// it has all changes up to it.
+		changes, err := api.Changes(ctx, math.MaxUint64, 1)
+		if err != nil {
+			return nil, err
+		}
+		revision = changes.Revision
+	}
+
+	// If nothing changed, the server confirms that the downloaded copy is
+	// current instead of sending the library again.
+	if replace || revision != since {
+		etag = ""
+	}
+	catItems, etag, err := api.LibraryIfModified(ctx, etag, client.VariantDisplay)
+	if errors.Is(err, client.ErrNotModified) {
+		syncLog.Debugf("library unchanged at revision %d", revision)
+		return categoriesFromDB()
 	}
-	catItems := make([]*Category, 0)
-	err = json.Unmarshal(body, &catItems)
 	if err != nil {
 		return nil, err
 	}
 
 	categories := make([]string, 0, len(catItems))
+	syncLog.Debugf("downloaded %d categories, %d deletions, library revision %d",
+		len(catItems), len(tombstones), revision)
 
 	return categories, db.Update(func(tx *bbolt.Tx) error {
+		if replace && tx.Bucket(categoriesBkt) != nil {
+			if err := tx.DeleteBucket(categoriesBkt); err != nil {
+				return err
+			}
+		}
+		if catsBucket := tx.Bucket(categoriesBkt); catsBucket != nil {
+			for _, change := range tombstones {
+				if err := applyTombstone(catsBucket, change); err != nil {
+					return err
+				}
+			}
+		}
+
 		for _, category := range catItems {
 			categories = append(categories, category.Name)
 
@@ -63,7 +133,7 @@ func downloadFromAPI() ([]string, error) {
 				return fmt.Errorf("failed to open db record for %s", category.Name)
 			}
 
-			for _, item := range category.Items {
+			for i, item := range category.Items {
 				itemBucket, err := catBucket.CreateBucketIfNotExists([]byte(item.Name))
 				if err != nil {
 					return fmt.Errorf("failed to open db record for %s", item.Name)
@@ -74,10 +144,90 @@ func downloadFromAPI() ([]string, error) {
 				if err = itemBucket.Put(itemContentKey, item.Content); err != nil {
 					return err
 				}
+				if err = putPreview(itemBucket, item.Preview); err != nil {
+					return err
+				}
+				if err = putMetadata(itemBucket, item.Metadata); err != nil {
+					return err
+				}
+				order := make([]byte, 8)
+				binary.BigEndian.PutUint64(order, uint64(i))
+				if err = itemBucket.Put(itemOrderKey, order); err != nil {
+					return err
+				}
 			}
 		}
+
+		syncBkt, err := tx.CreateBucketIfNotExists(syncBktKey)
+		if err != nil {
+			return err
+		}
+		if err = syncBkt.Put(libraryETagKey, []byte(etag)); err != nil {
+			return err
+		}
+		return syncBkt.Put(libraryRevisionKey, []byte(strconv.FormatUint(revision, 10)))
+	})
+}
+
+// putPreview stores the preview of a link item, or deletes the stored
+// preview if the item has none.
+func putPreview(itemBucket *bbolt.Bucket, preview *client.LinkPreview) error {
+	if preview == nil {
+		return itemBucket.Delete(itemPreviewKey)
+	}
+	v, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+	return itemBucket.Put(itemPreviewKey, v)
+}
+
+// putMetadata stores the metadata of an item, or deletes the stored metadata
+// if the item has none.
+func putMetadata(itemBucket *bbolt.Bucket, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return itemBucket.Delete(itemMetadataKey)
+	}
+	v, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return itemBucket.Put(itemMetadataKey, v)
+}
+
+// applyTombstone removes a deleted item or category from the local copy of
+// the library. Items that were restored or created again since are added
+// back from the downloaded library.
+func applyTombstone(catsBucket *bbolt.Bucket, change *client.Change) error {
+	catBucket := catsBucket.Bucket([]byte(change.Category))
+	if catBucket == nil {
 		return nil
+	}
+	if change.Op == client.OpCategoryDeleted {
+		return catsBucket.DeleteBucket([]byte(change.Category))
+	}
+	if catBucket.Bucket([]byte(change.Item)) == nil {
+		return nil
+	}
+	return catBucket.DeleteBucket([]byte(change.Item))
+}
+
+// lastSync returns the server's library revision at the last download, or
+// 0 if the library was never downloaded, and the entity tag of the
+// downloaded library.
+func lastSync() (revision uint64, etag string, err error) {
+	err = db.View(func(tx *bbolt.Tx) error {
+		syncBkt := tx.Bucket(syncBktKey)
+		if syncBkt == nil {
+			return nil
+		}
+		etag = string(syncBkt.Get(libraryETagKey))
+		if v := syncBkt.Get(libraryRevisionKey); v != nil {
+			revision, err = strconv.ParseUint(string(v), 10, 64)
+		}
+		return err
 	})
+	return
 }
 
 func categoriesFromDB() (categories []string, err error) {
@@ -105,21 +255,43 @@ func categoryItems(category string) (items []*Item, err error) {
 		if categoryBkt == nil {
 			return fmt.Errorf("unknown reminder category: %s", category)
 		}
+		orders := make(map[*Item]uint64)
 		categoryItems := categoryBkt.Cursor()
 		for itemB, _ := categoryItems.First(); itemB != nil; itemB, _ = categoryItems.Next() {
 			itemName := string(itemB)
 			itemBkt := categoryBkt.Bucket(itemB)
 			if itemBkt == nil {
-				fmt.Fprintf(os.Stderr, "item %s not a nested db bucket in %s\n", itemName, category)
+				dbLog.Warnf("item %s not a nested db bucket in %s", itemName, category)
 				continue
 			}
 			itemType := itemBkt.Get(itemTypeKey)
-			items = append(items, &Item{
+			item := &Item{
 				Name:    itemName,
 				Type:    string(itemType),
 				Content: itemBkt.Get(itemContentKey),
-			})
+			}
+			if order := itemBkt.Get(itemOrderKey); len(order) == 8 {
+				orders[item] = binary.BigEndian.Uint64(order)
+			}
+			if v := itemBkt.Get(itemMetadataKey); v != nil {
+				if err := json.Unmarshal(v, &item.Metadata); err != nil {
+					dbLog.Warnf("invalid metadata of %s in %s: %v", itemName, category, err)
+				}
+			}
+			if v := itemBkt.Get(itemPreviewKey); v != nil {
+				item.Preview = new(client.LinkPreview)
+				if err := json.Unmarshal(v, item.Preview); err != nil {
+					dbLog.Warnf("invalid preview of %s in %s: %v", itemName, category, err)
+					item.Preview = nil
+				}
+			}
+			items = append(items, item)
 		}
+		// Keep the order of items on the server. Items are in name order
+		// otherwise.
+		sort.SliceStable(items, func(i, j int) bool {
+			return orders[items[i]] < orders[items[j]]
+		})
 		return nil
 	})
 	return
@@ -156,7 +328,7 @@ func lastRuns() (map[string]int, error) {
 		for catB, indexB := records.First(); catB != nil; catB, _ = records.Next() {
 			index, err := strconv.Atoi(string(indexB))
 			if err != nil {
-				fmt.Println(err.Error())
+				dbLog.Warnf("invalid last run record for %s: %v", catB, err)
 				continue
 			}
 			lastRuns[string(catB)] = index
@@ -164,3 +336,202 @@ func lastRuns() (map[string]int, error) {
 		return nil
 	})
 }
+
+var checklistRunsBktKey = []byte("checklist_runs")
+
+// checklistRun is a showing of a checklist item and the entries the user
+// checked in it. Reported is set once the server has its current state.
+type checklistRun struct {
+	Category    string     `json:"category"`
+	Item        string     `json:"item"`
+	ShownAt     time.Time  `json:"shownAt"`
+	Checked     []bool     `json:"checked"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	Reported    bool       `json:"reported"`
+}
+
+// checklistRunPrefix is the start of the keys of the runs of a checklist.
+func checklistRunPrefix(category, item string) []byte {
+	return []byte(category + "\x00" + item + "\x00")
+}
+
+func (run *checklistRun) key() []byte {
+	key := checklistRunPrefix(run.Category, run.Item)
+	var shownAt [8]byte
+	binary.BigEndian.PutUint64(shownAt[:], uint64(run.ShownAt.UnixNano()))
+	return append(key, shownAt[:]...)
+}
+
+// startChecklistRun records a new showing of a checklist with entries
+// entries. Earlier runs of the checklist that were reported are dropped.
+func startChecklistRun(category, item string, entries int) (*checklistRun, error) {
+	run := &checklistRun{
+		Category: category,
+		Item:     item,
+		ShownAt:  time.Now().UTC(),
+		Checked:  make([]bool, entries),
+	}
+	return run, db.Update(func(tx *bbolt.Tx) error {
+		runsBkt, err := tx.CreateBucketIfNotExists(checklistRunsBktKey)
+		if err != nil {
+			return err
+		}
+		prefix := checklistRunPrefix(category, item)
+		c := runsBkt.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			earlier := new(checklistRun)
+			if err := json.Unmarshal(v, earlier); err != nil || earlier.Reported {
+				if err = c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return putChecklistRun(runsBkt, run)
+	})
+}
+
+func putChecklistRun(runsBkt *bbolt.Bucket, run *checklistRun) error {
+	v, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return runsBkt.Put(run.key(), v)
+}
+
+// saveChecklistRun stores the state of a checklist run.
+func saveChecklistRun(run *checklistRun) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		runsBkt, err := tx.CreateBucketIfNotExists(checklistRunsBktKey)
+		if err != nil {
+			return err
+		}
+		return putChecklistRun(runsBkt, run)
+	})
+}
+
+// unreportedChecklistRuns lists the checklist runs whose current state the
+// server does not have.
+func unreportedChecklistRuns() ([]*checklistRun, error) {
+	var runs []*checklistRun
+	return runs, db.View(func(tx *bbolt.Tx) error {
+		runsBkt := tx.Bucket(checklistRunsBktKey)
+		if runsBkt == nil {
+			return nil
+		}
+		return runsBkt.ForEach(func(k, v []byte) error {
+			run := new(checklistRun)
+			if err := json.Unmarshal(v, run); err != nil {
+				dbLog.Warnf("invalid checklist run record %q: %v", k, err)
+				return nil
+			}
+			if !run.Reported {
+				runs = append(runs, run)
+			}
+			return nil
+		})
+	})
+}
+
+// markChecklistRunReported records that the server has the state of a run,
+// unless the run changed since that state was sent.
+func markChecklistRunReported(sent *checklistRun) error {
+	sentV, err := json.Marshal(sent)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		runsBkt := tx.Bucket(checklistRunsBktKey)
+		if runsBkt == nil || !bytes.Equal(runsBkt.Get(sent.key()), sentV) {
+			return nil
+		}
+		reported := *sent
+		reported.Reported = true
+		return putChecklistRun(runsBkt, &reported)
+	})
+}
+
+var responsesBktKey = []byte("responses")
+
+// promptResponse is the user's answer to a prompt. Synced is set once the
+// server has it.
+type promptResponse struct {
+	client.PromptResponse
+	Synced bool `json:"synced"`
+}
+
+// responsePrefix is the start of the keys of the answers to a prompt.
+func responsePrefix(category, item string) []byte {
+	return []byte(category + "\x00" + item + "\x00")
+}
+
+func responseKey(response *client.PromptResponse) []byte {
+	key := responsePrefix(response.Category, response.Item)
+	var writtenAt [8]byte
+	binary.BigEndian.PutUint64(writtenAt[:], uint64(response.WrittenAt.UnixNano()))
+	return append(key, writtenAt[:]...)
+}
+
+func putResponse(responsesBkt *bbolt.Bucket, response *promptResponse) error {
+	v, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return responsesBkt.Put(responseKey(&response.PromptResponse), v)
+}
+
+// saveResponse stores an answer to a prompt.
+func saveResponse(response *promptResponse) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		responsesBkt, err := tx.CreateBucketIfNotExists(responsesBktKey)
+		if err != nil {
+			return err
+		}
+		return putResponse(responsesBkt, response)
+	})
+}
+
+// mergeResponses stores the answers downloaded from the server that are not
+// stored yet, such as those written on other devices.
+func mergeResponses(responses []*client.PromptResponse) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		responsesBkt, err := tx.CreateBucketIfNotExists(responsesBktKey)
+		if err != nil {
+			return err
+		}
+		for _, response := range responses {
+			if responsesBkt.Get(responseKey(response)) != nil {
+				continue
+			}
+			if err = putResponse(responsesBkt, &promptResponse{PromptResponse: *response, Synced: true}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readResponses reads the stored answers to a prompt, oldest first, or all
+// answers if category is empty.
+func readResponses(category, item string) ([]*promptResponse, error) {
+	var prefix []byte
+	if category != "" {
+		prefix = responsePrefix(category, item)
+	}
+	var responses []*promptResponse
+	return responses, db.View(func(tx *bbolt.Tx) error {
+		responsesBkt := tx.Bucket(responsesBktKey)
+		if responsesBkt == nil {
+			return nil
+		}
+		c := responsesBkt.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			response := new(promptResponse)
+			if err := json.Unmarshal(v, response); err != nil {
+				dbLog.Warnf("invalid response record %q: %v", k, err)
+				continue
+			}
+			responses = append(responses, response)
+		}
+		return nil
+	})
+}
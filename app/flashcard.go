@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/widget"
+)
+
+// flashcardCard shows the front of a flashcard with a Reveal button that
+// shows the back, or with the choices of answers if the card has
+// distractors. Images on the card are found among the items of its
+// category.
+func flashcardCard(item *Item, items []*Item) fyne.CanvasObject {
+	card := new(client.Flashcard)
+	if err := json.Unmarshal(item.Content, card); err != nil || card.Front == nil || card.Back == nil {
+		appLog.Errorf("invalid flashcard %s: %v", item.Name, err)
+		return widget.NewLabelWithStyle("Error displaying flashcard: "+item.Name, fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
+	}
+
+	back := flashcardSide(card.Back, items)
+	back.Hide()
+	answer := widget.NewVBox(widget.NewSeparator(), back)
+	box := widget.NewVBox(flashcardSide(card.Front, items), answer)
+
+	if len(card.Distractors) == 0 {
+		var reveal *widget.Button
+		reveal = widget.NewButton("Reveal", func() {
+			reveal.Hide()
+			back.Show()
+		})
+		answer.Prepend(reveal)
+		return widget.NewVScrollContainer(box)
+	}
+
+	choices := append([]string{card.Back.Text}, card.Distractors...)
+	shuffle := rand.New(rand.NewSource(time.Now().UnixNano()))
+	shuffle.Shuffle(len(choices), func(i, j int) {
+		choices[i], choices[j] = choices[j], choices[i]
+	})
+	result := widget.NewLabelWithStyle("", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
+	result.Hide()
+	buttons := widget.NewVBox()
+	for _, choice := range choices {
+		choice := choice
+		buttons.Append(widget.NewButton(choice, func() {
+			for _, b := range buttons.Children {
+				b.(*widget.Button).Disable()
+			}
+			if choice == card.Back.Text {
+				result.SetText("Correct!")
+			} else {
+				result.SetText("Not quite, the answer is:")
+			}
+			result.Show()
+			back.Show()
+		}))
+	}
+	answer.Prepend(result)
+	answer.Prepend(buttons)
+	return widget.NewVScrollContainer(box)
+}
+
+// flashcardSide shows a side of a flashcard.
+func flashcardSide(side *client.FlashcardSide, items []*Item) fyne.CanvasObject {
+	switch side.Type {
+	case client.TypeMarkdown:
+		return markdownContent([]byte(side.Text), items)
+	case client.TypeImage:
+		if imgUI := itemImage(items, side.Text); imgUI != nil {
+			return imgUI
+		}
+		return widget.NewLabelWithStyle("Missing image: "+side.Text, fyne.TextAlignCenter, fyne.TextStyle{Italic: true})
+	default:
+		label := widget.NewLabel(side.Text)
+		label.Wrapping = fyne.TextWrapWord
+		return label
+	}
+}
@@ -5,6 +5,12 @@ go 1.15
 require (
 	fyne.io/fyne v1.4.3
 	github.com/decred/dcrd/dcrutil/v3 v3.0.0
-	github.com/getlantern/systray v1.1.0
 	go.etcd.io/bbolt v1.3.5
 )
+
+require (
+	github.com/itswisdomagain/remindme v0.0.0
+	github.com/yuin/goldmark v1.4.4
+)
+
+replace github.com/itswisdomagain/remindme => ../
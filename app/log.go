@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/itswisdomagain/remindme/logging"
+)
+
+// logBackend writes the logs of all subsystems. Until initLogging is called
+// it writes info and above to stderr.
+var logBackend, _ = logging.New(&logging.Config{})
+
+// Subsystem loggers.
+var (
+	appLog  = logBackend.Logger("app")
+	syncLog = logBackend.Logger("sync")
+	dbLog   = logBackend.Logger("db")
+)
+
+// initLogging replaces the default log backend with one that logs at levels,
+// such as "info,sync=debug", and also writes to logs/app.log in dataDir. The
+// server keeps its own log file in the same directory.
+func initLogging(levels, dataDir string) error {
+	logDir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	backend, err := logging.New(&logging.Config{
+		Levels: levels,
+		File:   filepath.Join(logDir, "app.log"),
+	})
+	if err != nil {
+		return err
+	}
+	logBackend = backend
+	appLog = backend.Logger("app")
+	syncLog = backend.Logger("sync")
+	dbLog = backend.Logger("db")
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/canvas"
+	"fyne.io/fyne/layout"
+	"fyne.io/fyne/theme"
+	"fyne.io/fyne/widget"
+)
+
+// markdownImageScheme is the scheme of image references in markdown items,
+// which name image items of the same category.
+const markdownImageScheme = "item:"
+
+// maxInlineImageWidth is the widest that images in markdown and flashcards
+// are shown.
+const maxInlineImageWidth = 280
+
+// markdownRenderer turns markdown into fyne widgets.
+type markdownRenderer struct {
+	source []byte
+	// items are the items of the category, which images in the markdown
+	// may show.
+	items []*Item
+}
+
+// renderMarkdown shows a markdown item, with the images it references from
+// the items of its category, in a scroll container.
+func renderMarkdown(source []byte, items []*Item) fyne.CanvasObject {
+	return widget.NewVScrollContainer(markdownContent(source, items))
+}
+
+// markdownContent turns markdown into widgets, showing the images it
+// references from items.
+func markdownContent(source []byte, items []*Item) fyne.CanvasObject {
+	r := &markdownRenderer{source: source, items: items}
+	doc := goldmark.New().Parser().Parse(text.NewReader(source))
+	return r.blocks(doc)
+}
+
+// blocks lays out the blocks in a node one below the other.
+func (r *markdownRenderer) blocks(n ast.Node) fyne.CanvasObject {
+	box := widget.NewVBox()
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		if block := r.block(child); block != nil {
+			box.Append(block)
+		}
+	}
+	return box
+}
+
+func (r *markdownRenderer) block(n ast.Node) fyne.CanvasObject {
+	switch n := n.(type) {
+	case *ast.Heading:
+		size := theme.TextSize() + 2*(7-n.Level)
+		return r.flow(n, inlineStyle{size: size, TextStyle: fyne.TextStyle{Bold: true}})
+
+	case *ast.Paragraph, *ast.TextBlock:
+		return r.flow(n, inlineStyle{size: theme.TextSize()})
+
+	case *ast.CodeBlock, *ast.FencedCodeBlock:
+		var code strings.Builder
+		lines := n.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			segment := lines.At(i)
+			code.Write(segment.Value(r.source))
+		}
+		label := widget.NewLabelWithStyle(strings.TrimRight(code.String(), "\n"), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true})
+		background := canvas.NewRectangle(theme.ButtonColor())
+		return fyne.NewContainerWithLayout(layout.NewMaxLayout(), background, label)
+
+	case *ast.Blockquote:
+		bar := canvas.NewRectangle(theme.DisabledTextColor())
+		bar.SetMinSize(fyne.NewSize(3, 0))
+		quote := r.blocks(n)
+		return fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, nil, bar, nil), bar, quote)
+
+	case *ast.List:
+		list := widget.NewVBox()
+		number := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			marker := "•"
+			if n.IsOrdered() {
+				marker = fmt.Sprintf("%d.", number)
+				number++
+			}
+			markerLabel := widget.NewLabel(marker)
+			content := r.blocks(item)
+			list.Append(fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, nil, markerLabel, nil), markerLabel, content))
+		}
+		return list
+
+	case *ast.ThematicBreak:
+		return widget.NewSeparator()
+
+	case *ast.HTMLBlock:
+		return nil // HTML is not shown
+
+	default:
+		return r.blocks(n)
+	}
+}
+
+// inlineStyle is the style of text in a block.
+type inlineStyle struct {
+	fyne.TextStyle
+	size int
+	link *url.URL
+}
+
+// flow lays out the inline content of a block, wrapping it at word
+// boundaries.
+func (r *markdownRenderer) flow(n ast.Node, style inlineStyle) fyne.CanvasObject {
+	var objects []fyne.CanvasObject
+	r.inline(n, style, &objects)
+	return fyne.NewContainerWithLayout(&flowLayout{}, objects...)
+}
+
+// inline appends the widgets of the inline content of a node to objects.
+func (r *markdownRenderer) inline(n ast.Node, style inlineStyle, objects *[]fyne.CanvasObject) {
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		switch child := child.(type) {
+		case *ast.Text:
+			r.words(string(child.Segment.Value(r.source)), style, objects)
+			if child.HardLineBreak() {
+				*objects = append(*objects, lineBreak())
+			}
+		case *ast.String:
+			r.words(string(child.Value), style, objects)
+		case *ast.CodeSpan:
+			code := style
+			code.Monospace = true
+			r.inline(child, code, objects)
+		case *ast.Emphasis:
+			emphasis := style
+			if child.Level == 2 {
+				emphasis.Bold = true
+			} else {
+				emphasis.Italic = true
+			}
+			r.inline(child, emphasis, objects)
+		case *ast.Link:
+			link := style
+			link.link, _ = url.Parse(string(child.Destination))
+			r.inline(child, link, objects)
+		case *ast.AutoLink:
+			link := style
+			dest := string(child.URL(r.source))
+			if child.AutoLinkType == ast.AutoLinkEmail {
+				dest = "mailto:" + dest
+			}
+			link.link, _ = url.Parse(dest)
+			r.words(string(child.Label(r.source)), link, objects)
+		case *ast.Image:
+			*objects = append(*objects, r.image(child))
+		case *ast.RawHTML:
+			// HTML is not shown.
+		default:
+			r.inline(child, style, objects)
+		}
+	}
+}
+
+// words appends a widget for each word of text, so that the text wraps
+// between words.
+func (r *markdownRenderer) words(s string, style inlineStyle, objects *[]fyne.CanvasObject) {
+	for _, word := range strings.Fields(s) {
+		if style.link != nil {
+			*objects = append(*objects, widget.NewHyperlinkWithStyle(word, style.link, fyne.TextAlignLeading, style.TextStyle))
+			continue
+		}
+		t := canvas.NewText(word+" ", theme.TextColor())
+		t.TextStyle, t.TextSize = style.TextStyle, style.size
+		*objects = append(*objects, t)
+	}
+}
+
+// image shows an image item that an image in markdown references, or the
+// image's description if the item is not an image of the category.
+func (r *markdownRenderer) image(n *ast.Image) fyne.CanvasObject {
+	var alt strings.Builder
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		if t, ok := child.(*ast.Text); ok {
+			alt.Write(t.Segment.Value(r.source))
+		}
+	}
+	missing := canvas.NewText("["+alt.String()+"] ", theme.DisabledTextColor())
+	missing.TextStyle = fyne.TextStyle{Italic: true}
+
+	dest := string(n.Destination)
+	if !strings.HasPrefix(dest, markdownImageScheme) {
+		return missing
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(dest, markdownImageScheme))
+	if err != nil {
+		return missing
+	}
+	if imgUI := itemImage(r.items, name); imgUI != nil {
+		return imgUI
+	}
+	return missing
+}
+
+// itemImage shows the image item of a name among items, at most
+// maxInlineImageWidth wide. It returns nil if there is no such image.
+func itemImage(items []*Item, name string) *canvas.Image {
+	for _, item := range items {
+		if item.Name != name || item.Type != "image" {
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(item.Content))
+		if err != nil {
+			appLog.Debugf("failed to decode image %s: %v", name, err)
+			return nil
+		}
+		size := img.Bounds().Size()
+		if size.X > maxInlineImageWidth {
+			size.Y = size.Y * maxInlineImageWidth / size.X
+			size.X = maxInlineImageWidth
+		}
+		imgUI := canvas.NewImageFromImage(img)
+		imgUI.FillMode = canvas.ImageFillContain
+		imgUI.SetMinSize(fyne.NewSize(size.X, size.Y))
+		return imgUI
+	}
+	return nil
+}
+
+// lineBreakObject is an object that ends a line in a flowLayout.
+type lineBreakObject struct {
+	*canvas.Rectangle
+}
+
+func lineBreak() fyne.CanvasObject {
+	return lineBreakObject{canvas.NewRectangle(color.Transparent)}
+}
+
+// flowLayout places objects left to right, starting a new line when the
+// next object does not fit. Its minimum height is that of the objects laid
+// out at the width it was last given, as layouts cannot ask for a height
+// that depends on their width.
+type flowLayout struct {
+	width int
+}
+
+// defaultFlowWidth is the width that flowLayout assumes before it is first
+// laid out, about that of the smallest reminder window.
+const defaultFlowWidth = 280
+
+func (f *flowLayout) Layout(objects []fyne.CanvasObject, size fyne.Size) {
+	f.width = size.Width
+	f.place(objects, size.Width, true)
+}
+
+func (f *flowLayout) MinSize(objects []fyne.CanvasObject) fyne.Size {
+	width := f.width
+	if width == 0 {
+		width = defaultFlowWidth
+	}
+	var min fyne.Size
+	for _, o := range objects {
+		if o.Visible() {
+			min = min.Max(fyne.NewSize(o.MinSize().Width, 0))
+		}
+	}
+	min.Height = f.place(objects, width, false)
+	return min
+}
+
+// place lays out objects in lines at most width wide, moving and resizing
+// them if move is set, and returns the height of the lines.
+func (f *flowLayout) place(objects []fyne.CanvasObject, width int, move bool) int {
+	var x, y, lineHeight int
+	var line []fyne.CanvasObject
+	endLine := func() {
+		if move {
+			// Objects are aligned at the bottom of the line, which keeps
+			// words of different sizes on the same baseline.
+			for _, o := range line {
+				o.Move(fyne.NewPos(o.Position().X, y+lineHeight-o.MinSize().Height))
+			}
+		}
+		y += lineHeight
+		x, lineHeight, line = 0, 0, line[:0]
+	}
+	for _, o := range objects {
+		if !o.Visible() {
+			continue
+		}
+		if _, ok := o.(lineBreakObject); ok {
+			if lineHeight == 0 {
+				lineHeight = theme.TextSize()
+			}
+			endLine()
+			continue
+		}
+		min := o.MinSize()
+		if x > 0 && x+min.Width > width {
+			endLine()
+		}
+		if move {
+			o.Resize(min)
+			o.Move(fyne.NewPos(x, y))
+		}
+		line = append(line, o)
+		x += min.Width
+		if min.Height > lineHeight {
+			lineHeight = min.Height
+		}
+	}
+	if len(line) > 0 {
+		endLine()
+	}
+	return y
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+
+	"fyne.io/fyne"
+	"fyne.io/fyne/dialog"
+	"fyne.io/fyne/layout"
+	"fyne.io/fyne/widget"
+)
+
+// syncResponsesMtx keeps answers to prompts from being synced twice at once.
+var syncResponsesMtx sync.Mutex
+
+// promptCard shows a prompt with an entry for the user's answer, which is
+// saved with the time it was written and synced to the server.
+func promptCard(category string, item *Item) fyne.CanvasObject {
+	prompt := widget.NewLabelWithStyle(string(item.Content), fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+	prompt.Wrapping = fyne.TextWrapWord
+	entry := widget.NewMultiLineEntry()
+	entry.Wrapping = fyne.TextWrapWord
+	entry.SetPlaceHolder("Your answer")
+	status := widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+	status.Hide()
+
+	itemName := item.Name
+	save := widget.NewButton("Save", func() {
+		text := strings.TrimSpace(entry.Text)
+		if text == "" {
+			return
+		}
+		response := &promptResponse{PromptResponse: client.PromptResponse{
+			Category:  category,
+			Item:      itemName,
+			WrittenAt: time.Now().UTC(),
+			Text:      text,
+		}}
+		if err := saveResponse(response); err != nil {
+			appLog.Errorf("failed to save response to %s: %v", itemName, err)
+			status.SetText("Error saving your answer: " + err.Error())
+			status.Show()
+			return
+		}
+		entry.SetText("")
+		status.SetText("Saved.")
+		status.Show()
+		go syncResponses()
+	})
+	past := widget.NewButton("Past answers", func() {
+		showResponses(category, itemName, string(item.Content))
+	})
+
+	top := widget.NewVBox(prompt)
+	bottom := widget.NewVBox(status, widget.NewHBox(layout.NewSpacer(), past, save))
+	return fyne.NewContainerWithLayout(layout.NewBorderLayout(top, bottom, nil, nil), top, bottom, entry)
+}
+
+// showResponses shows the answers to a prompt in a new window, newest
+// first, with a button to export them to a text file.
+func showResponses(category, itemName, prompt string) {
+	responses, err := readResponses(category, itemName)
+	if err != nil {
+		appLog.Errorf("failed to read responses to %s: %v", itemName, err)
+		return
+	}
+	w := a.NewWindow(category + ": " + itemName + " (answers)")
+
+	list := widget.NewVBox()
+	for i := len(responses) - 1; i >= 0; i-- {
+		response := responses[i]
+		text := widget.NewLabel(response.Text)
+		text.Wrapping = fyne.TextWrapWord
+		list.Append(widget.NewLabelWithStyle(response.WrittenAt.Local().Format(time.RFC1123), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}))
+		list.Append(text)
+		list.Append(widget.NewSeparator())
+	}
+	if len(responses) == 0 {
+		list.Append(widget.NewLabelWithStyle("No answers yet.", fyne.TextAlignCenter, fyne.TextStyle{Italic: true}))
+	}
+
+	export := widget.NewButton("Export", func() {
+		dialog.ShowFileSave(func(writer fyne.URIWriteCloser, err error) {
+			if err != nil || writer == nil {
+				return
+			}
+			defer writer.Close()
+			if _, err = writer.Write([]byte(formatResponses(prompt, responses))); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}, w)
+	})
+	if len(responses) == 0 {
+		export.Disable()
+	}
+
+	bottom := widget.NewHBox(layout.NewSpacer(), export)
+	scroll := widget.NewVScrollContainer(list)
+	w.SetContent(fyne.NewContainerWithLayout(layout.NewBorderLayout(nil, bottom, nil, nil), bottom, scroll))
+	w.Resize(fyne.NewSize(500, 400))
+	w.Show()
+}
+
+// formatResponses writes a prompt and the answers to it as text, oldest
+// first.
+func formatResponses(prompt string, responses []*promptResponse) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", prompt)
+	for _, response := range responses {
+		fmt.Fprintf(&b, "\n%s\n\n%s\n", response.WrittenAt.Local().Format(time.RFC1123), response.Text)
+	}
+	return b.String()
+}
+
+// syncResponses sends the server the answers to prompts it does not have and
+// stores the answers written on other devices. Answers that fail to send are
+// sent the next time answers are synced.
+func syncResponses() {
+	syncResponsesMtx.Lock()
+	defer syncResponsesMtx.Unlock()
+	responses, err := readResponses("", "")
+	if err != nil {
+		syncLog.Errorf("failed to read responses: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+	for _, response := range responses {
+		if response.Synced {
+			continue
+		}
+		if _, err := api.SaveResponse(ctx, &response.PromptResponse); err != nil {
+			syncLog.Debugf("failed to sync response to %s in %s: %v", response.Item, response.Category, err)
+			continue
+		}
+		response.Synced = true
+		if err = saveResponse(response); err != nil {
+			syncLog.Errorf("failed to save response: %v", err)
+		}
+	}
+
+	downloaded, err := api.Responses(ctx, "", "")
+	if err != nil {
+		syncLog.Debugf("failed to download responses: %v", err)
+		return
+	}
+	if err = mergeResponses(downloaded); err != nil {
+		syncLog.Errorf("failed to save downloaded responses: %v", err)
+	}
+}
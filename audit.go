@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// auditBkt is the append-only audit log, keyed by sequence. Entries are
+// never trimmed.
+var auditBkt = []byte("audit")
+
+// auditExportBatch is how many entries are read per transaction when
+// exporting the audit log, so that a slow download does not hold a
+// transaction open.
+const auditExportBatch = 1000
+
+type auditEntry = client.AuditEntry
+
+// actor identifies who made a write, for item revisions and the audit log.
+type actor struct {
+	user string
+	ip   string
+}
+
+// systemActor is the actor of writes made by the server's own jobs.
+var systemActor = actor{user: "system"}
+
+// requestActor returns the user that made a request and the address it came
+// from.
+func requestActor(r *http.Request) actor {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return actor{user: requestUser(r), ip: ip}
+}
+
+// recordAudit appends an entry made by who to the audit log. It must be
+// called from the transaction that makes the write.
+func recordAudit(tx *bbolt.Tx, who actor, entry *auditEntry) error {
+	audit, err := tx.CreateBucketIfNotExists(auditBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if entry.ID, err = audit.NextSequence(); err != nil {
+		return err
+	}
+	entry.Time = time.Now().UTC()
+	entry.Actor = who.user
+	entry.IP = who.ip
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return audit.Put(uint64Bytes(entry.ID), v)
+}
+
+// auditFilter matches audit entries against the query parameters of a
+// request.
+type auditFilter struct {
+	actor, action, category, item string
+	since, until                  time.Time
+}
+
+func parseAuditFilter(r *http.Request) (*auditFilter, error) {
+	q := r.URL.Query()
+	filter := &auditFilter{
+		actor:    q.Get("actor"),
+		action:   q.Get("action"),
+		category: q.Get("category"),
+		item:     q.Get("item"),
+	}
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.since}, {"until", &filter.until}} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time", param.name)
+			}
+			*param.t = t
+		}
+	}
+	return filter, nil
+}
+
+func (f *auditFilter) matches(entry *auditEntry) bool {
+	return (f.actor == "" || entry.Actor == f.actor) &&
+		(f.action == "" || entry.Action == f.action) &&
+		(f.category == "" || entry.Category == f.category) &&
+		(f.item == "" || entry.Item == f.item) &&
+		(f.since.IsZero() || !entry.Time.Before(f.since)) &&
+		(f.until.IsZero() || entry.Time.Before(f.until))
+}
+
+// listAudit returns the audit log entries matching the actor, action,
+// category, item, since and until query parameters, newest first. Pages
+// older than the first are requested with the before parameter, the id of
+// the last entry of the previous page. With format=jsonl, all matching
+// entries are exported as JSON Lines, oldest first.
+func (api *apiServer) listAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "jsonl":
+		api.exportAudit(w, r, filter)
+		return
+	default:
+		writeError(w, "format must be json or jsonl", http.StatusBadRequest)
+		return
+	}
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var before uint64
+	if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
+		if before, err = strconv.ParseUint(beforeStr, 10, 64); err != nil {
+			writeError(w, "invalid before id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := &client.AuditLog{
+		Entries: make([]*auditEntry, 0),
+	}
+	err = api.db.View(func(tx *bbolt.Tx) error {
+		audit := tx.Bucket(auditBkt)
+		if audit == nil {
+			return nil
+		}
+		cursor := audit.Cursor()
+		k, v := cursor.Last()
+		if before != 0 {
+			// Seek finds the entry with the before id, or the one after it
+			// if it does not exist.
+			k, v = cursor.Seek(uint64Bytes(before))
+			if k == nil {
+				k, v = cursor.Last()
+			}
+			if k != nil && binary.BigEndian.Uint64(k) >= before {
+				k, v = cursor.Prev()
+			}
+		}
+		for ; k != nil; k, v = cursor.Prev() {
+			entry := new(auditEntry)
+			if err := json.Unmarshal(v, entry); err != nil {
+				return fmt.Errorf("failed to decode audit entry: %w", err)
+			}
+			if !filter.since.IsZero() && entry.Time.Before(filter.since) {
+				break
+			}
+			if !filter.matches(entry) {
+				continue
+			}
+			if len(resp.Entries) == limit {
+				resp.More = true
+				break
+			}
+			resp.Entries = append(resp.Entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching audit log from db: %v", err)
+		writeError(w, "error fetching audit log", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, resp)
+}
+
+// exportAudit writes the matching audit entries as JSON Lines, oldest first.
+func (api *apiServer) exportAudit(w http.ResponseWriter, r *http.Request, filter *auditFilter) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	var next uint64
+	for {
+		var batch [][]byte
+		err := api.db.View(func(tx *bbolt.Tx) error {
+			audit := tx.Bucket(auditBkt)
+			if audit == nil {
+				return nil
+			}
+			cursor := audit.Cursor()
+			for k, v := cursor.Seek(uint64Bytes(next)); k != nil; k, v = cursor.Next() {
+				next = binary.BigEndian.Uint64(k) + 1
+				entry := new(auditEntry)
+				if err := json.Unmarshal(v, entry); err != nil {
+					return fmt.Errorf("failed to decode audit entry: %w", err)
+				}
+				if !filter.until.IsZero() && !entry.Time.Before(filter.until) {
+					return nil
+				}
+				if filter.matches(entry) {
+					batch = append(batch, append([]byte(nil), v...))
+				}
+				if len(batch) == auditExportBatch {
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// The response has started, so the export just ends early.
+			reqLog(r).Errorf("Error exporting audit log: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+		for _, line := range batch {
+			if _, err := w.Write(append(line, '\n')); err != nil {
+				return
+			}
+		}
+		if len(batch) < auditExportBatch {
+			return
+		}
+	}
+}
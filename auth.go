@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const userCtxKey contextKey = "user"
+
+// anonymousUser is the user of all requests when no API tokens are
+// configured.
+const anonymousUser = "anonymous"
+
+// authenticate is middleware that identifies the user making a request from
+// the bearer token in the Authorization header, rejecting the request if the
+// token is not known. If the server has no tokens configured, all requests
+// are accepted as coming from the anonymous user.
+func (api *apiServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := anonymousUser
+		if len(api.authTokens) > 0 {
+			token, found := bearerToken(r)
+			if found {
+				user, found = api.authTokens[sha256.Sum256([]byte(token))]
+			}
+			if !found {
+				api.limits.authFailed(r)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="remindme"`)
+				writeError(w, "missing or invalid api token", http.StatusUnauthorized)
+				return
+			}
+		}
+		ctx := setRequestUser(r, user)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, userCtxKey, user)))
+	})
+}
+
+// bearerToken returns the token of the request's Authorization header, which
+// must use the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	const scheme = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) {
+		return "", false
+	}
+	return auth[len(scheme):], true
+}
+
+// hashAuthTokens indexes the configured users by the hash of their tokens,
+// so that tokens are not compared byte by byte when looked up.
+func hashAuthTokens(tokens map[string]string) map[[sha256.Size]byte]string {
+	hashed := make(map[[sha256.Size]byte]string, len(tokens))
+	for token, user := range tokens {
+		hashed[sha256.Sum256([]byte(token))] = user
+	}
+	return hashed
+}
+
+// requestUser returns the name of the user that made an authenticated
+// request.
+func requestUser(r *http.Request) string {
+	if user, ok := r.Context().Value(userCtxKey).(string); ok {
+		return user
+	}
+	return anonymousUser
+}
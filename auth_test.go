@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	api := &apiServer{
+		authTokens: hashAuthTokens(map[string]string{"s3cret": "ann"}),
+		limits:     newRateLimiter(&config{}),
+	}
+	handler := api.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(requestUser(r)))
+	}))
+
+	tests := []struct {
+		authorization string
+		user          string
+	}{
+		{"Bearer s3cret", "ann"},
+		{"bearer s3cret", "ann"},
+		{"s3cret", ""},
+		{"Basic s3cret", ""},
+		{"Bearer wrong", ""},
+		{"Bearer ", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/categories", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if test.user == "" {
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Authorization %q: got status %d, want %d", test.authorization, w.Code, http.StatusUnauthorized)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK || w.Body.String() != test.user {
+			t.Errorf("Authorization %q: got status %d, user %q, want user %q",
+				test.authorization, w.Code, w.Body.String(), test.user)
+		}
+	}
+}
+
+func TestReadAuthTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens")
+	err := ioutil.WriteFile(path, []byte("# users\nann:s3cret\n\n  bob:t0ken:with:colons  \n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := make(authTokensFlag)
+	if err = readAuthTokens(path, tokens); err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens["s3cret"] != "ann" || tokens["t0ken:with:colons"] != "bob" {
+		t.Errorf("wrong tokens read: %v", tokens)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("ann:s3cret\njusttoken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = readAuthTokens(path, make(authTokensFlag)); err == nil {
+		t.Error("line without a user was accepted")
+	}
+}
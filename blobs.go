@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// Blobs are content stored once by hash and shared by the records that
+// reference it, such as the revisions of items that were restored or
+// uploaded again unchanged. Each reference is counted and a blob is deleted
+// when its last reference is released.
+var (
+	blobsBkt    = []byte("blobs")
+	blobRefsBkt = []byte("blob_refs")
+)
+
+// contentHash is the hex encoded SHA-256 hash of content, which identifies
+// its blob.
+func contentHash(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// putBlob stores content if it is not stored yet and adds a reference to it.
+// It returns the blob's hash.
+func putBlob(tx *bbolt.Tx, content []byte) (string, error) {
+	blobs, err := tx.CreateBucketIfNotExists(blobsBkt)
+	if err != nil {
+		return "", fmt.Errorf("failed to open blob store: %w", err)
+	}
+	refs, err := tx.CreateBucketIfNotExists(blobRefsBkt)
+	if err != nil {
+		return "", fmt.Errorf("failed to open blob references: %w", err)
+	}
+	hash := contentHash(content)
+	key := []byte(hash)
+	var count uint64
+	if v := refs.Get(key); len(v) == 8 {
+		count = binary.BigEndian.Uint64(v)
+	} else if err = blobs.Put(key, content); err != nil {
+		return "", err
+	}
+	return hash, refs.Put(key, uint64Bytes(count+1))
+}
+
+// getBlob returns the content of a blob, or nil if it does not exist. The
+// content is only valid for the life of the transaction.
+func getBlob(tx *bbolt.Tx, hash string) []byte {
+	blobs := tx.Bucket(blobsBkt)
+	if blobs == nil {
+		return nil
+	}
+	return blobs.Get([]byte(hash))
+}
+
+// releaseBlob removes a reference to a blob, deleting the blob if it was the
+// last one.
+func releaseBlob(tx *bbolt.Tx, hash string) error {
+	refs := tx.Bucket(blobRefsBkt)
+	if refs == nil {
+		return nil
+	}
+	key := []byte(hash)
+	var count uint64
+	if v := refs.Get(key); len(v) == 8 {
+		count = binary.BigEndian.Uint64(v)
+	}
+	if count > 1 {
+		return refs.Put(key, uint64Bytes(count-1))
+	}
+	if err := refs.Delete(key); err != nil {
+		return err
+	}
+	if blobs := tx.Bucket(blobsBkt); blobs != nil {
+		return blobs.Delete(key)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// maxBulkFiles is the number of files accepted in a bulk upload,
+	// counting the files in zips.
+	maxBulkFiles = 1000
+	// maxBulkBytes is the total size of a bulk upload, and of the files in
+	// it once unzipped.
+	maxBulkBytes = 500_000_000
+	// bulkFormMemory is how much of a bulk upload is held in memory while
+	// parsing it, the rest is buffered in temporary files.
+	bulkFormMemory = 32 << 20
+)
+
+// bulkFile is a file of a bulk upload. item is nil if the file cannot be
+// stored.
+type bulkFile struct {
+	result *client.BulkFileResult
+	item   *Item
+	// original is the file as uploaded, if it is an image that was
+	// stripped of metadata.
+	original []byte
+}
+
+// bulkUpload stores the files uploaded in the files fields of a multipart
+// form as items of a category, expanding zip files. Item names are the file
+// names without their extension and types are inferred from the content.
+// Images are stripped of metadata.
+// All items are stored in one transaction, and the response reports the
+// outcome of each file. The existing form field decides what happens to
+// files named like existing items: they fail by default, or are skipped or
+// replace the items, whatever their version.
+func (api *apiServer) bulkUpload(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBytes)
+	if err := r.ParseMultipartForm(bulkFormMemory); err != nil {
+		if strings.Contains(err.Error(), errBodyTooLarge) {
+			writeError(w, fmt.Sprintf("upload is larger than the limit of %d bytes", maxBulkBytes),
+				http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeError(w, "invalid bulk upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	existing := r.FormValue("existing")
+	var cond itemCondition
+	switch existing {
+	case "", client.BulkExistingFail:
+		cond.createOnly = true
+	case client.BulkExistingSkip:
+	case client.BulkExistingReplace:
+		cond.anyVersion = true
+	default:
+		writeError(w, "existing must be fail, skip or replace", http.StatusBadRequest)
+		return
+	}
+	fileHeaders := r.MultipartForm.File["files"]
+	if len(fileHeaders) == 0 {
+		writeError(w, "no files uploaded", http.StatusBadRequest)
+		return
+	}
+
+	reader := &bulkReader{budget: maxBulkBytes, maxFile: api.maxUploadBytes, names: make(map[string]bool)}
+	for _, fh := range fileHeaders {
+		if err := reader.readUpload(fh); err != nil {
+			reqLog(r).Errorf("Error reading bulk upload file: %v", err)
+			writeError(w, "error reading uploaded files", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(reader.files) > maxBulkFiles {
+		writeError(w, fmt.Sprintf("too many files, at most %d can be uploaded at once", maxBulkFiles),
+			http.StatusBadRequest)
+		return
+	}
+
+	summary := &client.BulkResult{
+		Category: category,
+		Files:    make([]*client.BulkFileResult, 0, len(reader.files)),
+	}
+	who := requestActor(r)
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		quotas := api.quotas()
+		catBucket := categoryBucket(tx, category)
+		for _, file := range reader.files {
+			result := file.result
+			var existingBkt *bbolt.Bucket
+			if catBucket != nil && file.item != nil {
+				existingBkt = catBucket.Bucket([]byte(file.item.Name))
+			}
+			switch {
+			case file.item == nil:
+				result.Status = client.BulkFailed
+			case existing == client.BulkExistingSkip && existingBkt != nil:
+				result.Status = client.BulkSkipped
+				result.Version = itemVersion(existingBkt)
+			default:
+				err := cond.check(existingBkt)
+				if err == nil {
+					err = quotas.reserve(tx, category, file.item, who)
+				}
+				var event string
+				if err == nil {
+					event, err = putItem(tx, category, file.item, cond, who)
+				}
+				if err == nil {
+					err = keepOriginal(tx, category, file.item, file.original)
+				}
+				var conflict *versionConflict
+				if errors.As(err, &conflict) {
+					result.Status = client.BulkFailed
+					result.Error = conflict.msg
+					result.Version = conflict.current
+					break
+				}
+				var overQuota *quotaExceeded
+				if errors.As(err, &overQuota) {
+					result.Status = client.BulkFailed
+					result.Error = overQuota.msg
+					break
+				}
+				if err != nil {
+					return err
+				}
+				result.Status = client.BulkCreated
+				if event == eventItemUpdated {
+					result.Status = client.BulkUpdated
+				}
+				result.Version = file.item.Version
+			}
+			switch result.Status {
+			case client.BulkCreated:
+				summary.Created++
+			case client.BulkUpdated:
+				summary.Updated++
+			case client.BulkSkipped:
+				summary.Skipped++
+			case client.BulkFailed:
+				summary.Failed++
+			}
+		}
+		if summary.Created+summary.Updated == 0 {
+			return nil
+		}
+		return queueWebhookEvent(tx, eventCategoryUpdated, category, nil)
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error saving bulk upload: %v", err)
+		writeError(w, "error saving items", http.StatusInternalServerError)
+		return
+	}
+	api.webhooks.wake()
+	api.variants.wake()
+	api.links.wake()
+
+	for _, file := range reader.files {
+		summary.Files = append(summary.Files, file.result)
+	}
+	writeJSON(w, summary)
+}
+
+// bulkReader reads the files of a bulk upload, within a total size budget.
+type bulkReader struct {
+	files  []*bulkFile
+	budget int64
+	// maxFile is the size limit of each file.
+	maxFile int64
+	// names are the item names already used by files of the upload.
+	names map[string]bool
+}
+
+// readUpload reads an uploaded file, or the files in it if it is a zip. Only
+// failures to read the upload buffered by the server are returned, problems
+// with the files are reported in their results.
+func (br *bulkReader) readUpload(fh *multipart.FileHeader) error {
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !isZip(fh) {
+		br.add(fh.Filename, f, fh.Size)
+		return nil
+	}
+	zr, err := zip.NewReader(f, fh.Size)
+	if err != nil {
+		br.fail(fh.Filename, "invalid zip file: "+err.Error())
+		return nil
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || hiddenZipEntry(zf.Name) {
+			continue
+		}
+		if len(br.files) > maxBulkFiles {
+			return nil // the upload is rejected
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			br.fail(zf.Name, "invalid zip entry: "+err.Error())
+			continue
+		}
+		br.add(zf.Name, rc, int64(zf.UncompressedSize64))
+		rc.Close()
+	}
+	return nil
+}
+
+func isZip(fh *multipart.FileHeader) bool {
+	switch fh.Header.Get("Content-Type") {
+	case "application/zip", "application/x-zip-compressed":
+		return true
+	}
+	return strings.EqualFold(path.Ext(fh.Filename), ".zip")
+}
+
+// hiddenZipEntry reports whether a zip entry is a hidden file, such as the
+// metadata added to zips made on macOS, rather than content.
+func hiddenZipEntry(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// add reads a file and infers the item it describes.
+func (br *bulkReader) add(filename string, r io.Reader, size int64) {
+	if size > br.maxFile {
+		br.fail(filename, fmt.Sprintf("file is larger than %d bytes", br.maxFile))
+		return
+	}
+	if size > br.budget {
+		br.fail(filename, fmt.Sprintf("upload is larger than %d bytes", maxBulkBytes))
+		return
+	}
+	// The size of zip entries is not trusted.
+	content, err := ioutil.ReadAll(io.LimitReader(r, br.maxFile+1))
+	if err != nil {
+		br.fail(filename, "error reading file: "+err.Error())
+		return
+	}
+	if int64(len(content)) > br.maxFile {
+		br.fail(filename, fmt.Sprintf("file is larger than %d bytes", br.maxFile))
+		return
+	}
+	br.budget -= int64(len(content))
+
+	base := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	name := strings.TrimSpace(strings.TrimSuffix(base, path.Ext(base)))
+	if name == "" {
+		br.fail(filename, "cannot name an item after the file")
+		return
+	}
+	if br.names[name] {
+		br.fail(filename, "another file in the upload has the item name "+name)
+		return
+	}
+	itemType, content := inferItem(base, content)
+	if itemType == "" {
+		br.fail(filename, "not an image, video or text file")
+		return
+	}
+
+	item := &Item{Name: name, Type: itemType, Content: content}
+	original, err := stripUpload(item)
+	if err == nil {
+		err = validateItem(item)
+	}
+	if err != nil {
+		br.fail(filename, err.Error())
+		return
+	}
+
+	br.names[name] = true
+	br.files = append(br.files, &bulkFile{
+		result:   &client.BulkFileResult{File: filename, Name: name, Type: itemType},
+		item:     item,
+		original: original,
+	})
+}
+
+func (br *bulkReader) fail(filename, reason string) {
+	br.files = append(br.files, &bulkFile{
+		result: &client.BulkFileResult{File: filename, Error: reason},
+	})
+}
+
+// inferItem infers an item type from a file's content, or its name if the
+// content is not recognized. Text files holding just a URL are links, and
+// text files named .md or .markdown are markdown. It returns an empty type for files that are not a supported type.
+func inferItem(filename string, content []byte) (string, []byte) {
+	mediaType := http.DetectContentType(content)
+	if strings.HasPrefix(mediaType, "application/octet-stream") {
+		if byExt := mime.TypeByExtension(path.Ext(filename)); byExt != "" {
+			mediaType = byExt
+		}
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return client.TypeImage, content
+	case strings.HasPrefix(mediaType, "video/"):
+		return client.TypeVideo, content
+	case strings.HasPrefix(mediaType, "text/plain"):
+		if isMarkdownFile(filename) {
+			return client.TypeMarkdown, content
+		}
+		trimmed := bytes.TrimSpace(content)
+		if !bytes.ContainsAny(trimmed, " \n") {
+			if validLink(string(trimmed)) {
+				return client.TypeLink, trimmed
+			}
+		}
+		return client.TypeText, content
+	}
+	return "", nil
+}
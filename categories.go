@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+type (
+	categorySummary = client.CategorySummary
+	itemSummary     = client.ItemSummary
+)
+
+// urlParam returns the unescaped value of a route parameter. Item and
+// category names may contain characters that have to be escaped in paths.
+// Routes are matched against the raw path only when it differs from the
+// decoded path, otherwise the parameter is already unescaped.
+func urlParam(r *http.Request, key string) string {
+	v := chi.URLParam(r, key)
+	if r.URL.RawPath == "" {
+		return v
+	}
+	if unescaped, err := url.PathUnescape(v); err == nil {
+		return unescaped
+	}
+	return v
+}
+
+// itemContentType is the media type of an item's content.
+func itemContentType(item *Item) string {
+	switch item.Type {
+	case "image", "video":
+		// Content that is not media, such as SVG images stored before they
+		// were rejected, is not served as a type that browsers render.
+		contentType := http.DetectContentType(item.Content)
+		if !strings.HasPrefix(contentType, item.Type+"/") && contentType != "application/ogg" {
+			return "application/octet-stream"
+		}
+		return contentType
+	case client.TypeMarkdown:
+		return "text/markdown; charset=utf-8"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// countItems counts the items in a category bucket.
+func countItems(categoryBkt *bbolt.Bucket) int {
+	var n int
+	categoryBkt.ForEach(func(_, v []byte) error {
+		if v == nil {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// listCategories lists the categories by name with their item counts, or a
+// page of them if pagination parameters are given.
+func (api *apiServer) listCategories(w http.ResponseWriter, r *http.Request) {
+	start, limit, paged, err := listPage(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !paged {
+		limit = math.MaxInt32
+	}
+	var categories []*categorySummary
+	var next *listCursor
+	var notModified bool
+	err = api.db.View(func(tx *bbolt.Tx) error {
+		if notModified = libraryNotModified(w, r, tx); notModified {
+			return nil
+		}
+		categories, next = readCategoriesPage(tx, start, limit)
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching categories from db: %v", err)
+		writeError(w, "error fetching categories", http.StatusInternalServerError)
+		return
+	}
+	if notModified {
+		return
+	}
+
+	if paged {
+		writeJSON(w, &client.CategoryPage{Categories: categories, NextCursor: next.String()})
+		return
+	}
+	writeJSON(w, categories)
+}
+
+// listCategoryItems lists the items of a category in order, without their
+// content, or a page of them if pagination parameters are given.
+func (api *apiServer) listCategoryItems(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	start, limit, paged, err := listPage(r)
+	if err == nil && start != nil && start.Category != category {
+		err = errInvalidCursor
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !paged {
+		limit = math.MaxInt32
+	}
+	var items []*itemSummary
+	var next *listCursor
+	var notModified bool
+	err = api.db.View(func(tx *bbolt.Tx) error {
+		catBucket := categoryBucket(tx, category)
+		if catBucket == nil {
+			return nil
+		}
+		if notModified = libraryNotModified(w, r, tx); notModified {
+			return nil
+		}
+		items, next = readItemsPage(catBucket, category, start, limit)
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching items from db: %v", err)
+		writeError(w, "error fetching items", http.StatusInternalServerError)
+		return
+	}
+	if notModified {
+		return
+	}
+	if items == nil {
+		writeError(w, "category not found", http.StatusNotFound)
+		return
+	}
+
+	if paged {
+		writeJSON(w, &client.ItemPage{Items: items, NextCursor: next.String()})
+		return
+	}
+	writeJSON(w, items)
+}
+
+// fetchItem reads an item from the db. It returns nil if the item does not
+// exist.
+func (api *apiServer) fetchItem(category, itemName string) (*Item, error) {
+	return readItem(api.db, category, itemName)
+}
+
+// readItem reads an item with a copy of its content, like copyItem. It
+// returns nil if the item does not exist.
+func readItem(db *bbolt.DB, category, itemName string) (item *Item, err error) {
+	err = db.View(func(tx *bbolt.Tx) error {
+		itemBkt := itemBucket(tx, category, itemName)
+		if itemBkt == nil {
+			return nil
+		}
+		item, err = copyItem(tx, category, itemName, itemBkt)
+		return err
+	})
+	return
+}
+
+// copyItem reads an item from its bucket with a copy of its content, so that
+// it can be used after the transaction, its metadata and its link preview.
+func copyItem(tx *bbolt.Tx, category, itemName string, itemBkt *bbolt.Bucket) (*Item, error) {
+	item := &Item{
+		Name:    itemName,
+		Type:    string(itemBkt.Get(itemTypeKey)),
+		Content: append([]byte(nil), itemBkt.Get(itemContentKey)...),
+		Version: itemVersion(itemBkt),
+	}
+	var err error
+	if item.Metadata, err = itemMetadata(itemBkt); err != nil {
+		return nil, err
+	}
+	return item, addLinkPreview(tx, category, item)
+}
+
+// getItem returns an item with its content, as a legacy type if the types
+// query parameter does not list its type.
+func (api *apiServer) getItem(w http.ResponseWriter, r *http.Request) {
+	item, err := api.fetchItem(urlParam(r, "category"), urlParam(r, "item"))
+	if err != nil {
+		reqLog(r).Errorf("Error fetching item from db: %v", err)
+		writeError(w, "error fetching item", http.StatusInternalServerError)
+		return
+	}
+	if item == nil {
+		writeError(w, "item not found", http.StatusNotFound)
+		return
+	}
+	listItemsAs([]*Item{item}, knownTypes(r))
+
+	w.Header().Set("ETag", itemETag(item.Version))
+	writeJSON(w, item)
+}
+
+// itemContent serves the raw content of an item with its media type, so
+// that images and videos can be displayed directly by browsers. The variant
+// query parameter asks for a smaller variant of an image, thumb or display.
+func (api *apiServer) itemContent(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	variant := r.URL.Query().Get("variant")
+	if variant != "" && !validVariant(variant) {
+		writeError(w, "variant must be thumb or display", http.StatusBadRequest)
+		return
+	}
+	item, err := api.fetchItem(category, urlParam(r, "item"))
+	if err != nil {
+		reqLog(r).Errorf("Error fetching item from db: %v", err)
+		writeError(w, "error fetching item", http.StatusInternalServerError)
+		return
+	}
+	if item == nil {
+		writeError(w, "item not found", http.StatusNotFound)
+		return
+	}
+	etag := itemETag(item.Version)
+	if variant != "" {
+		content, err := api.variantContent(category, item, variant)
+		if err != nil {
+			reqLog(r).Errorf("Error reading image variants: %v", err)
+			writeError(w, "error fetching item", http.StatusInternalServerError)
+			return
+		}
+		if content != nil {
+			item.Content, etag = content, variantETag(item.Version, variant)
+		}
+	}
+
+	w.Header().Set("Content-Type", itemContentType(item))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag)
+	// ServeContent handles range requests, which browsers use to seek videos.
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(item.Content))
+}
+
+// deleteItem moves an item to the trash, from where it can be restored
+// until it is purged. If the request has an If-Match header, the item is
+// only deleted if it is at that version.
+func (api *apiServer) deleteItem(w http.ResponseWriter, r *http.Request) {
+	category, itemName := urlParam(r, "category"), urlParam(r, "item")
+	cond, err := requestCondition(r, r.FormValue("version"))
+	if err != nil || cond.createOnly {
+		writeError(w, "invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+	var found bool
+	err = api.db.Update(func(tx *bbolt.Tx) error {
+		catBucket := categoryBucket(tx, category)
+		if catBucket == nil || catBucket.Bucket([]byte(itemName)) == nil {
+			return nil
+		}
+		found = true
+		if cond.given() {
+			if err := cond.check(catBucket.Bucket([]byte(itemName))); err != nil {
+				return err
+			}
+		}
+		if err := trashItem(tx, category, itemName, requestActor(r), api.trashRetention); err != nil {
+			return err
+		}
+		if err := recordChange(tx, eventItemDeleted, category, itemName); err != nil {
+			return err
+		}
+		if err := queueWebhookEvent(tx, eventItemDeleted, category, &Item{Name: itemName}); err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventCategoryUpdated, category, nil)
+	})
+	var conflict *versionConflict
+	if errors.As(err, &conflict) {
+		writeVersionConflict(w, conflict)
+		return
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error deleting item: %v", err)
+		writeError(w, "error deleting item", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "item not found", http.StatusNotFound)
+		return
+	}
+
+	api.webhooks.wake()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteCategory moves a category and its items to the trash, from where
+// they can be restored until they are purged.
+func (api *apiServer) deleteCategory(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	var found bool
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		if categoryBucket(tx, category) == nil {
+			return nil
+		}
+		found = true
+		if err := trashCategory(tx, category, requestActor(r), api.trashRetention); err != nil {
+			return err
+		}
+		if err := recordChange(tx, eventCategoryDeleted, category, ""); err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventCategoryDeleted, category, nil)
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error deleting category: %v", err)
+		writeError(w, "error deleting category", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "category not found", http.StatusNotFound)
+		return
+	}
+
+	api.webhooks.wake()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type reorderRequest struct {
+	// Items are the names of all the category's items in their new order.
+	Items []string `json:"items"`
+}
+
+// reorderItems arranges the items of a category in the order given.
+func (api *apiServer) reorderItems(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	req := new(reorderRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, "invalid reorder request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+	var badRequest string
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		catBucket := categoryBucket(tx, category)
+		if catBucket == nil {
+			return nil
+		}
+		found = true
+
+		if numItems := countItems(catBucket); len(req.Items) != numItems {
+			badRequest = fmt.Sprintf("expected %d item names, got %d", numItems, len(req.Items))
+			return nil
+		}
+		seen := make(map[string]bool, len(req.Items))
+		for _, itemName := range req.Items {
+			if seen[itemName] || catBucket.Bucket([]byte(itemName)) == nil {
+				badRequest = "unknown or repeated item " + itemName
+				return nil
+			}
+			seen[itemName] = true
+		}
+
+		for i, itemName := range req.Items {
+			if err := catBucket.Bucket([]byte(itemName)).Put(itemOrderKey, uint64Bytes(uint64(i+1))); err != nil {
+				return err
+			}
+		}
+		// Continue the sequence used to order new items after the last item.
+		if err := catBucket.SetSequence(uint64(len(req.Items))); err != nil {
+			return err
+		}
+		if err := recordChange(tx, eventCategoryUpdated, category, ""); err != nil {
+			return err
+		}
+		err := recordAudit(tx, requestActor(r), &auditEntry{
+			Action:   client.AuditCategoryReordered,
+			Category: category,
+			Detail:   strings.Join(req.Items, ", "),
+		})
+		if err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventCategoryUpdated, category, nil)
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error reordering items: %v", err)
+		writeError(w, "error reordering items", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "category not found", http.StatusNotFound)
+		return
+	}
+	if badRequest != "" {
+		writeError(w, badRequest, http.StatusBadRequest)
+		return
+	}
+
+	api.webhooks.wake()
+	w.WriteHeader(http.StatusNoContent)
+}
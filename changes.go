@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+var changesBkt = []byte("changes")
+
+type libraryChange = client.Change
+
+const (
+	// maxChangeLog is the number of changes kept in the change log. Clients
+	// that fall further behind have to download the whole library again.
+	maxChangeLog     = 10_000
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// recordChange adds an entry to the library's change log, advancing the
+// library revision. It must be called from the transaction that makes the
+// change.
+func recordChange(tx *bbolt.Tx, op, category, itemName string) error {
+	changes, err := tx.CreateBucketIfNotExists(changesBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open change log: %w", err)
+	}
+	revision, err := changes.NextSequence()
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(&libraryChange{
+		Revision: revision,
+		Time:     time.Now().UTC(),
+		Op:       op,
+		Category: category,
+		Item:     itemName,
+	})
+	if err != nil {
+		return err
+	}
+	if err = changes.Put(uint64Bytes(revision), v); err != nil {
+		return err
+	}
+	if revision > maxChangeLog {
+		return changes.Delete(uint64Bytes(revision - maxChangeLog))
+	}
+	return nil
+}
+
+// libraryRevision is the revision produced by the last change to the
+// library.
+func libraryRevision(tx *bbolt.Tx) uint64 {
+	if changes := tx.Bucket(changesBkt); changes != nil {
+		return changes.Sequence()
+	}
+	return 0
+}
+
+// pageLimit parses the limit query parameter used by paginated endpoints.
+func pageLimit(r *http.Request) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return defaultPageLimit, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 1 || limit > maxPageLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+	return limit, nil
+}
+
+// listChanges returns the changes made to the library after the revision in
+// the since query parameter, oldest first. Clients keep the returned library
+// revision to request the next changes.
+func (api *apiServer) listChanges(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		var err error
+		if since, err = strconv.ParseUint(sinceStr, 10, 64); err != nil {
+			writeError(w, "invalid since revision", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := &client.Changes{
+		Changes: make([]*libraryChange, 0),
+	}
+	var truncated bool
+	err = api.db.View(func(tx *bbolt.Tx) error {
+		resp.Revision = libraryRevision(tx)
+		changes := tx.Bucket(changesBkt)
+		if changes == nil || since >= resp.Revision {
+			return nil
+		}
+		cursor := changes.Cursor()
+		k, v := cursor.Seek(uint64Bytes(since + 1))
+		if k == nil || binary.BigEndian.Uint64(k) != since+1 {
+			truncated = true
+			return nil
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			if len(resp.Changes) == limit {
+				resp.More = true
+				break
+			}
+			change := new(libraryChange)
+			if err := json.Unmarshal(v, change); err != nil {
+				return fmt.Errorf("failed to decode change record: %w", err)
+			}
+			resp.Changes = append(resp.Changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching changes from db: %v", err)
+		writeError(w, "error fetching changes", http.StatusInternalServerError)
+		return
+	}
+	if truncated {
+		writeError(w, fmt.Sprintf("changes since revision %d are no longer available, download the library again", since),
+			http.StatusGone)
+		return
+	}
+
+	writeJSON(w, resp)
+}
+
+// searchItems finds the items whose name, metadata, or text if they hold
+// text, contains the q query parameter, ignoring case. The search can be
+// limited to a category with the category query parameter.
+func (api *apiServer) searchItems(w http.ResponseWriter, r *http.Request) {
+	query := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if query == "" {
+		writeError(w, "no search query", http.StatusBadRequest)
+		return
+	}
+	onlyCategory := r.URL.Query().Get("category")
+	limit, err := pageLimit(r)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queryB := []byte(query)
+	results := make([]*client.SearchResult, 0)
+	err = api.db.View(func(tx *bbolt.Tx) error {
+		catsBucket := tx.Bucket(categoriesBkt)
+		if catsBucket == nil {
+			return nil
+		}
+		return catsBucket.ForEach(func(categoryB, _ []byte) error {
+			category := string(categoryB)
+			categoryBkt := catsBucket.Bucket(categoryB)
+			if categoryBkt == nil || (onlyCategory != "" && category != onlyCategory) {
+				return nil
+			}
+			for _, item := range readCategoryItems(category, categoryBkt) {
+				if len(results) == limit {
+					return nil
+				}
+				matches := strings.Contains(strings.ToLower(item.Name), query)
+				if !matches && isTextType(item.Type) {
+					matches = bytes.Contains(bytes.ToLower(item.Content), queryB)
+				}
+				for _, value := range item.Metadata {
+					matches = matches || strings.Contains(strings.ToLower(value), query)
+				}
+				if matches {
+					results = append(results, &client.SearchResult{
+						Category: category,
+						Name:     item.Name,
+						Type:     item.Type,
+						Size:     len(item.Content),
+					})
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error searching items: %v", err)
+		writeError(w, "error searching items", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, results)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// checklistRunsBkt holds the checklist runs of each user, in nested buckets
+// by user, category and item, keyed by when the checklist was shown.
+var checklistRunsBkt = []byte("checklist_runs")
+
+const (
+	// maxChecklistEntries is the most entries a checklist may have.
+	maxChecklistEntries = 100
+	// maxChecklistEntry is the length of the longest checklist entry, in
+	// characters.
+	maxChecklistEntry = 500
+)
+
+// checkChecklist checks that a checklist has entries, storing them one per
+// line without blank lines.
+func checkChecklist(item *Item) error {
+	if !utf8.Valid(item.Content) {
+		return errors.New("checklist must be UTF-8 text")
+	}
+	entries := client.ChecklistEntries(item.Content)
+	if len(entries) == 0 {
+		return errors.New("checklist must have entries")
+	}
+	if len(entries) > maxChecklistEntries {
+		return fmt.Errorf("checklist has more than %d entries", maxChecklistEntries)
+	}
+	for _, entry := range entries {
+		if utf8.RuneCountInString(entry) > maxChecklistEntry {
+			return fmt.Errorf("checklist entry is longer than %d characters", maxChecklistEntry)
+		}
+	}
+	item.Content = []byte(strings.Join(entries, "\n"))
+	return nil
+}
+
+// checklistFallback lists a checklist as a text item with a box before each
+// entry.
+func checklistFallback(item *Item) {
+	entries := client.ChecklistEntries(item.Content)
+	for i, entry := range entries {
+		entries[i] = "[ ] " + entry
+	}
+	item.Type, item.Content = client.TypeText, []byte(strings.Join(entries, "\n"))
+}
+
+func checklistRunKey(shownAt time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(shownAt.UnixNano()))
+	return key
+}
+
+// reportChecklistRun stores how far the requesting user got through a
+// checklist when it was shown, replacing the run reported before for the
+// same showing. Runs are complete when all entries are checked.
+func (api *apiServer) reportChecklistRun(w http.ResponseWriter, r *http.Request) {
+	category, itemName := urlParam(r, "category"), urlParam(r, "item")
+	run := new(client.ChecklistRun)
+	if err := json.NewDecoder(r.Body).Decode(run); err != nil {
+		writeError(w, "invalid checklist run: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	switch {
+	case run.ShownAt.IsZero():
+		writeError(w, "shownAt is required", http.StatusBadRequest)
+		return
+	case run.ShownAt.After(now):
+		writeError(w, "shownAt cannot be in the future", http.StatusBadRequest)
+		return
+	case run.Entries <= 0:
+		writeError(w, "entries must be positive", http.StatusBadRequest)
+		return
+	case run.Checked < 0 || run.Checked > run.Entries:
+		writeError(w, "checked must be between 0 and entries", http.StatusBadRequest)
+		return
+	}
+	run.ShownAt = run.ShownAt.UTC()
+	switch {
+	case run.Checked < run.Entries:
+		run.CompletedAt = nil
+	case run.CompletedAt == nil || run.CompletedAt.After(now) || run.CompletedAt.Before(run.ShownAt):
+		run.CompletedAt = &now
+	default:
+		completedAt := run.CompletedAt.UTC()
+		run.CompletedAt = &completedAt
+	}
+
+	var status int
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		itemBkt := itemBucket(tx, category, itemName)
+		if itemBkt == nil {
+			status = http.StatusNotFound
+			return nil
+		}
+		if string(itemBkt.Get(itemTypeKey)) != client.TypeChecklist {
+			status = http.StatusBadRequest
+			return nil
+		}
+		v, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+		who := requestActor(r)
+		before, err := putUserItemRecord(tx, api.quotas(), checklistRunsBkt, who.user, category, itemName,
+			checklistRunKey(run.ShownAt), v)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, who, &auditEntry{
+			Action:   client.AuditChecklistRun,
+			Category: category,
+			Item:     itemName,
+			Target:   run.ShownAt.Format(time.RFC3339Nano),
+			Before:   before,
+			After:    contentHash(v),
+		})
+	})
+	var overQuota *quotaExceeded
+	switch {
+	case errors.As(err, &overQuota):
+		writeError(w, overQuota.Error(), http.StatusInsufficientStorage)
+	case err != nil:
+		reqLog(r).Errorf("Error saving checklist run: %v", err)
+		writeError(w, "error saving checklist run", http.StatusInternalServerError)
+	case status == http.StatusNotFound:
+		writeError(w, "item not found", status)
+	case status == http.StatusBadRequest:
+		writeError(w, itemName+" is not a checklist", status)
+	default:
+		writeJSON(w, run)
+	}
+}
+
+// checklistStats sums up the checklist runs of each user and item, in name
+// order, or of the user and category given by the user and category query
+// parameters.
+func (api *apiServer) checklistStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userFilter, categoryFilter := query.Get("user"), query.Get("category")
+	stats := make([]*client.ChecklistStats, 0)
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		runsBkt := tx.Bucket(checklistRunsBkt)
+		if runsBkt == nil {
+			return nil
+		}
+		return runsBkt.ForEach(func(user, _ []byte) error {
+			userBkt := runsBkt.Bucket(user)
+			if userBkt == nil || (userFilter != "" && userFilter != string(user)) {
+				return nil
+			}
+			return userBkt.ForEach(func(category, _ []byte) error {
+				categoryBkt := userBkt.Bucket(category)
+				if categoryBkt == nil || (categoryFilter != "" && categoryFilter != string(category)) {
+					return nil
+				}
+				return categoryBkt.ForEach(func(item, _ []byte) error {
+					itemBkt := categoryBkt.Bucket(item)
+					if itemBkt == nil {
+						return nil
+					}
+					s, err := sumChecklistRuns(itemBkt)
+					if err != nil {
+						return err
+					}
+					s.User, s.Category, s.Item = string(user), string(category), string(item)
+					stats = append(stats, s)
+					return nil
+				})
+			})
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error reading checklist runs: %v", err)
+		writeError(w, "error fetching checklist stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// sumChecklistRuns sums up the runs in a bucket of the runs of a checklist.
+func sumChecklistRuns(runsBkt *bbolt.Bucket) (*client.ChecklistStats, error) {
+	s := new(client.ChecklistStats)
+	err := runsBkt.ForEach(func(_, v []byte) error {
+		run := new(client.ChecklistRun)
+		if err := json.Unmarshal(v, run); err != nil {
+			return fmt.Errorf("failed to decode checklist run: %w", err)
+		}
+		s.Shown++
+		if run.ShownAt.After(s.LastShownAt) {
+			s.LastShownAt = run.ShownAt
+		}
+		if run.CompletedAt != nil {
+			s.Completed++
+			if s.LastCompletedAt == nil || run.CompletedAt.After(*s.LastCompletedAt) {
+				s.LastCompletedAt = run.CompletedAt
+			}
+		}
+		return nil
+	})
+	return s, err
+}
@@ -0,0 +1,1087 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout    = 30 * time.Second
+	defaultRetries    = 3
+	defaultRetryDelay = 500 * time.Millisecond
+	maxRetryDelay     = 30 * time.Second
+)
+
+// Client makes requests to a RemindMe server. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	token      string
+	httpClient *http.Client
+	retries    int
+	retryDelay time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken sets the API token used to authenticate requests.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to make requests. The default
+// client has a 30 second timeout.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times a failed request is retried and the delay
+// before the first retry, which doubles with each further retry. Requests
+// are retried after connection errors and responses indicating that the
+// server is temporarily unavailable. The default is 3 retries starting at
+// 500ms.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+// New creates a client for the server at serverURL, e.g.
+// http://localhost:17778.
+func New(serverURL string, opts ...Option) (*Client, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(serverURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %w", err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("server url must be an http or https url")
+	}
+	c := &Client{
+		baseURL:    baseURL,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		retryDelay: defaultRetryDelay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// request describes an API request. The body is held in memory, or for
+// uploads written by form as it is sent, so that the request can be retried.
+type request struct {
+	method string
+	path   string
+	query  url.Values
+	body   []byte
+	// form, if set, is the body of an upload.
+	form        *uploadForm
+	contentType string
+	header      http.Header
+	// retry is true if the request can safely be repeated.
+	retry bool
+	// progress, if set, is called as the body is sent.
+	progress func(sent, total int64)
+}
+
+// pathEscape joins path segments, escaping each one.
+func pathEscape(segments ...string) string {
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func jsonRequest(method, path string, body interface{}) (*request, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &request{
+		method:      method,
+		path:        path,
+		body:        b,
+		contentType: "application/json",
+		retry:       method != http.MethodPost,
+	}, nil
+}
+
+// do makes the request, retrying it if appropriate, and returns the
+// response if it was successful. The caller must close the response body.
+func (c *Client) do(ctx context.Context, req *request) (*http.Response, error) {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := c.doOnce(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		var retryAfter time.Duration
+		var apiErr *Error
+		switch {
+		case ctx.Err() != nil:
+			return nil, err
+		case errors.As(err, &apiErr):
+			if !retryableStatus(apiErr.StatusCode) {
+				return nil, err
+			}
+			if resp != nil {
+				retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			}
+		}
+		if !req.retry || attempt >= c.retries {
+			return nil, err
+		}
+		if req.form != nil && req.form.rewind() != nil {
+			return nil, err
+		}
+
+		wait := delay
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > maxRetryDelay {
+			wait = maxRetryDelay
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// doOnce makes a single attempt at the request. If the server responds with
+// an error, the error is returned along with the response, whose body has
+// already been closed.
+func (c *Client) doOnce(ctx context.Context, req *request) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += "/api" + req.path
+	u.RawPath = ""
+	if strings.Contains(req.path, "%") {
+		u.RawPath = c.baseURL.EscapedPath() + "/api" + req.path
+		if unescaped, err := url.PathUnescape(u.RawPath); err == nil {
+			u.Path = unescaped
+		}
+	}
+	u.RawQuery = req.query.Encode()
+
+	var body io.Reader
+	size := int64(len(req.body))
+	switch {
+	case req.form != nil:
+		size = req.form.length()
+		formBody := req.form.open()
+		// The form is written until the transport closes the body, which
+		// must be done before the form can be sent again.
+		defer formBody.Close()
+		body = formBody
+		if req.progress != nil {
+			body = struct {
+				io.Reader
+				io.Closer
+			}{&progressReader{r: formBody, total: size, progress: req.progress}, formBody}
+		}
+	case req.body != nil:
+		body = bytes.NewReader(req.body)
+		if req.progress != nil {
+			body = &progressReader{r: body, total: size, progress: req.progress}
+		}
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if req.form != nil && size >= 0 {
+		httpReq.ContentLength = size
+	}
+	for k, v := range req.header {
+		httpReq.Header[k] = v
+	}
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if c.token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return resp, responseError(resp)
+}
+
+// responseError reads the error from an unsuccessful response.
+func responseError(resp *http.Response) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(b, apiErr); err != nil || apiErr.Code == "" {
+		// Not a JSON error, e.g. from a proxy in front of the server.
+		apiErr.Code = statusCodes[resp.StatusCode]
+		apiErr.Message = strings.TrimSpace(string(b))
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return apiErr
+}
+
+var statusCodes = map[int]string{
+	http.StatusNotModified:           CodeNotModified,
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusForbidden:             CodeForbidden,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusConflict:              CodeConflict,
+	http.StatusGone:                  CodeGone,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusRequestEntityTooLarge: CodeTooLarge,
+	http.StatusInsufficientStorage:   CodeQuotaExceeded,
+	http.StatusInternalServerError:   CodeInternal,
+	http.StatusBadGateway:            CodeUpstream,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// getJSON makes the request and decodes the JSON response into thing.
+func (c *Client) getJSON(ctx context.Context, req *request, thing interface{}) error {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(thing); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	return nil
+}
+
+// discard makes the request and discards any response body.
+func (c *Client) discard(ctx context.Context, req *request) error {
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+type progressReader struct {
+	r        io.Reader
+	sent     int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.sent += int64(n)
+		p.progress(p.sent, p.total)
+	}
+	return n, err
+}
+
+// itemTypesValues encodes the item types known to the package, which the
+// server lists items as.
+func itemTypesValues() url.Values {
+	return url.Values{"types": {strings.Join(ItemTypes, ",")}}
+}
+
+// Library returns all categories with all their items' content.
+func (c *Client) Library(ctx context.Context) ([]*Category, error) {
+	var categories []*Category
+	req := &request{method: http.MethodGet, path: "/items", query: itemTypesValues(), retry: true}
+	return categories, c.getJSON(ctx, req, &categories)
+}
+
+// LibraryIfModified is like Library, but returns ErrNotModified if the
+// library is still at the version identified by etag, an entity tag returned
+// by an earlier call. It also returns the entity tag of the downloaded
+// library. If variant is not empty, images are downloaded as that variant,
+// VariantThumb or VariantDisplay, instead of the original.
+func (c *Client) LibraryIfModified(ctx context.Context, etag, variant string) ([]*Category, string, error) {
+	req := &request{method: http.MethodGet, path: "/items", query: itemTypesValues(), retry: true}
+	if variant != "" {
+		req.query.Set("variant", variant)
+	}
+	if etag != "" {
+		req.header = http.Header{"If-None-Match": {etag}}
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var categories []*Category
+	if err = json.NewDecoder(resp.Body).Decode(&categories); err != nil {
+		return nil, "", fmt.Errorf("error decoding response: %w", err)
+	}
+	return categories, resp.Header.Get("ETag"), nil
+}
+
+// Categories lists the categories without their items.
+func (c *Client) Categories(ctx context.Context) ([]*CategorySummary, error) {
+	var categories []*CategorySummary
+	return categories, c.getJSON(ctx, &request{method: http.MethodGet, path: "/categories", retry: true}, &categories)
+}
+
+// CategoryItems lists the items of a category in order, without their
+// content.
+func (c *Client) CategoryItems(ctx context.Context, category string) ([]*ItemSummary, error) {
+	var items []*ItemSummary
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items"), retry: true}
+	return items, c.getJSON(ctx, req, &items)
+}
+
+// pageValues encodes pagination parameters. An empty cursor requests the
+// first page, and a limit of 0 uses the server's default.
+func pageValues(cursor string, limit int) url.Values {
+	query := url.Values{"cursor": {cursor}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	return query
+}
+
+// LibraryPage returns a page of up to limit items of the library, starting
+// at cursor.
+func (c *Client) LibraryPage(ctx context.Context, cursor string, limit int) (*LibraryPage, error) {
+	page := new(LibraryPage)
+	req := &request{method: http.MethodGet, path: "/items", query: pageValues(cursor, limit), retry: true}
+	req.query.Set("types", itemTypesValues().Get("types"))
+	return page, c.getJSON(ctx, req, page)
+}
+
+// CategoriesPage returns a page of up to limit categories, starting at
+// cursor.
+func (c *Client) CategoriesPage(ctx context.Context, cursor string, limit int) (*CategoryPage, error) {
+	page := new(CategoryPage)
+	req := &request{method: http.MethodGet, path: "/categories", query: pageValues(cursor, limit), retry: true}
+	return page, c.getJSON(ctx, req, page)
+}
+
+// CategoryItemsPage returns a page of up to limit items of a category,
+// starting at cursor.
+func (c *Client) CategoryItemsPage(ctx context.Context, category, cursor string, limit int) (*ItemPage, error) {
+	page := new(ItemPage)
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items"),
+		query: pageValues(cursor, limit), retry: true}
+	return page, c.getJSON(ctx, req, page)
+}
+
+// Item returns an item with its content.
+func (c *Client) Item(ctx context.Context, category, name string) (*Item, error) {
+	item := new(Item)
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items", name),
+		query: itemTypesValues(), retry: true}
+	return item, c.getJSON(ctx, req, item)
+}
+
+// ItemContent returns a reader for an item's raw content and its media type.
+// The caller must close the reader.
+func (c *Client) ItemContent(ctx context.Context, category, name string) (io.ReadCloser, string, error) {
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items", name, "content"), retry: true}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// ItemVariant returns a reader for a variant of an image item, VariantThumb
+// or VariantDisplay, and its media type. The original image is returned if
+// it is not larger than the variant or the server has not made its variants
+// yet, and the content of other items as is.
+// The caller must close the reader.
+func (c *Client) ItemVariant(ctx context.Context, category, name, variant string) (io.ReadCloser, string, error) {
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items", name, "content"),
+		query: url.Values{"variant": {variant}}, retry: true}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// ItemOriginal returns a reader for the original upload of an image item,
+// with its metadata, and its media type. Only admins can download originals,
+// and only of categories that keep them; the stored content is returned for
+// items without one. The caller must close the reader.
+func (c *Client) ItemOriginal(ctx context.Context, category, name string) (io.ReadCloser, string, error) {
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items", name, "original"), retry: true}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// Upload describes an item to add or replace.
+type Upload struct {
+	Category string
+	Name     string
+	Type     string
+	// Content is the text of text, link and quote items.
+	Content string
+	// Metadata are the item's metadata fields. Fields with empty values
+	// are left out.
+	Metadata map[string]string
+	// Attachment is the file data of image and video items, which is read
+	// as the upload is sent. Failed uploads are only retried, and the total
+	// passed to Progress is only known, if it is an io.Seeker such as an
+	// *os.File. Images must be JPEG, PNG, WebP or GIF.
+	Attachment io.Reader
+	// Filename and ContentType describe the attachment. ContentType must
+	// start with the item type, e.g. image/png for an image.
+	Filename    string
+	ContentType string
+	// Version is the current version of the item being replaced. Replacing
+	// an item without its version fails with ErrPreconditionRequired, and
+	// with ErrConflict if the item has changed since.
+	Version uint64
+	// Overwrite replaces the item whatever its version.
+	Overwrite bool
+	// CreateOnly fails with ErrConflict if the item exists.
+	CreateOnly bool
+	// Progress, if set, is called as the upload is sent with the number of
+	// bytes sent so far and the total, which is -1 if it is not known.
+	Progress func(sent, total int64)
+}
+
+// UploadItem adds an item to a category, creating the category if needed,
+// or replaces the item with the same name.
+func (c *Client) UploadItem(ctx context.Context, upload *Upload) error {
+	header := make(http.Header)
+	switch {
+	case upload.CreateOnly:
+		header.Set("If-None-Match", "*")
+	case upload.Overwrite:
+		header.Set("If-Match", "*")
+	case upload.Version != 0:
+		header.Set("If-Match", strconv.Quote(strconv.FormatUint(upload.Version, 10)))
+	}
+
+	form := newUploadForm()
+	form.addField("category", upload.Category)
+	form.addField("item.name", upload.Name)
+	form.addField("item.type", upload.Type)
+	if upload.Attachment == nil {
+		form.addField("item.content", upload.Content)
+	}
+	metadataFields := make([]string, 0, len(upload.Metadata))
+	for field := range upload.Metadata {
+		metadataFields = append(metadataFields, field)
+	}
+	sort.Strings(metadataFields)
+	for _, field := range metadataFields {
+		form.addField("item.metadata."+field, upload.Metadata[field])
+	}
+	if upload.Attachment != nil {
+		if err := form.addFile("item.attachment", upload.Filename, upload.ContentType, upload.Attachment); err != nil {
+			return err
+		}
+	}
+
+	return c.discard(ctx, &request{
+		method:      http.MethodPost,
+		path:        "/items",
+		form:        form,
+		contentType: form.contentType(),
+		header:      header,
+		// Otherwise a retry may conflict with the stored first attempt.
+		retry:    upload.Overwrite,
+		progress: upload.Progress,
+	})
+}
+
+// uploadForm is a multipart form whose files are read as it is sent, rather
+// than held in memory.
+type uploadForm struct {
+	boundary string
+	fields   [][2]string
+	files    []*formFile
+}
+
+// formFile is a file of an uploadForm.
+type formFile struct {
+	field       string
+	filename    string
+	contentType string
+	r           io.Reader
+	// start is where the file starts in r, if r is an io.Seeker.
+	start int64
+}
+
+func newUploadForm() *uploadForm {
+	return &uploadForm{boundary: multipart.NewWriter(nil).Boundary()}
+}
+
+func (f *uploadForm) addField(name, value string) {
+	f.fields = append(f.fields, [2]string{name, value})
+}
+
+func (f *uploadForm) addFile(field, filename, contentType string, r io.Reader) error {
+	if filename == "" {
+		filename = "attachment"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	file := &formFile{field: field, filename: filename, contentType: contentType, r: r}
+	if seeker, ok := r.(io.Seeker); ok {
+		var err error
+		if file.start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	f.files = append(f.files, file)
+	return nil
+}
+
+func (f *uploadForm) contentType() string {
+	return "multipart/form-data; boundary=" + f.boundary
+}
+
+// length returns the length of the encoded form, or -1 if the size of a
+// file is not known.
+func (f *uploadForm) length() int64 {
+	counter := new(countingWriter)
+	if err := f.write(counter, false); err != nil {
+		return -1
+	}
+	size := counter.n
+	for _, file := range f.files {
+		seeker, ok := file.r.(io.Seeker)
+		if !ok {
+			return -1
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		if _, err = seeker.Seek(file.start, io.SeekStart); err != nil {
+			return -1
+		}
+		size += end - file.start
+	}
+	return size
+}
+
+// write encodes the form to w, leaving out the content of the files if
+// withFiles is false.
+func (f *uploadForm) write(w io.Writer, withFiles bool) error {
+	form := multipart.NewWriter(w)
+	if err := form.SetBoundary(f.boundary); err != nil {
+		return err
+	}
+	for _, field := range f.fields {
+		if err := form.WriteField(field[0], field[1]); err != nil {
+			return err
+		}
+	}
+	for _, file := range f.files {
+		header := make(map[string][]string)
+		header["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name=%q; filename=%q`, file.field, file.filename)}
+		header["Content-Type"] = []string{file.contentType}
+		part, err := form.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if withFiles {
+			if _, err = io.Copy(part, file.r); err != nil {
+				return err
+			}
+		}
+	}
+	return form.Close()
+}
+
+// rewind moves the files back to their start, so that the form can be sent
+// again. It fails if a file is not an io.Seeker.
+func (f *uploadForm) rewind() error {
+	for _, file := range f.files {
+		seeker, ok := file.r.(io.Seeker)
+		if !ok {
+			return errors.New("upload cannot be sent again")
+		}
+		if _, err := seeker.Seek(file.start, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open starts writing the form, returning the body that it is written to.
+func (f *uploadForm) open() *uploadFormBody {
+	pr, pw := io.Pipe()
+	body := &uploadFormBody{PipeReader: pr, done: make(chan struct{})}
+	go func() {
+		defer close(body.done)
+		pw.CloseWithError(f.write(pw, true))
+	}()
+	return body
+}
+
+// uploadFormBody is the body of a request sending an uploadForm.
+type uploadFormBody struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close stops writing the form and waits until it is no longer read.
+func (b *uploadFormBody) Close() error {
+	b.PipeReader.Close()
+	<-b.done
+	return nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+// File is a file to upload in bulk.
+type File struct {
+	// Name is the file name, from which the item name is derived by
+	// dropping the extension.
+	Name string
+	// Data is read as the upload is sent, see Upload.Attachment.
+	Data io.Reader
+}
+
+// UploadFiles stores files as items of a category in one request, creating
+// the category if needed. Zip files are expanded. Item types are inferred
+// from the files' content. existing is one of the BulkExisting values and
+// decides what happens to files named like existing items, an empty string
+// fails them. progress, if not nil, is called as the upload is sent.
+func (c *Client) UploadFiles(ctx context.Context, category string, files []*File, existing string,
+	progress func(sent, total int64)) (*BulkResult, error) {
+
+	form := newUploadForm()
+	if existing != "" {
+		form.addField("existing", existing)
+	}
+	for _, file := range files {
+		contentType := ""
+		if strings.EqualFold(path.Ext(file.Name), ".zip") {
+			contentType = "application/zip"
+		}
+		if err := form.addFile("files", file.Name, contentType, file.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	result := new(BulkResult)
+	return result, c.getJSON(ctx, &request{
+		method:      http.MethodPost,
+		path:        pathEscape("categories", category, "items"),
+		form:        form,
+		contentType: form.contentType(),
+		retry:       existing != BulkExistingFail && existing != "",
+		progress:    progress,
+	}, result)
+}
+
+// DeleteItem moves an item to the trash. If version is not 0, the item is
+// only deleted if it is at that version, otherwise ErrConflict is returned.
+func (c *Client) DeleteItem(ctx context.Context, category, name string, version uint64) error {
+	req := &request{method: http.MethodDelete, path: pathEscape("categories", category, "items", name), retry: true}
+	if version != 0 {
+		req.header = http.Header{"If-Match": {strconv.Quote(strconv.FormatUint(version, 10))}}
+	}
+	return c.discard(ctx, req)
+}
+
+// DeleteCategory moves a category and all its items to the trash.
+func (c *Client) DeleteCategory(ctx context.Context, category string) error {
+	return c.discard(ctx, &request{method: http.MethodDelete, path: pathEscape("categories", category), retry: true})
+}
+
+// ReorderItems arranges the items of a category in the order of names,
+// which must list every item in the category.
+func (c *Client) ReorderItems(ctx context.Context, category string, names []string) error {
+	req, err := jsonRequest(http.MethodPut, pathEscape("categories", category, "order"), map[string][]string{"items": names})
+	if err != nil {
+		return err
+	}
+	return c.discard(ctx, req)
+}
+
+// Revisions lists the kept revisions of an item, newest first.
+func (c *Client) Revisions(ctx context.Context, category, name string) ([]*Revision, error) {
+	var revisions []*Revision
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "items", name, "revisions"), retry: true}
+	return revisions, c.getJSON(ctx, req, &revisions)
+}
+
+// RevisionContent returns a reader for the raw content of a revision of an
+// item and its media type. The caller must close the reader.
+func (c *Client) RevisionContent(ctx context.Context, category, name string, version uint64) (io.ReadCloser, string, error) {
+	req := &request{
+		method: http.MethodGet,
+		path:   pathEscape("categories", category, "items", name, "revisions", strconv.FormatUint(version, 10), "content"),
+		retry:  true,
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
+
+// RevisionDiff compares a revision of a text or link item with the revision
+// against, or the revision kept before it if against is 0.
+func (c *Client) RevisionDiff(ctx context.Context, category, name string, version, against uint64) (*RevisionDiff, error) {
+	req := &request{
+		method: http.MethodGet,
+		path:   pathEscape("categories", category, "items", name, "revisions", strconv.FormatUint(version, 10), "diff"),
+		retry:  true,
+	}
+	if against != 0 {
+		req.query = url.Values{"against": {strconv.FormatUint(against, 10)}}
+	}
+	diff := new(RevisionDiff)
+	return diff, c.getJSON(ctx, req, diff)
+}
+
+// RestoreRevision makes the content of a revision the item's content again,
+// as a new version, and returns the item. If current is not 0, the revision
+// is only restored if the item is at that version, otherwise ErrConflict is
+// returned.
+func (c *Client) RestoreRevision(ctx context.Context, category, name string, version, current uint64) (*Item, error) {
+	req := &request{
+		method: http.MethodPost,
+		path:   pathEscape("categories", category, "items", name, "revisions", strconv.FormatUint(version, 10), "restore"),
+	}
+	if current != 0 {
+		req.header = http.Header{"If-Match": {strconv.Quote(strconv.FormatUint(current, 10))}}
+	}
+	item := new(Item)
+	return item, c.getJSON(ctx, req, item)
+}
+
+// CategorySettings returns the settings of a category.
+func (c *Client) CategorySettings(ctx context.Context, category string) (*CategorySettings, error) {
+	settings := new(CategorySettings)
+	req := &request{method: http.MethodGet, path: pathEscape("categories", category, "settings"), retry: true}
+	return settings, c.getJSON(ctx, req, settings)
+}
+
+// SaveCategorySettings changes the settings of an existing category.
+func (c *Client) SaveCategorySettings(ctx context.Context, category string, settings *CategorySettings) (*CategorySettings, error) {
+	req, err := jsonRequest(http.MethodPut, pathEscape("categories", category, "settings"), settings)
+	if err != nil {
+		return nil, err
+	}
+	req.retry = true
+	saved := new(CategorySettings)
+	return saved, c.getJSON(ctx, req, saved)
+}
+
+// Usage returns the storage used by each user and category, and the
+// server's upload limits and quotas.
+func (c *Client) Usage(ctx context.Context) (*StorageUsage, error) {
+	usage := new(StorageUsage)
+	return usage, c.getJSON(ctx, &request{method: http.MethodGet, path: "/usage", retry: true}, usage)
+}
+
+// Changes returns up to limit changes made to the library after the since
+// revision, oldest first. A limit of 0 uses the server's default. If the
+// changes are no longer available, an error matching ErrGone is returned and
+// the library should be downloaded again.
+func (c *Client) Changes(ctx context.Context, since uint64, limit int) (*Changes, error) {
+	query := url.Values{"since": {strconv.FormatUint(since, 10)}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	changes := new(Changes)
+	req := &request{method: http.MethodGet, path: "/changes", query: query, retry: true}
+	return changes, c.getJSON(ctx, req, changes)
+}
+
+// auditValues encodes an audit log query as query parameters.
+func auditValues(query *AuditQuery) url.Values {
+	q := url.Values{}
+	for name, v := range map[string]string{
+		"actor":    query.Actor,
+		"action":   query.Action,
+		"category": query.Category,
+		"item":     query.Item,
+	} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	if !query.Since.IsZero() {
+		q.Set("since", query.Since.Format(time.RFC3339))
+	}
+	if !query.Until.IsZero() {
+		q.Set("until", query.Until.Format(time.RFC3339))
+	}
+	return q
+}
+
+// Audit returns a page of the audit log entries matching query, newest
+// first. If the returned log has more entries, the next page is requested
+// with Before set to the id of the last entry returned.
+func (c *Client) Audit(ctx context.Context, query *AuditQuery) (*AuditLog, error) {
+	q := auditValues(query)
+	if query.Before != 0 {
+		q.Set("before", strconv.FormatUint(query.Before, 10))
+	}
+	if query.Limit > 0 {
+		q.Set("limit", strconv.Itoa(query.Limit))
+	}
+	log := new(AuditLog)
+	req := &request{method: http.MethodGet, path: "/audit", query: q, retry: true}
+	return log, c.getJSON(ctx, req, log)
+}
+
+// ExportAudit writes all audit log entries matching query to w as JSON
+// Lines, oldest first.
+func (c *Client) ExportAudit(ctx context.Context, query *AuditQuery, w io.Writer) error {
+	q := auditValues(query)
+	q.Set("format", "jsonl")
+	resp, err := c.do(ctx, &request{method: http.MethodGet, path: "/audit", query: q, retry: true})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Search finds items whose name or text contains query, ignoring case. If
+// category is not empty, only its items are searched.
+func (c *Client) Search(ctx context.Context, query, category string) ([]*SearchResult, error) {
+	q := url.Values{"q": {query}}
+	if category != "" {
+		q.Set("category", category)
+	}
+	var results []*SearchResult
+	req := &request{method: http.MethodGet, path: "/search", query: q, retry: true}
+	return results, c.getJSON(ctx, req, &results)
+}
+
+// Progress lists the authenticated user's progress in active categories.
+func (c *Client) Progress(ctx context.Context) ([]*Progress, error) {
+	var progress []*Progress
+	return progress, c.getJSON(ctx, &request{method: http.MethodGet, path: "/progress", retry: true}, &progress)
+}
+
+// SaveProgress records the index of the last item of a category shown to
+// the authenticated user. The server keeps the most recent progress, so the
+// returned progress may differ if updatedAt is older than the saved
+// progress. A zero updatedAt means now.
+func (c *Client) SaveProgress(ctx context.Context, category string, lastIndex int, updatedAt time.Time) (*Progress, error) {
+	body := map[string]interface{}{"lastIndex": lastIndex}
+	if !updatedAt.IsZero() {
+		body["updatedAt"] = updatedAt
+	}
+	req, err := jsonRequest(http.MethodPut, pathEscape("progress", category), body)
+	if err != nil {
+		return nil, err
+	}
+	progress := new(Progress)
+	return progress, c.getJSON(ctx, req, progress)
+}
+
+// DeleteProgress clears the authenticated user's progress in a category.
+func (c *Client) DeleteProgress(ctx context.Context, category string) error {
+	return c.discard(ctx, &request{method: http.MethodDelete, path: pathEscape("progress", category), retry: true})
+}
+
+// ReportChecklistRun records how far the authenticated user got through a
+// checklist item when it was shown. Reporting a run again with the same
+// ShownAt replaces it, so a run can be reported as it progresses.
+func (c *Client) ReportChecklistRun(ctx context.Context, category, item string, run *ChecklistRun) (*ChecklistRun, error) {
+	req, err := jsonRequest(http.MethodPut, pathEscape("checklists", category, item, "runs"), run)
+	if err != nil {
+		return nil, err
+	}
+	stored := new(ChecklistRun)
+	return stored, c.getJSON(ctx, req, stored)
+}
+
+// ChecklistStats sums up the checklist runs of each user, or of one user or
+// in one category if they are not empty.
+func (c *Client) ChecklistStats(ctx context.Context, user, category string) ([]*ChecklistStats, error) {
+	query := url.Values{}
+	if user != "" {
+		query.Set("user", user)
+	}
+	if category != "" {
+		query.Set("category", category)
+	}
+	var stats []*ChecklistStats
+	req := &request{method: http.MethodGet, path: "/checklists/stats", query: query, retry: true}
+	return stats, c.getJSON(ctx, req, &stats)
+}
+
+// SaveResponse stores the authenticated user's answer to a prompt item,
+// replacing the answer written at the same time if it was saved before.
+func (c *Client) SaveResponse(ctx context.Context, response *PromptResponse) (*PromptResponse, error) {
+	body := map[string]interface{}{"writtenAt": response.WrittenAt, "text": response.Text}
+	req, err := jsonRequest(http.MethodPut, pathEscape("responses", response.Category, response.Item), body)
+	if err != nil {
+		return nil, err
+	}
+	stored := new(PromptResponse)
+	return stored, c.getJSON(ctx, req, stored)
+}
+
+// Responses lists the authenticated user's answers to prompts, oldest first,
+// or only those to the prompts of a category or to one prompt if category
+// and item are not empty.
+func (c *Client) Responses(ctx context.Context, category, item string) ([]*PromptResponse, error) {
+	query := url.Values{}
+	if category != "" {
+		query.Set("category", category)
+	}
+	if item != "" {
+		query.Set("item", item)
+	}
+	var responses []*PromptResponse
+	req := &request{method: http.MethodGet, path: "/responses", query: query, retry: true}
+	return responses, c.getJSON(ctx, req, &responses)
+}
+
+// Trash lists the deleted items and categories that can be restored, most
+// recently deleted first.
+func (c *Client) Trash(ctx context.Context) ([]*TrashEntry, error) {
+	var entries []*TrashEntry
+	return entries, c.getJSON(ctx, &request{method: http.MethodGet, path: "/trash", retry: true}, &entries)
+}
+
+// RestoreTrash restores a deleted item or category. ErrConflict is returned
+// if an item or category with the same name was created since.
+func (c *Client) RestoreTrash(ctx context.Context, id string) (*TrashEntry, error) {
+	entry := new(TrashEntry)
+	req := &request{method: http.MethodPost, path: pathEscape("trash", id, "restore")}
+	return entry, c.getJSON(ctx, req, entry)
+}
+
+// PurgeTrash deletes a trash entry for good.
+func (c *Client) PurgeTrash(ctx context.Context, id string) error {
+	return c.discard(ctx, &request{method: http.MethodDelete, path: pathEscape("trash", id), retry: true})
+}
+
+// Webhooks lists the registered webhooks, without their secrets.
+func (c *Client) Webhooks(ctx context.Context) ([]*Webhook, error) {
+	var hooks []*Webhook
+	return hooks, c.getJSON(ctx, &request{method: http.MethodGet, path: "/webhooks", retry: true}, &hooks)
+}
+
+// CreateWebhook registers a webhook. The returned webhook includes the
+// secret used to sign its payloads, which is not returned again.
+func (c *Client) CreateWebhook(ctx context.Context, hookReq *WebhookRequest) (*Webhook, error) {
+	req, err := jsonRequest(http.MethodPost, "/webhooks", hookReq)
+	if err != nil {
+		return nil, err
+	}
+	hook := new(Webhook)
+	return hook, c.getJSON(ctx, req, hook)
+}
+
+// DeleteWebhook removes a webhook.
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	return c.discard(ctx, &request{method: http.MethodDelete, path: pathEscape("webhooks", id), retry: true})
+}
+
+// PingWebhook queues a ping event for a webhook.
+func (c *Client) PingWebhook(ctx context.Context, id string) error {
+	return c.discard(ctx, &request{method: http.MethodPost, path: pathEscape("webhooks", id, "ping")})
+}
+
+// WebhookDeliveries lists the delivery attempts of a webhook, most recent
+// first.
+func (c *Client) WebhookDeliveries(ctx context.Context, id string) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	req := &request{method: http.MethodGet, path: pathEscape("webhooks", id, "deliveries"), retry: true}
+	return deliveries, c.getJSON(ctx, req, &deliveries)
+}
+
+// Digests lists email digest subscriptions, only those of email if it is
+// not empty.
+func (c *Client) Digests(ctx context.Context, email string) ([]*Digest, error) {
+	var query url.Values
+	if email != "" {
+		query = url.Values{"email": {email}}
+	}
+	var digests []*Digest
+	req := &request{method: http.MethodGet, path: "/digests", query: query, retry: true}
+	return digests, c.getJSON(ctx, req, &digests)
+}
+
+// CreateDigest subscribes an email address to a category's digests.
+func (c *Client) CreateDigest(ctx context.Context, digestReq *DigestRequest) (*Digest, error) {
+	req, err := jsonRequest(http.MethodPost, "/digests", digestReq)
+	if err != nil {
+		return nil, err
+	}
+	digest := new(Digest)
+	return digest, c.getJSON(ctx, req, digest)
+}
+
+// DeleteDigest removes a digest subscription.
+func (c *Client) DeleteDigest(ctx context.Context, id string) error {
+	return c.discard(ctx, &request{method: http.MethodDelete, path: pathEscape("digests", id), retry: true})
+}
+
+// SendDigest emails the next items of a digest right away.
+func (c *Client) SendDigest(ctx context.Context, id string) error {
+	return c.discard(ctx, &request{method: http.MethodPost, path: pathEscape("digests", id, "send")})
+}
+
+// DigestHistory lists the emails sent for a digest, most recent first.
+func (c *Client) DigestHistory(ctx context.Context, id string) ([]*DigestEmail, error) {
+	var history []*DigestEmail
+	req := &request{method: http.MethodGet, path: pathEscape("digests", id, "history"), retry: true}
+	return history, c.getJSON(ctx, req, &history)
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUploadItemStreamsAttachment(t *testing.T) {
+	attachment := bytes.Repeat([]byte("frame"), 100000)
+	var mtx sync.Mutex
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		attempts++
+		attempt := attempts
+		mtx.Unlock()
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("attempt %d: invalid form: %v", attempt, err)
+			return
+		}
+		if r.FormValue("category") != "clips" || r.FormValue("item.name") != "clip" || r.FormValue("item.metadata.note") != "hi" {
+			t.Errorf("attempt %d: wrong fields %v", attempt, r.MultipartForm.Value)
+		}
+		f, header, err := r.FormFile("item.attachment")
+		if err != nil {
+			t.Errorf("attempt %d: no attachment: %v", attempt, err)
+			return
+		}
+		got, _ := ioutil.ReadAll(f)
+		if !bytes.Equal(got, attachment) || header.Header.Get("Content-Type") != "video/mp4" {
+			t.Errorf("attempt %d: wrong attachment of %d bytes, %s", attempt, len(got), header.Header.Get("Content-Type"))
+		}
+		if attempt == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := New(srv.URL, WithRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent, total int64
+	upload := &Upload{
+		Category:    "clips",
+		Name:        "clip",
+		Type:        TypeVideo,
+		Metadata:    map[string]string{"note": "hi"},
+		Attachment:  bytes.NewReader(attachment),
+		ContentType: "video/mp4",
+		Overwrite:   true,
+		Progress:    func(s, t int64) { sent, total = s, t },
+	}
+	if err = c.UploadItem(context.Background(), upload); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("%d attempts, want 2", attempts)
+	}
+	if total <= int64(len(attachment)) || sent != total {
+		t.Errorf("sent %d of %d bytes", sent, total)
+	}
+
+	// Attachments that cannot be read again are not retried.
+	attempts = 0
+	upload.Attachment = io.MultiReader(bytes.NewReader(attachment))
+	if err = c.UploadItem(context.Background(), upload); err == nil {
+		t.Error("upload that cannot be sent again succeeded")
+	}
+	if attempts != 1 {
+		t.Errorf("%d attempts, want 1", attempts)
+	}
+	if total != -1 {
+		t.Errorf("total %d reported for an attachment of unknown size", total)
+	}
+}
@@ -0,0 +1,67 @@
+package client
+
+import "fmt"
+
+// Error codes returned by the server.
+const (
+	// Conditional requests for resources that did not change.
+	CodeNotModified  = "not_modified"
+	CodeBadRequest   = "bad_request"
+	CodeUnauthorized = "unauthorized"
+	// Requests that only admins may make.
+	CodeForbidden = "forbidden"
+	CodeNotFound  = "not_found"
+	CodeConflict  = "conflict"
+	// Updates of items must give the item's current version.
+	CodePreconditionRequired = "precondition_required"
+	CodeGone                 = "gone"
+	// Clients that made too many requests should retry later.
+	CodeRateLimited = "rate_limited"
+	// Uploads larger than the server's limit.
+	CodeTooLarge = "too_large"
+	// Uploads that would take a user or category over its storage quota.
+	CodeQuotaExceeded = "quota_exceeded"
+	CodeInternal      = "internal_error"
+	CodeUnavailable   = "unavailable"
+	CodeUpstream      = "upstream_error"
+)
+
+// Error is an error response from the server.
+type Error struct {
+	// StatusCode is the HTTP status of the response.
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// Version is the current version of the item, for conflicts and
+	// updates made without a version. It is 0 if the item does not exist.
+	Version uint64 `json:"version,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("remindme: %s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// Is reports whether target is an *Error with the same code, so that errors
+// can be compared with the sentinel errors using errors.Is.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Sentinel errors for use with errors.Is.
+var (
+	ErrNotModified          = &Error{Code: CodeNotModified}
+	ErrBadRequest           = &Error{Code: CodeBadRequest}
+	ErrUnauthorized         = &Error{Code: CodeUnauthorized}
+	ErrForbidden            = &Error{Code: CodeForbidden}
+	ErrNotFound             = &Error{Code: CodeNotFound}
+	ErrConflict             = &Error{Code: CodeConflict}
+	ErrPreconditionRequired = &Error{Code: CodePreconditionRequired}
+	ErrGone                 = &Error{Code: CodeGone}
+	ErrRateLimited          = &Error{Code: CodeRateLimited}
+	ErrTooLarge             = &Error{Code: CodeTooLarge}
+	ErrQuotaExceeded        = &Error{Code: CodeQuotaExceeded}
+	ErrInternal             = &Error{Code: CodeInternal}
+	ErrUnavailable          = &Error{Code: CodeUnavailable}
+	ErrUpstream             = &Error{Code: CodeUpstream}
+)
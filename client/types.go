@@ -0,0 +1,489 @@
+// Package client is a Go client for the RemindMe server API, along with the
+// types used in API requests and responses.
+package client
+
+import (
+	"strings"
+	"time"
+)
+
+// Item types.
+const (
+	TypeText  = "text"
+	TypeLink  = "link"
+	TypeImage = "image"
+	TypeVideo = "video"
+	// TypeQuote items are the text of a quote, attributed with the
+	// MetaAuthor, MetaSource and MetaURL metadata.
+	TypeQuote = "quote"
+	// TypeMarkdown items are text formatted with Markdown. Images in them
+	// may show image items of the same category, referenced as
+	// ![alt](item:name) with the name escaped as a URL path.
+	TypeMarkdown = "markdown"
+	// TypeFlashcard items are a Flashcard, encoded as JSON.
+	TypeFlashcard = "flashcard"
+	// TypeChecklist items are the entries of a checklist, one per line, in
+	// the order they are to be done.
+	TypeChecklist = "checklist"
+	// TypePrompt items are the text of a question for the user to answer.
+	// Users' answers are kept as PromptResponses.
+	TypePrompt = "prompt"
+)
+
+// ItemTypes are the item types known to this version of the package. The
+// client asks the server to list items as these types, and the server lists
+// items of newer types in a form that older clients can show, such as
+// markdown as plain text.
+var ItemTypes = []string{TypeText, TypeLink, TypeImage, TypeVideo, TypeQuote, TypeMarkdown, TypeFlashcard, TypeChecklist, TypePrompt}
+
+// Item metadata fields. The fields an item may have depend on its type.
+const (
+	// MetaNote is a note about an item, allowed on items of any type.
+	MetaNote = "note"
+	// MetaAuthor is who said or wrote a quote, MetaSource the work it is
+	// from and MetaURL where it can be found.
+	MetaAuthor = "author"
+	MetaSource = "source"
+	MetaURL    = "url"
+)
+
+// Category is a named collection of items.
+type Category struct {
+	Name  string  `json:"name"`
+	Items []*Item `json:"items"`
+}
+
+// Item is a single reminder. Content is the text of text, link, quote,
+// markdown, checklist and prompt items, the file data of image and video items and the JSON
+// encoding of flashcards.
+type Item struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content []byte `json:"Content"`
+	// Metadata holds the fields that describe the item beyond its content,
+	// such as the author of a quote, by the Meta field names.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Version increases with every update of the item. It must be given to
+	// replace the item, so that concurrent edits are not lost.
+	Version uint64 `json:"version,omitempty"`
+	// Preview describes the page that a link item points to. It is set
+	// once the server has fetched the page, which it does in the
+	// background after the link is stored.
+	Preview *LinkPreview `json:"preview,omitempty"`
+}
+
+// Flashcard is a question on its front and its answer on its back. The
+// answer is revealed after the question is shown.
+type Flashcard struct {
+	Front *FlashcardSide `json:"front"`
+	Back  *FlashcardSide `json:"back"`
+	// Distractors are wrong answers, shown as choices along with the
+	// answer. They can only be given if the back is text.
+	Distractors []string `json:"distractors,omitempty"`
+}
+
+// FlashcardSide is one side of a flashcard. Its Type is TypeText,
+// TypeMarkdown or TypeImage. Text is the text or markdown of the side, or
+// for an image the name of an image item of the same category.
+type FlashcardSide struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// ChecklistEntries splits the content of a checklist item into its entries.
+// Space around entries and blank lines are dropped.
+func ChecklistEntries(content []byte) []string {
+	var entries []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if entry := strings.TrimSpace(line); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// ChecklistRun is how far a user got through a checklist when it was shown
+// to them.
+type ChecklistRun struct {
+	// ShownAt is when the checklist was shown, which identifies the run.
+	ShownAt time.Time `json:"shownAt"`
+	// Entries is the number of entries the checklist had and Checked the
+	// number of them the user checked.
+	Entries int `json:"entries"`
+	Checked int `json:"checked"`
+	// CompletedAt is when the last entry was checked, if all were.
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// ChecklistStats sums up the runs of a checklist by a user.
+type ChecklistStats struct {
+	User     string `json:"user"`
+	Category string `json:"category"`
+	Item     string `json:"item"`
+	// Shown is the number of times the checklist was shown and Completed
+	// the number of times all its entries were checked.
+	Shown           int        `json:"shown"`
+	Completed       int        `json:"completed"`
+	LastShownAt     time.Time  `json:"lastShownAt"`
+	LastCompletedAt *time.Time `json:"lastCompletedAt,omitempty"`
+}
+
+// PromptResponse is a user's answer to a prompt item.
+type PromptResponse struct {
+	Category string `json:"category"`
+	Item     string `json:"item"`
+	// WrittenAt is when the answer was written, which identifies it among
+	// the user's answers to the prompt.
+	WrittenAt time.Time `json:"writtenAt"`
+	Text      string    `json:"text"`
+}
+
+// LinkPreview is what the server found on the page of a link item, for
+// showing the link as a card. Fields that the page does not give are empty.
+type LinkPreview struct {
+	// URL is the address of the page after redirects.
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"siteName,omitempty"`
+	// Image is a small copy of the page's preview image, in JPEG or PNG
+	// format, and ImageURL the address it was fetched from.
+	Image     []byte    `json:"image,omitempty"`
+	ImageURL  string    `json:"imageURL,omitempty"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+// CategorySummary describes a category without its items.
+type CategorySummary struct {
+	Name      string `json:"name"`
+	ItemCount int    `json:"itemCount"`
+}
+
+// ItemSummary describes an item without its content.
+type ItemSummary struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	Version uint64 `json:"version"`
+}
+
+// Image variants, smaller copies of images that the server makes for
+// listings and display. The original image is used for images that are not
+// larger than a variant, and until the server has made the variants of an
+// image.
+const (
+	// VariantThumb fits in 256x256 pixels.
+	VariantThumb = "thumb"
+	// VariantDisplay fits in 1200x800 pixels.
+	VariantDisplay = "display"
+)
+
+// LibraryPage is a page of the library. The first and last categories of a
+// page may be continued on the adjacent pages, with the rest of their items.
+type LibraryPage struct {
+	Categories []*Category `json:"categories"`
+	// NextCursor requests the next page. It is empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// CategoryPage is a page of the categories.
+type CategoryPage struct {
+	Categories []*CategorySummary `json:"categories"`
+	// NextCursor requests the next page. It is empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// ItemPage is a page of the items of a category.
+type ItemPage struct {
+	Items []*ItemSummary `json:"items"`
+	// NextCursor requests the next page. It is empty on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// Library change operations. These are also the names of the corresponding
+// webhook events.
+const (
+	OpItemCreated     = "item.created"
+	OpItemUpdated     = "item.updated"
+	OpItemDeleted     = "item.deleted"
+	OpCategoryUpdated = "category.updated"
+	OpCategoryDeleted = "category.deleted"
+)
+
+// Change is an entry in the library's change log.
+type Change struct {
+	// Revision is the library revision the change produced.
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"`
+	Category string    `json:"category"`
+	Item     string    `json:"item,omitempty"`
+}
+
+// Changes is a page of the library's change log.
+type Changes struct {
+	// Revision is the current revision of the library.
+	Revision uint64    `json:"revision"`
+	Changes  []*Change `json:"changes"`
+	// More is true if there are changes after the last one returned.
+	More bool `json:"more"`
+}
+
+// SearchResult is an item that matched a search.
+type SearchResult struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Size     int    `json:"size"`
+}
+
+// Revision is a stored version of an item.
+type Revision struct {
+	Version uint64 `json:"version"`
+	Type    string `json:"type"`
+	// Hash is the hex encoded SHA-256 hash of the content.
+	Hash   string `json:"hash"`
+	Size   int    `json:"size"`
+	Editor string `json:"editor,omitempty"`
+	// Metadata is the item's metadata at the revision.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Original is the hash of an image as it was uploaded, before it was
+	// stripped of metadata, if the category keeps originals.
+	Original string `json:"original,omitempty"`
+	// Time is when the revision was saved. It is zero for content saved
+	// before revisions were kept.
+	Time time.Time `json:"time"`
+	// Current is true for the item's current version.
+	Current bool `json:"current"`
+}
+
+// RevisionDiff is the difference between the text of two revisions of a
+// text or link item.
+type RevisionDiff struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+	// Diff is a unified diff of the lines of the two revisions.
+	Diff string `json:"diff"`
+}
+
+// CategorySettings are the settings of a category.
+type CategorySettings struct {
+	// RevisionLimit is how many revisions are kept for each item, counting
+	// the current version.
+	RevisionLimit int `json:"revisionLimit"`
+	// KeepOriginals keeps uploaded images as they were before they were
+	// stripped of metadata, for admins to download.
+	KeepOriginals bool `json:"keepOriginals"`
+}
+
+// TrashEntry is a deleted item or category that can be restored until it
+// expires.
+type TrashEntry struct {
+	ID       string `json:"id"`
+	Category string `json:"category"`
+	// Item is the name of the deleted item, or empty if the whole category
+	// was deleted.
+	Item      string    `json:"item,omitempty"`
+	ItemCount int       `json:"itemCount"`
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy,omitempty"`
+	// ExpiresAt is when the entry is purged from the trash.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// StorageUsage is the size of the content of items, by category and by the
+// user that last wrote them, with the server's upload limits. Quotas of 0
+// are unlimited. Items in the trash and older revisions are not counted.
+type StorageUsage struct {
+	// MaxUploadBytes is the largest item content that can be uploaded.
+	MaxUploadBytes int64    `json:"maxUploadBytes"`
+	UserQuota      int64    `json:"userQuota"`
+	CategoryQuota  int64    `json:"categoryQuota"`
+	Users          []*Usage `json:"users"`
+	Categories     []*Usage `json:"categories"`
+}
+
+// Usage is the storage used by a user or category.
+type Usage struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	Items int    `json:"items"`
+}
+
+// Audit log actions. Item and category changes use the library change
+// operations.
+const (
+	AuditCategoryReordered = "category.reordered"
+	AuditCategorySettings  = "category.settings_changed"
+	AuditTrashRestored     = "trash.restored"
+	AuditTrashPurged       = "trash.purged"
+	AuditWebhookCreated    = "webhook.created"
+	AuditWebhookDeleted    = "webhook.deleted"
+	AuditDigestCreated     = "digest.created"
+	AuditDigestDeleted     = "digest.deleted"
+	AuditChecklistRun      = "checklist.run_reported"
+	AuditResponseSaved     = "response.saved"
+)
+
+// AuditEntry records a write made through the API.
+type AuditEntry struct {
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	// Actor is the user that made the write, or "system" for the server's
+	// own jobs.
+	Actor  string `json:"actor"`
+	IP     string `json:"ip,omitempty"`
+	Action string `json:"action"`
+	// Category and Item name the library records written, if any.
+	Category string `json:"category,omitempty"`
+	Item     string `json:"item,omitempty"`
+	// Target is the id of the trash entry, webhook or digest written, or
+	// the time of the checklist run or prompt response, if any.
+	Target string `json:"target,omitempty"`
+	// Before and After are the hex encoded SHA-256 hashes of an item's
+	// content, or of a checklist run or prompt response record, before and
+	// after the write, empty if there was none.
+	Before  string `json:"before,omitempty"`
+	After   string `json:"after,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// AuditLog is a page of audit log entries, newest first.
+type AuditLog struct {
+	Entries []*AuditEntry `json:"entries"`
+	// More is true if there are older matching entries.
+	More bool `json:"more"`
+}
+
+// AuditQuery filters the audit log. Empty fields match all entries.
+type AuditQuery struct {
+	Actor    string
+	Action   string
+	Category string
+	Item     string
+	Since    time.Time
+	Until    time.Time
+	// Before only matches entries older than the entry with this id, to
+	// request the page after the last entry returned.
+	Before uint64
+	// Limit is the page size, 0 for the server's default. It is ignored
+	// when exporting.
+	Limit int
+}
+
+// What a bulk upload does with files named like existing items.
+const (
+	// BulkExistingFail fails the files, leaving the items alone.
+	BulkExistingFail = "fail"
+	// BulkExistingSkip skips the files, leaving the items alone.
+	BulkExistingSkip = "skip"
+	// BulkExistingReplace replaces the items, whatever their version.
+	BulkExistingReplace = "replace"
+)
+
+// Outcomes of the files of a bulk upload.
+const (
+	BulkCreated = "created"
+	BulkUpdated = "updated"
+	BulkSkipped = "skipped"
+	BulkFailed  = "failed"
+)
+
+// BulkFileResult is the outcome of storing one file of a bulk upload.
+type BulkFileResult struct {
+	// File is the name of the uploaded file, or its path in an uploaded zip.
+	File   string `json:"file"`
+	Name   string `json:"name,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Version is the version of the stored item, or of the existing item if
+	// the file was skipped or failed because of it.
+	Version uint64 `json:"version,omitempty"`
+}
+
+// BulkResult summarizes a bulk upload.
+type BulkResult struct {
+	Category string            `json:"category"`
+	Created  int               `json:"created"`
+	Updated  int               `json:"updated"`
+	Skipped  int               `json:"skipped"`
+	Failed   int               `json:"failed"`
+	Files    []*BulkFileResult `json:"files"`
+}
+
+// Progress is a user's position in the reminders of a category.
+type Progress struct {
+	Category string `json:"category"`
+	// LastIndex is the index of the last item shown.
+	LastIndex int       `json:"lastIndex"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Webhook is a registered receiver of event notifications.
+type Webhook struct {
+	ID               string     `json:"id"`
+	URL              string     `json:"url"`
+	Events           []string   `json:"events"`
+	Category         string     `json:"category,omitempty"`
+	ReminderInterval string     `json:"reminderInterval,omitempty"`
+	Secret           string     `json:"secret,omitempty"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	NextReminder     *time.Time `json:"nextReminder,omitempty"`
+	ReminderIndex    int        `json:"reminderIndex"`
+}
+
+// WebhookRequest registers a webhook. Category and ReminderInterval are
+// required for reminder.due events. A secret is generated if none is given.
+type WebhookRequest struct {
+	URL              string   `json:"url"`
+	Events           []string `json:"events"`
+	Category         string   `json:"category,omitempty"`
+	ReminderInterval string   `json:"reminderInterval,omitempty"`
+	Secret           string   `json:"secret,omitempty"`
+}
+
+// WebhookDelivery is the outcome of an attempt to deliver a webhook event.
+type WebhookDelivery struct {
+	DeliveryID  uint64     `json:"deliveryId"`
+	Event       string     `json:"event"`
+	Attempt     int        `json:"attempt"`
+	Time        time.Time  `json:"time"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	DurationMs  int64      `json:"durationMs"`
+	Delivered   bool       `json:"delivered"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// Digest is a subscription to periodic emails of a category's items.
+type Digest struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Category  string     `json:"category"`
+	Count     int        `json:"count"`
+	Schedule  string     `json:"schedule"`
+	NextSend  time.Time  `json:"nextSend"`
+	Position  int        `json:"position"`
+	LastSent  *time.Time `json:"lastSent,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// DigestRequest subscribes an email address to a category's digests.
+// Schedule is daily or weekly. The first digest is sent at Start, or right
+// away if Start is nil.
+type DigestRequest struct {
+	Email    string     `json:"email"`
+	Category string     `json:"category"`
+	Count    int        `json:"count"`
+	Schedule string     `json:"schedule"`
+	Start    *time.Time `json:"start,omitempty"`
+}
+
+// DigestEmail records a digest that was emailed.
+type DigestEmail struct {
+	Time  time.Time `json:"time"`
+	Items []string  `json:"items"`
+	Error string    `json:"error,omitempty"`
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+// listAudit shows the audit log entries matching the filters, newest first,
+// or exports them as JSON Lines.
+func listAudit(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	query := new(client.AuditQuery)
+	flags.StringVar(&query.Actor, "actor", "", "")
+	flags.StringVar(&query.Action, "action", "", "")
+	flags.StringVar(&query.Category, "category", "", "")
+	flags.StringVar(&query.Item, "item", "", "")
+	since := flags.String("since", "", "")
+	flags.IntVar(&query.Limit, "limit", 50, "")
+	export := flags.String("export", "", "")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if *since != "" {
+		t, err := parseSince(*since)
+		if err != nil {
+			return err
+		}
+		query.Since = t
+	}
+
+	if *export != "" {
+		out := os.Stdout
+		if *export != "-" {
+			f, err := os.OpenFile(*export, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		return c.api.ExportAudit(ctx, query, out)
+	}
+
+	log, err := c.api.Audit(ctx, query)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(log)
+	}
+	rows := make([][]string, 0, len(log.Entries))
+	for _, entry := range log.Entries {
+		target := entry.Category
+		if entry.Item != "" {
+			target += "/" + entry.Item
+		}
+		if entry.Target != "" {
+			if target != "" {
+				target += " "
+			}
+			target += entry.Target
+		}
+		version := ""
+		if entry.Version != 0 {
+			version = strconv.FormatUint(entry.Version, 10)
+		}
+		rows = append(rows, []string{strconv.FormatUint(entry.ID, 10), entry.Time.Local().Format(time.RFC822),
+			entry.Actor, entry.IP, entry.Action, target, version, entry.Detail})
+	}
+	if err = printTable([]string{"ID", "TIME", "ACTOR", "IP", "ACTION", "TARGET", "VERSION", "DETAIL"}, rows); err != nil {
+		return err
+	}
+	if log.More {
+		fmt.Printf("\nShowing the newest %d entries, use -limit or -export to see more.\n", len(log.Entries))
+	}
+	return nil
+}
+
+// parseSince parses an RFC 3339 time, or a duration before now such as 24h.
+func parseSince(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("audit: -since must be a duration like 24h or an RFC 3339 time")
+	}
+	return t, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// checklistStats shows how often each user finished each checklist.
+func checklistStats(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("checklists stats", flag.ContinueOnError)
+	user := flags.String("user", "", "")
+	category := flags.String("category", "", "")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	stats, err := c.api.ChecklistStats(ctx, *user, *category)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(stats)
+	}
+	rows := make([][]string, 0, len(stats))
+	for _, s := range stats {
+		lastCompleted := "never"
+		if s.LastCompletedAt != nil {
+			lastCompleted = s.LastCompletedAt.Local().Format(time.RFC822)
+		}
+		rows = append(rows, []string{s.User, s.Category, s.Item, strconv.Itoa(s.Shown),
+			fmt.Sprintf("%d (%d%%)", s.Completed, s.Completed*100/s.Shown),
+			s.LastShownAt.Local().Format(time.RFC822), lastCompleted})
+	}
+	return printTable([]string{"USER", "CATEGORY", "ITEM", "SHOWN", "COMPLETED", "LAST SHOWN", "LAST COMPLETED"}, rows)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+func listCategories(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("categories ls", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	categories, err := c.api.Categories(ctx)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(categories)
+	}
+	rows := make([][]string, 0, len(categories))
+	for _, category := range categories {
+		rows = append(rows, []string{category.Name, strconv.Itoa(category.ItemCount)})
+	}
+	return printTable([]string{"CATEGORY", "ITEMS"}, rows)
+}
+
+func deleteCategory(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("categories rm", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return c.api.DeleteCategory(ctx, args[0])
+}
+
+func listItems(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("items ls", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	items, err := c.api.CategoryItems(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(items)
+	}
+	rows := make([][]string, 0, len(items))
+	for i, item := range items {
+		rows = append(rows, []string{strconv.Itoa(i + 1), item.Name, item.Type, formatSize(item.Size)})
+	}
+	return printTable([]string{"#", "NAME", "TYPE", "SIZE"}, rows)
+}
+
+func addItem(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items add", flag.ContinueOnError)
+	name := flags.String("name", "", "")
+	itemType := flags.String("type", "", "")
+	file := flags.String("file", "", "")
+	text := flags.String("text", "", "")
+	version := flags.Uint64("version", 0, "")
+	force := flags.Bool("force", false, "")
+	metadata := make(metadataFlag)
+	flags.Var(metadata, "meta", "")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if (*file == "") == (*text == "") {
+		return errors.New("items add: exactly one of -file and -text is required")
+	}
+
+	upload := &client.Upload{
+		Category:  args[0],
+		Name:      *name,
+		Type:      strings.ToLower(*itemType),
+		Version:   *version,
+		Overwrite: *force,
+		Metadata:  metadata,
+	}
+	if *text != "" {
+		if upload.Type == "" {
+			upload.Type = client.TypeText
+		}
+		upload.Content = *text
+	} else {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// The content type is detected from the start of the file, which
+		// is then sent as it is read.
+		head := make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if upload.Name == "" {
+			upload.Name = filepath.Base(*file)
+		}
+		upload.ContentType = contentType(upload.Name, head[:n])
+		if upload.Type == "" {
+			switch strings.ToLower(filepath.Ext(*file)) {
+			case ".md", ".markdown":
+				upload.Type = client.TypeMarkdown
+			default:
+				upload.Type = strings.SplitN(upload.ContentType, "/", 2)[0]
+			}
+		}
+		switch upload.Type {
+		case client.TypeImage, client.TypeVideo:
+			upload.Attachment = f
+			upload.Filename = filepath.Base(*file)
+		case client.TypeText, client.TypeLink, client.TypeQuote, client.TypeMarkdown, client.TypeFlashcard,
+			client.TypeChecklist, client.TypePrompt:
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			upload.Content = string(data)
+		default:
+			return fmt.Errorf("items add: cannot tell the type of %s, use -type", *file)
+		}
+	}
+	if upload.Name == "" {
+		return errors.New("items add: -name is required")
+	}
+	err = c.api.UploadItem(ctx, upload)
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.Code == client.CodePreconditionRequired {
+		return fmt.Errorf("%s already has an item named %s, use -version %d to replace it",
+			upload.Category, upload.Name, apiErr.Version)
+	}
+	return err
+}
+
+// metadataFlag is a repeatable flag of item metadata fields, given as
+// field=value.
+type metadataFlag map[string]string
+
+func (f metadataFlag) String() string {
+	return fmt.Sprintf("%d fields", len(f))
+}
+
+func (f metadataFlag) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 1 {
+		return fmt.Errorf("expected field=value, got %q", v)
+	}
+	f[v[:i]] = v[i+1:]
+	return nil
+}
+
+// uploadFiles adds files, the files in directories and the files in zips as
+// items of a category.
+func uploadFiles(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items upload", flag.ContinueOnError)
+	existing := flags.String("existing", client.BulkExistingFail, "")
+	args, err := parseArgs(flags, args, 2, math.MaxInt32)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, arg := range args[1:] {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		entries, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+
+	files := make([]*client.File, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		files = append(files, &client.File{Name: filepath.Base(path), Data: f})
+	}
+	result, err := c.api.UploadFiles(ctx, args[0], files, *existing, nil)
+	if err != nil {
+		return err
+	}
+
+	if c.asJSON {
+		return printJSON(result)
+	}
+	rows := make([][]string, 0, len(result.Files))
+	for _, file := range result.Files {
+		rows = append(rows, []string{file.File, file.Name, file.Type, file.Status, file.Error})
+	}
+	if err = printTable([]string{"FILE", "NAME", "TYPE", "STATUS", "ERROR"}, rows); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d created, %d updated, %d skipped, %d failed.\n",
+		result.Created, result.Updated, result.Skipped, result.Failed)
+	return nil
+}
+
+// contentType guesses the media type of a file from its data, falling back
+// to its name.
+func contentType(name string, data []byte) string {
+	detected := http.DetectContentType(data)
+	if !strings.HasPrefix(detected, "application/octet-stream") {
+		return detected
+	}
+	if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+		return byExt
+	}
+	return detected
+}
+
+func deleteItem(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items rm", flag.ContinueOnError)
+	version := flags.Uint64("version", 0, "")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	return c.api.DeleteItem(ctx, args[0], args[1], *version)
+}
+
+// downloadOriginal saves the original upload of an image item, which only
+// admins can download.
+func downloadOriginal(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items original", flag.ContinueOnError)
+	out := flags.String("out", "", "")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return errUsage
+	}
+	content, _, err := c.api.ItemOriginal(ctx, args[0], args[1])
+	if errors.Is(err, client.ErrForbidden) {
+		return errors.New("only admins can download originals")
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	b, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, b, 0600)
+}
+
+// moveItem moves an item to another category, renames it or changes its
+// position in its category. Moving and renaming copy the item and then
+// delete the original.
+func moveItem(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items mv", flag.ContinueOnError)
+	to := flags.String("to", "", "")
+	rename := flags.String("rename", "", "")
+	position := flags.Int("position", 0, "")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	category, name := args[0], args[1]
+	destCategory, destName := category, name
+	if *to != "" {
+		destCategory = *to
+	}
+	if *rename != "" {
+		destName = *rename
+	}
+	if destCategory == category && destName == name && *position == 0 {
+		return errors.New("items mv: nothing to do, use -to, -rename or -position")
+	}
+
+	if destCategory != category || destName != name {
+		item, err := c.api.Item(ctx, category, name)
+		if err != nil {
+			return err
+		}
+		upload := itemUpload(destCategory, destName, item)
+		upload.CreateOnly = true
+		err = c.api.UploadItem(ctx, upload)
+		if errors.Is(err, client.ErrConflict) {
+			return fmt.Errorf("items mv: %s already has an item named %s", destCategory, destName)
+		}
+		if err != nil {
+			return err
+		}
+		// The original is left alone if it was changed since it was copied.
+		if err = c.api.DeleteItem(ctx, category, name, item.Version); err != nil {
+			return fmt.Errorf("copied item to %s but failed to delete the original: %w", destCategory, err)
+		}
+	}
+
+	if *position == 0 {
+		return nil
+	}
+	items, err := c.api.CategoryItems(ctx, destCategory)
+	if err != nil {
+		return err
+	}
+	if *position < 1 || *position > len(items) {
+		return fmt.Errorf("items mv: position must be between 1 and %d", len(items))
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		if item.Name != destName {
+			names = append(names, item.Name)
+		}
+	}
+	i := *position - 1
+	names = append(names[:i], append([]string{destName}, names[i:]...)...)
+	return c.api.ReorderItems(ctx, destCategory, names)
+}
+
+// itemUpload describes the upload of an existing item.
+func itemUpload(category, name string, item *client.Item) *client.Upload {
+	upload := &client.Upload{
+		Category: category,
+		Name:     name,
+		Type:     item.Type,
+		Metadata: item.Metadata,
+	}
+	switch item.Type {
+	case client.TypeImage, client.TypeVideo:
+		upload.Attachment = bytes.NewReader(item.Content)
+		upload.Filename = name
+		upload.ContentType = contentType(name, item.Content)
+	default:
+		upload.Content = string(item.Content)
+	}
+	return upload
+}
+
+func formatSize(bytes int) string {
+	switch {
+	case bytes < 1024:
+		return fmt.Sprintf("%d B", bytes)
+	case bytes < 1024*1024:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/1024)
+	default:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/1024/1024)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+// exportLibrary writes the whole library, including the content of every
+// item, in the JSON format of GET /api/items.
+func exportLibrary(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	out := flags.String("out", "", "")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	library, err := c.api.Library(ctx)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return printJSON(library)
+	}
+	b, err := json.MarshalIndent(library, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, append(b, '\n'), 0600)
+}
+
+type importSummary struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// importLibrary adds the items of an exported library, replacing items with
+// the same name unless -skip-existing is set. Items of categories that
+// already exist are arranged in the order of the export, ahead of the items
+// that are not in the export.
+func importLibrary(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	skipExisting := flags.Bool("skip-existing", false, "")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var library []*client.Category
+	if err = json.Unmarshal(b, &library); err != nil {
+		return fmt.Errorf("invalid library file: %w", err)
+	}
+
+	summary := new(importSummary)
+	for _, category := range library {
+		existing, err := c.api.CategoryItems(ctx, category.Name)
+		if err != nil && !errors.Is(err, client.ErrNotFound) {
+			return err
+		}
+		existingVersions := make(map[string]uint64, len(existing))
+		for _, item := range existing {
+			existingVersions[item.Name] = item.Version
+		}
+
+		for _, item := range category.Items {
+			version, exists := existingVersions[item.Name]
+			if *skipExisting && exists {
+				summary.Skipped++
+				continue
+			}
+			upload := itemUpload(category.Name, item.Name, item)
+			upload.Version = version
+			upload.CreateOnly = !exists
+			if err = c.api.UploadItem(ctx, upload); err != nil {
+				return fmt.Errorf("error importing %s/%s: %w", category.Name, item.Name, err)
+			}
+			summary.Imported++
+		}
+
+		if len(existing) == 0 {
+			continue // new items were added in order
+		}
+		order := make([]string, 0, len(existing)+len(category.Items))
+		imported := make(map[string]bool, len(category.Items))
+		for _, item := range category.Items {
+			if !imported[item.Name] {
+				imported[item.Name] = true
+				order = append(order, item.Name)
+			}
+		}
+		for _, item := range existing {
+			if !imported[item.Name] {
+				order = append(order, item.Name)
+			}
+		}
+		if err = c.api.ReorderItems(ctx, category.Name, order); err != nil {
+			return fmt.Errorf("error ordering %s: %w", category.Name, err)
+		}
+	}
+
+	if c.asJSON {
+		return printJSON(summary)
+	}
+	fmt.Printf("Imported %d items, skipped %d.\n", summary.Imported, summary.Skipped)
+	return nil
+}
+
+type reminder struct {
+	Category  string `json:"category"`
+	Index     int    `json:"index"`
+	Remaining int    `json:"remaining"`
+	*client.Item
+}
+
+// nextReminder shows the next item of a category after the last one shown
+// to the user, by any client, and records it as shown. Once the last item
+// has been shown the category's progress is cleared, as the app does, so
+// the following call starts again from the first item.
+func nextReminder(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("next", flag.ContinueOnError)
+	save := flags.String("save", "", "")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	category := args[0]
+
+	progress, err := c.api.Progress(ctx)
+	if err != nil {
+		return err
+	}
+	lastIndex := -1
+	for _, p := range progress {
+		if p.Category == category {
+			lastIndex = p.LastIndex
+		}
+	}
+	items, err := c.api.CategoryItems(ctx, category)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("%s has no items", category)
+	}
+	nextIndex := lastIndex + 1
+	if nextIndex >= len(items) {
+		// Items were deleted since the progress was saved.
+		nextIndex = 0
+	}
+
+	item, err := c.api.Item(ctx, category, items[nextIndex].Name)
+	if err != nil {
+		return err
+	}
+	remaining := len(items) - nextIndex - 1
+	if remaining > 0 {
+		_, err = c.api.SaveProgress(ctx, category, nextIndex, time.Time{})
+	} else {
+		err = c.api.DeleteProgress(ctx, category)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving progress: %w", err)
+	}
+
+	if *save != "" {
+		if err = ioutil.WriteFile(*save, item.Content, 0644); err != nil {
+			return err
+		}
+	}
+	if c.asJSON {
+		return printJSON(&reminder{Category: category, Index: nextIndex, Remaining: remaining, Item: item})
+	}
+	fmt.Printf("%s: %s (%d of %d)\n\n", category, item.Name, nextIndex+1, len(items))
+	switch item.Type {
+	case client.TypeText, client.TypeMarkdown:
+		fmt.Println(string(item.Content))
+	case client.TypePrompt:
+		fmt.Println(string(item.Content))
+		fmt.Fprintf(os.Stderr, "\nUse responses add %s %s to answer it.\n", category, item.Name)
+	case client.TypeQuote:
+		fmt.Printf("\"%s\"\n", item.Content)
+		var attribution []string
+		for _, field := range []string{client.MetaAuthor, client.MetaSource, client.MetaURL} {
+			if v := item.Metadata[field]; v != "" {
+				attribution = append(attribution, v)
+			}
+		}
+		if len(attribution) > 0 {
+			fmt.Println("  - " + strings.Join(attribution, ", "))
+		}
+	case client.TypeFlashcard:
+		printFlashcard(item.Content)
+	case client.TypeChecklist:
+		for _, entry := range client.ChecklistEntries(item.Content) {
+			fmt.Println("[ ] " + entry)
+		}
+	case client.TypeLink:
+		fmt.Println(string(item.Content))
+		if p := item.Preview; p != nil {
+			for _, line := range []string{p.Title, p.SiteName, p.Description} {
+				if line != "" {
+					fmt.Println("  " + line)
+				}
+			}
+		}
+	default:
+		fmt.Printf("[%s, %s]\n", item.Type, formatSize(len(item.Content)))
+		if *save == "" {
+			fmt.Fprintln(os.Stderr, "Use -save <file> to save it.")
+		}
+	}
+	if note := item.Metadata[client.MetaNote]; note != "" {
+		fmt.Println("\nNote: " + note)
+	}
+	if remaining == 0 {
+		fmt.Println("\nThat was the last reminder, the next one starts from the beginning.")
+	} else {
+		fmt.Printf("\n%d remaining.\n", remaining)
+	}
+	return nil
+}
+
+// printFlashcard prints the question of a flashcard, the choices of answers
+// if it has distractors, and the answer.
+func printFlashcard(content []byte) {
+	card := new(client.Flashcard)
+	if err := json.Unmarshal(content, card); err != nil || card.Front == nil || card.Back == nil {
+		fmt.Println(string(content))
+		return
+	}
+	fmt.Println("Q: " + flashcardSide(card.Front))
+	if len(card.Distractors) > 0 {
+		choices := append([]string{card.Back.Text}, card.Distractors...)
+		sort.Strings(choices)
+		for i, choice := range choices {
+			fmt.Printf("  %c) %s\n", 'a'+i, choice)
+		}
+	}
+	fmt.Println("\nA: " + flashcardSide(card.Back))
+}
+
+func flashcardSide(side *client.FlashcardSide) string {
+	if side.Type == client.TypeImage {
+		return fmt.Sprintf("[image %s]", side.Text)
+	}
+	return side.Text
+}
@@ -0,0 +1,275 @@
+// Command remindme-cli manages the reminder library of a RemindMe server from
+// the terminal.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/decred/dcrd/dcrutil/v3"
+	"github.com/itswisdomagain/remindme/client"
+)
+
+const usage = `Usage: remindme-cli [options] <command> [arguments]
+
+Commands:
+  categories ls                          list categories
+  categories rm <category>               move a category and its items to the
+                                         trash
+  categories settings [-revision-limit <n>] [-keep-originals=true|false]
+                      <category>         show or change a category's settings,
+                                         keeping the original uploads of
+                                         images for admins
+  items ls <category>                    list the items of a category in order
+  items add <category> -name <name> -type <type> (-file <path> | -text <text>)
+            [-meta <field>=<value>]... [-version <n> | -force]
+                                         add an item, or replace the item with
+                                         the same name if it is at version n;
+                                         quotes take author, source and url
+                                         metadata, and any item a note; .md
+                                         files are added as markdown, and
+                                         flashcards are given as JSON files
+  items upload [-existing fail|skip|replace] <category> <file|dir|zip>...
+                                         add files as items in one request,
+                                         named after the files
+  items rm [-version <n>] <category> <name>
+                                         move an item to the trash
+  items mv <category> <name> [-to <category>] [-rename <name>] [-position <n>]
+                                         move, rename or reorder an item
+  items original -out <file> <category> <name>
+                                         save the original upload of an image,
+                                         for admins
+  items revisions <category> <name>      list the kept versions of an item
+  items diff [-against <n>] <category> <name> <version>
+                                         compare a text version with version n
+                                         or the version kept before it
+  items restore [-version <n>] <category> <name> <version>
+                                         make an earlier version current again
+  trash ls                               list deleted items and categories
+  trash restore <id>                     restore a deleted item or category
+  trash purge <id>                       delete a trash entry for good
+  checklists stats [-user <user>] [-category <category>]
+                                         show how often checklists were
+                                         finished when shown
+  responses ls [-category <category>] [-item <name>]
+                                         show your answers to prompts
+  responses add <category> <name> (-text <text> | -file <path>)
+                                         answer a prompt
+  responses export [-category <category>] [-item <name>] [-out <file>]
+                                         write your answers to prompts as JSON
+  audit [-actor <user>] [-action <action>] [-category <category>]
+        [-item <name>] [-since <time|duration>] [-limit <n>] [-export <file>]
+                                         show who changed what, or export the
+                                         audit log as JSON Lines
+  usage                                  show the storage used by each user and
+                                         category, and the quotas
+  export [-out <file>]                   write the library as JSON
+  import [-skip-existing] <file>         add the items of an exported library
+  next [-save <file>] <category>         show your next reminder in a category,
+                                         saving image and video content
+
+Options:
+`
+
+// config is read from the config file. Options given on the command line
+// take precedence.
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+func defaultConfigPath() string {
+	return filepath.Join(dcrutil.AppDataDir("remindme-cli", false), "config.json")
+}
+
+// loadConfig reads the config file at path. A missing file is only an error
+// if the path was given explicitly.
+func loadConfig(path string, explicit bool) (*config, error) {
+	cfg := &config{
+		Server: "http://localhost:17778",
+		Token:  os.Getenv("REMINDME_TOKEN"),
+	}
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// cli holds what commands need to talk to the server and print results.
+type cli struct {
+	api    *client.Client
+	asJSON bool
+}
+
+// command runs a command with its arguments.
+type command func(ctx context.Context, c *cli, args []string) error
+
+var commands = map[string]command{
+	"categories ls":       listCategories,
+	"categories rm":       deleteCategory,
+	"categories settings": categorySettings,
+	"items ls":            listItems,
+	"items add":           addItem,
+	"items upload":        uploadFiles,
+	"items rm":            deleteItem,
+	"items mv":            moveItem,
+	"items original":      downloadOriginal,
+	"items revisions":     listRevisions,
+	"items diff":          diffRevisions,
+	"items restore":       restoreRevision,
+	"trash ls":            listTrash,
+	"trash restore":       restoreTrash,
+	"trash purge":         purgeTrash,
+	"checklists stats":    checklistStats,
+	"responses ls":        listResponses,
+	"responses add":       addResponse,
+	"responses export":    exportResponses,
+	"audit":               listAudit,
+	"usage":               showUsage,
+	"export":              exportLibrary,
+	"import":              importLibrary,
+	"next":                nextReminder,
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	configPath := flag.String("config", defaultConfigPath(), "path to the config file, a JSON object with server and token fields")
+	server := flag.String("server", "", "url of the RemindMe server (default from the config file, or http://localhost:17778)")
+	token := flag.String("token", "", "API token for the server (default from the config file, or $REMINDME_TOKEN)")
+	format := flag.String("format", "table", "output format, table or json")
+	flag.Parse()
+
+	explicitConfig := false
+	flag.Visit(func(f *flag.Flag) {
+		explicitConfig = explicitConfig || f.Name == "config"
+	})
+	cfg, err := loadConfig(*configPath, explicitConfig)
+	if err != nil {
+		fatalf("error loading config: %v", err)
+	}
+	if *server != "" {
+		cfg.Server = *server
+	}
+	if *token != "" {
+		cfg.Token = *token
+	}
+	if *format != "table" && *format != "json" {
+		fatalf("invalid -format %q, must be table or json", *format)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	run, args := findCommand(args)
+	if run == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", strings.Join(args, " "))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	api, err := client.New(cfg.Server, client.WithToken(cfg.Token))
+	if err != nil {
+		fatalf("invalid server url: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	killChan := make(chan os.Signal, 1)
+	signal.Notify(killChan, os.Interrupt)
+	go func() {
+		<-killChan
+		cancel()
+	}()
+
+	err = run(ctx, &cli{api: api, asJSON: *format == "json"}, args)
+	cancel()
+	if errors.Is(err, errUsage) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// findCommand finds the command named by the first one or two arguments and
+// returns it with the remaining arguments.
+func findCommand(args []string) (command, []string) {
+	if run, ok := commands[args[0]]; ok {
+		return run, args[1:]
+	}
+	if len(args) > 1 {
+		if run, ok := commands[args[0]+" "+args[1]]; ok {
+			return run, args[2:]
+		}
+	}
+	return nil, args
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "remindme-cli: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// errUsage is returned by commands given the wrong arguments.
+var errUsage = errors.New("invalid arguments")
+
+// parseArgs parses the flags of a command, which may come before, between or
+// after its positional arguments, and checks the number of positional
+// arguments.
+func parseArgs(flags *flag.FlagSet, args []string, minArgs, maxArgs int) ([]string, error) {
+	flags.SetOutput(ioutil.Discard)
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, fmt.Errorf("%s: %w", flags.Name(), err)
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) < minArgs || len(positional) > maxArgs {
+		return nil, errUsage
+	}
+	return positional, nil
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printTable writes rows to stdout in aligned columns under a header.
+func printTable(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+// listResponses shows your answers to prompts, oldest first.
+func listResponses(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("responses ls", flag.ContinueOnError)
+	category := flags.String("category", "", "")
+	item := flags.String("item", "", "")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	responses, err := c.api.Responses(ctx, *category, *item)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(responses)
+	}
+	if len(responses) == 0 {
+		fmt.Println("No responses.")
+		return nil
+	}
+	for i, response := range responses {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s: %s, %s\n%s\n", response.Category, response.Item,
+			response.WrittenAt.Local().Format(time.RFC822), response.Text)
+	}
+	return nil
+}
+
+// addResponse saves an answer to a prompt.
+func addResponse(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("responses add", flag.ContinueOnError)
+	text := flags.String("text", "", "")
+	file := flags.String("file", "", "")
+	args, err := parseArgs(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if (*text == "") == (*file == "") {
+		return errors.New("responses add: one of -text or -file is required")
+	}
+	if *file != "" {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		*text = string(data)
+	}
+	response, err := c.api.SaveResponse(ctx, &client.PromptResponse{
+		Category:  args[0],
+		Item:      args[1],
+		WrittenAt: time.Now(),
+		Text:      *text,
+	})
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(response)
+	}
+	fmt.Printf("Saved your response to %s.\n", response.Item)
+	return nil
+}
+
+// exportResponses writes your answers to prompts as JSON.
+func exportResponses(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("responses export", flag.ContinueOnError)
+	category := flags.String("category", "", "")
+	item := flags.String("item", "", "")
+	out := flags.String("out", "", "")
+	if _, err := parseArgs(flags, args, 0, 0); err != nil {
+		return err
+	}
+	responses, err := c.api.Responses(ctx, *category, *item)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return printJSON(responses)
+	}
+	b, err := json.MarshalIndent(responses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, append(b, '\n'), 0600)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+func listRevisions(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("items revisions", flag.ContinueOnError), args, 2, 2)
+	if err != nil {
+		return err
+	}
+	revisions, err := c.api.Revisions(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(revisions)
+	}
+	rows := make([][]string, 0, len(revisions))
+	for _, revision := range revisions {
+		version := strconv.FormatUint(revision.Version, 10)
+		if revision.Current {
+			version += " (current)"
+		}
+		saved := "-"
+		if !revision.Time.IsZero() {
+			saved = revision.Time.Local().Format(time.RFC822)
+		}
+		rows = append(rows, []string{version, revision.Type, formatSize(revision.Size), revision.Editor, saved})
+	}
+	return printTable([]string{"VERSION", "TYPE", "SIZE", "EDITOR", "SAVED"}, rows)
+}
+
+func diffRevisions(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items diff", flag.ContinueOnError)
+	against := flags.Uint64("against", 0, "")
+	args, err := parseArgs(flags, args, 3, 3)
+	if err != nil {
+		return err
+	}
+	version, err := parseRevision(args[2])
+	if err != nil {
+		return err
+	}
+	diff, err := c.api.RevisionDiff(ctx, args[0], args[1], version, *against)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(diff)
+	}
+	if diff.Diff == "" {
+		fmt.Printf("Versions %d and %d are the same.\n", diff.From, diff.To)
+		return nil
+	}
+	fmt.Print(diff.Diff)
+	return nil
+}
+
+// restoreRevision makes a revision the current content of an item. With
+// -version, the item is only changed if it is still at that version.
+func restoreRevision(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("items restore", flag.ContinueOnError)
+	current := flags.Uint64("version", 0, "")
+	args, err := parseArgs(flags, args, 3, 3)
+	if err != nil {
+		return err
+	}
+	version, err := parseRevision(args[2])
+	if err != nil {
+		return err
+	}
+	item, err := c.api.RestoreRevision(ctx, args[0], args[1], version, *current)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(item)
+	}
+	fmt.Printf("Restored version %d of %s as version %d.\n", version, item.Name, item.Version)
+	return nil
+}
+
+func parseRevision(arg string) (uint64, error) {
+	version, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("invalid revision %q, it should be an item version", arg)
+	}
+	return version, nil
+}
+
+// categorySettings shows the settings of a category, changing them first if
+// any setting is given.
+func categorySettings(ctx context.Context, c *cli, args []string) error {
+	flags := flag.NewFlagSet("categories settings", flag.ContinueOnError)
+	revisionLimit := flags.Int("revision-limit", 0, "")
+	keepOriginals := flags.Bool("keep-originals", false, "")
+	args, err := parseArgs(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	var changed bool
+	flags.Visit(func(*flag.Flag) { changed = true })
+	settings, err := c.api.CategorySettings(ctx, args[0])
+	if err == nil && changed {
+		// Settings are saved together, so unchanged settings are sent as
+		// they are.
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "revision-limit":
+				settings.RevisionLimit = *revisionLimit
+			case "keep-originals":
+				settings.KeepOriginals = *keepOriginals
+			}
+		})
+		settings, err = c.api.SaveCategorySettings(ctx, args[0], settings)
+	}
+	if errors.Is(err, client.ErrNotFound) {
+		return fmt.Errorf("no category named %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(settings)
+	}
+	return printTable([]string{"SETTING", "VALUE"}, [][]string{
+		{"revision-limit", strconv.Itoa(settings.RevisionLimit)},
+		{"keep-originals", strconv.FormatBool(settings.KeepOriginals)},
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+func listTrash(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("trash ls", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	entries, err := c.api.Trash(ctx)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(entries)
+	}
+	rows := make([][]string, 0, len(entries))
+	for _, entry := range entries {
+		rows = append(rows, []string{entry.ID, entry.Category, entry.Item, strconv.Itoa(entry.ItemCount),
+			entry.DeletedBy, entry.DeletedAt.Local().Format(time.RFC822), entry.ExpiresAt.Local().Format(time.RFC822)})
+	}
+	return printTable([]string{"ID", "CATEGORY", "ITEM", "ITEMS", "DELETED BY", "DELETED", "EXPIRES"}, rows)
+}
+
+func restoreTrash(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("trash restore", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	entry, err := c.api.RestoreTrash(ctx, args[0])
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.Code == client.CodeConflict {
+		return fmt.Errorf("trash restore: %s, delete or rename it first", apiErr.Message)
+	}
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(entry)
+	}
+	if entry.Item != "" {
+		fmt.Printf("Restored %s to %s.\n", entry.Item, entry.Category)
+	} else {
+		fmt.Printf("Restored %s with %d items.\n", entry.Category, entry.ItemCount)
+	}
+	return nil
+}
+
+func purgeTrash(ctx context.Context, c *cli, args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("trash purge", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	return c.api.PurgeTrash(ctx, args[0])
+}
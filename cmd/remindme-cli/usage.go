@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+func showUsage(ctx context.Context, c *cli, args []string) error {
+	if _, err := parseArgs(flag.NewFlagSet("usage", flag.ContinueOnError), args, 0, 0); err != nil {
+		return err
+	}
+	usage, err := c.api.Usage(ctx)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		return printJSON(usage)
+	}
+	fmt.Printf("Largest upload: %s\n\n", formatBytes(usage.MaxUploadBytes))
+	if err = printUsage("USER", usage.Users, usage.UserQuota); err != nil {
+		return err
+	}
+	fmt.Println()
+	return printUsage("CATEGORY", usage.Categories, usage.CategoryQuota)
+}
+
+func printUsage(kind string, usages []*client.Usage, quota int64) error {
+	quotaStr := "unlimited"
+	if quota > 0 {
+		quotaStr = formatBytes(quota)
+	}
+	rows := make([][]string, 0, len(usages))
+	for _, u := range usages {
+		rows = append(rows, []string{u.Name, strconv.Itoa(u.Items), formatBytes(u.Bytes), quotaStr})
+	}
+	return printTable([]string{kind, "ITEMS", "SIZE", "QUOTA"}, rows)
+}
+
+// formatBytes formats a size in bytes with a decimal unit.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
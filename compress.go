@@ -0,0 +1,226 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMinSize is the size below which responses are not compressed, as
+// compression would save little.
+const compressMinSize = 1024
+
+// encoder is a compressing writer that can be reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders pools the encoders of each supported content coding.
+var encoders = map[string]*sync.Pool{
+	"zstd": {New: func() interface{} {
+		// A small window keeps the memory needed to decode responses
+		// within what browsers allow.
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return enc
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+}
+
+// negotiateEncoding picks the content coding of a response from an
+// Accept-Encoding header, preferring zstd over gzip when both are equally
+// acceptable. It returns an empty string if neither is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	var best string
+	var bestQ float64
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, params := entry, ""
+		if i := strings.Index(entry, ";"); i >= 0 {
+			coding, params = entry[:i], entry[i+1:]
+		}
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(params[2:], 64); err != nil {
+				continue
+			}
+		}
+		candidates := []string{coding}
+		if coding == "*" {
+			candidates = []string{"zstd", "gzip"}
+		}
+		for _, c := range candidates {
+			if encoders[c] == nil || q <= 0 {
+				continue
+			}
+			if q > bestQ || q == bestQ && c == "zstd" {
+				best, bestQ = c, q
+			}
+		}
+	}
+	return best
+}
+
+// compressibleType reports whether responses of a content type are worth
+// compressing. Images, videos and archives are already compressed.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml",
+		"image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// compressResponses is middleware that compresses responses with zstd or
+// gzip, as accepted by the client. Only text and JSON responses of at least
+// compressMinSize bytes are compressed, and never partial content.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status int
+	// buf is the start of the body, written once it is decided whether to
+	// compress the response.
+	buf         []byte
+	enc         encoder
+	passthrough bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	switch {
+	case cw.enc != nil:
+		return cw.enc.Write(p)
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(p)
+	}
+	if cw.Header().Get("Content-Type") == "" {
+		// Sniff the type now, as it cannot be sniffed from compressed
+		// content.
+		cw.Header().Set("Content-Type", http.DetectContentType(append(cw.buf, p...)))
+	}
+	if !cw.compressible() {
+		if err := cw.startPassthrough(); err != nil {
+			return 0, err
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= compressMinSize {
+		if err := cw.startCompression(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// compressible reports whether the response can be compressed.
+func (cw *compressWriter) compressible() bool {
+	h := cw.Header()
+	return cw.status >= 200 && cw.status < 300 &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		compressibleType(h.Get("Content-Type"))
+}
+
+func (cw *compressWriter) startPassthrough() error {
+	cw.passthrough = true
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+func (cw *compressWriter) startCompression() error {
+	h := cw.Header()
+	h.Del("Content-Length")
+	// The compressed body is another representation than the one a strong
+	// entity tag was given for, so the tag is only kept as a weak one and
+	// ranges, which are served uncompressed, are not offered.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", cw.encoding)
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.enc = encoders[cw.encoding].Get().(encoder)
+	cw.enc.Reset(cw.ResponseWriter)
+	_, err := cw.enc.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// Flush sends what was written so far, compressing it if the response is
+// compressible whatever its size.
+func (cw *compressWriter) Flush() {
+	if cw.enc == nil && !cw.passthrough && cw.status != 0 {
+		if cw.compressible() {
+			cw.startCompression()
+		} else {
+			cw.startPassthrough()
+		}
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close ends the compressed stream, or writes a response that was too small
+// to compress.
+func (cw *compressWriter) close() {
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.enc.Reset(nil)
+		encoders[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+		return
+	}
+	if !cw.passthrough && cw.status != 0 {
+		cw.startPassthrough()
+	}
+}
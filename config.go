@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// config holds the server's command line options.
+type config struct {
+	// SMTPServer is the host:port of the SMTP server used to send email
+	// digests. Digests are not sent if it is empty.
+	SMTPServer   string
+	SMTPUser     string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// AuthTokens maps the API tokens accepted by the server to the names of
+	// the users they identify. The API is open to anonymous users if no
+	// tokens are configured.
+	AuthTokens map[string]string
+	// AuthTokenFile is a file of user:token pairs, one per line, added to
+	// AuthTokens. Tokens in a file or the environment are not exposed in
+	// the process list like those given with the -authtoken flag.
+	AuthTokenFile string
+	// Admins are the users that may download the originals of images,
+	// before they were stripped of metadata.
+	Admins map[string]bool
+
+	// TrashRetention is how long deleted items and categories can be
+	// restored before they are purged.
+	TrashRetention time.Duration
+
+	// MaxUploadBytes is the largest item content accepted by the server.
+	MaxUploadBytes int64
+	// UserQuota and CategoryQuota limit the size of the content of the
+	// items last written by each user and of the items in each category.
+	// They are unlimited if 0.
+	UserQuota     int64
+	CategoryQuota int64
+
+	// RateLimit limits the requests of each address and user.
+	// ExpensiveRateLimit also limits uploads and downloads of the whole
+	// library.
+	RateLimit          rateLimit
+	ExpensiveRateLimit rateLimit
+	// AuthBanFailures is how many failed authentications from an address
+	// within AuthBanDuration ban it for that long. Addresses are never
+	// banned if it is 0.
+	AuthBanFailures int
+	AuthBanDuration time.Duration
+
+	// LinkPreviews is where the previews of links are fetched from, public
+	// addresses only, all addresses, or off.
+	LinkPreviews string
+
+	// LogLevel is the default log level, optionally followed by levels for
+	// subsystems, e.g. "info,webhooks=debug".
+	LogLevel string
+	// LogFormat is text or json.
+	LogFormat string
+}
+
+// authTokensFlag is a repeatable flag of user:token pairs.
+type authTokensFlag map[string]string
+
+func (f authTokensFlag) String() string {
+	return fmt.Sprintf("%d tokens", len(f))
+}
+
+func (f authTokensFlag) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i < 1 || i == len(v)-1 {
+		// The value is not quoted in the error, it may be a token.
+		return errors.New("expected user:token")
+	}
+	f[v[i+1:]] = v[:i]
+	return nil
+}
+
+// readAuthTokens adds the user:token pairs in the file at path, one per
+// line, to tokens. Blank lines and lines starting with # are skipped.
+func readAuthTokens(path string, tokens authTokensFlag) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := tokens.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return lines.Err()
+}
+
+// adminsFlag is a repeatable flag of user names.
+type adminsFlag map[string]bool
+
+func (f adminsFlag) String() string {
+	users := make([]string, 0, len(f))
+	for user := range f {
+		users = append(users, user)
+	}
+	return strings.Join(users, ",")
+}
+
+func (f adminsFlag) Set(v string) error {
+	if v == "" {
+		return errors.New("expected a user name")
+	}
+	f[v] = true
+	return nil
+}
+
+// defaultMaxUploadBytes is the default limit on the size of item content.
+const defaultMaxUploadBytes = 10_000_000 // 10mb
+
+// authTokensEnv is the environment variable holding user:token pairs,
+// separated by spaces or commas.
+const authTokensEnv = "REMINDME_AUTH_TOKENS"
+
+func loadConfig() (*config, error) {
+	cfg := &config{
+		AuthTokens:         make(map[string]string),
+		Admins:             make(map[string]bool),
+		RateLimit:          rateLimit{n: 600, per: time.Minute},
+		ExpensiveRateLimit: rateLimit{n: 60, per: time.Minute},
+	}
+	flag.StringVar(&cfg.SMTPServer, "smtpserver", "", "host:port of the SMTP server used to send email digests")
+	flag.StringVar(&cfg.SMTPUser, "smtpuser", "", "username for authenticating with the SMTP server")
+	flag.StringVar(&cfg.SMTPPassword, "smtppass", os.Getenv("REMINDME_SMTP_PASSWORD"),
+		"password for authenticating with the SMTP server (default $REMINDME_SMTP_PASSWORD)")
+	flag.StringVar(&cfg.SMTPFrom, "smtpfrom", "remindme@localhost", "sender address of email digests")
+	flag.Var(authTokensFlag(cfg.AuthTokens), "authtoken",
+		"user:token pair allowed to use the API, may be repeated; visible to other local users, "+
+			"prefer -authtokenfile or $"+authTokensEnv+" (default allow anonymous access)")
+	flag.StringVar(&cfg.AuthTokenFile, "authtokenfile", os.Getenv("REMINDME_AUTH_TOKEN_FILE"),
+		"file of user:token pairs allowed to use the API, one per line (default $REMINDME_AUTH_TOKEN_FILE)")
+	flag.Var(adminsFlag(cfg.Admins), "admin",
+		"user allowed to download the originals of uploaded images, may be repeated")
+	flag.DurationVar(&cfg.TrashRetention, "trashretention", 30*24*time.Hour,
+		"how long deleted items and categories can be restored before they are purged")
+	flag.Int64Var(&cfg.MaxUploadBytes, "maxupload", defaultMaxUploadBytes, "largest item content accepted, in bytes")
+	flag.Int64Var(&cfg.UserQuota, "userquota", 0, "bytes of item content each user may store (default unlimited)")
+	flag.Int64Var(&cfg.CategoryQuota, "categoryquota", 0, "bytes of item content each category may hold (default unlimited)")
+	flag.Var(&cfg.RateLimit, "ratelimit", "requests allowed per period from each address and user, e.g. 600/1m, or off")
+	flag.Var(&cfg.ExpensiveRateLimit, "expensiveratelimit",
+		"uploads and library downloads allowed per period from each address and user, or off")
+	flag.IntVar(&cfg.AuthBanFailures, "authbanfailures", 10,
+		"failed authentications after which an address is banned, 0 never bans")
+	flag.DurationVar(&cfg.AuthBanDuration, "authbanduration", 15*time.Minute,
+		"how long addresses are banned, and the window in which failed authentications are counted")
+	flag.StringVar(&cfg.LinkPreviews, "linkpreviews", linkPreviewsPublic,
+		"fetch the previews of links from public addresses only (public), from any address (all), or not at all (off)")
+	flag.StringVar(&cfg.LogLevel, "loglevel", "info",
+		"log level (debug, info, warn, error or off), optionally followed by subsystem levels, e.g. info,webhooks=debug")
+	flag.StringVar(&cfg.LogFormat, "logformat", "text", "format of log lines, text or json")
+	flag.Parse()
+
+	for _, pair := range strings.FieldsFunc(os.Getenv(authTokensEnv), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		if err := authTokensFlag(cfg.AuthTokens).Set(pair); err != nil {
+			return nil, fmt.Errorf("invalid $%s: %w", authTokensEnv, err)
+		}
+	}
+	if cfg.AuthTokenFile != "" {
+		if err := readAuthTokens(cfg.AuthTokenFile, cfg.AuthTokens); err != nil {
+			return nil, fmt.Errorf("failed to read auth tokens: %w", err)
+		}
+	}
+	return cfg, nil
+}
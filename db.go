@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 
 	"go.etcd.io/bbolt"
@@ -47,3 +49,180 @@ func (api *apiServer) Get(b string, k string) ([]byte, error) {
 		return nil
 	})
 }
+
+var (
+	metaBkt       = []byte("meta")
+	dbVersionKey  = []byte("version")
+	libraryIDKey  = []byte("library_id")
+	categoriesBkt = []byte("categories")
+)
+
+// dbVersion is the current version of the db layout. Version 0 stored every
+// category as a top-level bucket, version 1 nests them in categoriesBkt so
+// that other records can be kept alongside. Version 2 keeps the storage
+// usage of categories and users in usageBkt.
+const dbVersion = 2
+
+// upgradeDB brings a db created by an older version of the server up to the
+// current layout.
+func upgradeDB(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		// The meta bucket is only created along with the version, so a db
+		// without a version may have a category named like the meta bucket.
+		var version uint64
+		if meta := tx.Bucket(metaBkt); meta != nil {
+			if v := meta.Get(dbVersionKey); v != nil {
+				version = binary.BigEndian.Uint64(v)
+			}
+		}
+		if version > dbVersion {
+			return fmt.Errorf("db version %d is newer than supported version %d", version, dbVersion)
+		}
+
+		if version < 1 {
+			if err := nestLegacyCategories(tx); err != nil {
+				return err
+			}
+		}
+		if version < 2 {
+			if err := countStorageUsage(tx); err != nil {
+				return fmt.Errorf("failed to count storage usage: %w", err)
+			}
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBkt)
+		if err != nil {
+			return fmt.Errorf("failed to open db meta record: %w", err)
+		}
+
+		// The library id tells apart libraries at the same revision, such
+		// as after the db was recreated, in the entity tags of listings.
+		if meta.Get(libraryIDKey) == nil {
+			id, err := randomHex(8)
+			if err != nil {
+				return err
+			}
+			if err = meta.Put(libraryIDKey, []byte(id)); err != nil {
+				return err
+			}
+		}
+
+		return meta.Put(dbVersionKey, uint64Bytes(dbVersion))
+	})
+}
+
+// nestLegacyCategories moves the categories of a version 0 db, where every
+// top-level bucket is a category, into categoriesBkt. The categories are
+// first gathered in a bucket named unlike any of them, so that categories
+// named like categoriesBkt or metaBkt are kept.
+func nestLegacyCategories(tx *bbolt.Tx) error {
+	var legacyCategories [][]byte
+	err := tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+		legacyCategories = append(legacyCategories, append([]byte(nil), name...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stagingName := []byte("categories.upgrade")
+	for tx.Bucket(stagingName) != nil {
+		stagingName = append(stagingName, '_')
+	}
+	staging, err := tx.CreateBucket(stagingName)
+	if err != nil {
+		return fmt.Errorf("failed to create db record for upgrade: %w", err)
+	}
+	for _, name := range legacyCategories {
+		dst, err := staging.CreateBucket(name)
+		if err != nil {
+			return fmt.Errorf("failed to create db record for %s: %w", name, err)
+		}
+		if err = copyBucket(dst, tx.Bucket(name)); err != nil {
+			return fmt.Errorf("failed to move category %s: %w", name, err)
+		}
+		if err = tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+
+	catsBucket, err := tx.CreateBucket(categoriesBkt)
+	if err != nil {
+		return fmt.Errorf("failed to create db record for all categories: %w", err)
+	}
+	if err = copyBucket(catsBucket, staging); err != nil {
+		return fmt.Errorf("failed to move categories: %w", err)
+	}
+	return tx.DeleteBucket(stagingName)
+}
+
+// putUserItemRecord stores a record that a user keeps about an item, such as
+// a checklist run or a prompt response, under key in a bucket of top nested
+// by user, category and item. Records count against the user's storage
+// quota, and a *quotaExceeded error is returned if a record would take the
+// user over it. It returns the content hash of the record replaced, if any.
+func putUserItemRecord(tx *bbolt.Tx, quotas *quotaChecker, top []byte, user, category, itemName string, key, v []byte) (string, error) {
+	bkt, err := tx.CreateBucketIfNotExists(top)
+	for _, name := range []string{user, category, itemName} {
+		if err != nil {
+			break
+		}
+		bkt, err = bkt.CreateBucketIfNotExists([]byte(name))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open db record for %s: %w", top, err)
+	}
+	var before string
+	growth := int64(len(v))
+	if old := bkt.Get(key); old != nil {
+		before = contentHash(old)
+		growth -= int64(len(old))
+	}
+	if growth > 0 {
+		if err = quotas.check(tx, "", 0, user, growth); err != nil {
+			return "", err
+		}
+	}
+	if err = addUsage(tx, "", user, growth, 0); err != nil {
+		return "", err
+	}
+	return before, bkt.Put(key, v)
+}
+
+// copyBucket recursively copies the keys and nested buckets of src into dst.
+func copyBucket(dst, src *bbolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nestedDst, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nestedDst, src.Bucket(k))
+	})
+}
+
+// uint64Bytes encodes i as 8 big-endian bytes, the format used for sequence
+// keys so that they sort numerically.
+func uint64Bytes(i uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, i)
+	return b
+}
+
+// trimLog deletes the oldest entries of a log bucket keyed by sequence
+// numbers, keeping the keep entries up to lastSeq.
+func trimLog(logBkt *bbolt.Bucket, lastSeq uint64, keep int) error {
+	if lastSeq <= uint64(keep) {
+		return nil
+	}
+	cutoff := uint64Bytes(lastSeq - uint64(keep) + 1)
+	cursor := logBkt.Cursor()
+	for k, _ := cursor.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = cursor.First() {
+		if err := logBkt.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
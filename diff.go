@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around changes.
+	diffContext = 3
+	// maxDiffCells bounds the work of diffing, the product of the line
+	// counts of the two texts.
+	maxDiffCells = 4_000_000
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns a unified diff of the lines of a and b, labelled with
+// fromName and toName. It returns an empty diff if the texts are the same.
+func unifiedDiff(fromName, toName, a, b string) (string, error) {
+	aLines, bLines := splitLines(a), splitLines(b)
+	if len(aLines)*len(bLines) > maxDiffCells {
+		return "", fmt.Errorf("texts are too long to compare")
+	}
+	ops := diffLines(aLines, bLines)
+
+	// Find the ranges of ops to show, each change with its context.
+	type span struct{ start, end int }
+	var hunks []span
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		start, end := i-diffContext, i+diffContext+1
+		if start < 0 {
+			start = 0
+		}
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if n := len(hunks); n > 0 && start <= hunks[n-1].end {
+			hunks[n-1].end = end
+		} else {
+			hunks = append(hunks, span{start, end})
+		}
+	}
+	if len(hunks) == 0 {
+		return "", nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromName, toName)
+	// aLine and bLine count the lines of a and b before the current op.
+	aLine, bLine, next := 0, 0, 0
+	for _, hunk := range hunks {
+		for ; next < hunk.start; next++ {
+			aLine, bLine = advanceLines(ops[next].kind, aLine, bLine)
+		}
+		aStart, bStart := aLine, bLine
+		var aCount, bCount int
+		var body strings.Builder
+		for ; next < hunk.end; next++ {
+			op := ops[next]
+			body.WriteByte(op.kind)
+			body.WriteString(op.text)
+			body.WriteByte('\n')
+			aLine, bLine = advanceLines(op.kind, aLine, bLine)
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		// Ranges start at their first line, or the line before them if
+		// they are empty.
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		sb.WriteString(body.String())
+	}
+	return sb.String(), nil
+}
+
+func advanceLines(kind byte, aLine, bLine int) (int, int) {
+	if kind != '+' {
+		aLine++
+	}
+	if kind != '-' {
+		bLine++
+	}
+	return aLine, bLine
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines finds the shortest edit turning a into b from their longest
+// common subsequence of lines.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
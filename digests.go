@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	digestsBkt    = []byte("digests")
+	digestLogsBkt = []byte("digest_logs")
+)
+
+// Digest schedules.
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+var digestPeriods = map[string]time.Duration{
+	digestDaily:  24 * time.Hour,
+	digestWeekly: 7 * 24 * time.Hour,
+}
+
+const (
+	maxDigestItems     = 50
+	digestRetryDelay   = 15 * time.Minute
+	digestLogsPerEntry = 100
+)
+
+// digest is a subscription of a user, identified by their email address, to
+// periodic emails containing the next items of a category.
+type digest struct {
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	Category string `json:"category"`
+	// Count is the number of items included in each digest.
+	Count    int       `json:"count"`
+	Schedule string    `json:"schedule"`
+	NextSend time.Time `json:"nextSend"`
+	// Position is the index of the next category item to send. Digests
+	// start over from the first item after the last item is sent.
+	Position  int        `json:"position"`
+	LastSent  *time.Time `json:"lastSent,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// digestLog records a single digest email.
+type digestLog struct {
+	Time  time.Time `json:"time"`
+	Items []string  `json:"items"`
+	Error string    `json:"error,omitempty"`
+}
+
+// digestScheduler emails digests as they fall due.
+type digestScheduler struct {
+	db  *bbolt.DB
+	cfg *config
+	// mtx prevents a digest from being sent concurrently by the scheduler
+	// and the send endpoint.
+	mtx sync.Mutex
+}
+
+func newDigestScheduler(db *bbolt.DB, cfg *config) *digestScheduler {
+	return &digestScheduler{
+		db:  db,
+		cfg: cfg,
+	}
+}
+
+func (s *digestScheduler) enabled() bool {
+	return s.cfg.SMTPServer != ""
+}
+
+// Run sends due digests every minute until the context is canceled.
+func (s *digestScheduler) Run(ctx context.Context) {
+	if !s.enabled() {
+		digestsLog.Infof("No SMTP server configured, email digests disabled.")
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		s.sendDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *digestScheduler) sendDue() {
+	now := time.Now()
+	var dueIDs []string
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		digestsBucket := tx.Bucket(digestsBkt)
+		if digestsBucket == nil {
+			return nil
+		}
+		return digestsBucket.ForEach(func(_, v []byte) error {
+			d := new(digest)
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to decode digest record: %w", err)
+			}
+			if !d.NextSend.After(now) {
+				dueIDs = append(dueIDs, d.ID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		digestsLog.Errorf("Error reading digests: %v", err)
+		return
+	}
+	for _, id := range dueIDs {
+		if err := s.send(id, true); err != nil {
+			digestsLog.Errorf("Error sending digest %s: %v", id, err)
+		}
+	}
+}
+
+// send emails the next items of the digest and advances its position. If
+// scheduled is true, the next send time is moved forward by the digest's
+// period, otherwise the schedule is unchanged.
+func (s *digestScheduler) send(id string, scheduled bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var d *digest
+	var items []*Item
+	var numCategoryItems int
+	err := s.db.View(func(tx *bbolt.Tx) (err error) {
+		d, err = getDigest(tx, id)
+		if err != nil || d == nil {
+			return err
+		}
+		catBucket := categoryBucket(tx, d.Category)
+		if catBucket == nil {
+			return nil
+		}
+		categoryItems := readCategoryItems(d.Category, catBucket)
+		numCategoryItems = len(categoryItems)
+		if d.Position >= numCategoryItems {
+			d.Position = 0
+		}
+		for i := 0; i < d.Count && i < len(categoryItems); i++ {
+			item := categoryItems[(d.Position+i)%len(categoryItems)]
+			items = append(items, &Item{
+				Name:     item.Name,
+				Type:     item.Type,
+				Content:  append([]byte(nil), item.Content...),
+				Metadata: item.Metadata,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return nil // deleted since it was found due
+	}
+
+	now := time.Now()
+	logEntry := &digestLog{
+		Time:  now.UTC(),
+		Items: make([]string, 0, len(items)),
+	}
+	for _, item := range items {
+		logEntry.Items = append(logEntry.Items, item.Name)
+	}
+
+	// Nothing is sent for empty categories, but the schedule still moves on.
+	var sendErr error
+	if len(items) > 0 {
+		var msg []byte
+		msg, sendErr = composeDigestEmail(s.cfg.SMTPFrom, d.Email, d.Category, items)
+		if sendErr == nil {
+			sendErr = sendEmail(s.cfg, d.Email, msg)
+		}
+	}
+
+	if sendErr != nil {
+		logEntry.Error = sendErr.Error()
+		if scheduled {
+			d.NextSend = now.Add(digestRetryDelay)
+		}
+	} else {
+		if len(items) > 0 {
+			d.Position = (d.Position + len(items)) % numCategoryItems
+			sent := now.UTC()
+			d.LastSent = &sent
+		}
+		if scheduled {
+			period := digestPeriods[d.Schedule]
+			for !d.NextSend.After(now) {
+				d.NextSend = d.NextSend.Add(period)
+			}
+		}
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		current, err := getDigest(tx, id)
+		if err != nil || current == nil {
+			return err
+		}
+		if err = putDigest(tx, d); err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		return appendDigestLog(tx, id, logEntry)
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// appendDigestLog adds an entry to the digest's send log, discarding the
+// oldest entries once there are more than digestLogsPerEntry.
+func appendDigestLog(tx *bbolt.Tx, id string, logEntry *digestLog) error {
+	logsBucket, err := tx.CreateBucketIfNotExists(digestLogsBkt)
+	if err != nil {
+		return err
+	}
+	digestLogs, err := logsBucket.CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	seq, err := digestLogs.NextSequence()
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(logEntry)
+	if err != nil {
+		return err
+	}
+	if err = digestLogs.Put(uint64Bytes(seq), v); err != nil {
+		return err
+	}
+	return trimLog(digestLogs, seq, digestLogsPerEntry)
+}
+
+func getDigest(tx *bbolt.Tx, id string) (*digest, error) {
+	digestsBucket := tx.Bucket(digestsBkt)
+	if digestsBucket == nil {
+		return nil, nil
+	}
+	v := digestsBucket.Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	d := new(digest)
+	if err := json.Unmarshal(v, d); err != nil {
+		return nil, fmt.Errorf("failed to decode digest record: %w", err)
+	}
+	return d, nil
+}
+
+func putDigest(tx *bbolt.Tx, d *digest) error {
+	digestsBucket, err := tx.CreateBucketIfNotExists(digestsBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open db record for digests: %w", err)
+	}
+	v, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return digestsBucket.Put([]byte(d.ID), v)
+}
+
+type digestRequest struct {
+	Email    string `json:"email"`
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+	Schedule string `json:"schedule"`
+	// Start is when the first digest is sent, defaults to now.
+	Start *time.Time `json:"start"`
+}
+
+func (api *apiServer) createDigest(w http.ResponseWriter, r *http.Request) {
+	req := new(digestRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, "invalid digest request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		writeError(w, "invalid email address", http.StatusBadRequest)
+		return
+	}
+	if req.Category == "" {
+		writeError(w, "no digest category specified", http.StatusBadRequest)
+		return
+	}
+	if req.Count < 1 || req.Count > maxDigestItems {
+		writeError(w, fmt.Sprintf("digest count must be between 1 and %d", maxDigestItems), http.StatusBadRequest)
+		return
+	}
+	if _, ok := digestPeriods[req.Schedule]; !ok {
+		writeError(w, "digest schedule must be daily or weekly", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	d := &digest{
+		Email:     addr.Address,
+		Category:  req.Category,
+		Count:     req.Count,
+		Schedule:  req.Schedule,
+		NextSend:  now,
+		CreatedAt: now,
+	}
+	if req.Start != nil {
+		d.NextSend = req.Start.UTC()
+	}
+	if d.ID, err = randomHex(8); err != nil {
+		reqLog(r).Errorf("Error generating digest id: %v", err)
+		writeError(w, "error creating digest", http.StatusInternalServerError)
+		return
+	}
+
+	var duplicate bool
+	err = api.db.Update(func(tx *bbolt.Tx) error {
+		if digestsBucket := tx.Bucket(digestsBkt); digestsBucket != nil {
+			err := digestsBucket.ForEach(func(_, v []byte) error {
+				existing := new(digest)
+				if err := json.Unmarshal(v, existing); err != nil {
+					return fmt.Errorf("failed to decode digest record: %w", err)
+				}
+				duplicate = duplicate || (existing.Email == d.Email && existing.Category == d.Category)
+				return nil
+			})
+			if err != nil || duplicate {
+				return err
+			}
+		}
+		if err := putDigest(tx, d); err != nil {
+			return err
+		}
+		return recordAudit(tx, requestActor(r), &auditEntry{
+			Action:   client.AuditDigestCreated,
+			Category: d.Category,
+			Target:   d.ID,
+			Detail:   d.Email,
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error saving digest: %v", err)
+		writeError(w, "error creating digest", http.StatusInternalServerError)
+		return
+	}
+	if duplicate {
+		writeError(w, d.Email+" already has a digest for "+d.Category, http.StatusConflict)
+		return
+	}
+
+	writeJSONWithStatus(w, d, http.StatusCreated)
+}
+
+// listDigests lists digest subscriptions, optionally only those of the user
+// with the email address given by the email query parameter.
+func (api *apiServer) listDigests(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	digests := make([]*digest, 0)
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		digestsBucket := tx.Bucket(digestsBkt)
+		if digestsBucket == nil {
+			return nil
+		}
+		return digestsBucket.ForEach(func(_, v []byte) error {
+			d := new(digest)
+			if err := json.Unmarshal(v, d); err != nil {
+				return fmt.Errorf("failed to decode digest record: %w", err)
+			}
+			if email == "" || d.Email == email {
+				digests = append(digests, d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching digests from db: %v", err)
+		writeError(w, "error fetching digests", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, digests)
+}
+
+func (api *apiServer) deleteDigest(w http.ResponseWriter, r *http.Request) {
+	id := []byte(chi.URLParam(r, "id"))
+	var found bool
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		digestsBucket := tx.Bucket(digestsBkt)
+		if digestsBucket == nil || digestsBucket.Get(id) == nil {
+			return nil
+		}
+		found = true
+		if err := digestsBucket.Delete(id); err != nil {
+			return err
+		}
+		err := recordAudit(tx, requestActor(r), &auditEntry{
+			Action: client.AuditDigestDeleted,
+			Target: string(id),
+		})
+		if err != nil {
+			return err
+		}
+		if logsBucket := tx.Bucket(digestLogsBkt); logsBucket != nil && logsBucket.Bucket(id) != nil {
+			return logsBucket.DeleteBucket(id)
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error deleting digest: %v", err)
+		writeError(w, "error deleting digest", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "digest not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendDigest immediately emails the next items of a digest without waiting
+// for its schedule.
+func (api *apiServer) sendDigest(w http.ResponseWriter, r *http.Request) {
+	if !api.digests.enabled() {
+		writeError(w, "email digests are not enabled on this server", http.StatusServiceUnavailable)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	var found bool
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		d, err := getDigest(tx, id)
+		found = d != nil
+		return err
+	})
+	if err == nil && found {
+		err = api.digests.send(id, false)
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error sending digest %s: %v", id, err)
+		writeError(w, "error sending digest: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !found {
+		writeError(w, "digest not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// digestHistory lists the digests emailed for a subscription, most recent
+// first.
+func (api *apiServer) digestHistory(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	logs := make([]*digestLog, 0)
+	var found bool
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		d, err := getDigest(tx, id)
+		if err != nil || d == nil {
+			return err
+		}
+		found = true
+		logsBucket := tx.Bucket(digestLogsBkt)
+		if logsBucket == nil {
+			return nil
+		}
+		digestLogs := logsBucket.Bucket([]byte(id))
+		if digestLogs == nil {
+			return nil
+		}
+		entries := digestLogs.Cursor()
+		for k, v := entries.Last(); k != nil; k, v = entries.Prev() {
+			logEntry := new(digestLog)
+			if err := json.Unmarshal(v, logEntry); err != nil {
+				return fmt.Errorf("failed to decode digest log: %w", err)
+			}
+			logs = append(logs, logEntry)
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching digest history from db: %v", err)
+		writeError(w, "error fetching digest history", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "digest not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, logs)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// smtpMessage is an email received by smtpSink.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpSink is an SMTP server that accepts and keeps every message, or
+// rejects all recipients if reject is set.
+type smtpSink struct {
+	ln       net.Listener
+	mtx      sync.Mutex
+	reject   bool
+	messages []*smtpMessage
+}
+
+func newSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	return sink
+}
+
+func (sink *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 localhost ESMTP sink")
+	msg := new(smtpMessage)
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			c.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			c.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			sink.mtx.Lock()
+			reject := sink.reject
+			sink.mtx.Unlock()
+			if reject {
+				c.PrintfLine("550 no such user")
+				continue
+			}
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+			c.PrintfLine("250 OK")
+		case cmd == "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			sink.mtx.Lock()
+			sink.messages = append(sink.messages, msg)
+			sink.mtx.Unlock()
+			msg = new(smtpMessage)
+			c.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (sink *smtpSink) received() []*smtpMessage {
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	return append([]*smtpMessage(nil), sink.messages...)
+}
+
+func readTestDigest(t *testing.T, db *bbolt.DB, id string) *digest {
+	t.Helper()
+	var d *digest
+	err := db.View(func(tx *bbolt.Tx) (err error) {
+		d, err = getDigest(tx, id)
+		return err
+	})
+	if err != nil || d == nil {
+		t.Fatalf("reading digest %s: %v", id, err)
+	}
+	return d
+}
+
+func digestLogEntries(t *testing.T, db *bbolt.DB, id string) []*digestLog {
+	t.Helper()
+	var entries []*digestLog
+	err := db.View(func(tx *bbolt.Tx) error {
+		logsBucket := tx.Bucket(digestLogsBkt)
+		if logsBucket == nil || logsBucket.Bucket([]byte(id)) == nil {
+			return nil
+		}
+		return logsBucket.Bucket([]byte(id)).ForEach(func(_, v []byte) error {
+			entry := new(digestLog)
+			entries = append(entries, entry)
+			return json.Unmarshal(v, entry)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestDigestScheduler(t *testing.T) {
+	sink := newSMTPSink(t)
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	cfg := &config{SMTPServer: sink.ln.Addr().String(), SMTPFrom: "remindme@example.com"}
+	s := newDigestScheduler(db, cfg)
+
+	now := time.Now().UTC()
+	due := now.Add(-time.Minute)
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for i := 1; i <= 3; i++ {
+			item := &Item{Name: fmt.Sprintf("book%d", i), Type: "text", Content: []byte(fmt.Sprintf("chapter %d", i))}
+			if _, err := putItem(tx, "books", item, itemCondition{}, systemActor); err != nil {
+				return err
+			}
+		}
+		digests := []*digest{
+			{ID: "due", Email: "ann@example.com", Category: "books", Count: 2, Schedule: digestDaily, NextSend: due},
+			{ID: "later", Email: "bob@example.com", Category: "books", Count: 2, Schedule: digestWeekly, NextSend: now.Add(time.Hour)},
+		}
+		for _, d := range digests {
+			if err := putDigest(tx, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.sendDue()
+	messages := sink.received()
+	if len(messages) != 1 {
+		t.Fatalf("%d digests sent, want 1", len(messages))
+	}
+	msg := messages[0]
+	if msg.from != cfg.SMTPFrom || len(msg.to) != 1 || msg.to[0] != "ann@example.com" {
+		t.Errorf("digest sent from %s to %v", msg.from, msg.to)
+	}
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := header.Get("To"); to != "ann@example.com" {
+		t.Errorf("digest addressed to %q", to)
+	}
+	if !strings.Contains(msg.data, "chapter 1") || !strings.Contains(msg.data, "chapter 2") || strings.Contains(msg.data, "chapter 3") {
+		t.Errorf("wrong items in digest:\n%s", msg.data)
+	}
+
+	d := readTestDigest(t, db, "due")
+	if want := due.Add(digestPeriods[digestDaily]); !d.NextSend.Equal(want) {
+		t.Errorf("next digest at %v, want %v", d.NextSend, want)
+	}
+	if d.Position != 2 || d.LastSent == nil {
+		t.Errorf("digest not advanced: position %d, last sent %v", d.Position, d.LastSent)
+	}
+	if logs := digestLogEntries(t, db, "due"); len(logs) != 1 || strings.Join(logs[0].Items, ",") != "book1,book2" {
+		t.Errorf("wrong digest log: %+v", logs)
+	}
+
+	// A digest is not sent again before its next send time.
+	s.sendDue()
+	if n := len(sink.received()); n != 1 {
+		t.Fatalf("%d digests sent after sending again, want 1", n)
+	}
+
+	// Missed sends are not caught up on, the schedule moves on to the next
+	// send time after now. Items start over after the last is sent.
+	missed := now.Add(-3 * 24 * time.Hour)
+	err = db.Update(func(tx *bbolt.Tx) error {
+		d.NextSend = missed
+		return putDigest(tx, d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sendDue()
+	messages = sink.received()
+	if len(messages) != 2 {
+		t.Fatalf("%d digests sent, want 2", len(messages))
+	}
+	if data := messages[1].data; !strings.Contains(data, "chapter 3") || !strings.Contains(data, "chapter 1") {
+		t.Errorf("wrong items in digest:\n%s", data)
+	}
+	d = readTestDigest(t, db, "due")
+	if want := missed.Add(4 * digestPeriods[digestDaily]); !d.NextSend.Equal(want) {
+		t.Errorf("next digest at %v, want %v", d.NextSend, want)
+	}
+	if d.Position != 1 {
+		t.Errorf("digest at position %d, want 1", d.Position)
+	}
+}
+
+func TestDigestSendFailure(t *testing.T) {
+	sink := newSMTPSink(t)
+	sink.reject = true
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	s := newDigestScheduler(db, &config{SMTPServer: sink.ln.Addr().String(), SMTPFrom: "remindme@example.com"})
+
+	due := time.Now().UTC().Add(-time.Minute)
+	err := db.Update(func(tx *bbolt.Tx) error {
+		item := &Item{Name: "book", Type: "text", Content: []byte("chapter")}
+		if _, err := putItem(tx, "books", item, itemCondition{}, systemActor); err != nil {
+			return err
+		}
+		return putDigest(tx, &digest{ID: "due", Email: "ann@example.com", Category: "books", Count: 1, Schedule: digestDaily, NextSend: due})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	s.sendDue()
+	if n := len(sink.received()); n != 0 {
+		t.Fatalf("%d digests delivered to a rejected recipient", n)
+	}
+	d := readTestDigest(t, db, "due")
+	if d.Position != 0 || d.LastSent != nil {
+		t.Errorf("failed digest advanced: position %d, last sent %v", d.Position, d.LastSent)
+	}
+	if earliest := before.Add(digestRetryDelay); d.NextSend.Before(earliest) || d.NextSend.After(earliest.Add(time.Minute)) {
+		t.Errorf("failed digest retried at %v, want about %v", d.NextSend, earliest)
+	}
+	if logs := digestLogEntries(t, db, "due"); len(logs) != 1 || logs[0].Error == "" {
+		t.Errorf("failure not logged: %+v", logs)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+// composeDigestEmail builds a MIME message presenting the items. Text is
+// included inline, links as anchors, quotes with their attribution, images
+// as inline parts referenced from the html body and any other media as
+// attachments. Items of other types are included as text, the way they are
+// listed to clients that do not know their type. Notes follow the items they
+// are about.
+func composeDigestEmail(from, to, category string, items []*Item) ([]byte, error) {
+	listItemsAs(items, digestItemTypes)
+	var plain, htmlBody strings.Builder
+	type part struct {
+		item        *Item
+		contentType string
+		contentID   string
+		filename    string
+	}
+	var inline, attachments []*part
+
+	fmt.Fprintf(&htmlBody, "<html><body>\n<h2>%s</h2>\n", html.EscapeString(category))
+	fmt.Fprintf(&plain, "%s\n\n", category)
+	for i, item := range items {
+		fmt.Fprintf(&htmlBody, "<h3>%s</h3>\n", html.EscapeString(item.Name))
+		fmt.Fprintf(&plain, "%s\n", item.Name)
+
+		switch item.Type {
+		case "image", "video":
+			contentType := http.DetectContentType(item.Content)
+			p := &part{
+				item:        item,
+				contentType: contentType,
+				contentID:   fmt.Sprintf("item%d@remindme", i),
+				filename:    attachmentFilename(item.Name, contentType),
+			}
+			if item.Type == "image" {
+				inline = append(inline, p)
+				fmt.Fprintf(&htmlBody, "<p><img src=\"cid:%s\" alt=\"%s\" style=\"max-width:100%%\"></p>\n",
+					p.contentID, html.EscapeString(item.Name))
+				fmt.Fprintf(&plain, "[image: %s]\n\n", p.filename)
+			} else {
+				attachments = append(attachments, p)
+				fmt.Fprintf(&htmlBody, "<p><em>Attached: %s</em></p>\n", html.EscapeString(p.filename))
+				fmt.Fprintf(&plain, "[attached: %s]\n\n", p.filename)
+			}
+
+		case "link":
+			link := strings.TrimSpace(string(item.Content))
+			fmt.Fprintf(&htmlBody, "<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(link), html.EscapeString(link))
+			fmt.Fprintf(&plain, "%s\n\n", link)
+
+		case client.TypeQuote:
+			text := html.EscapeString(string(item.Content))
+			fmt.Fprintf(&htmlBody, "<blockquote>%s</blockquote>\n", strings.ReplaceAll(text, "\n", "<br>\n"))
+			fmt.Fprintf(&plain, "\"%s\"\n", item.Content)
+			if attribution := quoteAttribution(item.Metadata); attribution != "" {
+				htmlAttribution := html.EscapeString(attribution)
+				if link := item.Metadata[client.MetaURL]; link != "" {
+					htmlAttribution = fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(link), htmlAttribution)
+				}
+				fmt.Fprintf(&htmlBody, "<p>&mdash; %s</p>\n", htmlAttribution)
+				fmt.Fprintf(&plain, "- %s\n", attribution)
+			}
+			plain.WriteString("\n")
+
+		default:
+			text := html.EscapeString(string(item.Content))
+			fmt.Fprintf(&htmlBody, "<p>%s</p>\n", strings.ReplaceAll(text, "\n", "<br>\n"))
+			fmt.Fprintf(&plain, "%s\n\n", item.Content)
+		}
+		if note := item.Metadata[client.MetaNote]; note != "" {
+			fmt.Fprintf(&htmlBody, "<p><em>%s</em></p>\n", html.EscapeString(note))
+			fmt.Fprintf(&plain, "Note: %s\n\n", note)
+		}
+	}
+	htmlBody.WriteString("</body></html>\n")
+
+	buf := new(bytes.Buffer)
+	mixed := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", to)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "RemindMe digest: "+category))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mixed.Boundary())
+
+	// The message body and its inline images are grouped in a
+	// multipart/related part, within which the plain text and html versions
+	// are alternatives.
+	relatedBuf := new(bytes.Buffer)
+	related := multipart.NewWriter(relatedBuf)
+	alternativeBuf := new(bytes.Buffer)
+	alternative := multipart.NewWriter(alternativeBuf)
+	if err := writeTextPart(alternative, "text/plain", plain.String()); err != nil {
+		return nil, err
+	}
+	if err := writeTextPart(alternative, "text/html", htmlBody.String()); err != nil {
+		return nil, err
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+	if err := writeRawPart(related, textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	}, alternativeBuf.Bytes()); err != nil {
+		return nil, err
+	}
+	for _, p := range inline {
+		if err := writeBinaryPart(related, p.contentType, "inline", p.filename, p.contentID, p.item.Content); err != nil {
+			return nil, err
+		}
+	}
+	if err := related.Close(); err != nil {
+		return nil, err
+	}
+	if err := writeRawPart(mixed, textproto.MIMEHeader{
+		"Content-Type": {"multipart/related; type=\"multipart/alternative\"; boundary=" + related.Boundary()},
+	}, relatedBuf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, p := range attachments {
+		if err := writeBinaryPart(mixed, p.contentType, "attachment", p.filename, "", p.item.Content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeRawPart(w *multipart.Writer, header textproto.MIMEHeader, body []byte) error {
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = pw.Write(body)
+	return err
+}
+
+func writeTextPart(w *multipart.Writer, contentType, text string) error {
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(pw)
+	if _, err = qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func writeBinaryPart(w *multipart.Writer, contentType, disposition, filename, contentID string, content []byte) error {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType(disposition, map[string]string{"filename": filename})},
+	}
+	if contentID != "" {
+		header.Set("Content-ID", "<"+contentID+">")
+	}
+	pw, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	// Base64 bodies must be wrapped at 76 characters per line.
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		if _, err = fmt.Fprintf(pw, "%s\r\n", encoded[:76]); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(pw, "%s\r\n", encoded)
+	return err
+}
+
+// digestItemTypes are the item types that digest emails present as such.
+var digestItemTypes = map[string]bool{
+	client.TypeText:  true,
+	client.TypeLink:  true,
+	client.TypeImage: true,
+	client.TypeVideo: true,
+	client.TypeQuote: true,
+}
+
+// quoteAttribution names the author and source of a quote, as far as its
+// metadata gives them.
+func quoteAttribution(metadata map[string]string) string {
+	var parts []string
+	for _, field := range []string{client.MetaAuthor, client.MetaSource} {
+		if v := metadata[field]; v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// attachmentFilename derives a file name for an item's content from the
+// item name, adding an extension for the content type if it has none.
+func attachmentFilename(itemName, contentType string) string {
+	if strings.Contains(itemName, ".") {
+		return itemName
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return itemName + exts[0]
+	}
+	return itemName
+}
+
+// sendEmail sends the message through the configured SMTP server.
+func sendEmail(cfg *config, to string, msg []byte) error {
+	var auth smtp.Auth
+	if cfg.SMTPUser != "" {
+		host, _, err := net.SplitHostPort(cfg.SMTPServer)
+		if err != nil {
+			return fmt.Errorf("invalid smtp server address %q: %w", cfg.SMTPServer, err)
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(cfg.SMTPServer, auth, cfg.SMTPFrom, []string{to}, msg)
+}
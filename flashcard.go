@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+// maxDistractors is the most wrong answers a flashcard may have.
+const maxDistractors = 8
+
+// checkFlashcard checks that a flashcard has a front and a back of the side
+// types and that its distractors are different wrong answers. The content
+// is stored indented, so that revisions can be compared line by line.
+func checkFlashcard(item *Item) error {
+	dec := json.NewDecoder(bytes.NewReader(item.Content))
+	dec.DisallowUnknownFields()
+	card := new(client.Flashcard)
+	if err := dec.Decode(card); err != nil {
+		return fmt.Errorf("invalid flashcard: %v", err)
+	}
+	if err := checkFlashcardSide("front", card.Front); err != nil {
+		return err
+	}
+	if err := checkFlashcardSide("back", card.Back); err != nil {
+		return err
+	}
+	if len(card.Distractors) > 0 && card.Back.Type != client.TypeText {
+		return errors.New("flashcard distractors need a text back")
+	}
+	if len(card.Distractors) > maxDistractors {
+		return fmt.Errorf("flashcard has more than %d distractors", maxDistractors)
+	}
+	choices := map[string]bool{card.Back.Text: true}
+	for i, distractor := range card.Distractors {
+		distractor = strings.TrimSpace(distractor)
+		switch {
+		case distractor == "":
+			return errors.New("flashcard distractors must have text")
+		case !utf8.ValidString(distractor):
+			return errors.New("flashcard distractors must be UTF-8 text")
+		case choices[distractor]:
+			return fmt.Errorf("flashcard distractor %q is the answer or another distractor", distractor)
+		}
+		choices[distractor] = true
+		card.Distractors[i] = distractor
+	}
+	content, err := json.MarshalIndent(card, "", "  ")
+	if err != nil {
+		return err
+	}
+	item.Content = content
+	return nil
+}
+
+// checkFlashcardSide checks a side of a flashcard, trimming the space around
+// its text.
+func checkFlashcardSide(name string, side *client.FlashcardSide) error {
+	if side == nil {
+		return fmt.Errorf("flashcard must have a %s", name)
+	}
+	side.Text = strings.TrimSpace(side.Text)
+	if !utf8.ValidString(side.Text) {
+		return fmt.Errorf("flashcard %s must be UTF-8 text", name)
+	}
+	switch side.Type {
+	case client.TypeText:
+		if side.Text == "" {
+			return fmt.Errorf("flashcard %s must have text", name)
+		}
+	case client.TypeMarkdown:
+		if side.Text == "" {
+			return fmt.Errorf("flashcard %s must have text", name)
+		}
+		return checkMarkdownLinks([]byte(side.Text))
+	case client.TypeImage:
+		if side.Text == "" {
+			return fmt.Errorf("flashcard %s must name an image item", name)
+		}
+	default:
+		return fmt.Errorf("flashcard %s must be text, markdown or image", name)
+	}
+	return nil
+}
+
+// flashcardFallback lists a flashcard as a text item with its question and
+// answer.
+func flashcardFallback(item *Item) {
+	item.Type = client.TypeText
+	item.Content = []byte(flashcardPlainText(item.Content))
+}
+
+// flashcardPlainText renders a flashcard as its question and answer in
+// plain text. Images are shown by the name of their item.
+func flashcardPlainText(content []byte) string {
+	card := new(client.Flashcard)
+	if err := json.Unmarshal(content, card); err != nil || card.Front == nil || card.Back == nil {
+		return string(content)
+	}
+	return fmt.Sprintf("Q: %s\n\nA: %s", flashcardSideText(card.Front), flashcardSideText(card.Back))
+}
+
+func flashcardSideText(side *client.FlashcardSide) string {
+	switch side.Type {
+	case client.TypeMarkdown:
+		return markdownPlainText([]byte(side.Text))
+	case client.TypeImage:
+		return "[" + side.Text + "]"
+	default:
+		return side.Text
+	}
+}
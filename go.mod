@@ -1,9 +1,13 @@
 module github.com/itswisdomagain/remindme
 
-go 1.15
+go 1.16
 
 require (
 	github.com/decred/dcrd/dcrutil/v3 v3.0.0
 	github.com/go-chi/chi v1.5.1
+	github.com/klauspost/compress v1.14.4
+	github.com/yuin/goldmark v1.4.4
 	go.etcd.io/bbolt v1.3.5
+	golang.org/x/image v0.0.0-20200430140353-33d19683fad8
+	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
 )
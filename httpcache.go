@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// libraryETag is the entity tag of responses listing the library, which
+// changes with every library revision. It is weak as responses may be
+// compressed.
+func libraryETag(tx *bbolt.Tx) string {
+	var id []byte
+	if meta := tx.Bucket(metaBkt); meta != nil {
+		id = meta.Get(libraryIDKey)
+	}
+	return fmt.Sprintf(`W/"%s-%d"`, id, libraryRevision(tx))
+}
+
+// libraryModified returns when the library last changed, or the zero time if
+// it never did.
+func libraryModified(tx *bbolt.Tx) time.Time {
+	changes := tx.Bucket(changesBkt)
+	if changes == nil {
+		return time.Time{}
+	}
+	_, v := changes.Cursor().Last()
+	change := new(libraryChange)
+	if v == nil || json.Unmarshal(v, change) != nil {
+		return time.Time{}
+	}
+	return change.Time
+}
+
+// libraryNotModified sets the ETag and Last-Modified headers of a GET or
+// HEAD request listing the library. If the request's If-None-Match or
+// If-Modified-Since header shows that the client has the current listing, it
+// writes a 304 response and returns true. It must be called from the
+// transaction that reads the listing.
+func libraryNotModified(w http.ResponseWriter, r *http.Request, tx *bbolt.Tx) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	etag, modified := libraryETag(tx), libraryModified(tx)
+	w.Header().Set("ETag", etag)
+	// Clients may cache listings but must check that they are current.
+	w.Header().Set("Cache-Control", "no-cache")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	// If-Modified-Since is ignored if If-None-Match is given.
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !etagListMatches(ifNoneMatch, etag) {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagListMatches reports whether a list of entity tags from an If-None-Match
+// header includes etag, using the weak comparison.
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
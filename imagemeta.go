@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// Uploaded images are stripped of metadata before they are stored, as it
+// would otherwise be sent to every client: EXIF data with the location and
+// camera a photo was taken with, XMP and IPTC data, comments and data
+// appended to the image. Color profiles are kept. JPEG photos are turned
+// upright as their EXIF orientation says, since the orientation is lost with
+// the EXIF data. Only JPEG, PNG, WebP and GIF images can be stripped, so
+// images of other formats, such as HEIC and TIFF, are rejected, as are SVG
+// images, which browsers would run the scripts of. Categories can keep the
+// originals, which only admins can download.
+
+var (
+	// errInvalidImage is returned when an image that has to be stripped of
+	// metadata cannot be parsed.
+	errInvalidImage = errors.New("invalid image")
+	// errUnsupportedImage is returned for images of formats that cannot be
+	// stripped of metadata.
+	errUnsupportedImage = errors.New("unsupported image format, images must be JPEG, PNG, WebP or GIF")
+)
+
+// stripJPEGQuality is the quality of JPEG images that are encoded again to
+// turn them upright.
+const stripJPEGQuality = 90
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	gifSignature = []byte("GIF8")
+	iccProfileID = []byte("ICC_PROFILE\x00")
+	exifID       = []byte("Exif\x00\x00")
+)
+
+// stripImageMetadata returns an image without its metadata. The content is
+// returned as is if it has no metadata. Images that are not JPEG, PNG, WebP
+// or GIF are rejected with errUnsupportedImage.
+func stripImageMetadata(content []byte) ([]byte, error) {
+	var stripped []byte
+	var err error
+	switch {
+	case bytes.HasPrefix(content, []byte{0xff, 0xd8}):
+		stripped, err = stripJPEG(content)
+	case bytes.HasPrefix(content, pngSignature):
+		stripped, err = stripPNG(content)
+	case len(content) >= 12 && string(content[:4]) == "RIFF" && string(content[8:12]) == "WEBP":
+		stripped, err = stripWebP(content)
+	case bytes.HasPrefix(content, gifSignature):
+		stripped, err = stripGIF(content)
+	default:
+		return nil, errUnsupportedImage
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImage, err)
+	}
+	return stripped, nil
+}
+
+// stripJPEG keeps the segments of a JPEG image that describe how to decode
+// it and its ICC profile, and drops the rest.
+func stripJPEG(content []byte) ([]byte, error) {
+	out := make([]byte, 0, len(content))
+	out = append(out, 0xff, 0xd8)
+	var kept [][]byte // color profile segments
+	orientation := 1
+	i := 2
+	for {
+		// Markers may be preceded by fill bytes.
+		for i+1 < len(content) && content[i] == 0xff && content[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(content) || content[i] != 0xff {
+			return nil, errors.New("missing JPEG marker")
+		}
+		marker := content[i+1]
+		if marker == 0xd9 { // end of image, anything after it is dropped
+			out = append(out, 0xff, 0xd9)
+			break
+		}
+		if marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			out = append(out, 0xff, marker)
+			i += 2
+			continue
+		}
+		if i+4 > len(content) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(content[i+2:]))
+		if end > len(content) || end < i+4 {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		segment, data := content[i:end], content[i+4:end]
+		i = end
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, exifID):
+			orientation = exifOrientation(data[len(exifID):])
+			continue
+		case marker == 0xe2 && bytes.HasPrefix(data, iccProfileID):
+			kept = append(kept, segment)
+		case marker >= 0xe0 && marker <= 0xef && marker != 0xe0 && marker != 0xee, marker == 0xfe:
+			// Application data other than the JFIF and Adobe headers, which
+			// affect decoding, and comments.
+			continue
+		}
+		out = append(out, segment...)
+		if marker != 0xda {
+			continue
+		}
+		// The scan's entropy coded data runs to the next marker that is
+		// not a stuffed byte or restart marker.
+		start := i
+		for i+1 < len(content) && !(content[i] == 0xff && content[i+1] != 0 && (content[i+1] < 0xd0 || content[i+1] > 0xd7)) {
+			i++
+		}
+		if i+1 >= len(content) {
+			return nil, errors.New("truncated JPEG scan")
+		}
+		out = append(out, content[start:i]...)
+	}
+	if orientation == 1 {
+		return out, nil
+	}
+	return orientJPEG(out, orientation, kept)
+}
+
+// exifOrientation reads the orientation tag of EXIF data, returning 1, the
+// upright orientation, if there is none.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		// The orientation is a short, stored in the entry.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// orientJPEG turns a JPEG image upright from an EXIF orientation, encoding
+// it again with its color profile segments.
+func orientJPEG(content []byte, orientation int, profile [][]byte) ([]byte, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxVariantPixels {
+		return nil, fmt.Errorf("image is larger than %d pixels", maxVariantPixels)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if _, cmyk := img.(*image.CMYK); cmyk {
+		// The image is converted to RGB, which its profile does not
+		// describe.
+		profile = nil
+	}
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: stripJPEGQuality}); err != nil {
+		return nil, err
+	}
+	encoded := buf.Bytes()
+	out := append([]byte(nil), encoded[:2]...)
+	for _, segment := range profile {
+		out = append(out, segment...)
+	}
+	return append(out, encoded[2:]...), nil
+}
+
+// orientImage flips and rotates an image from an EXIF orientation, 2 to 8,
+// to its upright orientation, 1.
+func orientImage(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	dstSize := image.Pt(w, h)
+	if orientation >= 5 {
+		dstSize = image.Pt(h, w)
+	}
+	dst := image.NewRGBA(image.Rectangle{Max: dstSize})
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
+
+// stripPNG drops the text, time, EXIF and private ancillary chunks of a PNG
+// image, and anything after its end.
+func stripPNG(content []byte) ([]byte, error) {
+	out := make([]byte, 0, len(content))
+	out = append(out, pngSignature...)
+	i := len(pngSignature)
+	for {
+		if i+12 > len(content) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(content[i:]))
+		end := i + 12 + length
+		if end > len(content) || end < i {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunkType := string(content[i+4 : i+8])
+		chunk := content[i:end]
+		i = end
+		switch chunkType {
+		case "tEXt", "zTXt", "iTXt", "tIME", "eXIf":
+			continue
+		}
+		// Ancillary chunks with a lowercase first letter are optional and
+		// private chunks with a lowercase second letter are not defined by
+		// the standard.
+		if isLower(chunkType[0]) && isLower(chunkType[1]) {
+			continue
+		}
+		out = append(out, chunk...)
+		if chunkType == "IEND" {
+			return out, nil
+		}
+	}
+}
+
+func isLower(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+// stripWebP drops the EXIF and XMP chunks of a WebP image, and anything
+// after it.
+func stripWebP(content []byte) ([]byte, error) {
+	size := int(binary.LittleEndian.Uint32(content[4:])) + 8
+	if size > len(content) || size < 12 {
+		return nil, errors.New("truncated WebP image")
+	}
+	out := make([]byte, 12, size)
+	copy(out, content[:12])
+	for i := 12; i < size; {
+		if i+8 > size {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		length := int(binary.LittleEndian.Uint32(content[i+4:]))
+		end := i + 8 + length + length%2
+		if end > size || end < i {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		fourCC := string(content[i : i+4])
+		chunk := content[i:end]
+		i = end
+		switch fourCC {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			// Clear the flags saying there is EXIF and XMP data.
+			if length < 1 {
+				return nil, errors.New("invalid WebP header")
+			}
+			chunk = append([]byte(nil), chunk...)
+			chunk[8] &^= 0x08 | 0x04
+		}
+		out = append(out, chunk...)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// stripGIF drops the comment and application extensions of a GIF image,
+// except those that make animations loop, and anything after its end.
+func stripGIF(content []byte) ([]byte, error) {
+	errTruncated := errors.New("truncated GIF block")
+	i := 13 // header and logical screen descriptor
+	if i > len(content) {
+		return nil, errTruncated
+	}
+	if flags := content[10]; flags&0x80 != 0 { // global color table
+		i += 3 << (flags&0x07 + 1)
+	}
+	if i > len(content) {
+		return nil, errTruncated
+	}
+	out := make([]byte, 0, len(content))
+	out = append(out, content[:i]...)
+	for {
+		if i >= len(content) {
+			return nil, errTruncated
+		}
+		start, keep := i, true
+		switch content[i] {
+		case 0x3b: // trailer, anything after it is dropped
+			return append(out, 0x3b), nil
+		case 0x21: // extension
+			if i+2 > len(content) {
+				return nil, errTruncated
+			}
+			label := content[i+1]
+			i += 2
+			switch label {
+			case 0xfe: // comment
+				keep = false
+			case 0xff: // application, which XMP data is stored in
+				keep = isLoopExtension(content[i:])
+			}
+		case 0x2c: // image descriptor
+			if i+10 > len(content) {
+				return nil, errTruncated
+			}
+			flags := content[i+9]
+			i += 10
+			if flags&0x80 != 0 { // local color table
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++ // LZW minimum code size
+		default:
+			return nil, fmt.Errorf("invalid GIF block %#x", content[i])
+		}
+		// Extensions and image data end with an empty sub-block.
+		for {
+			if i >= len(content) {
+				return nil, errTruncated
+			}
+			n := int(content[i])
+			i += 1 + n
+			if n == 0 {
+				break
+			}
+		}
+		if keep {
+			out = append(out, content[start:i]...)
+		}
+	}
+}
+
+// isLoopExtension reports whether the data of a GIF application extension
+// is the one that sets how many times an animation loops.
+func isLoopExtension(data []byte) bool {
+	if len(data) < 12 || data[0] != 11 {
+		return false
+	}
+	switch string(data[1:12]) {
+	case "NETSCAPE2.0", "ANIMEXTS1.0":
+		return true
+	}
+	return false
+}
+
+// stripUpload strips an uploaded image item of metadata. It returns the
+// image as uploaded if it was changed, nil otherwise.
+func stripUpload(item *Item) ([]byte, error) {
+	if item.Type != client.TypeImage {
+		return nil, nil
+	}
+	stripped, err := stripImageMetadata(item.Content)
+	if err != nil || bytes.Equal(stripped, item.Content) {
+		return nil, err
+	}
+	original := item.Content
+	item.Content = stripped
+	return original, nil
+}
+
+// keepOriginal keeps the original of an image item version that was
+// stripped of metadata, if its category keeps originals. It is referenced
+// by the version's revision record, so that it is deleted with it.
+func keepOriginal(tx *bbolt.Tx, category string, item *Item, original []byte) error {
+	if original == nil {
+		return nil
+	}
+	settings, err := getCategorySettings(tx, category)
+	if err != nil || !settings.KeepOriginals {
+		return err
+	}
+	itemRevisions, err := itemRevisionsBucket(tx, category, item.Name, false)
+	if err != nil || itemRevisions == nil {
+		return err
+	}
+	key := uint64Bytes(item.Version)
+	v := itemRevisions.Get(key)
+	if v == nil {
+		return nil
+	}
+	record := new(revisionRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return fmt.Errorf("failed to decode revision record: %w", err)
+	}
+	if record.Original, err = putBlob(tx, original); err != nil {
+		return err
+	}
+	if v, err = json.Marshal(record); err != nil {
+		return err
+	}
+	return itemRevisions.Put(key, v)
+}
+
+// itemOriginal serves an image item as it was uploaded, before it was
+// stripped of metadata, to admins. Items whose original was not kept are
+// served as stored.
+func (api *apiServer) itemOriginal(w http.ResponseWriter, r *http.Request) {
+	if !api.admins[requestUser(r)] {
+		writeError(w, "only admins can download originals", http.StatusForbidden)
+		return
+	}
+	category, itemName := urlParam(r, "category"), urlParam(r, "item")
+	var item *Item
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		itemBkt := itemBucket(tx, category, itemName)
+		if itemBkt == nil {
+			return nil
+		}
+		item = &Item{
+			Name:    itemName,
+			Type:    string(itemBkt.Get(itemTypeKey)),
+			Version: itemVersion(itemBkt),
+		}
+		content := itemBkt.Get(itemContentKey)
+		record, _, err := findRevision(tx, category, itemName, item.Version)
+		if err != nil && !errors.Is(err, errRevisionNotFound) {
+			return err
+		}
+		if record != nil && record.Original != "" {
+			if original := getBlob(tx, record.Original); original != nil {
+				content = original
+			}
+		}
+		item.Content = append([]byte(nil), content...)
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching item from db: %v", err)
+		writeError(w, "error fetching item", http.StatusInternalServerError)
+		return
+	}
+	if item == nil {
+		writeError(w, "item not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", itemContentType(item))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The original may hold private metadata.
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Set("ETag", variantETag(item.Version, "original"))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(item.Content))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+func TestStripGIF(t *testing.T) {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+		},
+		Delay: []int{10, 10},
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+	loopAt := bytes.Index(clean, []byte("\x21\xff\x0bNETSCAPE2.0"))
+	if loopAt < 0 {
+		t.Fatal("encoded GIF has no loop extension")
+	}
+
+	comment := []byte("\x21\xfe\x0cGPS 52N 13E!\x00")
+	xmp := append([]byte("\x21\xff\x0bXMP DataXMP\x05<xmp>"), 0)
+	var tagged []byte
+	tagged = append(tagged, clean[:loopAt]...)
+	tagged = append(tagged, comment...)
+	tagged = append(tagged, clean[loopAt:len(clean)-1]...)
+	tagged = append(tagged, xmp...)
+	tagged = append(tagged, 0x3b)
+	tagged = append(tagged, "appended"...)
+
+	stripped, err := stripImageMetadata(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, clean) {
+		t.Errorf("GIF not stripped of metadata:\n got %q\nwant %q", stripped, clean)
+	}
+	if _, err = stripImageMetadata(tagged[:len(tagged)-20]); !errors.Is(err, errInvalidImage) {
+		t.Errorf("truncated GIF: got error %v", err)
+	}
+}
+
+func TestStripImageMetadataUnsupported(t *testing.T) {
+	for name, content := range map[string]string{
+		"svg":  `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"tiff": "II*\x00\x08\x00\x00\x00",
+		"heic": "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic",
+	} {
+		if _, err := stripImageMetadata([]byte(content)); !errors.Is(err, errUnsupportedImage) {
+			t.Errorf("%s image: got error %v", name, err)
+		}
+	}
+}
+
+func TestItemContentType(t *testing.T) {
+	svg := &Item{Type: client.TypeImage, Content: []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`)}
+	if got := itemContentType(svg); got != "application/octet-stream" {
+		t.Errorf("SVG image served as %s", got)
+	}
+	png := &Item{Type: client.TypeImage, Content: append(append([]byte(nil), pngSignature...), make([]byte, 16)...)}
+	if got := itemContentType(png); got != "image/png" {
+		t.Errorf("PNG image served as %s", got)
+	}
+}
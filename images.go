@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // to make variants of GIF images
+	"image/jpeg"
+	"image/png"
+	"strconv"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // to make variants of WebP images
+)
+
+// Image variants are smaller copies of image items, for listings and for
+// display. They are made by a background generator that goes through the
+// library after images are uploaded, and for images stored before. Until the
+// generator has got to an image, requests for its variants get the image
+// itself, so images are never decoded while serving requests. Variant content
+// is kept in the blob store and recorded for the item version it was made of.
+
+// imageVariantsBkt holds a bucket for each category with the variant record
+// of each image item, keyed by item name.
+var imageVariantsBkt = []byte("image_variants")
+
+// imageVariantSizes are the sizes that the variants of an image fit in.
+var imageVariantSizes = map[string]image.Point{
+	client.VariantThumb:   {X: 256, Y: 256},
+	client.VariantDisplay: {X: 1200, Y: 800},
+}
+
+const (
+	// maxVariantPixels is the size of the largest image variants are made
+	// of, so that decoding an image cannot exhaust memory.
+	maxVariantPixels   = 50_000_000
+	variantJPEGQuality = 85
+	// variantBatch is how many images the generator looks for at a time.
+	variantBatch = 20
+)
+
+// variantRecord records the variants made of a version of an image item.
+// Variants missing from it would not be smaller than the image, or the
+// image could not be decoded, and the image itself is used instead.
+type variantRecord struct {
+	Version uint64 `json:"version"`
+	// Variants are the blob hashes of the variants, by variant name.
+	Variants map[string]string `json:"variants,omitempty"`
+}
+
+func validVariant(variant string) bool {
+	_, ok := imageVariantSizes[variant]
+	return ok
+}
+
+// variantETag is the entity tag of a variant of an item version's content.
+func variantETag(version uint64, variant string) string {
+	return `"` + strconv.FormatUint(version, 10) + "-" + variant + `"`
+}
+
+// getVariantRecord returns the variant record of an item, or nil if there
+// is none.
+func getVariantRecord(tx *bbolt.Tx, category, itemName string) (*variantRecord, error) {
+	variants := tx.Bucket(imageVariantsBkt)
+	if variants == nil {
+		return nil, nil
+	}
+	catVariants := variants.Bucket([]byte(category))
+	if catVariants == nil {
+		return nil, nil
+	}
+	v := catVariants.Get([]byte(itemName))
+	if v == nil {
+		return nil, nil
+	}
+	record := new(variantRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return nil, fmt.Errorf("failed to decode variant record: %w", err)
+	}
+	return record, nil
+}
+
+// releaseVariants releases the blobs of a variant record.
+func releaseVariants(tx *bbolt.Tx, v []byte) error {
+	record := new(variantRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return fmt.Errorf("failed to decode variant record: %w", err)
+	}
+	for _, hash := range record.Variants {
+		if err := releaseBlob(tx, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropImageVariants deletes the variants of an item, or of all items of a
+// category if itemName is empty.
+func dropImageVariants(tx *bbolt.Tx, category, itemName string) error {
+	variants := tx.Bucket(imageVariantsBkt)
+	if variants == nil {
+		return nil
+	}
+	catVariants := variants.Bucket([]byte(category))
+	if catVariants == nil {
+		return nil
+	}
+	if itemName != "" {
+		v := catVariants.Get([]byte(itemName))
+		if v == nil {
+			return nil
+		}
+		if err := releaseVariants(tx, v); err != nil {
+			return err
+		}
+		return catVariants.Delete([]byte(itemName))
+	}
+	err := catVariants.ForEach(func(_, v []byte) error {
+		return releaseVariants(tx, v)
+	})
+	if err != nil {
+		return err
+	}
+	return variants.DeleteBucket([]byte(category))
+}
+
+// putImageVariants stores the variants made of an item version, replacing
+// the variants of earlier versions. If there are variants, the library
+// revision is advanced so that clients that were sent the image in their
+// place download the item again. Nothing is stored if the item is no longer
+// at that version.
+func putImageVariants(tx *bbolt.Tx, category string, item *Item, variants map[string][]byte) error {
+	itemBkt := itemBucket(tx, category, item.Name)
+	if itemBkt == nil || itemVersion(itemBkt) != item.Version {
+		return nil
+	}
+	if err := dropImageVariants(tx, category, item.Name); err != nil {
+		return err
+	}
+	record := &variantRecord{Version: item.Version, Variants: make(map[string]string, len(variants))}
+	for name, content := range variants {
+		hash, err := putBlob(tx, content)
+		if err != nil {
+			return err
+		}
+		record.Variants[name] = hash
+	}
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	allVariants, err := tx.CreateBucketIfNotExists(imageVariantsBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open db record for image variants: %w", err)
+	}
+	catVariants, err := allVariants.CreateBucketIfNotExists([]byte(category))
+	if err != nil {
+		return err
+	}
+	if err = catVariants.Put([]byte(item.Name), v); err != nil || len(variants) == 0 {
+		return err
+	}
+	return recordChange(tx, client.OpItemUpdated, category, item.Name)
+}
+
+// makeImageVariants makes the variants of an image item and stores them.
+// If the image cannot be decoded, it is recorded as having no variants.
+func makeImageVariants(db *bbolt.DB, category string, item *Item) error {
+	variants, err := resizeImage(item.Content)
+	if err != nil {
+		imagesLog.Warnf("Cannot make variants of %s/%s: %v", category, item.Name, err)
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		return putImageVariants(tx, category, item, variants)
+	})
+}
+
+// resizeImage makes the variants of an image that are smaller than it. JPEG
+// images are resized to JPEG variants, others to PNG variants. Animated GIFs
+// are only made into thumbnails, which show their first frame.
+func resizeImage(content []byte) (map[string][]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxVariantPixels {
+		return nil, fmt.Errorf("image is larger than %d pixels", maxVariantPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	variants := make(map[string][]byte)
+	for name, fit := range imageVariantSizes {
+		if format == "gif" && name != client.VariantThumb {
+			continue
+		}
+		size := fitImage(img.Bounds().Size(), fit)
+		if size == img.Bounds().Size() {
+			continue
+		}
+		resized, err := scaleImage(img, format, size)
+		if err != nil {
+			return nil, err
+		}
+		// Resizing can make a bigger file of a well compressed image.
+		if len(resized) < len(content) {
+			variants[name] = resized
+		}
+	}
+	return variants, nil
+}
+
+// scaleImage scales an image to size and encodes it, as JPEG if it was
+// decoded from the jpeg format and as PNG otherwise.
+func scaleImage(img image.Image, format string, size image.Point) ([]byte, error) {
+	resized := image.NewRGBA(image.Rectangle{Max: size})
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, resized, &jpeg.Options{Quality: variantJPEGQuality})
+	} else {
+		err = png.Encode(&buf, resized)
+	}
+	return buf.Bytes(), err
+}
+
+// fitImage scales down an image size to fit in a bounding size, keeping its
+// aspect ratio. Sizes that fit already are kept.
+func fitImage(size, bounds image.Point) image.Point {
+	if size.X <= bounds.X && size.Y <= bounds.Y {
+		return size
+	}
+	scale := float64(bounds.X) / float64(size.X)
+	if yScale := float64(bounds.Y) / float64(size.Y); yScale < scale {
+		scale = yScale
+	}
+	fitted := image.Pt(int(float64(size.X)*scale+0.5), int(float64(size.Y)*scale+0.5))
+	if fitted.X < 1 {
+		fitted.X = 1
+	}
+	if fitted.Y < 1 {
+		fitted.Y = 1
+	}
+	return fitted
+}
+
+// variantContent returns the content of a variant of an item. It returns nil
+// if the item's own content is used for the variant, as it is not an image,
+// is not larger than the variant, or the generator has not made its variants
+// yet.
+func (api *apiServer) variantContent(category string, item *Item, variant string) ([]byte, error) {
+	if item.Type != client.TypeImage {
+		return nil, nil
+	}
+	var content []byte
+	var made bool
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		record, err := getVariantRecord(tx, category, item.Name)
+		if err != nil || record == nil || record.Version != item.Version {
+			return err
+		}
+		made = true
+		if hash := record.Variants[variant]; hash != "" {
+			content = append([]byte(nil), getBlob(tx, hash)...)
+		}
+		return nil
+	})
+	if err == nil && !made {
+		api.variants.wake()
+	}
+	return content, err
+}
+
+// useVariants replaces the content of the image items of categories with a
+// variant, where the variant is smaller.
+func (api *apiServer) useVariants(categories []*Category, variant string) error {
+	for _, category := range categories {
+		for _, item := range category.Items {
+			content, err := api.variantContent(category.Name, item, variant)
+			if err != nil {
+				return err
+			}
+			if content != nil {
+				item.Content = content
+			}
+		}
+	}
+	return nil
+}
+
+// variantGenerator makes the variants of image items that have none for
+// their current version.
+type variantGenerator struct {
+	db     *bbolt.DB
+	wakeCh chan struct{}
+}
+
+func newVariantGenerator(db *bbolt.DB) *variantGenerator {
+	return &variantGenerator{
+		db:     db,
+		wakeCh: make(chan struct{}, 1),
+	}
+}
+
+// wake signals the generator to look for images without variants. It should
+// be called after images are stored.
+func (g *variantGenerator) wake() {
+	select {
+	case g.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run makes the missing variants of the library's images, then whenever it
+// is woken, until the context is canceled.
+func (g *variantGenerator) Run(ctx context.Context) {
+	for {
+		if err := g.makeMissing(ctx); err != nil {
+			imagesLog.Errorf("Error making image variants: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.wakeCh:
+		}
+	}
+}
+
+// makeMissing makes variants until every image has variants for its current
+// version.
+func (g *variantGenerator) makeMissing(ctx context.Context) error {
+	for ctx.Err() == nil {
+		pending, err := g.pendingImages()
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+		for _, p := range pending {
+			if ctx.Err() != nil {
+				return nil
+			}
+			item, err := readItem(g.db, p.category, p.name)
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				continue
+			}
+			if err = makeImageVariants(g.db, p.category, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type pendingImage struct {
+	category, name string
+}
+
+// pendingImages finds up to variantBatch image items without variants for
+// their current version.
+func (g *variantGenerator) pendingImages() ([]pendingImage, error) {
+	var pending []pendingImage
+	errBatchFull := errors.New("batch full")
+	err := g.db.View(func(tx *bbolt.Tx) error {
+		catsBucket := tx.Bucket(categoriesBkt)
+		if catsBucket == nil {
+			return nil
+		}
+		return catsBucket.ForEach(func(category, _ []byte) error {
+			catBucket := catsBucket.Bucket(category)
+			if catBucket == nil {
+				return nil
+			}
+			return catBucket.ForEach(func(itemName, v []byte) error {
+				itemBkt := catBucket.Bucket(itemName)
+				if v != nil || itemBkt == nil || string(itemBkt.Get(itemTypeKey)) != client.TypeImage {
+					return nil
+				}
+				record, err := getVariantRecord(tx, string(category), string(itemName))
+				if err != nil {
+					return err
+				}
+				if record != nil && record.Version == itemVersion(itemBkt) {
+					return nil
+				}
+				pending = append(pending, pendingImage{category: string(category), name: string(itemName)})
+				if len(pending) == variantBatch {
+					return errBatchFull
+				}
+				return nil
+			})
+		})
+	})
+	if errors.Is(err, errBatchFull) {
+		err = nil
+	}
+	return pending, err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+func TestVariantContent(t *testing.T) {
+	api := newTestAPI(t)
+	// Noise, so that the variants compress to less than the image.
+	img := image.NewGray(image.Rect(0, 0, 2000, 1000))
+	rand.Read(img.Pix)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	item := &Item{Name: "photo", Type: client.TypeImage, Content: buf.Bytes()}
+	var revision uint64
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		if _, err := putItem(tx, "photos", item, itemCondition{}, systemActor); err != nil {
+			return err
+		}
+		revision = libraryRevision(tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Until the generator has made the variants, the image itself is used
+	// and nothing is made while serving the request.
+	content, err := api.variantContent("photos", item, client.VariantDisplay)
+	if err != nil || content != nil {
+		t.Fatalf("variant of an image without variants: %d bytes, %v", len(content), err)
+	}
+	if len(api.variants.wakeCh) != 1 {
+		t.Error("generator not woken for an image without variants")
+	}
+	err = api.db.View(func(tx *bbolt.Tx) error {
+		record, err := getVariantRecord(tx, "photos", "photo")
+		if record != nil {
+			t.Error("variants made while serving a request")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = api.variants.makeMissing(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	content, err = api.variantContent("photos", item, client.VariantDisplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil || config.Width != 1200 || config.Height != 600 {
+		t.Errorf("wrong display variant: %dx%d, %v", config.Width, config.Height, err)
+	}
+	api.db.View(func(tx *bbolt.Tx) error {
+		if libraryRevision(tx) == revision {
+			t.Error("library revision not advanced when variants were made")
+		}
+		return nil
+	})
+}
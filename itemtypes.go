@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// itemMetadataKey holds the metadata of an item as a JSON object.
+var itemMetadataKey = []byte("metadata")
+
+// maxMetadataValue is the length of the longest metadata value, in
+// characters.
+const maxMetadataValue = 1000
+
+// itemType describes the items of a type that the server accepts.
+type itemType struct {
+	// text is true for types whose content is text, which can be searched
+	// and compared between revisions.
+	text bool
+	// metadata are the metadata fields that items of the type may have.
+	metadata map[string]bool
+	// check, if set, checks the content and metadata of an item of the
+	// type, and may normalize them.
+	check func(item *Item) error
+	// fallback, if set, changes an item of the type into one of the legacy
+	// types, for clients that do not know the type.
+	fallback func(item *Item)
+}
+
+func metadataFields(names ...string) map[string]bool {
+	fields := map[string]bool{client.MetaNote: true}
+	for _, name := range names {
+		fields[name] = true
+	}
+	return fields
+}
+
+// itemTypes are the item types known to the server. Items of other types
+// are accepted too, without metadata.
+var itemTypes = map[string]*itemType{
+	client.TypeText:  {text: true, metadata: metadataFields()},
+	client.TypeLink:  {text: true, metadata: metadataFields(), check: checkLink},
+	client.TypeImage: {metadata: metadataFields()},
+	client.TypeVideo: {metadata: metadataFields()},
+	client.TypeQuote: {
+		text:     true,
+		metadata: metadataFields(client.MetaAuthor, client.MetaSource, client.MetaURL),
+		check:    checkQuote,
+		fallback: quoteFallback,
+	},
+	client.TypeMarkdown: {
+		text:     true,
+		metadata: metadataFields(),
+		check:    checkMarkdown,
+		fallback: markdownFallback,
+	},
+	client.TypeFlashcard: {
+		text:     true,
+		metadata: metadataFields(),
+		check:    checkFlashcard,
+		fallback: flashcardFallback,
+	},
+	client.TypeChecklist: {
+		text:     true,
+		metadata: metadataFields(),
+		check:    checkChecklist,
+		fallback: checklistFallback,
+	},
+	client.TypePrompt: {
+		text:     true,
+		metadata: metadataFields(),
+		check:    checkPrompt,
+		fallback: promptFallback,
+	},
+}
+
+// legacyItemTypes are the item types of clients that do not say which types
+// they know.
+var legacyItemTypes = map[string]bool{
+	client.TypeText:  true,
+	client.TypeLink:  true,
+	client.TypeImage: true,
+	client.TypeVideo: true,
+}
+
+// isTextType reports whether items of a type hold text.
+func isTextType(typ string) bool {
+	t := itemTypes[typ]
+	return t != nil && t.text
+}
+
+// validateItem checks that an item being stored has the metadata fields of
+// its type. Items of other types are stored as they are uploaded, as they
+// always have been, but cannot have metadata. Metadata with empty values is
+// dropped.
+func validateItem(item *Item) error {
+	t := itemTypes[item.Type]
+	if t == nil {
+		t = &itemType{}
+	}
+	for field, value := range item.Metadata {
+		switch {
+		case value == "":
+			delete(item.Metadata, field)
+		case !t.metadata[field]:
+			return fmt.Errorf("%s items cannot have %s metadata", item.Type, field)
+		case !utf8.ValidString(value):
+			return fmt.Errorf("%s metadata must be UTF-8 text", field)
+		case utf8.RuneCountInString(value) > maxMetadataValue:
+			return fmt.Errorf("%s metadata is longer than %d characters", field, maxMetadataValue)
+		}
+	}
+	if len(item.Metadata) == 0 {
+		item.Metadata = nil
+	}
+	if link := item.Metadata[client.MetaURL]; link != "" && !validLink(link) {
+		return errors.New("url metadata must be an http or https URL")
+	}
+	if t.check != nil {
+		return t.check(item)
+	}
+	return nil
+}
+
+// checkQuote checks that a quote has text, trimming the space around it.
+func checkQuote(item *Item) error {
+	item.Content = bytes.TrimSpace(item.Content)
+	if len(item.Content) == 0 {
+		return errors.New("quote must have text")
+	}
+	if !utf8.Valid(item.Content) {
+		return errors.New("quote must be UTF-8 text")
+	}
+	return nil
+}
+
+// quoteFallback lists a quote as a text item with its attribution.
+func quoteFallback(item *Item) {
+	content := fmt.Sprintf("\"%s\"", item.Content)
+	if attribution := quoteAttribution(item.Metadata); attribution != "" {
+		content += "\n- " + attribution
+	}
+	item.Type, item.Content = client.TypeText, []byte(content)
+}
+
+// knownTypes reads the item types that a client knows from the comma
+// separated types query parameter. Clients that do not send it are assumed
+// to know only the legacy types.
+func knownTypes(r *http.Request) map[string]bool {
+	param := r.URL.Query().Get("types")
+	if param == "" {
+		return legacyItemTypes
+	}
+	types := make(map[string]bool)
+	for _, typ := range strings.Split(param, ",") {
+		types[strings.TrimSpace(typ)] = true
+	}
+	return types
+}
+
+// listItemsAs changes the items of types that a client does not know into
+// items of the legacy types, where their type has a fallback.
+func listItemsAs(items []*Item, types map[string]bool) {
+	for _, item := range items {
+		if types[item.Type] {
+			continue
+		}
+		if t := itemTypes[item.Type]; t != nil && t.fallback != nil {
+			t.fallback(item)
+		}
+	}
+}
+
+// putItemMetadata stores the metadata of an item in its bucket.
+func putItemMetadata(itemBkt *bbolt.Bucket, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		return itemBkt.Delete(itemMetadataKey)
+	}
+	v, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return itemBkt.Put(itemMetadataKey, v)
+}
+
+// itemMetadata reads the metadata of an item from its bucket. It returns nil
+// if the item has none.
+func itemMetadata(itemBkt *bbolt.Bucket) (map[string]string, error) {
+	v := itemBkt.Get(itemMetadataKey)
+	if v == nil {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(v, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode item metadata: %w", err)
+	}
+	return metadata, nil
+}
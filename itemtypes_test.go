@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/itswisdomagain/remindme/client"
+)
+
+func TestValidateItem(t *testing.T) {
+	tests := []struct {
+		item  *Item
+		valid bool
+	}{
+		{&Item{Type: client.TypeText, Metadata: map[string]string{client.MetaNote: "hi"}}, true},
+		{&Item{Type: client.TypeText, Metadata: map[string]string{client.MetaAuthor: "Ann"}}, false},
+		// Types the server does not know are stored as uploaded.
+		{&Item{Type: "audio", Content: []byte("ID3")}, true},
+		{&Item{Type: ""}, true},
+		{&Item{Type: "audio", Metadata: map[string]string{client.MetaNote: ""}}, true},
+		{&Item{Type: "audio", Metadata: map[string]string{client.MetaNote: "hi"}}, false},
+	}
+	for _, test := range tests {
+		if err := validateItem(test.item); (err == nil) != test.valid {
+			t.Errorf("%q item with metadata %v: got error %v", test.item.Type, test.item.Metadata, err)
+		}
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// Link previews are the title, description, site name and image of the
+// pages that link items point to, for clients to show links as cards. They
+// are fetched in the background after links are stored and recorded for the
+// item version they were fetched for. A page that cannot be fetched is
+// recorded with the error and not fetched again until the link changes.
+
+// linkPreviewsBkt holds a bucket for each category with the link preview
+// record of each link item, keyed by item name.
+var linkPreviewsBkt = []byte("link_previews")
+
+// Link preview modes, set with the -linkpreviews option.
+const (
+	// linkPreviewsPublic only fetches pages from public addresses, so that
+	// links cannot be used to probe the server's network.
+	linkPreviewsPublic = "public"
+	linkPreviewsAll    = "all"
+	linkPreviewsOff    = "off"
+)
+
+const (
+	// linkFetchTimeout limits each request for a page or its image.
+	linkFetchTimeout = 10 * time.Second
+	// maxLinkPageBytes is how much of a page is read. Preview metadata is
+	// at the start of pages, in their head.
+	maxLinkPageBytes = 1 << 20
+	// maxLinkImageBytes is the size of the largest preview image fetched.
+	maxLinkImageBytes = 5 << 20
+	maxLinkRedirects  = 5
+	// linkPreviewBatch is how many links the previewer looks for at a
+	// time.
+	linkPreviewBatch = 20
+
+	maxPreviewTitle       = 200
+	maxPreviewDescription = 500
+)
+
+// linkImageSize is the size that preview images are scaled down to fit in.
+var linkImageSize = image.Point{X: 480, Y: 320}
+
+// linkSchemes are the URL schemes allowed in link items.
+var linkSchemes = map[string]bool{"http": true, "https": true}
+
+// validLink reports whether s is an absolute URL with an allowed scheme.
+func validLink(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && linkSchemes[strings.ToLower(u.Scheme)] && u.Host != ""
+}
+
+// checkLink checks that a link item holds a valid URL, trimming the space
+// around it.
+func checkLink(item *Item) error {
+	item.Content = bytes.TrimSpace(item.Content)
+	if !validLink(string(item.Content)) {
+		return errors.New("link must be an http or https URL")
+	}
+	return nil
+}
+
+// linkPreviewRecord records the preview fetched for a version of a link
+// item.
+type linkPreviewRecord struct {
+	Version uint64 `json:"version"`
+	// URL is the link the preview was fetched for.
+	URL     string              `json:"url"`
+	Preview *client.LinkPreview `json:"preview,omitempty"`
+	// Image is the blob hash of the preview image.
+	Image string `json:"image,omitempty"`
+	// Error is why the preview could not be fetched.
+	Error string `json:"error,omitempty"`
+}
+
+// getLinkPreviewRecord returns the link preview record of an item, or nil if
+// there is none.
+func getLinkPreviewRecord(tx *bbolt.Tx, category, itemName string) (*linkPreviewRecord, error) {
+	previews := tx.Bucket(linkPreviewsBkt)
+	if previews == nil {
+		return nil, nil
+	}
+	catPreviews := previews.Bucket([]byte(category))
+	if catPreviews == nil {
+		return nil, nil
+	}
+	v := catPreviews.Get([]byte(itemName))
+	if v == nil {
+		return nil, nil
+	}
+	record := new(linkPreviewRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return nil, fmt.Errorf("failed to decode link preview record: %w", err)
+	}
+	return record, nil
+}
+
+// saveLinkPreviewRecord stores the link preview record of an item.
+func saveLinkPreviewRecord(tx *bbolt.Tx, category, itemName string, record *linkPreviewRecord) error {
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	previews, err := tx.CreateBucketIfNotExists(linkPreviewsBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open db record for link previews: %w", err)
+	}
+	catPreviews, err := previews.CreateBucketIfNotExists([]byte(category))
+	if err != nil {
+		return err
+	}
+	return catPreviews.Put([]byte(itemName), v)
+}
+
+// releaseLinkPreview releases the image blob of a link preview record.
+func releaseLinkPreview(tx *bbolt.Tx, v []byte) error {
+	record := new(linkPreviewRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return fmt.Errorf("failed to decode link preview record: %w", err)
+	}
+	if record.Image == "" {
+		return nil
+	}
+	return releaseBlob(tx, record.Image)
+}
+
+// dropLinkPreviews deletes the link preview of an item, or of all items of a
+// category if itemName is empty.
+func dropLinkPreviews(tx *bbolt.Tx, category, itemName string) error {
+	previews := tx.Bucket(linkPreviewsBkt)
+	if previews == nil {
+		return nil
+	}
+	catPreviews := previews.Bucket([]byte(category))
+	if catPreviews == nil {
+		return nil
+	}
+	if itemName != "" {
+		v := catPreviews.Get([]byte(itemName))
+		if v == nil {
+			return nil
+		}
+		if err := releaseLinkPreview(tx, v); err != nil {
+			return err
+		}
+		return catPreviews.Delete([]byte(itemName))
+	}
+	err := catPreviews.ForEach(func(_, v []byte) error {
+		return releaseLinkPreview(tx, v)
+	})
+	if err != nil {
+		return err
+	}
+	return previews.DeleteBucket([]byte(category))
+}
+
+// carryLinkPreview keeps the preview of an item that is saved with the link
+// it was fetched for, so that it is not fetched again, and drops it
+// otherwise. It is called by putItem with the new version of the item.
+func carryLinkPreview(tx *bbolt.Tx, category string, item *Item) error {
+	record, err := getLinkPreviewRecord(tx, category, item.Name)
+	if err != nil || record == nil {
+		return err
+	}
+	if item.Type != client.TypeLink || record.URL != string(item.Content) {
+		return dropLinkPreviews(tx, category, item.Name)
+	}
+	record.Version = item.Version
+	return saveLinkPreviewRecord(tx, category, item.Name, record)
+}
+
+// putLinkPreview stores the preview fetched for a version of a link item,
+// with the image of the preview if it has one, replacing the preview of an
+// earlier version. The library revision is advanced so that clients download
+// the item again with its preview. Nothing is stored if the item is no
+// longer at that version.
+func putLinkPreview(tx *bbolt.Tx, category string, item *Item, record *linkPreviewRecord, img []byte) error {
+	itemBkt := itemBucket(tx, category, item.Name)
+	if itemBkt == nil || itemVersion(itemBkt) != item.Version {
+		return nil
+	}
+	if err := dropLinkPreviews(tx, category, item.Name); err != nil {
+		return err
+	}
+	if img != nil {
+		hash, err := putBlob(tx, img)
+		if err != nil {
+			return err
+		}
+		record.Image = hash
+	}
+	if err := saveLinkPreviewRecord(tx, category, item.Name, record); err != nil {
+		return err
+	}
+	if record.Preview == nil {
+		return nil
+	}
+	return recordChange(tx, client.OpItemUpdated, category, item.Name)
+}
+
+// addLinkPreview sets the preview of a link item that was read from the db,
+// if one was fetched for its version.
+func addLinkPreview(tx *bbolt.Tx, category string, item *Item) error {
+	if item.Type != client.TypeLink {
+		return nil
+	}
+	record, err := getLinkPreviewRecord(tx, category, item.Name)
+	if err != nil || record == nil || record.Version != item.Version || record.Preview == nil {
+		return err
+	}
+	item.Preview = record.Preview
+	if record.Image != "" {
+		item.Preview.Image = append([]byte(nil), getBlob(tx, record.Image)...)
+	}
+	return nil
+}
+
+// linkPreviewer fetches the previews of link items that have none for their
+// current version.
+type linkPreviewer struct {
+	db     *bbolt.DB
+	client *http.Client
+	wakeCh chan struct{}
+}
+
+// newLinkPreviewer returns a link previewer that fetches pages in the given
+// mode, linkPreviewsPublic or linkPreviewsAll.
+func newLinkPreviewer(db *bbolt.DB, mode string) *linkPreviewer {
+	dialer := &net.Dialer{Timeout: linkFetchTimeout}
+	if mode == linkPreviewsPublic {
+		dialer.Control = dialPublicOnly
+	}
+	return &linkPreviewer{
+		db: db,
+		client: &http.Client{
+			Timeout: linkFetchTimeout,
+			// Proxies are not used, as requests through them would not be
+			// limited to public addresses.
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   linkFetchTimeout,
+				ResponseHeaderTimeout: linkFetchTimeout,
+				MaxIdleConns:          10,
+				IdleConnTimeout:       time.Minute,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxLinkRedirects {
+					return errors.New("too many redirects")
+				}
+				if !linkSchemes[req.URL.Scheme] {
+					return fmt.Errorf("redirected to a %s URL", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+		wakeCh: make(chan struct{}, 1),
+	}
+}
+
+// errPrivateAddress is returned for connections to addresses that are not
+// public in the linkPreviewsPublic mode.
+var errPrivateAddress = errors.New("address is not public")
+
+// privateNetworks are the address ranges that are not reachable from the
+// internet, other than loopback and link-local addresses.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// dialPublicOnly refuses connections to addresses that are not public. It
+// checks the resolved address being dialed, so that host names resolving to
+// private addresses are refused too.
+func dialPublicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return errPrivateAddress
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// wake signals the previewer to look for links without previews. It should
+// be called after links are stored.
+func (p *linkPreviewer) wake() {
+	select {
+	case p.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run fetches the missing previews of the library's links, then whenever it
+// is woken, until the context is canceled.
+func (p *linkPreviewer) Run(ctx context.Context) {
+	for {
+		if err := p.fetchMissing(ctx); err != nil {
+			linksLog.Errorf("Error fetching link previews: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wakeCh:
+		}
+	}
+}
+
+// fetchMissing fetches previews until every link has a preview record for
+// its current version.
+func (p *linkPreviewer) fetchMissing(ctx context.Context) error {
+	for ctx.Err() == nil {
+		pending, err := p.pendingLinks()
+		if err != nil || len(pending) == 0 {
+			return err
+		}
+		for _, link := range pending {
+			if ctx.Err() != nil {
+				return nil
+			}
+			item, err := readItem(p.db, link.category, link.name)
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				continue
+			}
+			record := &linkPreviewRecord{Version: item.Version, URL: string(item.Content)}
+			var img []byte
+			record.Preview, img, err = p.fetchPreview(ctx, record.URL)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				linksLog.Debugf("Cannot preview %s/%s: %v", link.category, link.name, err)
+				record.Error = err.Error()
+			}
+			err = p.db.Update(func(tx *bbolt.Tx) error {
+				return putLinkPreview(tx, link.category, item, record, img)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type pendingLink struct {
+	category, name string
+}
+
+// pendingLinks finds up to linkPreviewBatch link items without a preview
+// record for their current version.
+func (p *linkPreviewer) pendingLinks() ([]pendingLink, error) {
+	var pending []pendingLink
+	errBatchFull := errors.New("batch full")
+	err := p.db.View(func(tx *bbolt.Tx) error {
+		catsBucket := tx.Bucket(categoriesBkt)
+		if catsBucket == nil {
+			return nil
+		}
+		return catsBucket.ForEach(func(category, _ []byte) error {
+			catBucket := catsBucket.Bucket(category)
+			if catBucket == nil {
+				return nil
+			}
+			return catBucket.ForEach(func(itemName, v []byte) error {
+				itemBkt := catBucket.Bucket(itemName)
+				if v != nil || itemBkt == nil || string(itemBkt.Get(itemTypeKey)) != client.TypeLink {
+					return nil
+				}
+				record, err := getLinkPreviewRecord(tx, string(category), string(itemName))
+				if err != nil {
+					return err
+				}
+				if record != nil && record.Version == itemVersion(itemBkt) {
+					return nil
+				}
+				pending = append(pending, pendingLink{category: string(category), name: string(itemName)})
+				if len(pending) == linkPreviewBatch {
+					return errBatchFull
+				}
+				return nil
+			})
+		})
+	})
+	if errors.Is(err, errBatchFull) {
+		err = nil
+	}
+	return pending, err
+}
+
+// fetchPreview fetches the page of a link and reads its preview, from the
+// Open Graph and Twitter card metadata of the page or its title and
+// description. The preview image, if the page has one, is returned scaled
+// down. Links to images are previewed with the image.
+func (p *linkPreviewer) fetchPreview(ctx context.Context, link string) (*client.LinkPreview, []byte, error) {
+	resp, err := p.get(ctx, link, "text/html,application/xhtml+xml,image/*;q=0.8")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	pageURL := resp.Request.URL
+	preview := &client.LinkPreview{
+		URL:       pageURL.String(),
+		SiteName:  pageURL.Hostname(),
+		FetchedAt: time.Now().UTC(),
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		img, err := readPreviewImage(resp.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		preview.ImageURL = preview.URL
+		return preview, img, nil
+	case mediaType != "text/html" && mediaType != "application/xhtml+xml":
+		return nil, nil, fmt.Errorf("cannot preview %s content", mediaType)
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, maxLinkPageBytes), resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := html.Parse(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, title := pageMetadata(doc)
+	preview.Title = previewText(firstOf(meta["og:title"], meta["twitter:title"], title), maxPreviewTitle)
+	preview.Description = previewText(firstOf(meta["og:description"], meta["twitter:description"], meta["description"]),
+		maxPreviewDescription)
+	if siteName := previewText(meta["og:site_name"], maxPreviewTitle); siteName != "" {
+		preview.SiteName = siteName
+	}
+
+	imageRef := firstOf(meta["og:image:secure_url"], meta["og:image"], meta["og:image:url"], meta["twitter:image"])
+	if imageRef == "" {
+		return preview, nil, nil
+	}
+	imageURL, err := pageURL.Parse(imageRef)
+	if err != nil || !linkSchemes[imageURL.Scheme] {
+		return preview, nil, nil
+	}
+	// The preview is kept without an image if the image cannot be used.
+	img, err := p.fetchImage(ctx, imageURL.String())
+	if err != nil {
+		linksLog.Debugf("Cannot use preview image %s of %s: %v", imageURL, link, err)
+		return preview, nil, nil
+	}
+	preview.ImageURL = imageURL.String()
+	return preview, img, nil
+}
+
+// fetchImage fetches an image and scales it down for a preview.
+func (p *linkPreviewer) fetchImage(ctx context.Context, imageURL string) ([]byte, error) {
+	resp, err := p.get(ctx, imageURL, "image/*")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readPreviewImage(resp.Body)
+}
+
+// get requests a page, failing unless the response is successful.
+func (p *linkPreviewer) get(ctx context.Context, link, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "RemindMe link preview")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server responded %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// readPreviewImage reads an image of up to maxLinkImageBytes and scales it
+// down to fit linkImageSize.
+func readPreviewImage(r io.Reader) ([]byte, error) {
+	content, err := readUploadPart(r, maxLinkImageBytes, 0)
+	if errors.Is(err, errPartTooLarge) {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxLinkImageBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxVariantPixels {
+		return nil, fmt.Errorf("image is larger than %d pixels", maxVariantPixels)
+	}
+	img, format, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	return scaleImage(img, format, fitImage(img.Bounds().Size(), linkImageSize))
+}
+
+// pageMetadata returns the content of the meta elements of an HTML document
+// by lowercase property or name, the first of each, and the title.
+func pageMetadata(doc *html.Node) (map[string]string, string) {
+	meta := make(map[string]string)
+	var title string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				if title == "" && n.FirstChild != nil {
+					title = n.FirstChild.Data
+				}
+			case "meta":
+				var key, content string
+				for _, attr := range n.Attr {
+					switch attr.Key {
+					case "property", "name":
+						if key == "" {
+							key = strings.ToLower(attr.Val)
+						}
+					case "content":
+						content = attr.Val
+					}
+				}
+				if _, ok := meta[key]; key != "" && !ok {
+					meta[key] = content
+				}
+			case "body", "svg":
+				// Metadata is in the head, though parsers move it to the
+				// body after errors.
+				if meta["og:title"] != "" || title != "" {
+					return
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return meta, title
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// previewText collapses the white space of text and shortens it to at most
+// max characters.
+func previewText(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	runes := []rune(text)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchPreview(t *testing.T) {
+	img := testPNG(t, 960, 640)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head>
+			<title>Page title</title>
+			<meta property="og:title" content="OG title">
+			<meta name="description" content="Plain description">
+			<meta property="og:description" content="OG description">
+			<meta property="og:site_name" content="Example">
+			<meta property="og:image" content="/image.png">
+			</head><body></body></html>`)
+	})
+	mux.HandleFunc("/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>Just a title</title>
+			<meta name="description" content="Just a description"></head></html>`)
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+	})
+	mux.HandleFunc("/padded", func(w http.ResponseWriter, r *http.Request) {
+		// Metadata past the size cap is not read.
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<html><head><!--%s--><title>Too far</title></head></html>",
+			strings.Repeat("x", maxLinkPageBytes))
+	})
+	mux.HandleFunc("/huge.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img)
+		w.Write(make([]byte, maxLinkImageBytes))
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := newLinkPreviewer(nil, linkPreviewsAll)
+	ctx := context.Background()
+
+	preview, previewImg, err := p.fetchPreview(ctx, srv.URL+"/page")
+	if err != nil {
+		t.Fatalf("fetching page: %v", err)
+	}
+	if preview.Title != "OG title" || preview.Description != "OG description" || preview.SiteName != "Example" {
+		t.Errorf("wrong preview of page: %+v", preview)
+	}
+	if preview.ImageURL != srv.URL+"/image.png" {
+		t.Errorf("wrong image URL %q", preview.ImageURL)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(previewImg))
+	if err != nil {
+		t.Fatalf("decoding preview image: %v", err)
+	}
+	if config.Width > linkImageSize.X || config.Height > linkImageSize.Y {
+		t.Errorf("preview image of %dx%d not scaled down to fit %v", config.Width, config.Height, linkImageSize)
+	}
+
+	preview, previewImg, err = p.fetchPreview(ctx, srv.URL+"/plain")
+	if err != nil {
+		t.Fatalf("fetching plain page: %v", err)
+	}
+	if preview.Title != "Just a title" || preview.Description != "Just a description" || previewImg != nil {
+		t.Errorf("wrong preview of plain page: %+v", preview)
+	}
+
+	preview, _, err = p.fetchPreview(ctx, srv.URL+"/padded")
+	if err != nil {
+		t.Fatalf("fetching padded page: %v", err)
+	}
+	if preview.Title != "" {
+		t.Errorf("title %q read past the size cap", preview.Title)
+	}
+
+	if _, _, err = p.fetchPreview(ctx, srv.URL+"/huge.png"); err == nil {
+		t.Error("image over the size cap was previewed")
+	}
+	if _, _, err = p.fetchPreview(ctx, srv.URL+"/missing"); err == nil {
+		t.Error("missing page was previewed")
+	}
+}
+
+func TestFetchPreviewTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	p := newLinkPreviewer(nil, linkPreviewsAll)
+	p.client.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, _, err := p.fetchPreview(context.Background(), srv.URL); err == nil {
+		t.Fatal("slow page was previewed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetch gave up after %v", elapsed)
+	}
+}
+
+func TestDialPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:80", true},
+		{"[2606:2800:220:1:248:1893:25c8:1946]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"0.0.0.0:80", false},
+		{"10.1.2.3:80", false},
+		{"172.16.0.1:80", false},
+		{"172.31.255.255:80", false},
+		{"192.168.1.1:80", false},
+		{"100.64.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[fd00::1]:80", false},
+		{"224.0.0.1:80", false},
+	}
+	for _, test := range tests {
+		err := dialPublicOnly("tcp", test.address, nil)
+		if test.public && err != nil {
+			t.Errorf("%s refused: %v", test.address, err)
+		}
+		if !test.public && !errors.Is(err, errPrivateAddress) {
+			t.Errorf("%s not refused", test.address)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached a loopback server")
+	}))
+	defer srv.Close()
+	p := newLinkPreviewer(nil, linkPreviewsPublic)
+	if _, _, err := p.fetchPreview(context.Background(), srv.URL); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("fetching from a loopback address: got %v, want %v", err, errPrivateAddress)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// Listings of the library, its categories and their items are sent as JSON
+// arrays, read in batches so that neither the whole listing nor a
+// transaction is held while a slow client downloads it. The library is
+// pinned to the revision its first batch was read at, and its download
+// aborted if a later batch finds it changed, so that a listing never mixes
+// revisions or differs from its entity tag. Clients that give the limit or
+// cursor query parameter, even if empty, get a page of the listing instead,
+// with the cursor of the next page.
+
+const (
+	// listBatchItems and listBatchBytes bound the items and the item
+	// content read per transaction when streaming a listing. Pages of the
+	// library also end once listBatchBytes of content are read.
+	listBatchItems = 500
+	listBatchBytes = 8 << 20
+)
+
+// listCursor is the position in a listing to read from: the item at
+// position order and name in a category, or the start of the category if
+// item is empty and order is 0. Items are ordered by position, so that new
+// items and reordered items do not shift the following pages.
+type listCursor struct {
+	Category string `json:"c"`
+	Order    uint64 `json:"o,omitempty"`
+	Item     string `json:"i,omitempty"`
+}
+
+func (c *listCursor) String() string {
+	if c == nil {
+		return ""
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// errLibraryChanged is returned when the library changes while it is
+// streamed.
+var errLibraryChanged = errors.New("library changed while it was listed")
+
+// listPage reads the pagination parameters of a request. paged is false if
+// neither was given, and the whole listing is wanted.
+func listPage(r *http.Request) (start *listCursor, limit int, paged bool, err error) {
+	q := r.URL.Query()
+	_, hasLimit := q["limit"]
+	_, hasCursor := q["cursor"]
+	if !hasLimit && !hasCursor {
+		return nil, 0, false, nil
+	}
+	if limit, err = pageLimit(r); err != nil {
+		return nil, 0, true, err
+	}
+	if cursorStr := q.Get("cursor"); cursorStr != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursorStr)
+		start = new(listCursor)
+		if err != nil || json.Unmarshal(b, start) != nil {
+			return nil, 0, true, errInvalidCursor
+		}
+	}
+	return start, limit, true, nil
+}
+
+// itemPosition is the position of an item in its category.
+type itemPosition struct {
+	name  []byte
+	order uint64
+}
+
+// before reports whether the item comes before the cursor's position.
+func (p itemPosition) before(c *listCursor) bool {
+	return p.order < c.Order || p.order == c.Order && string(p.name) < c.Item
+}
+
+// itemPositions returns the positions of a category's items in order. Items
+// are listed in the order they were added or last arranged in, items saved
+// before ordering was supported come first by name.
+func itemPositions(catBucket *bbolt.Bucket) []itemPosition {
+	var positions []itemPosition
+	cursor := catBucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if v != nil {
+			continue
+		}
+		positions = append(positions, itemPosition{name: k, order: itemOrder(catBucket.Bucket(k))})
+	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return positions[i].order < positions[j].order
+	})
+	return positions
+}
+
+// readLibraryPage reads up to limit items of the library from start, or
+// fewer if their content reaches maxBytes, with the cursor of the rest of
+// the library. Items are read with copyItem. Categories without items
+// are listed with no items. The first and last categories of a page may be
+// continued on adjacent pages.
+func readLibraryPage(tx *bbolt.Tx, start *listCursor, limit, maxBytes int) ([]*Category, *listCursor, error) {
+	page := make([]*Category, 0)
+	catsBucket := tx.Bucket(categoriesBkt)
+	if catsBucket == nil {
+		return page, nil, nil
+	}
+	var n, size int
+	full := func() bool {
+		return n == limit || n > 0 && size >= maxBytes
+	}
+	categories := catsBucket.Cursor()
+	k, _ := categories.First()
+	if start != nil {
+		k, _ = categories.Seek([]byte(start.Category))
+	}
+	for ; k != nil; k, _ = categories.Next() {
+		catBucket := catsBucket.Bucket(k)
+		if catBucket == nil {
+			continue
+		}
+		name := string(k)
+		from := &listCursor{Category: name}
+		if start != nil && start.Category == name {
+			from = start
+		}
+		positions := itemPositions(catBucket)
+		if full() {
+			return page, from, nil
+		}
+		category := &Category{Name: name, Items: make([]*Item, 0)}
+		page = append(page, category)
+		for _, pos := range positions {
+			if pos.before(from) {
+				continue
+			}
+			if full() {
+				return page, &listCursor{Category: name, Order: pos.order, Item: string(pos.name)}, nil
+			}
+			item, err := copyItem(tx, name, string(pos.name), catBucket.Bucket(pos.name))
+			if err != nil {
+				return nil, nil, err
+			}
+			category.Items = append(category.Items, item)
+			n++
+			size += len(item.Content)
+		}
+	}
+	return page, nil, nil
+}
+
+// readCategoriesPage reads up to limit category summaries from start, with
+// the cursor of the rest.
+func readCategoriesPage(tx *bbolt.Tx, start *listCursor, limit int) ([]*categorySummary, *listCursor) {
+	page := make([]*categorySummary, 0)
+	catsBucket := tx.Bucket(categoriesBkt)
+	if catsBucket == nil {
+		return page, nil
+	}
+	categories := catsBucket.Cursor()
+	k, _ := categories.First()
+	if start != nil {
+		k, _ = categories.Seek([]byte(start.Category))
+	}
+	for ; k != nil; k, _ = categories.Next() {
+		catBucket := catsBucket.Bucket(k)
+		if catBucket == nil {
+			continue
+		}
+		if len(page) == limit {
+			return page, &listCursor{Category: string(k)}
+		}
+		page = append(page, &categorySummary{
+			Name:      string(k),
+			ItemCount: countItems(catBucket),
+		})
+	}
+	return page, nil
+}
+
+// readItemsPage reads up to limit item summaries of a category from start,
+// with the cursor of the rest.
+func readItemsPage(catBucket *bbolt.Bucket, category string, start *listCursor, limit int) ([]*itemSummary, *listCursor) {
+	page := make([]*itemSummary, 0)
+	if start == nil {
+		start = &listCursor{Category: category}
+	}
+	for _, pos := range itemPositions(catBucket) {
+		if pos.before(start) {
+			continue
+		}
+		if len(page) == limit {
+			return page, &listCursor{Category: category, Order: pos.order, Item: string(pos.name)}
+		}
+		itemBkt := catBucket.Bucket(pos.name)
+		page = append(page, &itemSummary{
+			Name:    string(pos.name),
+			Type:    string(itemBkt.Get(itemTypeKey)),
+			Size:    len(itemBkt.Get(itemContentKey)),
+			Version: itemVersion(itemBkt),
+		})
+	}
+	return page, nil
+}
+
+// jsonStream writes a JSON response as it is produced. Once anything is
+// written, errors can no longer be reported and the response just ends.
+type jsonStream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	started bool
+	err     error
+}
+
+func newJSONStream(w http.ResponseWriter) *jsonStream {
+	return &jsonStream{w: w, enc: json.NewEncoder(w)}
+}
+
+// raw writes JSON punctuation.
+func (s *jsonStream) raw(str string) {
+	if s.err == nil {
+		_, s.err = io.WriteString(s.w, str)
+	}
+}
+
+// value writes a value, preceded by a comma if it is not the first element
+// of an array.
+func (s *jsonStream) value(v interface{}, first bool) {
+	if !first {
+		s.raw(",")
+	}
+	if s.err == nil {
+		s.err = s.enc.Encode(v)
+	}
+}
+
+// start sets the content type and opens the response.
+func (s *jsonStream) start(opening string) {
+	s.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	s.started = true
+	s.raw(opening)
+}
+
+// streamLibrary writes all categories with all their items, in the shape of
+// []*client.Category, with a variant of the images if variant is not empty
+// and items of types not in types listed as legacy types. If the library
+// changes between batches, or a batch cannot be read once the response has
+// started, the response is aborted so that the client sees it incomplete.
+func (api *apiServer) streamLibrary(w http.ResponseWriter, r *http.Request, variant string, types map[string]bool) {
+	stream := newJSONStream(w)
+	var start *listCursor
+	var openCategory *string
+	var itemCount int
+	var revision uint64
+	for stream.err == nil {
+		var page []*Category
+		var next *listCursor
+		var notModified bool
+		err := api.db.View(func(tx *bbolt.Tx) error {
+			if !stream.started {
+				if notModified = libraryNotModified(w, r, tx); notModified {
+					return nil
+				}
+				revision = libraryRevision(tx)
+			} else if libraryRevision(tx) != revision {
+				return errLibraryChanged
+			}
+			var err error
+			page, next, err = readLibraryPage(tx, start, listBatchItems, listBatchBytes)
+			return err
+		})
+		if err == nil && variant != "" {
+			err = api.useVariants(page, variant)
+		}
+		if errors.Is(err, errLibraryChanged) {
+			reqLog(r).Infof("Library changed while it was downloaded, aborting the download")
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil {
+			reqLog(r).Errorf("Error fetching items from db: %v", err)
+			if stream.started {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(w, "error fetching items", http.StatusInternalServerError)
+			return
+		}
+		if notModified {
+			return
+		}
+		if !stream.started {
+			stream.start("[")
+		}
+		for _, category := range page {
+			listItemsAs(category.Items, types)
+			// A category continued from the previous batch is already open.
+			if openCategory == nil || *openCategory != category.Name {
+				if openCategory != nil {
+					stream.raw("]},")
+				}
+				name := category.Name
+				openCategory, itemCount = &name, 0
+				stream.raw(`{"name":`)
+				stream.value(name, true)
+				stream.raw(`,"items":[`)
+			}
+			for _, item := range category.Items {
+				stream.value(item, itemCount == 0)
+				itemCount++
+			}
+		}
+		if next == nil {
+			break
+		}
+		start = next
+	}
+	if openCategory != nil {
+		stream.raw("]}")
+	}
+	stream.raw("]\n")
+}
+
+// libraryPage writes a page of the library, with a variant of the images if
+// variant is not empty and items of types not in types listed as legacy
+// types.
+func (api *apiServer) libraryPage(w http.ResponseWriter, r *http.Request, start *listCursor, limit int, variant string, types map[string]bool) {
+	resp := new(client.LibraryPage)
+	var notModified bool
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		if notModified = libraryNotModified(w, r, tx); notModified {
+			return nil
+		}
+		var next *listCursor
+		var err error
+		resp.Categories, next, err = readLibraryPage(tx, start, limit, listBatchBytes)
+		resp.NextCursor = next.String()
+		return err
+	})
+	if err == nil && !notModified && variant != "" {
+		err = api.useVariants(resp.Categories, variant)
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error fetching items from db: %v", err)
+		writeError(w, "error fetching items", http.StatusInternalServerError)
+		return
+	}
+	if !notModified {
+		for _, category := range resp.Categories {
+			listItemsAs(category.Items, types)
+		}
+		writeJSON(w, resp)
+	}
+}
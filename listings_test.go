@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// putTestItems stores n text items in category.
+func putTestItems(t *testing.T, db *bbolt.DB, category string, n int) {
+	t.Helper()
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < n; i++ {
+			item := &Item{Name: fmt.Sprintf("item%04d", i), Type: "text", Content: []byte("content")}
+			if _, err := putItem(tx, category, item, itemCondition{}, systemActor); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// changingRecorder stores an item when the response is first written to,
+// as if the library changed while it was downloaded.
+type changingRecorder struct {
+	*httptest.ResponseRecorder
+	db      *bbolt.DB
+	changed bool
+}
+
+func (w *changingRecorder) Write(b []byte) (int, error) {
+	if !w.changed {
+		w.changed = true
+		err := w.db.Update(func(tx *bbolt.Tx) error {
+			_, err := putItem(tx, "aaa", &Item{Name: "new", Type: "text", Content: []byte("new")}, itemCondition{}, systemActor)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStreamLibrary(t *testing.T) {
+	api := newTestAPI(t)
+	// More items than fit in one batch.
+	putTestItems(t, api.db, "notes", listBatchItems+10)
+
+	w := httptest.NewRecorder()
+	api.streamLibrary(w, httptest.NewRequest(http.MethodGet, "/api/items", nil), "", nil)
+	var library []*Category
+	if err := json.Unmarshal(w.Body.Bytes(), &library); err != nil {
+		t.Fatalf("invalid library: %v", err)
+	}
+	if len(library) != 1 || len(library[0].Items) != listBatchItems+10 {
+		t.Fatalf("wrong library listed")
+	}
+	etag := w.Header().Get("ETag")
+
+	changing := &changingRecorder{ResponseRecorder: httptest.NewRecorder(), db: api.db}
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("download of a changing library not aborted, recovered %v", recovered)
+			}
+		}()
+		api.streamLibrary(changing, httptest.NewRequest(http.MethodGet, "/api/items", nil), "", nil)
+	}()
+	if changing.Header().Get("ETag") != etag {
+		t.Errorf("library changed before it was first read")
+	}
+}
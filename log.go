@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/itswisdomagain/remindme/logging"
+)
+
+// logBackend writes the logs of all subsystems. Until initLogging is called
+// it writes info and above to stderr.
+var logBackend, _ = logging.New(&logging.Config{})
+
+// Subsystem loggers.
+var (
+	srvLog      = logBackend.Logger("server")
+	apiLog      = logBackend.Logger("api")
+	accessLog   = logBackend.Logger("http")
+	dbLog       = logBackend.Logger("db")
+	webhooksLog = logBackend.Logger("webhooks")
+	digestsLog  = logBackend.Logger("digests")
+	trashLog    = logBackend.Logger("trash")
+	imagesLog   = logBackend.Logger("images")
+	linksLog    = logBackend.Logger("links")
+)
+
+// initLogging replaces the default log backend with one configured by cfg,
+// which also writes to logs/remindme.log in dataDir.
+func initLogging(cfg *config, dataDir string) error {
+	logDir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(logDir, 0700); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	backend, err := logging.New(&logging.Config{
+		Levels: cfg.LogLevel,
+		Format: logging.Format(cfg.LogFormat),
+		File:   filepath.Join(logDir, "remindme.log"),
+	})
+	if err != nil {
+		return err
+	}
+	logBackend = backend
+	srvLog = backend.Logger("server")
+	apiLog = backend.Logger("api")
+	accessLog = backend.Logger("http")
+	dbLog = backend.Logger("db")
+	webhooksLog = backend.Logger("webhooks")
+	digestsLog = backend.Logger("digests")
+	trashLog = backend.Logger("trash")
+	imagesLog = backend.Logger("images")
+	linksLog = backend.Logger("links")
+	return nil
+}
+
+type requestInfoKey struct{}
+
+// requestInfo collects what is learned about a request while it is handled,
+// for its access log.
+type requestInfo struct {
+	user string
+}
+
+// logRequests is middleware that gives each request a logger with its
+// request id, which is also returned in the X-Request-Id header, and
+// writes an access log line for it. It must follow chi's RequestID
+// middleware.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := middleware.GetReqID(r.Context())
+		w.Header().Set(middleware.RequestIDHeader, id)
+		info := new(requestInfo)
+		ctx := logging.NewContext(r.Context(), apiLog.With("request_id", id))
+		ctx = context.WithValue(ctx, requestInfoKey{}, info)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		accessLog.With(
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start).Round(time.Microsecond).String(),
+			"ip", requestActor(r).ip,
+			"user", info.user,
+		).Infof("%s %s %d", r.Method, r.URL.Path, status)
+	})
+}
+
+// setRequestUser records the user of a request for its access log and
+// returns a context whose logger names the user.
+func setRequestUser(r *http.Request, user string) context.Context {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.user = user
+	}
+	return logging.NewContext(r.Context(), reqLog(r).With("user", user))
+}
+
+// reqLog returns the logger of a request, which adds its request id and
+// user to messages.
+func reqLog(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context(), apiLog)
+}
@@ -0,0 +1,412 @@
+// Package logging provides leveled, structured loggers for the subsystems of
+// the RemindMe server and app. Loggers share a backend that writes text or
+// JSON lines to stderr and, optionally, to a log file that is rotated by
+// size.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelOff:   "off",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel parses the name of a level.
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn, error or off", s)
+}
+
+// Format is the encoding of log lines.
+type Format string
+
+// Log formats.
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Config configures a Backend.
+type Config struct {
+	// Levels is the default level, optionally followed by levels for
+	// particular subsystems, e.g. "info,webhooks=debug".
+	Levels string
+	Format Format
+	// File is the path of the log file, which is rotated when it grows
+	// past MaxSize bytes, keeping MaxFiles old files. Logs are only
+	// written to stderr if it is empty.
+	File     string
+	MaxSize  int64
+	MaxFiles int
+	// Quiet stops logs from also being written to stderr when File is set.
+	Quiet bool
+}
+
+// Defaults for rotating log files.
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 5
+)
+
+// Backend writes the logs of all subsystems. It is safe for concurrent use.
+type Backend struct {
+	format Format
+
+	mtx          sync.Mutex
+	defaultLevel Level
+	levels       map[string]Level
+	stderr       io.Writer
+	file         *rotatingFile
+}
+
+// New creates a backend, opening the log file if one is configured.
+func New(cfg *Config) (*Backend, error) {
+	b := &Backend{
+		format:       cfg.Format,
+		defaultLevel: LevelInfo,
+		levels:       make(map[string]Level),
+		stderr:       os.Stderr,
+	}
+	switch b.format {
+	case "":
+		b.format = FormatText
+	case FormatText, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", cfg.Format)
+	}
+	if err := b.SetLevels(cfg.Levels); err != nil {
+		return nil, err
+	}
+	if cfg.File != "" {
+		maxSize, maxFiles := cfg.MaxSize, cfg.MaxFiles
+		if maxSize <= 0 {
+			maxSize = DefaultMaxSize
+		}
+		if maxFiles <= 0 {
+			maxFiles = DefaultMaxFiles
+		}
+		f, err := openRotatingFile(cfg.File, maxSize, maxFiles)
+		if err != nil {
+			return nil, err
+		}
+		b.file = f
+		if cfg.Quiet {
+			b.stderr = nil
+		}
+	}
+	return b, nil
+}
+
+// SetLevels sets the default level and subsystem levels from a spec like
+// "info,webhooks=debug". An empty spec leaves the levels unchanged.
+func (b *Backend) SetLevels(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	defaultLevel := b.defaultLevel
+	levels := make(map[string]Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		subsystem, levelStr := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			subsystem, levelStr = strings.ToLower(part[:i]), part[i+1:]
+		}
+		level, err := ParseLevel(levelStr)
+		if err != nil {
+			return err
+		}
+		if subsystem == "" {
+			defaultLevel = level
+		} else {
+			levels[subsystem] = level
+		}
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.defaultLevel = defaultLevel
+	b.levels = levels
+	return nil
+}
+
+func (b *Backend) enabled(subsystem string, level Level) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	min, ok := b.levels[subsystem]
+	if !ok {
+		min = b.defaultLevel
+	}
+	return level >= min && level != LevelOff
+}
+
+// Close closes the log file, if any.
+func (b *Backend) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// Logger returns the logger of a subsystem. Subsystem names are used in the
+// level spec in lower case.
+func (b *Backend) Logger(subsystem string) *Logger {
+	return &Logger{backend: b, subsystem: strings.ToLower(subsystem)}
+}
+
+func (b *Backend) write(l *Logger, level Level, msg string) {
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	if b.format == FormatJSON {
+		record := map[string]interface{}{
+			"time":      now.Format(time.RFC3339Nano),
+			"level":     level.String(),
+			"subsystem": l.subsystem,
+			"msg":       msg,
+		}
+		for _, f := range l.fields {
+			if _, taken := record[f.key]; !taken {
+				record[f.key] = f.value
+			}
+		}
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(record); err != nil {
+			buf.Reset()
+			fmt.Fprintf(&buf, `{"time":%q,"level":"error","subsystem":"logging","msg":%q}`+"\n",
+				now.Format(time.RFC3339Nano), "cannot encode log fields: "+err.Error())
+		}
+	} else {
+		fmt.Fprintf(&buf, "%s [%s] %s: %s", now.Format("2006-01-02 15:04:05.000"),
+			strings.ToUpper(level.String()), strings.ToUpper(l.subsystem), msg)
+		for _, f := range l.fields {
+			value := fmt.Sprint(f.value)
+			if value == "" || strings.ContainsAny(value, " \"=") {
+				value = fmt.Sprintf("%q", value)
+			}
+			fmt.Fprintf(&buf, " %s=%s", f.key, value)
+		}
+		buf.WriteByte('\n')
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.stderr != nil {
+		b.stderr.Write(buf.Bytes())
+	}
+	if b.file != nil {
+		if err := b.file.write(buf.Bytes()); err != nil {
+			// File errors are reported even if logs are not written to
+			// stderr, as they would otherwise go unnoticed.
+			stderr := b.stderr
+			if stderr == nil {
+				stderr = os.Stderr
+			}
+			fmt.Fprintf(stderr, "%v\n", err)
+		}
+	}
+}
+
+// Logger logs the messages of a subsystem, with any fields added by With.
+type Logger struct {
+	backend   *Backend
+	subsystem string
+	fields    []field
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// With returns a logger that adds fields to every message, given as
+// alternating keys and values.
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	fields := make([]field, 0, len(l.fields)+len(keyValues)/2)
+	fields = append(fields, l.fields...)
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		fields = append(fields, field{fmt.Sprint(keyValues[i]), keyValues[i+1]})
+	}
+	return &Logger{backend: l.backend, subsystem: l.subsystem, fields: fields}
+}
+
+// Enabled reports whether messages at level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	return l.backend.enabled(l.subsystem, level)
+}
+
+func (l *Logger) logf(level Level, format string, args []interface{}) {
+	if l.Enabled(level) {
+		l.backend.write(l, level, fmt.Sprintf(format, args...))
+	}
+}
+
+// Debugf logs a debug message.
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args) }
+
+// Infof logs an informational message.
+func (l *Logger) Infof(format string, args ...interface{}) { l.logf(LevelInfo, format, args) }
+
+// Warnf logs a warning.
+func (l *Logger) Warnf(format string, args ...interface{}) { l.logf(LevelWarn, format, args) }
+
+// Errorf logs an error.
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args) }
+
+type contextKey struct{}
+
+// NewContext returns a context carrying a logger, such as one with the
+// fields of a request.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or fallback if there is
+// none.
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return fallback
+}
+
+// rotatingFile is a log file that is renamed to path.1, shifting older
+// files up to path.<maxFiles>, when it grows past maxSize bytes.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+	// retryRotate is when rotation is next attempted after a failure.
+	retryRotate time.Time
+}
+
+// rotateRetryDelay is how long a log file that failed to rotate keeps being
+// appended to before rotation is attempted again.
+const rotateRetryDelay = time.Minute
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// write appends b to the file, rotating it first if b would take it past
+// maxSize. If the rotation fails, b is still appended to the current file and
+// the rotation is retried after rotateRetryDelay; the error is returned for
+// the caller to report.
+func (rf *rotatingFile) write(b []byte) error {
+	var rotateErr error
+	if rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize && !time.Now().Before(rf.retryRotate) {
+		if rotateErr = rf.rotate(); rotateErr != nil {
+			rf.retryRotate = time.Now().Add(rotateRetryDelay)
+			rotateErr = fmt.Errorf("cannot rotate log file: %w", rotateErr)
+		}
+	}
+	if rf.f == nil {
+		// The file could not be reopened after an earlier rotation.
+		if err := rf.open(); err != nil {
+			return err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write log file: %w", err)
+	}
+	return rotateErr
+}
+
+// rotate renames the file to path.1, shifting older files, and opens a new
+// file at path. The file is reopened even if renaming fails, so that logs
+// keep being appended to it.
+func (rf *rotatingFile) rotate() error {
+	closeErr := rf.f.Close()
+	rf.f = nil
+	err := rf.shift()
+	if openErr := rf.open(); openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// shift renames the files at path and path.<n> to path.1 and path.<n+1>.
+func (rf *rotatingFile) shift() error {
+	// Shift the oldest files first so that each name is free when reused.
+	// The file at path.<maxFiles> is replaced.
+	for i := rf.maxFiles - 1; i >= 1; i-- {
+		old := fmt.Sprintf("%s.%d", rf.path, i)
+		if _, err := os.Stat(old); err == nil {
+			if err = os.Rename(old, fmt.Sprintf("%s.%d", rf.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(rf.path, rf.path+".1")
+}
+
+// Close closes the file.
+func (rf *rotatingFile) Close() error {
+	if rf.f == nil {
+		return nil
+	}
+	return rf.f.Close()
+}
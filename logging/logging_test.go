@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		if err = rf.write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "four\n",
+		path + ".1": "three\n",
+		path + ".2": "one\ntwo\n",
+	} {
+		if got, _ := ioutil.ReadFile(name); string(got) != want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	// A directory that is not empty cannot be replaced by the log file.
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := openRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if err = rf.write([]byte("first line\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.write([]byte("second line\n")); err == nil || !strings.Contains(err.Error(), "rotate") {
+		t.Fatalf("rotation failure not reported, got %v", err)
+	}
+	// Rotation is not retried right away and logs are still written.
+	if err = rf.write([]byte("third line\n")); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(path)
+	if want := "first line\nsecond line\nthird line\n"; string(got) != want {
+		t.Errorf("log file holds %q, want %q", got, want)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -13,70 +12,98 @@ import (
 )
 
 func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		srvLog.Errorf("%v", err)
+		os.Exit(1)
+	}
+	switch cfg.LinkPreviews {
+	case linkPreviewsPublic, linkPreviewsAll, linkPreviewsOff:
+	default:
+		srvLog.Errorf("invalid -linkpreviews %q, must be public, all or off", cfg.LinkPreviews)
+		os.Exit(1)
+	}
+
 	appDataDir := dcrutil.AppDataDir("remindme", false)
-	err := os.MkdirAll(appDataDir, 0700)
+	err = os.MkdirAll(appDataDir, 0700)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to create app data directory: %v\n", err)
+		srvLog.Errorf("failed to create app data directory: %v", err)
 		os.Exit(1)
 	}
 
+	if err = initLogging(cfg, appDataDir); err != nil {
+		srvLog.Errorf("failed to set up logging: %v", err)
+		os.Exit(1)
+	}
+	defer logBackend.Close()
+
 	dbPath := filepath.Join(appDataDir, "bdb.db")
 	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to open database: %v\n", err)
+		srvLog.Errorf("failed to open database: %v", err)
 		os.Exit(1)
 	}
 
 	defer func() {
 		if err := db.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "failed to close db: %v\n", err)
+			srvLog.Errorf("failed to close db: %v", err)
 		}
 	}()
 
+	if err = upgradeDB(db); err != nil {
+		srvLog.Errorf("failed to upgrade database: %v", err)
+		os.Exit(1)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Start a goroutine to catch interrupt signal (e.g. ctrl+c)
 	// before starting the api server. On interrupt, kill the
 	// ctx associated with the api server to signal the api
 	// server to stop.
-	killChan := make(chan os.Signal)
+	killChan := make(chan os.Signal, 1)
 	signal.Notify(killChan, os.Interrupt)
 	go func() {
 		for range killChan {
-			fmt.Println("shutting down...")
+			srvLog.Infof("shutting down...")
 			cancel()
 			break
 		}
 	}()
 
-	api := &apiServer{
-		db: db,
+	webhooks := newWebhookDispatcher(db)
+	go webhooks.Run(ctx)
+
+	digests := newDigestScheduler(db, cfg)
+	go digests.Run(ctx)
+
+	go newTrashPurger(db).Run(ctx)
+
+	variants := newVariantGenerator(db)
+	go variants.Run(ctx)
+
+	links := newLinkPreviewer(db, cfg.LinkPreviews)
+	if cfg.LinkPreviews != linkPreviewsOff {
+		go links.Run(ctx)
 	}
 
-	// go func() {
-	// 	time.Sleep(5 * time.Second)
-	// 	resp, err := http.Get("http://0.0.0.0:54321/api/items")
-	// 	if err != nil {
-	// 		fmt.Println(err.Error())
-	// 		return
-	// 	}
-	// 	body, err := ioutil.ReadAll(resp.Body)
-	// 	if err != nil {
-	// 		fmt.Println(err.Error())
-	// 		return
-	// 	}
-	// 	cats := make([]*Category, 0)
-	// 	err = json.Unmarshal(body, &cats)
-	// 	if err != nil {
-	// 		fmt.Fprintf(os.Stderr, "failed to unmarshal JSON request: %v\n", err)
-	// 		return
-	// 	}
-	// 	item := cats[0].Items[1]
-	// 	println("o")
-	// 	println(len(item.Attachment))
-	// }()
+	api := &apiServer{
+		db:             db,
+		webhooks:       webhooks,
+		digests:        digests,
+		variants:       variants,
+		links:          links,
+		authTokens:     hashAuthTokens(cfg.AuthTokens),
+		admins:         cfg.Admins,
+		metrics:        newServerMetrics(),
+		limits:         newRateLimiter(cfg),
+		trashRetention: cfg.TrashRetention,
+		maxUploadBytes: cfg.MaxUploadBytes,
+		userQuota:      cfg.UserQuota,
+		categoryQuota:  cfg.CategoryQuota,
+	}
 
 	if err := api.Start(ctx); err != nil {
-		fmt.Fprintf(os.Stderr, "api start error: %v\n", err)
+		srvLog.Errorf("api start error: %v", err)
 	}
 }
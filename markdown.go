@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/itswisdomagain/remindme/client"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// markdownImageScheme is the scheme of the image references in markdown
+// items, which name image items of the same category.
+const markdownImageScheme = "item:"
+
+// markdownLinkSchemes are the schemes that links in markdown items may use.
+var markdownLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+var markdownParser = goldmark.New().Parser()
+
+func parseMarkdown(source []byte) ast.Node {
+	return markdownParser.Parse(text.NewReader(source))
+}
+
+// checkMarkdown checks that a markdown item has text, that its links are web
+// or mail links and that its images reference items, trimming the space
+// around the text.
+func checkMarkdown(item *Item) error {
+	item.Content = bytes.TrimSpace(item.Content)
+	if len(item.Content) == 0 {
+		return errors.New("markdown must have text")
+	}
+	if !utf8.Valid(item.Content) {
+		return errors.New("markdown must be UTF-8 text")
+	}
+	return checkMarkdownLinks(item.Content)
+}
+
+// checkMarkdownLinks checks that the links in markdown are web or mail links
+// and that its images reference items.
+func checkMarkdownLinks(source []byte) error {
+	return ast.Walk(parseMarkdown(source), func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			if !markdownLink(string(n.Destination)) {
+				return ast.WalkStop, fmt.Errorf("markdown link %q must be an http, https or mailto URL", n.Destination)
+			}
+		case *ast.AutoLink:
+			dest := string(n.URL(source))
+			if n.AutoLinkType == ast.AutoLinkEmail {
+				dest = "mailto:" + dest
+			}
+			if !markdownLink(dest) {
+				return ast.WalkStop, fmt.Errorf("markdown link %q must be an http, https or mailto URL", dest)
+			}
+		case *ast.Image:
+			if _, ok := markdownImageItem(string(n.Destination)); !ok {
+				return ast.WalkStop, fmt.Errorf("markdown image %q must reference an item as item:name", n.Destination)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+func markdownLink(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && markdownLinkSchemes[strings.ToLower(u.Scheme)] && (u.Host != "" || u.Opaque != "")
+}
+
+// markdownImageItem returns the name of the item that an image in markdown
+// references.
+func markdownImageItem(dest string) (string, bool) {
+	if !strings.HasPrefix(dest, markdownImageScheme) {
+		return "", false
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(dest, markdownImageScheme))
+	return name, err == nil && name != ""
+}
+
+// isMarkdownFile reports whether a file is named as markdown.
+func isMarkdownFile(filename string) bool {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// markdownFallback lists a markdown item as a text item with the plain text
+// of the markdown, for clients that cannot render markdown.
+func markdownFallback(item *Item) {
+	item.Type = client.TypeText
+	item.Content = []byte(markdownPlainText(item.Content))
+}
+
+// markdownPlainText renders markdown as plain text. Emphasis is dropped,
+// list items keep their markers, links are followed by their URL and images
+// are replaced by their description.
+func markdownPlainText(source []byte) string {
+	lines := plainBlockLines(parseMarkdown(source), source)
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// plainBlockLines renders a block node as lines of plain text.
+func plainBlockLines(n ast.Node, source []byte) []string {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock, *ast.Heading:
+		return strings.Split(plainInlineText(n, source), "\n")
+	case *ast.CodeBlock, *ast.FencedCodeBlock:
+		var lines []string
+		segments := n.Lines()
+		for i := 0; i < segments.Len(); i++ {
+			segment := segments.At(i)
+			lines = append(lines, "    "+strings.TrimRight(string(segment.Value(source)), "\r\n"))
+		}
+		return lines
+	case *ast.ThematicBreak:
+		return []string{"---"}
+	case *ast.HTMLBlock:
+		return nil
+	case *ast.Blockquote:
+		lines := plainChildLines(n, source, true)
+		for i, line := range lines {
+			lines[i] = strings.TrimRight("> "+line, " ")
+		}
+		return lines
+	case *ast.List:
+		var lines []string
+		number := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			marker := "- "
+			if n.IsOrdered() {
+				marker = fmt.Sprintf("%d. ", number)
+				number++
+			}
+			if len(lines) > 0 && !n.IsTight {
+				lines = append(lines, "")
+			}
+			for i, line := range plainChildLines(item, source, !n.IsTight) {
+				switch {
+				case i == 0:
+					line = marker + line
+				case line != "":
+					line = strings.Repeat(" ", len(marker)) + line
+				}
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	default:
+		return plainChildLines(n, source, true)
+	}
+}
+
+// plainChildLines renders the blocks in a node as lines of plain text,
+// separated by blank lines if loose is set.
+func plainChildLines(n ast.Node, source []byte, loose bool) []string {
+	var lines []string
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		childLines := plainBlockLines(child, source)
+		if len(childLines) == 0 {
+			continue
+		}
+		if len(lines) > 0 && loose {
+			lines = append(lines, "")
+		}
+		lines = append(lines, childLines...)
+	}
+	return lines
+}
+
+// plainInlineText renders the inline content of a block as plain text.
+func plainInlineText(n ast.Node, source []byte) string {
+	var b strings.Builder
+	for child := n.FirstChild(); child != nil; child = child.NextSibling() {
+		switch child := child.(type) {
+		case *ast.Text:
+			b.Write(child.Segment.Value(source))
+			switch {
+			case child.HardLineBreak():
+				b.WriteString("\n")
+			case child.SoftLineBreak():
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.Write(child.Value)
+		case *ast.AutoLink:
+			b.Write(child.URL(source))
+		case *ast.Link:
+			label := plainInlineText(child, source)
+			b.WriteString(label)
+			if dest := string(child.Destination); dest != label && "mailto:"+label != dest {
+				fmt.Fprintf(&b, " (%s)", dest)
+			}
+		case *ast.Image:
+			if alt := plainInlineText(child, source); alt != "" {
+				fmt.Fprintf(&b, "[%s]", alt)
+			}
+		case *ast.RawHTML:
+			// HTML is not shown.
+		default:
+			b.WriteString(plainInlineText(child, source))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.etcd.io/bbolt"
+)
+
+// requestDurationBuckets are the upper bounds, in seconds, of the request
+// latency histogram buckets.
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// syncClientWindow is how recently a client must have downloaded the
+// library or its changes to count as a connected sync client.
+const syncClientWindow = 5 * time.Minute
+
+type requestKey struct {
+	route, method, code string
+}
+
+type routeKey struct {
+	route, method string
+}
+
+// syncClient identifies a client by its address and the hash of its
+// credentials, as metrics are collected before requests are authenticated.
+type syncClient struct {
+	ip        string
+	tokenHash [sha256.Size]byte
+}
+
+type histogram struct {
+	// counts[i] is the number of observations in bucket i, not cumulative.
+	// The last count is of observations above all buckets.
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(requestDurationBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// serverMetrics collects the request metrics exposed by /metrics. Metrics
+// about the library and database are read when scraped.
+type serverMetrics struct {
+	uploadBytes uint64 // atomic
+
+	mtx       sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[routeKey]*histogram
+	// syncClients maps each client that downloaded the library or its
+	// changes to when it last did.
+	syncClients map[syncClient]time.Time
+	// library caches the counts of categories and items in the library, so
+	// that it is only walked when scraped after it changed.
+	library libraryCounts
+}
+
+// libraryCounts are the counts of categories and items at a library
+// revision.
+type libraryCounts struct {
+	revision   uint64
+	counted    bool
+	categories int
+	items      int
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests:    make(map[requestKey]uint64),
+		durations:   make(map[routeKey]*histogram),
+		syncClients: make(map[syncClient]time.Time),
+	}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n *uint64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	atomic.AddUint64(r.n, uint64(n))
+	return n, err
+}
+
+// middleware records the count and latency of API requests by route, and
+// the bytes uploaded in request bodies.
+func (m *serverMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if r.Body != nil && r.Method != http.MethodGet {
+			r.Body = &countingReader{ReadCloser: r.Body, n: &m.uploadBytes}
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.mtx.Lock()
+		defer m.mtx.Unlock()
+		m.requests[requestKey{route, r.Method, strconv.Itoa(status)}]++
+		h := m.durations[routeKey{route, r.Method}]
+		if h == nil {
+			h = &histogram{counts: make([]uint64, len(requestDurationBuckets)+1)}
+			m.durations[routeKey{route, r.Method}] = h
+		}
+		h.observe(time.Since(start).Seconds())
+		if r.Method == http.MethodGet && status == http.StatusOK && (route == "/api/items" || route == "/api/changes") {
+			client := syncClient{
+				ip:        requestActor(r).ip,
+				tokenHash: sha256.Sum256([]byte(r.Header.Get("Authorization"))),
+			}
+			m.syncClients[client] = start
+		}
+	})
+}
+
+// connectedSyncClients counts the clients that synced recently, forgetting
+// the others.
+func (m *serverMetrics) connectedSyncClients(now time.Time) int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for client, last := range m.syncClients {
+		if now.Sub(last) > syncClientWindow {
+			delete(m.syncClients, client)
+		}
+	}
+	return len(m.syncClients)
+}
+
+// libraryCounts returns the counts of categories and items in the library,
+// counting them only if the library changed since they were last counted.
+func (m *serverMetrics) libraryCounts(tx *bbolt.Tx) libraryCounts {
+	revision := libraryRevision(tx)
+	m.mtx.Lock()
+	cached := m.library
+	m.mtx.Unlock()
+	if cached.counted && cached.revision == revision {
+		return cached
+	}
+
+	counts := libraryCounts{revision: revision, counted: true}
+	if catsBucket := tx.Bucket(categoriesBkt); catsBucket != nil {
+		catsBucket.ForEach(func(k, _ []byte) error {
+			if categoryBkt := catsBucket.Bucket(k); categoryBkt != nil {
+				counts.categories++
+				counts.items += countItems(categoryBkt)
+			}
+			return nil
+		})
+	}
+	m.mtx.Lock()
+	m.library = counts
+	m.mtx.Unlock()
+	return counts
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	sb strings.Builder
+}
+
+func (mw *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(&mw.sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricsWriter) value(name string, v interface{}, labels ...string) {
+	mw.sb.WriteString(name)
+	if len(labels) > 0 {
+		mw.sb.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				mw.sb.WriteByte(',')
+			}
+			fmt.Fprintf(&mw.sb, "%s=%q", labels[i], labels[i+1])
+		}
+		mw.sb.WriteByte('}')
+	}
+	fmt.Fprintf(&mw.sb, " %v\n", v)
+}
+
+func (mw *metricsWriter) gauge(name, help string, v interface{}) {
+	mw.header(name, "gauge", help)
+	mw.value(name, v)
+}
+
+func (mw *metricsWriter) counter(name, help string, v interface{}) {
+	mw.header(name, "counter", help)
+	mw.value(name, v)
+}
+
+func (m *serverMetrics) writeRequestMetrics(mw *metricsWriter) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requestKeys = append(requestKeys, key)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		a, b := requestKeys[i], requestKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	mw.header("remindme_http_requests_total", "counter", "API requests by route, method and status code.")
+	for _, key := range requestKeys {
+		mw.value("remindme_http_requests_total", m.requests[key], "route", key.route, "method", key.method, "code", key.code)
+	}
+
+	routeKeys := make([]routeKey, 0, len(m.durations))
+	for key := range m.durations {
+		routeKeys = append(routeKeys, key)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool {
+		if routeKeys[i].route != routeKeys[j].route {
+			return routeKeys[i].route < routeKeys[j].route
+		}
+		return routeKeys[i].method < routeKeys[j].method
+	})
+	const durationName = "remindme_http_request_duration_seconds"
+	mw.header(durationName, "histogram", "Latency of API requests by route and method.")
+	for _, key := range routeKeys {
+		h := m.durations[key]
+		var cumulative uint64
+		for i, le := range requestDurationBuckets {
+			cumulative += h.counts[i]
+			mw.value(durationName+"_bucket", cumulative, "route", key.route, "method", key.method,
+				"le", strconv.FormatFloat(le, 'g', -1, 64))
+		}
+		mw.value(durationName+"_bucket", h.total, "route", key.route, "method", key.method, "le", "+Inf")
+		mw.value(durationName+"_sum", h.sum, "route", key.route, "method", key.method)
+		mw.value(durationName+"_count", h.total, "route", key.route, "method", key.method)
+	}
+}
+
+// serveMetrics exposes the server's metrics for Prometheus.
+func (api *apiServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var dbSize int64
+	var counts libraryCounts
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		dbSize = tx.Size()
+		counts = api.metrics.libraryCounts(tx)
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error reading metrics from db: %v", err)
+		writeError(w, "error reading metrics", http.StatusInternalServerError)
+		return
+	}
+
+	mw := new(metricsWriter)
+	api.metrics.writeRequestMetrics(mw)
+	mw.counter("remindme_upload_bytes_total", "Bytes received in API request bodies.",
+		atomic.LoadUint64(&api.metrics.uploadBytes))
+	mw.gauge("remindme_sync_clients", fmt.Sprintf("Clients that downloaded the library or its changes in the last %v.",
+		syncClientWindow), api.metrics.connectedSyncClients(time.Now()))
+	mw.gauge("remindme_categories", "Categories in the library.", counts.categories)
+	mw.gauge("remindme_items", "Items in the library.", counts.items)
+	mw.gauge("remindme_db_size_bytes", "Size of the database file.", dbSize)
+
+	stats := api.db.Stats()
+	mw.gauge("remindme_db_free_pages", "Free pages on the database freelist.", stats.FreePageN)
+	mw.gauge("remindme_db_pending_pages", "Pages freed by transactions still in use.", stats.PendingPageN)
+	mw.gauge("remindme_db_free_alloc_bytes", "Bytes allocated in free pages.", stats.FreeAlloc)
+	mw.gauge("remindme_db_freelist_inuse_bytes", "Bytes used by the freelist.", stats.FreelistInuse)
+	mw.counter("remindme_db_read_tx_total", "Read transactions started.", stats.TxN)
+	mw.gauge("remindme_db_open_read_tx", "Read transactions currently open.", stats.OpenTxN)
+	txStats := stats.TxStats
+	mw.counter("remindme_db_tx_page_count_total", "Page allocations by transactions.", txStats.PageCount)
+	mw.counter("remindme_db_tx_page_alloc_bytes_total", "Bytes allocated for pages by transactions.", txStats.PageAlloc)
+	mw.counter("remindme_db_tx_cursor_count_total", "Cursors created by transactions.", txStats.CursorCount)
+	mw.counter("remindme_db_tx_node_count_total", "Node allocations by transactions.", txStats.NodeCount)
+	mw.counter("remindme_db_tx_rebalance_total", "Node rebalances by transactions.", txStats.Rebalance)
+	mw.counter("remindme_db_tx_rebalance_seconds_total", "Time spent rebalancing nodes.", txStats.RebalanceTime.Seconds())
+	mw.counter("remindme_db_tx_split_total", "Node splits by transactions.", txStats.Split)
+	mw.counter("remindme_db_tx_spill_total", "Node spills by transactions.", txStats.Spill)
+	mw.counter("remindme_db_tx_spill_seconds_total", "Time spent spilling nodes.", txStats.SpillTime.Seconds())
+	mw.counter("remindme_db_tx_write_total", "Page writes by transactions.", txStats.Write)
+	mw.counter("remindme_db_tx_write_seconds_total", "Time spent writing pages to disk.", txStats.WriteTime.Seconds())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, mw.sb.String())
+}
+
+// healthz reports that the server is running.
+func (api *apiServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the server can serve requests, checking that the
+// database can be read and the blob store is consistent.
+func (api *apiServer) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"db": "ok", "blobs": "ok"}
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		blobs, refs := tx.Bucket(blobsBkt), tx.Bucket(blobRefsBkt)
+		if (blobs == nil) != (refs == nil) {
+			checks["blobs"] = "blob store is missing its references"
+			return nil
+		}
+		if blobs != nil {
+			// Check that a blob can be read back through its reference.
+			if k, _ := refs.Cursor().First(); k != nil {
+				if found, _ := blobs.Cursor().Seek(k); !bytes.Equal(found, k) {
+					checks["blobs"] = "referenced blob " + string(k) + " is missing"
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		checks["db"] = err.Error()
+		if errors.Is(err, bbolt.ErrDatabaseNotOpen) {
+			checks["db"] = "database is closed"
+		}
+		checks["blobs"] = "not checked"
+	}
+
+	status := http.StatusOK
+	for _, check := range checks {
+		if check != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONWithStatus(w, map[string]interface{}{
+		"status": http.StatusText(status),
+		"checks": checks,
+	}, status)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+var progressBkt = []byte("progress")
+
+// progressRecord is a user's position in the reminders of a category. A
+// category has a progress record while its reminders are active for the user.
+type progressRecord = client.Progress
+
+// userProgressBucket returns the bucket of progress records for a user,
+// creating it if create is true. It returns nil if the bucket does not exist
+// and create is false.
+func userProgressBucket(tx *bbolt.Tx, user string, create bool) (*bbolt.Bucket, error) {
+	if !create {
+		progressBucket := tx.Bucket(progressBkt)
+		if progressBucket == nil {
+			return nil, nil
+		}
+		return progressBucket.Bucket([]byte(user)), nil
+	}
+	progressBucket, err := tx.CreateBucketIfNotExists(progressBkt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db record for progress: %w", err)
+	}
+	return progressBucket.CreateBucketIfNotExists([]byte(user))
+}
+
+// listProgress lists the progress records of the requesting user.
+func (api *apiServer) listProgress(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	records := make([]*progressRecord, 0)
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		userBucket, err := userProgressBucket(tx, user, false)
+		if err != nil || userBucket == nil {
+			return err
+		}
+		return userBucket.ForEach(func(_, v []byte) error {
+			record := new(progressRecord)
+			if err := json.Unmarshal(v, record); err != nil {
+				return fmt.Errorf("failed to decode progress record: %w", err)
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching progress from db: %v", err)
+		writeError(w, "error fetching progress", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, records)
+}
+
+type progressRequest struct {
+	LastIndex int `json:"lastIndex"`
+	// UpdatedAt is when the progress was made, which may be well before
+	// the request if the client was offline. Defaults to now.
+	UpdatedAt *time.Time `json:"updatedAt"`
+}
+
+// saveProgress records the requesting user's position in a category. An
+// update made before the stored record was updated is ignored, so that
+// clients syncing progress made offline do not undo newer progress. The
+// stored record is returned either way.
+func (api *apiServer) saveProgress(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	req := new(progressRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, "invalid progress request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.LastIndex < 0 {
+		writeError(w, "lastIndex cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	record := &progressRecord{
+		Category:  category,
+		LastIndex: req.LastIndex,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if req.UpdatedAt != nil && req.UpdatedAt.Before(record.UpdatedAt) {
+		record.UpdatedAt = req.UpdatedAt.UTC()
+	}
+
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		userBucket, err := userProgressBucket(tx, requestUser(r), true)
+		if err != nil {
+			return err
+		}
+		if v := userBucket.Get([]byte(category)); v != nil {
+			stored := new(progressRecord)
+			if err := json.Unmarshal(v, stored); err != nil {
+				return fmt.Errorf("failed to decode progress record: %w", err)
+			}
+			if stored.UpdatedAt.After(record.UpdatedAt) {
+				record = stored
+				return nil
+			}
+		}
+		v, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return userBucket.Put([]byte(category), v)
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error saving progress: %v", err)
+		writeError(w, "error saving progress", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, record)
+}
+
+// deleteProgress clears the requesting user's position in a category, when
+// they stop its reminders or reach the end of them.
+func (api *apiServer) deleteProgress(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		userBucket, err := userProgressBucket(tx, requestUser(r), false)
+		if err != nil || userBucket == nil {
+			return err
+		}
+		return userBucket.Delete([]byte(category))
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error deleting progress: %v", err)
+		writeError(w, "error deleting progress", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// Storage quotas limit the size of the content of the items in a category,
+// and of the items last written by a user. The content of items in the trash
+// and of older revisions is not counted. Items saved before revisions were
+// kept have no known writer and only count against their category. The
+// checklist runs and prompt responses of a user count against their quota
+// only.
+
+// quotaExceeded is returned when storing an item would take a category or
+// user over its quota.
+type quotaExceeded struct {
+	msg string
+}
+
+func (e *quotaExceeded) Error() string {
+	return e.msg
+}
+
+var (
+	usageBkt         = []byte("usage")
+	categoryUsageBkt = []byte("categories")
+	userUsageBkt     = []byte("users")
+)
+
+// The storage usage of each category and user is kept up to date as items
+// are written, deleted and restored, so that quotas are checked without
+// adding up the size of every item.
+
+// addUsage adds bytes and items to the usage of a category and of a user,
+// each if not empty. Usage records that drop to nothing are deleted.
+func addUsage(tx *bbolt.Tx, category, user string, bytes int64, items int) error {
+	usage, err := tx.CreateBucketIfNotExists(usageBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open db record for storage usage: %w", err)
+	}
+	if category != "" {
+		if err = addUsageRecord(usage, categoryUsageBkt, category, bytes, items); err != nil {
+			return err
+		}
+	}
+	if user == "" {
+		return nil
+	}
+	return addUsageRecord(usage, userUsageBkt, user, bytes, items)
+}
+
+func addUsageRecord(usage *bbolt.Bucket, kind []byte, name string, bytes int64, items int) error {
+	records, err := usage.CreateBucketIfNotExists(kind)
+	if err != nil {
+		return err
+	}
+	record, err := decodeUsage(name, records.Get([]byte(name)))
+	if err != nil {
+		return err
+	}
+	record.Bytes += bytes
+	record.Items += items
+	if record.Bytes <= 0 && record.Items <= 0 {
+		return records.Delete([]byte(name))
+	}
+	v, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return records.Put([]byte(name), v)
+}
+
+func decodeUsage(name string, v []byte) (*client.Usage, error) {
+	record := &client.Usage{Name: name}
+	if v == nil {
+		return record, nil
+	}
+	if err := json.Unmarshal(v, record); err != nil {
+		return nil, fmt.Errorf("failed to decode storage usage of %s: %w", name, err)
+	}
+	return record, nil
+}
+
+// readUsage returns the usage of a category or user, depending on kind.
+func readUsage(tx *bbolt.Tx, kind []byte, name string) (*client.Usage, error) {
+	var v []byte
+	if usage := tx.Bucket(usageBkt); usage != nil {
+		if records := usage.Bucket(kind); records != nil {
+			v = records.Get([]byte(name))
+		}
+	}
+	return decodeUsage(name, v)
+}
+
+// readAllUsage returns the usage of every category or user, depending on
+// kind, sorted by name.
+func readAllUsage(tx *bbolt.Tx, kind []byte) ([]*client.Usage, error) {
+	all := make([]*client.Usage, 0)
+	usage := tx.Bucket(usageBkt)
+	if usage == nil || usage.Bucket(kind) == nil {
+		return all, nil
+	}
+	err := usage.Bucket(kind).ForEach(func(k, v []byte) error {
+		record, err := decodeUsage(string(k), v)
+		if err != nil {
+			return err
+		}
+		all = append(all, record)
+		return nil
+	})
+	return all, err
+}
+
+// countItemUsage adds an item to the usage of its category and of the user
+// that last wrote it, or removes it if sign is -1. It must be called while
+// the item's revisions are in place.
+func countItemUsage(tx *bbolt.Tx, category, itemName string, itemBkt *bbolt.Bucket, sign int) error {
+	writer, err := itemWriter(tx, category, itemName)
+	if err != nil {
+		return err
+	}
+	size := int64(len(itemBkt.Get(itemContentKey)))
+	return addUsage(tx, category, writer, int64(sign)*size, sign)
+}
+
+// countStorageUsage adds up the size of all items and user item records to
+// start keeping the usage of a db that did not.
+func countStorageUsage(tx *bbolt.Tx) error {
+	if err := tx.DeleteBucket(usageBkt); err != nil && !errors.Is(err, bbolt.ErrBucketNotFound) {
+		return err
+	}
+	for _, top := range [][]byte{checklistRunsBkt, responsesBkt} {
+		if err := countUserItemRecords(tx, top); err != nil {
+			return err
+		}
+	}
+	catsBucket := tx.Bucket(categoriesBkt)
+	if catsBucket == nil {
+		return nil
+	}
+	return catsBucket.ForEach(func(catB, v []byte) error {
+		catBucket := catsBucket.Bucket(catB)
+		if v != nil || catBucket == nil {
+			return nil
+		}
+		return catBucket.ForEach(func(itemB, v []byte) error {
+			itemBkt := catBucket.Bucket(itemB)
+			if v != nil || itemBkt == nil {
+				return nil
+			}
+			return countItemUsage(tx, string(catB), string(itemB), itemBkt, 1)
+		})
+	})
+}
+
+// countUserItemRecords adds the records stored with putUserItemRecord under
+// top to the usage of their users.
+func countUserItemRecords(tx *bbolt.Tx, top []byte) error {
+	topBkt := tx.Bucket(top)
+	if topBkt == nil {
+		return nil
+	}
+	return topBkt.ForEach(func(user, _ []byte) error {
+		var size int64
+		userBkt := topBkt.Bucket(user)
+		err := userBkt.ForEach(func(category, _ []byte) error {
+			catBkt := userBkt.Bucket(category)
+			return catBkt.ForEach(func(itemName, _ []byte) error {
+				return catBkt.Bucket(itemName).ForEach(func(_, v []byte) error {
+					size += int64(len(v))
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return addUsage(tx, "", string(user), size, 0)
+	})
+}
+
+// itemWriter returns the user that last wrote an item, from its newest
+// revision record.
+func itemWriter(tx *bbolt.Tx, category, itemName string) (string, error) {
+	itemRevisions, err := itemRevisionsBucket(tx, category, itemName, false)
+	if err != nil || itemRevisions == nil {
+		return "", err
+	}
+	_, v := itemRevisions.Cursor().Last()
+	if v == nil {
+		return "", nil
+	}
+	record := new(revisionRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return "", fmt.Errorf("failed to decode revision record: %w", err)
+	}
+	return record.Editor, nil
+}
+
+// quotaChecker checks writes against the configured quotas.
+type quotaChecker struct {
+	userQuota, categoryQuota int64
+}
+
+func (api *apiServer) quotas() *quotaChecker {
+	return &quotaChecker{userQuota: api.userQuota, categoryQuota: api.categoryQuota}
+}
+
+func (qc *quotaChecker) enabled() bool {
+	return qc.userQuota > 0 || qc.categoryQuota > 0
+}
+
+// reserve checks that who may store item in category, replacing the item of
+// the same name if there is one. Writes that do not grow the content are
+// allowed even if a quota is exceeded, so that space can be freed by
+// replacing items. A *quotaExceeded error is returned if the item does not
+// fit. It must be called before the item is stored.
+func (qc *quotaChecker) reserve(tx *bbolt.Tx, category string, item *Item, who actor) error {
+	if !qc.enabled() {
+		return nil
+	}
+	oldSize, ownSize, err := replacedSize(tx, category, item.Name, who)
+	newSize := int64(len(item.Content))
+	if err != nil || newSize <= oldSize {
+		return err
+	}
+	return qc.check(tx, category, newSize-oldSize, who.user, newSize-ownSize)
+}
+
+// allowance returns the size of the largest item who may store in
+// category under the name itemName, as reserve would allow.
+func (qc *quotaChecker) allowance(tx *bbolt.Tx, category, itemName string, who actor) (int64, error) {
+	allowed := int64(math.MaxInt64)
+	if !qc.enabled() {
+		return allowed, nil
+	}
+	oldSize, ownSize, err := replacedSize(tx, category, itemName, who)
+	if err != nil {
+		return 0, err
+	}
+	if qc.categoryQuota > 0 {
+		usage, err := readUsage(tx, categoryUsageBkt, category)
+		if err != nil {
+			return 0, err
+		}
+		if left := qc.categoryQuota - usage.Bytes + oldSize; left < allowed {
+			allowed = left
+		}
+	}
+	if qc.userQuota > 0 && who.user != "" {
+		usage, err := readUsage(tx, userUsageBkt, who.user)
+		if err != nil {
+			return 0, err
+		}
+		if left := qc.userQuota - usage.Bytes + ownSize; left < allowed {
+			allowed = left
+		}
+	}
+	if allowed < oldSize {
+		allowed = oldSize
+	}
+	return allowed, nil
+}
+
+// replacedSize returns the content size of the item that a write would
+// replace, and the part of it counted in who's usage: all of it if who
+// wrote the item last, otherwise none.
+func replacedSize(tx *bbolt.Tx, category, itemName string, who actor) (oldSize, ownSize int64, err error) {
+	itemBkt := itemBucket(tx, category, itemName)
+	if itemBkt == nil {
+		return 0, 0, nil
+	}
+	oldSize = int64(len(itemBkt.Get(itemContentKey)))
+	oldWriter, err := itemWriter(tx, category, itemName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if oldWriter == who.user {
+		ownSize = oldSize
+	}
+	return oldSize, ownSize, nil
+}
+
+// checkRestored checks that the items of a category just restored, last
+// written by users, keep the category and users within their quotas. A
+// *quotaExceeded error is returned if they do not.
+func (qc *quotaChecker) checkRestored(tx *bbolt.Tx, category string, users []string) error {
+	if !qc.enabled() {
+		return nil
+	}
+	if err := qc.check(tx, category, 0, "", 0); err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := qc.check(tx, "", 0, user, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns a *quotaExceeded error if growing the usage of category
+// and user by the given bytes would take either over its quota. Empty names
+// are not checked.
+func (qc *quotaChecker) check(tx *bbolt.Tx, category string, catGrowth int64, user string, userGrowth int64) error {
+	if category != "" && qc.categoryQuota > 0 {
+		usage, err := readUsage(tx, categoryUsageBkt, category)
+		if err != nil {
+			return err
+		}
+		if catBytes := usage.Bytes + catGrowth; catBytes > qc.categoryQuota {
+			return &quotaExceeded{fmt.Sprintf("category %s would use %d bytes, over its quota of %d bytes",
+				category, catBytes, qc.categoryQuota)}
+		}
+	}
+	if user != "" && qc.userQuota > 0 {
+		usage, err := readUsage(tx, userUsageBkt, user)
+		if err != nil {
+			return err
+		}
+		if userBytes := usage.Bytes + userGrowth; userBytes > qc.userQuota {
+			return &quotaExceeded{fmt.Sprintf("user %s would use %d bytes, over their quota of %d bytes",
+				user, userBytes, qc.userQuota)}
+		}
+	}
+	return nil
+}
+
+// getUsage returns the size of the items of each category and user, and
+// the upload limits and quotas.
+func (api *apiServer) getUsage(w http.ResponseWriter, r *http.Request) {
+	resp := &client.StorageUsage{
+		MaxUploadBytes: api.maxUploadBytes,
+		UserQuota:      api.userQuota,
+		CategoryQuota:  api.categoryQuota,
+	}
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		if resp.Users, err = readAllUsage(tx, userUsageBkt); err != nil {
+			return err
+		}
+		resp.Categories, err = readAllUsage(tx, categoryUsageBkt)
+		return err
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error reading storage usage from db: %v", err)
+		writeError(w, "error reading storage usage", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resp)
+}
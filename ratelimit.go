@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit is a number of requests allowed per period, in bursts of up to
+// that many requests. A limit of 0 requests is no limit.
+type rateLimit struct {
+	n   int
+	per time.Duration
+}
+
+func (l *rateLimit) String() string {
+	if l.n <= 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%v", l.n, l.per)
+}
+
+// Set parses a limit such as 300/1m, or off.
+func (l *rateLimit) Set(v string) error {
+	if v == "off" || v == "0" {
+		*l = rateLimit{}
+		return nil
+	}
+	i := strings.Index(v, "/")
+	if i < 0 {
+		return fmt.Errorf("expected <requests>/<period> or off, got %q", v)
+	}
+	n, err := strconv.Atoi(v[:i])
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid number of requests %q", v[:i])
+	}
+	per, err := time.ParseDuration(v[i+1:])
+	if err != nil || per <= 0 {
+		return fmt.Errorf("invalid period %q", v[i+1:])
+	}
+	*l = rateLimit{n: n, per: per}
+	return nil
+}
+
+// tokenBucket holds the requests a client can make right away. It is
+// refilled at the rate of its limit.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter keeps a token bucket for each client.
+type limiter struct {
+	limit rateLimit
+
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newLimiter(limit rateLimit) *limiter {
+	return &limiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// take takes a token from a client's bucket. If the bucket is empty, it
+// returns how long until a token is available.
+func (l *limiter) take(key string, now time.Time) time.Duration {
+	if l.limit.n <= 0 {
+		return 0
+	}
+	rate := float64(l.limit.n) / l.limit.per.Seconds()
+	burst := float64(l.limit.n)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	// Buckets that were refilled since are forgotten, a new bucket is
+	// full.
+	if now.Sub(l.lastSweep) >= l.limit.per {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) >= l.limit.per {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// authBans bans addresses for a while after repeated failed
+// authentications. Failures are counted over the length of a ban.
+type authBans struct {
+	maxFailures int
+	duration    time.Duration
+
+	mtx       sync.Mutex
+	failures  map[string][]time.Time
+	banned    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newAuthBans(maxFailures int, duration time.Duration) *authBans {
+	return &authBans{
+		maxFailures: maxFailures,
+		duration:    duration,
+		failures:    make(map[string][]time.Time),
+		banned:      make(map[string]time.Time),
+	}
+}
+
+// failed records a failed authentication from ip. It returns true if the
+// address is banned as a result.
+func (b *authBans) failed(ip string, now time.Time) bool {
+	if b.maxFailures <= 0 {
+		return false
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.sweep(now)
+	recent := b.failures[ip][:0]
+	for _, t := range b.failures[ip] {
+		if now.Sub(t) < b.duration {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < b.maxFailures {
+		b.failures[ip] = recent
+		return false
+	}
+	delete(b.failures, ip)
+	b.banned[ip] = now.Add(b.duration)
+	return true
+}
+
+// bannedFor returns how long ip remains banned, or 0 if it is not.
+func (b *authBans) bannedFor(ip string, now time.Time) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.sweep(now)
+	until, ok := b.banned[ip]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(b.banned, ip)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+// sweep forgets the failures and bans of addresses that are over, at most
+// once per ban duration. The mutex must be held.
+func (b *authBans) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.duration {
+		return
+	}
+	for ip, failures := range b.failures {
+		if now.Sub(failures[len(failures)-1]) >= b.duration {
+			delete(b.failures, ip)
+		}
+	}
+	for ip, until := range b.banned {
+		if !now.Before(until) {
+			delete(b.banned, ip)
+		}
+	}
+	b.lastSweep = now
+}
+
+// rateLimiter limits the requests of each address and user. Expensive
+// requests, such as uploads and downloads of the whole library, have their
+// own limits on top of the limits of all requests. Addresses are limited
+// before requests are authenticated and users after, so that the limits of
+// users cannot be used up with made up credentials.
+type rateLimiter struct {
+	ip, user                   *limiter
+	expensiveIP, expensiveUser *limiter
+	bans                       *authBans
+}
+
+func newRateLimiter(cfg *config) *rateLimiter {
+	return &rateLimiter{
+		ip:            newLimiter(cfg.RateLimit),
+		user:          newLimiter(cfg.RateLimit),
+		expensiveIP:   newLimiter(cfg.ExpensiveRateLimit),
+		expensiveUser: newLimiter(cfg.ExpensiveRateLimit),
+		bans:          newAuthBans(cfg.AuthBanFailures, cfg.AuthBanDuration),
+	}
+}
+
+// middleware rejects requests from banned addresses and requests over the
+// address limit of all requests. It must run before authenticate.
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := rl.bans.bannedFor(requestActor(r).ip, time.Now()); wait > 0 {
+			writeRateLimited(w, "too many failed authentications", wait)
+			return
+		}
+		if rl.allow(w, r, rl.ip, nil) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// users is middleware that rejects requests over the user limit of all
+// requests. It must run after authenticate.
+func (rl *rateLimiter) users(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.allow(w, r, nil, rl.user) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// expensive is middleware for expensive routes that rejects requests over
+// their limits. It must run after authenticate.
+func (rl *rateLimiter) expensive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.allow(w, r, rl.expensiveIP, rl.expensiveUser) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// allow takes a token for the address and then the user of a request,
+// writing a 429 response and returning false if either is over its limit.
+// A nil limiter is skipped, as is the user limiter for anonymous requests,
+// which are only limited by address.
+func (rl *rateLimiter) allow(w http.ResponseWriter, r *http.Request, byIP, byUser *limiter) bool {
+	now := time.Now()
+	var wait time.Duration
+	if byIP != nil {
+		wait = byIP.take(requestActor(r).ip, now)
+	}
+	if user := requestUser(r); wait == 0 && byUser != nil && user != anonymousUser {
+		wait = byUser.take(user, now)
+	}
+	if wait == 0 {
+		return true
+	}
+	reqLog(r).Debugf("rate limited for %v", wait)
+	writeRateLimited(w, "too many requests", wait)
+	return false
+}
+
+// authFailed records a failed authentication from a request's address,
+// banning it if it failed too often.
+func (rl *rateLimiter) authFailed(r *http.Request) {
+	ip := requestActor(r).ip
+	if rl.bans.failed(ip, time.Now()) {
+		apiLog.Warnf("banning %s for %v after %d failed authentications", ip, rl.bans.duration, rl.bans.maxFailures)
+	}
+}
+
+// writeRateLimited writes a 429 response asking the client to retry after
+// wait.
+func writeRateLimited(w http.ResponseWriter, msg string, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeError(w, fmt.Sprintf("%s, retry in %d seconds", msg, secs), http.StatusTooManyRequests)
+}
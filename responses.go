@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// responsesBkt holds users' answers to prompts, in nested buckets by user,
+// category and item, keyed by when they were written. Answers are only
+// listed to the user who wrote them.
+var responsesBkt = []byte("responses")
+
+// maxResponse is the length of the longest answer to a prompt, in
+// characters.
+const maxResponse = 10000
+
+// checkPrompt checks that a prompt has text, trimming the space around it.
+func checkPrompt(item *Item) error {
+	item.Content = bytes.TrimSpace(item.Content)
+	if len(item.Content) == 0 {
+		return errors.New("prompt must have text")
+	}
+	if !utf8.Valid(item.Content) {
+		return errors.New("prompt must be UTF-8 text")
+	}
+	return nil
+}
+
+// promptFallback lists a prompt as a text item of the prompt.
+func promptFallback(item *Item) {
+	item.Type = client.TypeText
+}
+
+func responseKey(writtenAt time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(writtenAt.UnixNano()))
+	return key
+}
+
+type responseRequest struct {
+	WrittenAt time.Time `json:"writtenAt"`
+	Text      string    `json:"text"`
+}
+
+// saveResponse stores the requesting user's answer to a prompt, replacing
+// the answer written at the same time. Answers are kept if their prompt is
+// deleted, and may be saved for it after, so that answers written offline
+// are not lost.
+func (api *apiServer) saveResponse(w http.ResponseWriter, r *http.Request) {
+	category, itemName := urlParam(r, "category"), urlParam(r, "item")
+	req := new(responseRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, "invalid response: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := &client.PromptResponse{
+		Category:  category,
+		Item:      itemName,
+		WrittenAt: req.WrittenAt.UTC(),
+		Text:      strings.TrimSpace(req.Text),
+	}
+	switch {
+	case response.WrittenAt.IsZero():
+		writeError(w, "writtenAt is required", http.StatusBadRequest)
+		return
+	case response.WrittenAt.After(time.Now()):
+		writeError(w, "writtenAt cannot be in the future", http.StatusBadRequest)
+		return
+	case response.Text == "":
+		writeError(w, "response must have text", http.StatusBadRequest)
+		return
+	case !utf8.ValidString(response.Text):
+		writeError(w, "response must be UTF-8 text", http.StatusBadRequest)
+		return
+	case utf8.RuneCountInString(response.Text) > maxResponse:
+		writeError(w, fmt.Sprintf("response is longer than %d characters", maxResponse), http.StatusBadRequest)
+		return
+	}
+
+	var notPrompt bool
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		if itemBkt := itemBucket(tx, category, itemName); itemBkt != nil {
+			if notPrompt = string(itemBkt.Get(itemTypeKey)) != client.TypePrompt; notPrompt {
+				return nil
+			}
+		}
+		v, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		who := requestActor(r)
+		before, err := putUserItemRecord(tx, api.quotas(), responsesBkt, who.user, category, itemName,
+			responseKey(response.WrittenAt), v)
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, who, &auditEntry{
+			Action:   client.AuditResponseSaved,
+			Category: category,
+			Item:     itemName,
+			Target:   response.WrittenAt.Format(time.RFC3339Nano),
+			Before:   before,
+			After:    contentHash(v),
+		})
+	})
+	var overQuota *quotaExceeded
+	switch {
+	case errors.As(err, &overQuota):
+		writeError(w, overQuota.Error(), http.StatusInsufficientStorage)
+	case err != nil:
+		reqLog(r).Errorf("Error saving response: %v", err)
+		writeError(w, "error saving response", http.StatusInternalServerError)
+	case notPrompt:
+		writeError(w, itemName+" is not a prompt", http.StatusBadRequest)
+	default:
+		writeJSON(w, response)
+	}
+}
+
+// listResponses lists the requesting user's answers to prompts, oldest
+// first, or those to the prompts of the category and item given by the
+// category and item query parameters.
+func (api *apiServer) listResponses(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	categoryFilter, itemFilter := query.Get("category"), query.Get("item")
+	responses := make([]*client.PromptResponse, 0)
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		bkt := tx.Bucket(responsesBkt)
+		if bkt != nil {
+			bkt = bkt.Bucket([]byte(requestUser(r)))
+		}
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(category, _ []byte) error {
+			categoryBkt := bkt.Bucket(category)
+			if categoryBkt == nil || (categoryFilter != "" && categoryFilter != string(category)) {
+				return nil
+			}
+			return categoryBkt.ForEach(func(item, _ []byte) error {
+				itemBkt := categoryBkt.Bucket(item)
+				if itemBkt == nil || (itemFilter != "" && itemFilter != string(item)) {
+					return nil
+				}
+				return itemBkt.ForEach(func(_, v []byte) error {
+					response := new(client.PromptResponse)
+					if err := json.Unmarshal(v, response); err != nil {
+						return fmt.Errorf("failed to decode response: %w", err)
+					}
+					responses = append(responses, response)
+					return nil
+				})
+			})
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error reading responses: %v", err)
+		writeError(w, "error fetching responses", http.StatusInternalServerError)
+		return
+	}
+	sort.SliceStable(responses, func(i, j int) bool {
+		return responses[i].WrittenAt.Before(responses[j].WrittenAt)
+	})
+	writeJSON(w, responses)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	// revisionsBkt holds a bucket for each category with a bucket of
+	// revision records for each item, keyed by item version.
+	revisionsBkt        = []byte("revisions")
+	categorySettingsBkt = []byte("category_settings")
+)
+
+const (
+	defaultRevisionLimit = 20
+	maxRevisionLimit     = 1000
+)
+
+type revisionRecord = client.Revision
+
+// getCategorySettings returns the settings of a category, which are the
+// defaults if they were never changed.
+func getCategorySettings(tx *bbolt.Tx, category string) (*client.CategorySettings, error) {
+	settings := &client.CategorySettings{RevisionLimit: defaultRevisionLimit}
+	if settingsBucket := tx.Bucket(categorySettingsBkt); settingsBucket != nil {
+		if v := settingsBucket.Get([]byte(category)); v != nil {
+			if err := json.Unmarshal(v, settings); err != nil {
+				return nil, fmt.Errorf("failed to decode category settings: %w", err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// itemRevisionsBucket returns the bucket of an item's revision records,
+// creating it if create is true. It returns nil if the bucket does not exist
+// and create is false.
+func itemRevisionsBucket(tx *bbolt.Tx, category, itemName string, create bool) (*bbolt.Bucket, error) {
+	if !create {
+		revisions := tx.Bucket(revisionsBkt)
+		if revisions == nil {
+			return nil, nil
+		}
+		catRevisions := revisions.Bucket([]byte(category))
+		if catRevisions == nil {
+			return nil, nil
+		}
+		return catRevisions.Bucket([]byte(itemName)), nil
+	}
+	revisions, err := tx.CreateBucketIfNotExists(revisionsBkt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db record for revisions: %w", err)
+	}
+	catRevisions, err := revisions.CreateBucketIfNotExists([]byte(category))
+	if err != nil {
+		return nil, err
+	}
+	return catRevisions.CreateBucketIfNotExists([]byte(itemName))
+}
+
+// recordRevision saves the content and metadata of an item version in its
+// revision history, dropping the oldest revisions beyond the category's
+// limit.
+func recordRevision(tx *bbolt.Tx, category string, item *Item, editor string, t time.Time) error {
+	itemRevisions, err := itemRevisionsBucket(tx, category, item.Name, true)
+	if err != nil {
+		return err
+	}
+	hash, err := putBlob(tx, item.Content)
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(&revisionRecord{
+		Version:  item.Version,
+		Type:     item.Type,
+		Hash:     hash,
+		Size:     len(item.Content),
+		Editor:   editor,
+		Metadata: item.Metadata,
+		Time:     t,
+	})
+	if err != nil {
+		return err
+	}
+	if err = itemRevisions.Put(uint64Bytes(item.Version), v); err != nil {
+		return err
+	}
+	settings, err := getCategorySettings(tx, category)
+	if err != nil {
+		return err
+	}
+	return trimRevisions(tx, itemRevisions, settings.RevisionLimit)
+}
+
+// keepLegacyRevision records the current content of an item saved before
+// revisions were kept, so that it is not lost when the item is updated.
+func keepLegacyRevision(tx *bbolt.Tx, category, itemName string, itemBkt *bbolt.Bucket) error {
+	version := itemVersion(itemBkt)
+	itemRevisions, err := itemRevisionsBucket(tx, category, itemName, false)
+	if err != nil {
+		return err
+	}
+	if itemRevisions != nil && itemRevisions.Get(uint64Bytes(version)) != nil {
+		return nil
+	}
+	return recordRevision(tx, category, &Item{
+		Name:    itemName,
+		Type:    string(itemBkt.Get(itemTypeKey)),
+		Content: itemBkt.Get(itemContentKey),
+		Version: version,
+	}, "", time.Time{})
+}
+
+// trimRevisions deletes the oldest revisions in a bucket of revision records
+// until limit remain.
+func trimRevisions(tx *bbolt.Tx, itemRevisions *bbolt.Bucket, limit int) error {
+	// Stats does not count changes made in the transaction, so count the
+	// records with a cursor.
+	var n int
+	cursor := itemRevisions.Cursor()
+	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+		n++
+	}
+	for k, v := cursor.First(); k != nil && n > limit; k, v = cursor.First() {
+		record := new(revisionRecord)
+		if err := json.Unmarshal(v, record); err != nil {
+			return fmt.Errorf("failed to decode revision record: %w", err)
+		}
+		if err := releaseBlob(tx, record.Hash); err != nil {
+			return err
+		}
+		if record.Original != "" {
+			if err := releaseBlob(tx, record.Original); err != nil {
+				return err
+			}
+		}
+		if err := itemRevisions.Delete(k); err != nil {
+			return err
+		}
+		n--
+	}
+	return nil
+}
+
+// readRevisions reads the revision records of an item, newest first.
+func readRevisions(itemRevisions *bbolt.Bucket) ([]*revisionRecord, error) {
+	records := make([]*revisionRecord, 0)
+	if itemRevisions == nil {
+		return records, nil
+	}
+	cursor := itemRevisions.Cursor()
+	for k, v := cursor.Last(); k != nil; k, v = cursor.Prev() {
+		record := new(revisionRecord)
+		if err := json.Unmarshal(v, record); err != nil {
+			return nil, fmt.Errorf("failed to decode revision record: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// errRevisionNotFound is returned by withRevision if the item or revision
+// does not exist.
+var errRevisionNotFound = errors.New("revision not found")
+
+// withRevision calls f with the revision record in the revision URL
+// parameter of the request and its content, in a read transaction.
+func (api *apiServer) withRevision(r *http.Request, f func(tx *bbolt.Tx, record *revisionRecord, content []byte) error) error {
+	version, err := strconv.ParseUint(urlParam(r, "revision"), 10, 64)
+	if err != nil {
+		return errRevisionNotFound
+	}
+	return api.db.View(func(tx *bbolt.Tx) error {
+		record, content, err := findRevision(tx, urlParam(r, "category"), urlParam(r, "item"), version)
+		if err != nil {
+			return err
+		}
+		return f(tx, record, content)
+	})
+}
+
+// findRevision reads a revision of an item and its content.
+func findRevision(tx *bbolt.Tx, category, itemName string, version uint64) (*revisionRecord, []byte, error) {
+	itemRevisions, err := itemRevisionsBucket(tx, category, itemName, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if itemRevisions == nil {
+		return nil, nil, errRevisionNotFound
+	}
+	v := itemRevisions.Get(uint64Bytes(version))
+	if v == nil {
+		return nil, nil, errRevisionNotFound
+	}
+	record := new(revisionRecord)
+	if err := json.Unmarshal(v, record); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode revision record: %w", err)
+	}
+	return record, getBlob(tx, record.Hash), nil
+}
+
+// listRevisions lists the kept revisions of an item, newest first.
+func (api *apiServer) listRevisions(w http.ResponseWriter, r *http.Request) {
+	category, itemName := urlParam(r, "category"), urlParam(r, "item")
+	var records []*revisionRecord
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		catBucket := categoryBucket(tx, category)
+		if catBucket == nil {
+			return nil
+		}
+		itemBkt := catBucket.Bucket([]byte(itemName))
+		if itemBkt == nil {
+			return nil
+		}
+		itemRevisions, err := itemRevisionsBucket(tx, category, itemName, false)
+		if err != nil {
+			return err
+		}
+		if records, err = readRevisions(itemRevisions); err != nil {
+			return err
+		}
+		current := itemVersion(itemBkt)
+		for _, record := range records {
+			record.Current = record.Version == current
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching revisions from db: %v", err)
+		writeError(w, "error fetching revisions", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		writeError(w, "item not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, records)
+}
+
+// revisionContent serves the raw content of a revision, like itemContent.
+func (api *apiServer) revisionContent(w http.ResponseWriter, r *http.Request) {
+	var item *Item
+	err := api.withRevision(r, func(_ *bbolt.Tx, record *revisionRecord, content []byte) error {
+		item = &Item{Type: record.Type, Content: append([]byte(nil), content...)}
+		return nil
+	})
+	if errors.Is(err, errRevisionNotFound) {
+		writeError(w, "revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error fetching revision from db: %v", err)
+		writeError(w, "error fetching revision", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", itemContentType(item))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(item.Content))
+}
+
+// revisionDiff compares the text of a revision of a text or link item with
+// the revision in the against query parameter, by default the revision kept
+// before it.
+func (api *apiServer) revisionDiff(w http.ResponseWriter, r *http.Request) {
+	var against uint64
+	if againstStr := r.URL.Query().Get("against"); againstStr != "" {
+		var err error
+		if against, err = strconv.ParseUint(againstStr, 10, 64); err != nil {
+			writeError(w, "invalid against revision", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var diff *client.RevisionDiff
+	var badRequest string
+	err := api.withRevision(r, func(tx *bbolt.Tx, to *revisionRecord, toContent []byte) error {
+		category, itemName := urlParam(r, "category"), urlParam(r, "item")
+		if against == 0 {
+			itemRevisions, _ := itemRevisionsBucket(tx, category, itemName, false)
+			cursor := itemRevisions.Cursor()
+			cursor.Seek(uint64Bytes(to.Version))
+			k, _ := cursor.Prev()
+			if k == nil {
+				badRequest = "there is no earlier revision to compare with"
+				return nil
+			}
+			against = binary.BigEndian.Uint64(k)
+		}
+		from, fromContent, err := findRevision(tx, category, itemName, against)
+		if err != nil {
+			return err
+		}
+		for _, record := range []*revisionRecord{from, to} {
+			if !isTextType(record.Type) {
+				badRequest = fmt.Sprintf("revision %d is not text", record.Version)
+				return nil
+			}
+		}
+		text, err := unifiedDiff(fmt.Sprintf("version %d", from.Version), fmt.Sprintf("version %d", to.Version),
+			string(fromContent), string(toContent))
+		if err != nil {
+			badRequest = err.Error()
+			return nil
+		}
+		diff = &client.RevisionDiff{From: from.Version, To: to.Version, Diff: text}
+		return nil
+	})
+	if errors.Is(err, errRevisionNotFound) {
+		writeError(w, "revision not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error fetching revisions from db: %v", err)
+		writeError(w, "error fetching revisions", http.StatusInternalServerError)
+		return
+	}
+	if badRequest != "" {
+		writeError(w, badRequest, http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, diff)
+}
+
+// restoreRevision makes the content and metadata of a revision the item's
+// current ones, as a new version. An If-Match header is honored but not
+// required, as the revision to restore is named explicitly.
+func (api *apiServer) restoreRevision(w http.ResponseWriter, r *http.Request) {
+	category, itemName := urlParam(r, "category"), urlParam(r, "item")
+	version, err := strconv.ParseUint(urlParam(r, "revision"), 10, 64)
+	if err != nil {
+		writeError(w, "revision not found", http.StatusNotFound)
+		return
+	}
+	cond, err := requestCondition(r, r.FormValue("version"))
+	if err != nil || cond.createOnly {
+		writeError(w, "invalid If-Match header", http.StatusBadRequest)
+		return
+	}
+	if !cond.given() {
+		cond.anyVersion = true
+	}
+
+	var item *Item
+	err = api.db.Update(func(tx *bbolt.Tx) error {
+		catBucket := categoryBucket(tx, category)
+		if catBucket == nil || catBucket.Bucket([]byte(itemName)) == nil {
+			return errRevisionNotFound
+		}
+		record, content, err := findRevision(tx, category, itemName, version)
+		if err != nil {
+			return err
+		}
+		item = &Item{
+			Name:     itemName,
+			Type:     record.Type,
+			Content:  append([]byte(nil), content...),
+			Metadata: record.Metadata,
+		}
+		if err = api.quotas().reserve(tx, category, item, requestActor(r)); err != nil {
+			return err
+		}
+		if _, err = putItem(tx, category, item, cond, requestActor(r)); err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventCategoryUpdated, category, nil)
+	})
+	var conflict *versionConflict
+	var overQuota *quotaExceeded
+	switch {
+	case errors.As(err, &conflict):
+		writeVersionConflict(w, conflict)
+		return
+	case errors.As(err, &overQuota):
+		writeError(w, overQuota.Error(), http.StatusInsufficientStorage)
+		return
+	case errors.Is(err, errRevisionNotFound):
+		writeError(w, "revision not found", http.StatusNotFound)
+		return
+	case err != nil:
+		reqLog(r).Errorf("Error restoring revision: %v", err)
+		writeError(w, "error restoring revision", http.StatusInternalServerError)
+		return
+	}
+
+	api.webhooks.wake()
+	api.variants.wake()
+	api.links.wake()
+	w.Header().Set("ETag", itemETag(item.Version))
+	writeJSON(w, item)
+}
+
+func (api *apiServer) getSettings(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	var settings *client.CategorySettings
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		if categoryBucket(tx, category) == nil {
+			return nil
+		}
+		var err error
+		settings, err = getCategorySettings(tx, category)
+		return err
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching category settings: %v", err)
+		writeError(w, "error fetching category settings", http.StatusInternalServerError)
+		return
+	}
+	if settings == nil {
+		writeError(w, "category not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, settings)
+}
+
+// saveSettings changes the settings of a category. Revisions beyond a
+// lowered revision limit are deleted right away.
+func (api *apiServer) saveSettings(w http.ResponseWriter, r *http.Request) {
+	category := urlParam(r, "category")
+	settings := new(client.CategorySettings)
+	if err := json.NewDecoder(r.Body).Decode(settings); err != nil {
+		writeError(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if settings.RevisionLimit < 1 || settings.RevisionLimit > maxRevisionLimit {
+		writeError(w, fmt.Sprintf("revisionLimit must be between 1 and %d", maxRevisionLimit), http.StatusBadRequest)
+		return
+	}
+
+	var found bool
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		if categoryBucket(tx, category) == nil {
+			return nil
+		}
+		found = true
+		settingsBucket, err := tx.CreateBucketIfNotExists(categorySettingsBkt)
+		if err != nil {
+			return fmt.Errorf("failed to open db record for category settings: %w", err)
+		}
+		v, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		if err = settingsBucket.Put([]byte(category), v); err != nil {
+			return err
+		}
+		err = recordAudit(tx, requestActor(r), &auditEntry{
+			Action:   client.AuditCategorySettings,
+			Category: category,
+			Detail:   string(v),
+		})
+		if err != nil {
+			return err
+		}
+
+		revisions := tx.Bucket(revisionsBkt)
+		if revisions == nil || revisions.Bucket([]byte(category)) == nil {
+			return nil
+		}
+		catRevisions := revisions.Bucket([]byte(category))
+		return catRevisions.ForEach(func(k, _ []byte) error {
+			return trimRevisions(tx, catRevisions.Bucket(k), settings.RevisionLimit)
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error saving category settings: %v", err)
+		writeError(w, "error saving category settings", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "category not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, settings)
+}
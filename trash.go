@@ -0,0 +1,557 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// trashBkt holds a bucket for each deleted item or category, keyed by a
+// random id. Each has the trash record, a copy of the item or category
+// bucket and its revision history, which keeps its references to blobs
+// until the entry is purged.
+var (
+	trashBkt          = []byte("trash")
+	trashRecordKey    = []byte("record")
+	trashDataKey      = []byte("data")
+	trashRevisionsKey = []byte("revisions")
+	trashSettingsKey  = []byte("settings")
+)
+
+// trashPurgeInterval is how often expired trash entries are purged.
+const trashPurgeInterval = time.Hour
+
+var errTrashNotFound = errors.New("trash entry not found")
+
+type trashEntry = client.TrashEntry
+
+// trashConflict is returned when a trash entry cannot be restored because
+// its name was reused.
+type trashConflict struct {
+	msg string
+}
+
+func (e *trashConflict) Error() string {
+	return e.msg
+}
+
+// moveToTrash adds an entry to the trash with copies of data and revisions,
+// which may be nil. The caller deletes the originals.
+func moveToTrash(tx *bbolt.Tx, entry *trashEntry, data, revisions *bbolt.Bucket, settings []byte) error {
+	trash, err := tx.CreateBucketIfNotExists(trashBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open trash: %w", err)
+	}
+	if entry.ID, err = randomHex(8); err != nil {
+		return err
+	}
+	entryBkt, err := trash.CreateBucket([]byte(entry.ID))
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = entryBkt.Put(trashRecordKey, v); err != nil {
+		return err
+	}
+	dataBkt, err := entryBkt.CreateBucket(trashDataKey)
+	if err != nil {
+		return err
+	}
+	if err = copyBucket(dataBkt, data); err != nil {
+		return err
+	}
+	if revisions != nil {
+		trashedRevisions, err := entryBkt.CreateBucket(trashRevisionsKey)
+		if err != nil {
+			return err
+		}
+		if err = copyBucket(trashedRevisions, revisions); err != nil {
+			return err
+		}
+	}
+	if settings != nil {
+		return entryBkt.Put(trashSettingsKey, settings)
+	}
+	return nil
+}
+
+// trashItem moves an item and its revision history to the trash. Its image
+// variants or link preview are deleted, and made again if it is restored.
+func trashItem(tx *bbolt.Tx, category, itemName string, who actor, retention time.Duration) error {
+	catBucket := categoryBucket(tx, category)
+	now := time.Now().UTC()
+	entry := &trashEntry{
+		Category:  category,
+		Item:      itemName,
+		ItemCount: 1,
+		DeletedAt: now,
+		DeletedBy: who.user,
+		ExpiresAt: now.Add(retention),
+	}
+	itemRevisions, err := itemRevisionsBucket(tx, category, itemName, false)
+	if err != nil {
+		return err
+	}
+	itemBkt := catBucket.Bucket([]byte(itemName))
+	if err = countItemUsage(tx, category, itemName, itemBkt, -1); err != nil {
+		return err
+	}
+	if err = moveToTrash(tx, entry, itemBkt, itemRevisions, nil); err != nil {
+		return err
+	}
+	err = recordAudit(tx, who, &auditEntry{
+		Action:   eventItemDeleted,
+		Category: category,
+		Item:     itemName,
+		Target:   entry.ID,
+		Before:   contentHash(itemBkt.Get(itemContentKey)),
+		Version:  itemVersion(itemBkt),
+	})
+	if err != nil {
+		return err
+	}
+	if err = dropImageVariants(tx, category, itemName); err != nil {
+		return err
+	}
+	if err = dropLinkPreviews(tx, category, itemName); err != nil {
+		return err
+	}
+	if err = catBucket.DeleteBucket([]byte(itemName)); err != nil {
+		return err
+	}
+	if itemRevisions != nil {
+		return tx.Bucket(revisionsBkt).Bucket([]byte(category)).DeleteBucket([]byte(itemName))
+	}
+	return nil
+}
+
+// trashCategory moves a category, with its items, their revision histories
+// and the category settings, to the trash. The image variants and link
+// previews of its items are deleted.
+func trashCategory(tx *bbolt.Tx, category string, who actor, retention time.Duration) error {
+	catBucket := categoryBucket(tx, category)
+	now := time.Now().UTC()
+	entry := &trashEntry{
+		Category:  category,
+		ItemCount: countItems(catBucket),
+		DeletedAt: now,
+		DeletedBy: who.user,
+		ExpiresAt: now.Add(retention),
+	}
+	var catRevisions *bbolt.Bucket
+	if revisions := tx.Bucket(revisionsBkt); revisions != nil {
+		catRevisions = revisions.Bucket([]byte(category))
+	}
+	var settings []byte
+	settingsBucket := tx.Bucket(categorySettingsBkt)
+	if settingsBucket != nil {
+		settings = settingsBucket.Get([]byte(category))
+	}
+	err := catBucket.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return countItemUsage(tx, category, string(k), catBucket.Bucket(k), -1)
+	})
+	if err != nil {
+		return err
+	}
+	if err := moveToTrash(tx, entry, catBucket, catRevisions, settings); err != nil {
+		return err
+	}
+	err = recordAudit(tx, who, &auditEntry{
+		Action:   eventCategoryDeleted,
+		Category: category,
+		Target:   entry.ID,
+		Detail:   fmt.Sprintf("%d items", entry.ItemCount),
+	})
+	if err != nil {
+		return err
+	}
+	if err := dropImageVariants(tx, category, ""); err != nil {
+		return err
+	}
+	if err := dropLinkPreviews(tx, category, ""); err != nil {
+		return err
+	}
+	if err := tx.Bucket(categoriesBkt).DeleteBucket([]byte(category)); err != nil {
+		return err
+	}
+	if catRevisions != nil {
+		if err := tx.Bucket(revisionsBkt).DeleteBucket([]byte(category)); err != nil {
+			return err
+		}
+	}
+	if settings != nil {
+		return settingsBucket.Delete([]byte(category))
+	}
+	return nil
+}
+
+// getTrashEntry returns a trash entry and its bucket.
+func getTrashEntry(tx *bbolt.Tx, id string) (*trashEntry, *bbolt.Bucket, error) {
+	trash := tx.Bucket(trashBkt)
+	if trash == nil {
+		return nil, nil, errTrashNotFound
+	}
+	entryBkt := trash.Bucket([]byte(id))
+	if entryBkt == nil {
+		return nil, nil, errTrashNotFound
+	}
+	entry := new(trashEntry)
+	if err := json.Unmarshal(entryBkt.Get(trashRecordKey), entry); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode trash record: %w", err)
+	}
+	return entry, entryBkt, nil
+}
+
+// restoreTrashEntry puts a deleted item or category back where it was and
+// removes it from the trash. Restored items are listed after the existing
+// items of their category. A *trashConflict is returned if an item or
+// category with the same name was created since, and a *quotaExceeded if
+// restoring it would take its category or the users that wrote its items
+// over their quotas.
+func restoreTrashEntry(tx *bbolt.Tx, id string, who actor, quotas *quotaChecker) (*trashEntry, error) {
+	entry, entryBkt, err := getTrashEntry(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	catsBucket, err := tx.CreateBucketIfNotExists(categoriesBkt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db record for all categories")
+	}
+	if entry.Item == "" {
+		err = restoreCategory(tx, catsBucket, entry, entryBkt)
+	} else {
+		err = restoreItem(tx, catsBucket, entry, entryBkt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = countRestoredUsage(tx, entry, quotas); err != nil {
+		return nil, err
+	}
+	if err = queueWebhookEvent(tx, eventCategoryUpdated, entry.Category, nil); err != nil {
+		return nil, err
+	}
+	err = recordAudit(tx, who, &auditEntry{
+		Action:   client.AuditTrashRestored,
+		Category: entry.Category,
+		Item:     entry.Item,
+		Target:   id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, tx.Bucket(trashBkt).DeleteBucket([]byte(id))
+}
+
+// countRestoredUsage adds the items of a restored trash entry to the storage
+// usage, and checks that their category and the users that last wrote them
+// are still within their quotas.
+func countRestoredUsage(tx *bbolt.Tx, entry *trashEntry, quotas *quotaChecker) error {
+	catBucket := categoryBucket(tx, entry.Category)
+	restored := []string{entry.Item}
+	if entry.Item == "" {
+		restored = nil
+		catBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				restored = append(restored, string(k))
+			}
+			return nil
+		})
+	}
+	var writers []string
+	seen := make(map[string]bool)
+	for _, itemName := range restored {
+		if err := countItemUsage(tx, entry.Category, itemName, catBucket.Bucket([]byte(itemName)), 1); err != nil {
+			return err
+		}
+		writer, err := itemWriter(tx, entry.Category, itemName)
+		if err != nil {
+			return err
+		}
+		if writer != "" && !seen[writer] {
+			seen[writer] = true
+			writers = append(writers, writer)
+		}
+	}
+	return quotas.checkRestored(tx, entry.Category, writers)
+}
+
+func restoreItem(tx *bbolt.Tx, catsBucket *bbolt.Bucket, entry *trashEntry, entryBkt *bbolt.Bucket) error {
+	catBucket, err := catsBucket.CreateBucketIfNotExists([]byte(entry.Category))
+	if err != nil {
+		return fmt.Errorf("failed to open db record for %s", entry.Category)
+	}
+	itemBkt, err := catBucket.CreateBucket([]byte(entry.Item))
+	if errors.Is(err, bbolt.ErrBucketExists) {
+		return &trashConflict{fmt.Sprintf("%s already has an item named %s", entry.Category, entry.Item)}
+	}
+	if err != nil {
+		return err
+	}
+	if err = copyBucket(itemBkt, entryBkt.Bucket(trashDataKey)); err != nil {
+		return err
+	}
+	order, err := catBucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err = itemBkt.Put(itemOrderKey, uint64Bytes(order)); err != nil {
+		return err
+	}
+	if trashedRevisions := entryBkt.Bucket(trashRevisionsKey); trashedRevisions != nil {
+		itemRevisions, err := itemRevisionsBucket(tx, entry.Category, entry.Item, true)
+		if err != nil {
+			return err
+		}
+		if err = copyBucket(itemRevisions, trashedRevisions); err != nil {
+			return err
+		}
+	}
+	if err = recordChange(tx, eventItemCreated, entry.Category, entry.Item); err != nil {
+		return err
+	}
+	return queueWebhookEvent(tx, eventItemCreated, entry.Category, &Item{
+		Name:    entry.Item,
+		Type:    string(itemBkt.Get(itemTypeKey)),
+		Content: itemBkt.Get(itemContentKey),
+		Version: itemVersion(itemBkt),
+	})
+}
+
+func restoreCategory(tx *bbolt.Tx, catsBucket *bbolt.Bucket, entry *trashEntry, entryBkt *bbolt.Bucket) error {
+	catBucket, err := catsBucket.CreateBucket([]byte(entry.Category))
+	if errors.Is(err, bbolt.ErrBucketExists) {
+		return &trashConflict{fmt.Sprintf("a category named %s was created since it was deleted", entry.Category)}
+	}
+	if err != nil {
+		return err
+	}
+	if err = copyBucket(catBucket, entryBkt.Bucket(trashDataKey)); err != nil {
+		return err
+	}
+	items := readCategoryItems(entry.Category, catBucket)
+	// Continue the sequence used to order new items after the last item.
+	var lastOrder uint64
+	for _, item := range items {
+		if order := itemOrder(catBucket.Bucket([]byte(item.Name))); order > lastOrder {
+			lastOrder = order
+		}
+	}
+	if err = catBucket.SetSequence(lastOrder); err != nil {
+		return err
+	}
+
+	if trashedRevisions := entryBkt.Bucket(trashRevisionsKey); trashedRevisions != nil {
+		revisions, err := tx.CreateBucketIfNotExists(revisionsBkt)
+		if err != nil {
+			return fmt.Errorf("failed to open db record for revisions: %w", err)
+		}
+		catRevisions, err := revisions.CreateBucketIfNotExists([]byte(entry.Category))
+		if err != nil {
+			return err
+		}
+		if err = copyBucket(catRevisions, trashedRevisions); err != nil {
+			return err
+		}
+	}
+	if settings := entryBkt.Get(trashSettingsKey); settings != nil {
+		settingsBucket, err := tx.CreateBucketIfNotExists(categorySettingsBkt)
+		if err != nil {
+			return fmt.Errorf("failed to open db record for category settings: %w", err)
+		}
+		if err = settingsBucket.Put([]byte(entry.Category), settings); err != nil {
+			return err
+		}
+	}
+
+	for _, item := range items {
+		if err = recordChange(tx, eventItemCreated, entry.Category, item.Name); err != nil {
+			return err
+		}
+		if err = queueWebhookEvent(tx, eventItemCreated, entry.Category, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeTrashEntry deletes a trash entry for good, releasing the content of
+// its revisions.
+func purgeTrashEntry(tx *bbolt.Tx, id string, who actor) error {
+	entry, entryBkt, err := getTrashEntry(tx, id)
+	if err != nil {
+		return err
+	}
+	if trashedRevisions := entryBkt.Bucket(trashRevisionsKey); trashedRevisions != nil {
+		if entry.Item != "" {
+			err = trimRevisions(tx, trashedRevisions, 0)
+		} else {
+			err = trashedRevisions.ForEach(func(k, _ []byte) error {
+				return trimRevisions(tx, trashedRevisions.Bucket(k), 0)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = recordAudit(tx, who, &auditEntry{
+		Action:   client.AuditTrashPurged,
+		Category: entry.Category,
+		Item:     entry.Item,
+		Target:   id,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(trashBkt).DeleteBucket([]byte(id))
+}
+
+// trashPurger deletes trash entries once their retention period is over.
+type trashPurger struct {
+	db *bbolt.DB
+}
+
+func newTrashPurger(db *bbolt.DB) *trashPurger {
+	return &trashPurger{db: db}
+}
+
+// Run purges expired trash entries every hour until the context is
+// canceled.
+func (p *trashPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.purgeExpired(time.Now()); err != nil {
+			trashLog.Errorf("Error purging trash: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *trashPurger) purgeExpired(now time.Time) error {
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		trash := tx.Bucket(trashBkt)
+		if trash == nil {
+			return nil
+		}
+		var expired []string
+		err := trash.ForEach(func(k, _ []byte) error {
+			entry, _, err := getTrashEntry(tx, string(k))
+			if err != nil {
+				return err
+			}
+			if now.After(entry.ExpiresAt) {
+				expired = append(expired, entry.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err = purgeTrashEntry(tx, id, systemActor); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// listTrash lists the deleted items and categories that can be restored,
+// most recently deleted first.
+func (api *apiServer) listTrash(w http.ResponseWriter, r *http.Request) {
+	entries := make([]*trashEntry, 0)
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		trash := tx.Bucket(trashBkt)
+		if trash == nil {
+			return nil
+		}
+		return trash.ForEach(func(k, _ []byte) error {
+			entry, _, err := getTrashEntry(tx, string(k))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching trash from db: %v", err)
+		writeError(w, "error fetching trash", http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	writeJSON(w, entries)
+}
+
+// restoreTrash restores a deleted item or category and responds with its
+// trash entry.
+func (api *apiServer) restoreTrash(w http.ResponseWriter, r *http.Request) {
+	var entry *trashEntry
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		entry, err = restoreTrashEntry(tx, urlParam(r, "id"), requestActor(r), api.quotas())
+		return err
+	})
+	var conflict *trashConflict
+	var overQuota *quotaExceeded
+	switch {
+	case errors.Is(err, errTrashNotFound):
+		writeError(w, "trash entry not found", http.StatusNotFound)
+		return
+	case errors.As(err, &conflict):
+		writeError(w, conflict.msg, http.StatusConflict)
+		return
+	case errors.As(err, &overQuota):
+		writeError(w, overQuota.Error(), http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		reqLog(r).Errorf("Error restoring from trash: %v", err)
+		writeError(w, "error restoring from trash", http.StatusInternalServerError)
+		return
+	}
+
+	api.webhooks.wake()
+	api.variants.wake()
+	api.links.wake()
+	writeJSON(w, entry)
+}
+
+// purgeTrash deletes a trash entry for good without waiting for it to
+// expire.
+func (api *apiServer) purgeTrash(w http.ResponseWriter, r *http.Request) {
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		return purgeTrashEntry(tx, urlParam(r, "id"), requestActor(r))
+	})
+	if errors.Is(err, errTrashNotFound) {
+		writeError(w, "trash entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error purging trash entry: %v", err)
+		writeError(w, "error purging trash entry", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
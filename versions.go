@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+var itemVersionKey = []byte("version")
+
+// itemVersion is the version of an item, which increases with every update.
+// Items saved before versions were introduced are at version 1.
+func itemVersion(itemBkt *bbolt.Bucket) uint64 {
+	if v := itemBkt.Get(itemVersionKey); len(v) == 8 {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 1
+}
+
+// itemETag is the entity tag of an item version.
+func itemETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// itemCondition is a precondition on the current version of an item that
+// must hold for a write of the item to go ahead, so that concurrent editors
+// do not overwrite each other's changes.
+type itemCondition struct {
+	// version is the version the item must be at, if not 0. Updates of
+	// existing items require it unless anyVersion is set.
+	version uint64
+	// anyVersion allows updating the item whatever its version.
+	anyVersion bool
+	// createOnly requires that the item does not exist.
+	createOnly bool
+}
+
+// requestCondition reads the write precondition of a request from its
+// If-Match or If-None-Match header, or from versionField, the value of its
+// version form field. If-Match: * allows updating any version of an existing
+// item and If-None-Match: * only allows creating the item.
+func requestCondition(r *http.Request, versionField string) (itemCondition, error) {
+	var cond itemCondition
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		ifMatch = versionField
+	}
+	switch {
+	case ifMatch == "*":
+		cond.anyVersion = true
+	case ifMatch != "":
+		version, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), 10, 64)
+		if err != nil || version == 0 {
+			return cond, fmt.Errorf("invalid item version %q", ifMatch)
+		}
+		cond.version = version
+	}
+	if ifNoneMatch := strings.TrimSpace(r.Header.Get("If-None-Match")); ifNoneMatch != "" {
+		if ifNoneMatch != "*" {
+			return cond, fmt.Errorf("If-None-Match must be *")
+		}
+		cond.createOnly = true
+	}
+	if cond.createOnly && (cond.anyVersion || cond.version != 0) {
+		return cond, fmt.Errorf("If-Match and If-None-Match cannot be combined")
+	}
+	return cond, nil
+}
+
+// given reports whether the request stated any precondition.
+func (cond itemCondition) given() bool {
+	return cond.version != 0 || cond.anyVersion || cond.createOnly
+}
+
+// versionConflict is the error returned when a write's precondition does
+// not hold.
+type versionConflict struct {
+	status int
+	msg    string
+	// current is the item's version, or 0 if it does not exist.
+	current uint64
+}
+
+func (e *versionConflict) Error() string {
+	return e.msg
+}
+
+// check returns a *versionConflict if the condition does not hold for the
+// item, which is nil if it does not exist.
+func (cond itemCondition) check(itemBkt *bbolt.Bucket) error {
+	if itemBkt == nil {
+		if cond.version != 0 || cond.anyVersion {
+			return &versionConflict{status: http.StatusConflict, msg: "item no longer exists"}
+		}
+		return nil
+	}
+	current := itemVersion(itemBkt)
+	switch {
+	case cond.createOnly:
+		return &versionConflict{status: http.StatusConflict, msg: "item already exists", current: current}
+	case cond.anyVersion:
+		return nil
+	case cond.version == 0:
+		return &versionConflict{
+			status:  http.StatusPreconditionRequired,
+			msg:     "the current version of the item is required to update it, in an If-Match header or version field",
+			current: current,
+		}
+	case cond.version != current:
+		return &versionConflict{
+			status:  http.StatusConflict,
+			msg:     fmt.Sprintf("item was changed by someone else, it is now at version %d", current),
+			current: current,
+		}
+	}
+	return nil
+}
+
+// writeVersionConflict writes the error response for a conflict, with the
+// item's current version.
+func writeVersionConflict(w http.ResponseWriter, conflict *versionConflict) {
+	if conflict.current != 0 {
+		w.Header().Set("ETag", itemETag(conflict.current))
+	}
+	writeJSONWithStatus(w, &client.Error{
+		Code:    errorCodes[conflict.status],
+		Message: conflict.msg,
+		Version: conflict.current,
+	}, conflict.status)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webFiles are the browser clients served alongside the API.
+//
+//go:embed web
+var webFiles embed.FS
+
+// webHandler serves the embedded web files, with the web admin at the root
+// and the reminder player at /player.html.
+func webHandler() http.Handler {
+	root, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err) // the embedded directory always exists
+	}
+	return http.FileServer(http.FS(root))
+}
@@ -0,0 +1,309 @@
+'use strict';
+
+const state = {
+  categories: [],
+  category: null,
+  items: [],
+  previewURL: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function showStatus(message, isError) {
+  const status = $('status');
+  status.textContent = message;
+  status.className = isError ? 'error' : '';
+  status.hidden = !message;
+}
+
+// run performs an action, reporting any error in the status bar.
+async function run(action) {
+  try {
+    showStatus('');
+    await action();
+  } catch (err) {
+    showStatus(err.message, true);
+  }
+}
+
+async function loadCategories() {
+  state.categories = await apiJSON('/categories');
+  const list = $('categories');
+  list.replaceChildren();
+  for (const cat of state.categories) {
+    const entry = el('li', { className: cat.name === state.category ? 'selected' : '' },
+      el('span', { textContent: cat.name }),
+      el('span', { className: 'muted', textContent: ' (' + cat.itemCount + ')' }));
+    entry.addEventListener('click', () => run(() => selectCategory(cat.name)));
+    list.append(entry);
+  }
+}
+
+// loadTrash lists the deleted items and categories with buttons to restore
+// them.
+async function loadTrash() {
+  const entries = await apiJSON('/trash');
+  $('trash').replaceChildren(...entries.map((entry) => {
+    const restore = el('button', { textContent: 'Restore' });
+    restore.addEventListener('click', () => run(async () => {
+      await api('/trash/' + encodeURIComponent(entry.id) + '/restore', { method: 'POST' });
+      showStatus('Restored ' + (entry.item ? entry.item + ' to ' : '') + entry.category + '.');
+      await reload();
+    }));
+    const what = entry.item ? entry.item + ' from ' + entry.category : entry.category + ' (' + entry.itemCount + ')';
+    return el('li', { title: 'Deleted ' + new Date(entry.deletedAt).toLocaleString() + (entry.deletedBy ? ' by ' + entry.deletedBy : '') },
+      el('span', { textContent: what + ' ' }), restore);
+  }));
+  $('trash-empty').hidden = entries.length > 0;
+}
+
+async function selectCategory(name) {
+  state.category = name;
+  closePreview();
+  $('category-name').textContent = name;
+  $('category-panel').hidden = false;
+  for (const entry of $('categories').children) {
+    entry.classList.toggle('selected', entry.firstChild.textContent === name);
+  }
+  await loadItems();
+}
+
+async function loadItems() {
+  // A category that has no items yet only exists in this page.
+  if (state.categories.some((cat) => cat.name === state.category)) {
+    state.items = await apiJSON('/categories/' + encodeURIComponent(state.category) + '/items');
+  } else {
+    state.items = [];
+  }
+  renderItems();
+}
+
+function renderItems() {
+  const body = $('items').tBodies[0];
+  body.replaceChildren();
+  state.items.forEach((item, i) => {
+    const up = el('button', { textContent: '▲', title: 'Move up', disabled: i === 0 });
+    up.addEventListener('click', () => run(() => moveItem(i, i - 1)));
+    const down = el('button', { textContent: '▼', title: 'Move down', disabled: i === state.items.length - 1 });
+    down.addEventListener('click', () => run(() => moveItem(i, i + 1)));
+    const preview = el('button', { textContent: 'Preview' });
+    preview.addEventListener('click', () => run(() => previewItem(item)));
+    const del = el('button', { textContent: 'Delete', className: 'danger' });
+    del.addEventListener('click', () => run(() => deleteItem(item)));
+
+    body.append(el('tr', {},
+      el('td', {}, up, down),
+      el('td', { textContent: item.name }),
+      el('td', { textContent: item.type }),
+      el('td', { textContent: formatSize(item.size) }),
+      el('td', {}, preview, del)));
+  });
+  $('items').hidden = state.items.length === 0;
+  $('no-items').hidden = state.items.length > 0;
+}
+
+async function moveItem(from, to) {
+  const names = state.items.map((item) => item.name);
+  names.splice(to, 0, names.splice(from, 1)[0]);
+  await api('/categories/' + encodeURIComponent(state.category) + '/order', {
+    method: 'PUT',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ items: names }),
+  });
+  await loadItems();
+}
+
+async function deleteItem(item) {
+  if (!confirm('Move ' + item.name + ' to the trash?')) return;
+  await api(itemPath(state.category, item.name), { method: 'DELETE', headers: { 'If-Match': '"' + item.version + '"' } });
+  closePreview();
+  await loadCategories();
+  await loadItems();
+  await loadTrash();
+}
+
+async function deleteCategory() {
+  if (!confirm('Move ' + state.category + ' and all its items to the trash?')) return;
+  if (state.categories.some((cat) => cat.name === state.category)) {
+    await api('/categories/' + encodeURIComponent(state.category), { method: 'DELETE' });
+  }
+  state.category = null;
+  $('category-panel').hidden = true;
+  closePreview();
+  await loadCategories();
+  await loadTrash();
+}
+
+// storeItem adds a text or link item, or replaces the item at version if
+// given, and returns the item's new version. Adding fails if the category
+// has an item with the name, and replacing fails if the item was changed
+// since it was loaded, so that editors do not overwrite each other. The
+// item's metadata is replaced too, so edits must send back what they loaded.
+async function storeItem(name, type, content, version, metadata) {
+  const form = new FormData();
+  form.append('category', state.category);
+  form.append('item.name', name);
+  form.append('item.type', type);
+  form.append('item.content', content);
+  for (const [field, value] of Object.entries(metadata || {})) {
+    form.append('item.metadata.' + field, value);
+  }
+  const headers = version ? { 'If-Match': '"' + version + '"' } : { 'If-None-Match': '*' };
+  const resp = await api('/items', { method: 'POST', body: form, headers });
+  return Number(resp.headers.get('ETag').replace(/^W\//, '').replace(/"/g, ''));
+}
+
+// uploadFiles adds the selected files to the category in one request. The
+// server names items after the files and infers their types.
+async function uploadFiles() {
+  const files = Array.from($('files').files);
+  const form = new FormData();
+  for (const file of files) {
+    form.append('files', file);
+  }
+  showStatus('Uploading ' + files.length + ' file' + (files.length === 1 ? '' : 's') + '...');
+  const result = await apiJSON('/categories/' + encodeURIComponent(state.category) + '/items',
+    { method: 'POST', body: form });
+  $('upload').reset();
+  const failures = result.files.filter((file) => file.status === 'failed');
+  const summary = 'Uploaded ' + (result.created + result.updated) + ' of ' + result.files.length + ' files.';
+  if (failures.length) {
+    showStatus(summary + ' Failed: ' + failures.map((file) => file.file + ' (' + file.error + ')').join(', '), true);
+  } else {
+    showStatus(summary);
+  }
+  await loadCategories();
+  await loadItems();
+}
+
+async function addText() {
+  await storeItem($('text-name').value.trim(), $('text-type').value, $('text-content').value);
+  $('add-text').reset();
+  await loadCategories();
+  await loadItems();
+}
+
+async function previewItem(item) {
+  closePreview();
+  $('preview-name').textContent = item.name;
+  $('preview-panel').hidden = false;
+  const preview = $('preview');
+  const editForm = $('edit-text');
+  await loadRevisions(item);
+
+  if (item.type === 'image' || item.type === 'video') {
+    state.previewURL = await fetchContentURL(state.category, item.name);
+    preview.append(item.type === 'image'
+      ? el('img', { src: state.previewURL, alt: item.name })
+      : el('video', { src: state.previewURL, controls: true }));
+    return;
+  }
+
+  // The item is loaded as its own type, with its metadata, which is kept
+  // when the content is edited.
+  const current = await apiJSON(itemPath(state.category, item.name) + '?types=' + encodeURIComponent(item.type));
+  const text = decodeContent(current.Content);
+  if (item.type === 'link') {
+    preview.append(el('a', { href: text.trim(), textContent: text.trim(), target: '_blank', rel: 'noopener' }));
+  }
+  $('edit-content').value = text;
+  editForm.hidden = false;
+  editForm.onsubmit = (e) => {
+    e.preventDefault();
+    run(async () => {
+      item.version = await storeItem(item.name, item.type, $('edit-content').value, item.version, current.metadata);
+      showStatus('Saved ' + item.name + '.');
+      await loadItems();
+      await loadRevisions(item);
+    });
+  };
+}
+
+// loadRevisions lists the kept versions of the previewed item, with buttons
+// to compare text versions with the one before and to restore them.
+async function loadRevisions(item) {
+  const revisionPath = (version) => itemPath(state.category, item.name) + '/revisions/' + version;
+  const revisions = await apiJSON(itemPath(state.category, item.name) + '/revisions');
+  $('revision-diff').hidden = true;
+  $('revisions').replaceChildren(...revisions.map((revision, i) => {
+    const actions = el('td');
+    const isText = revision.type === 'text' || revision.type === 'link';
+    const previous = revisions[i + 1];
+    if (isText && previous && (previous.type === 'text' || previous.type === 'link')) {
+      const diff = el('button', { textContent: 'Diff' });
+      diff.addEventListener('click', () => run(async () => {
+        const result = await apiJSON(revisionPath(revision.version) + '/diff');
+        $('revision-diff').textContent = result.diff || 'No changes.';
+        $('revision-diff').hidden = false;
+      }));
+      actions.append(diff);
+    }
+    if (!revision.current) {
+      const restore = el('button', { textContent: 'Restore' });
+      restore.addEventListener('click', () => run(async () => {
+        const resp = await api(revisionPath(revision.version) + '/restore',
+          { method: 'POST', headers: { 'If-Match': '"' + item.version + '"' } });
+        const restored = await resp.json();
+        showStatus('Restored version ' + revision.version + ' of ' + item.name + '.');
+        await loadItems();
+        await previewItem({ ...item, type: restored.type, version: restored.version });
+      }));
+      actions.append(restore);
+    }
+    const saved = revision.time.startsWith('0001-') ? '' : new Date(revision.time).toLocaleString();
+    return el('tr', {},
+      el('td', { textContent: revision.version + (revision.current ? ' (current)' : '') }),
+      el('td', { textContent: formatSize(revision.size) }),
+      el('td', { textContent: revision.editor || '' }),
+      el('td', { textContent: saved }),
+      actions);
+  }));
+}
+
+// decodeContent decodes the base64 content of an item as UTF-8 text.
+function decodeContent(content) {
+  const bytes = Uint8Array.from(atob(content || ''), (c) => c.charCodeAt(0));
+  return new TextDecoder().decode(bytes);
+}
+
+function closePreview() {
+  if (state.previewURL) {
+    URL.revokeObjectURL(state.previewURL);
+    state.previewURL = null;
+  }
+  $('preview').replaceChildren();
+  $('edit-text').hidden = true;
+  $('revisions').replaceChildren();
+  $('revision-diff').hidden = true;
+  $('preview-panel').hidden = true;
+}
+
+async function reload() {
+  await loadCategories();
+  await loadTrash();
+  if (state.category) {
+    await loadItems();
+  }
+}
+
+setupLogin($('login'), () => run(reload));
+
+$('new-category').addEventListener('submit', (e) => {
+  e.preventDefault();
+  const name = $('new-category-name').value.trim();
+  $('new-category').reset();
+  // Categories are created on the server when their first item is added.
+  run(() => selectCategory(name));
+});
+$('delete-category').addEventListener('click', () => run(deleteCategory));
+$('upload').addEventListener('submit', (e) => {
+  e.preventDefault();
+  run(uploadFiles);
+});
+$('add-text').addEventListener('submit', (e) => {
+  e.preventDefault();
+  run(addText);
+});
+$('close-preview').addEventListener('click', closePreview);
+
+run(reload);
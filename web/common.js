@@ -0,0 +1,87 @@
+'use strict';
+
+// Helpers shared by the web clients for talking to the RemindMe API.
+
+const tokenStorageKey = 'remindme.token';
+
+class UnauthorizedError extends Error {}
+
+// api makes a request to an API path, authenticating with the stored token,
+// and throws an error for any unsuccessful response.
+async function api(path, options = {}) {
+  const headers = new Headers(options.headers || {});
+  const token = localStorage.getItem(tokenStorageKey);
+  if (token) {
+    headers.set('Authorization', 'Bearer ' + token);
+  }
+  const resp = await fetch('/api' + path, { ...options, headers });
+  if (resp.status === 401) {
+    throw new UnauthorizedError('Please sign in with an API token.');
+  }
+  if (!resp.ok) {
+    let message = resp.statusText;
+    try {
+      message = (await resp.json()).message || message;
+    } catch (err) {
+      // Not a JSON error response.
+    }
+    throw new Error(message);
+  }
+  return resp;
+}
+
+async function apiJSON(path, options) {
+  const resp = await api(path, options);
+  return resp.json();
+}
+
+// itemPath is the API path of an item, with names escaped.
+function itemPath(category, itemName) {
+  return '/categories/' + encodeURIComponent(category) + '/items/' + encodeURIComponent(itemName);
+}
+
+// fetchContentURL downloads an item's content and returns an object URL for
+// it, for use in img and video elements which cannot send the API token.
+async function fetchContentURL(category, itemName) {
+  const resp = await api(itemPath(category, itemName) + '/content');
+  return URL.createObjectURL(await resp.blob());
+}
+
+// setupLogin wires a sign in form with a token input and sign out button.
+// onChange is called after the stored token changes.
+function setupLogin(form, onChange) {
+  const input = form.querySelector('input[type=password]');
+  const logout = form.querySelector('button[type=button]');
+  const update = () => {
+    const signedIn = !!localStorage.getItem(tokenStorageKey);
+    input.hidden = signedIn;
+    form.querySelector('button[type=submit]').hidden = signedIn;
+    logout.hidden = !signedIn;
+  };
+  form.addEventListener('submit', (e) => {
+    e.preventDefault();
+    localStorage.setItem(tokenStorageKey, input.value.trim());
+    input.value = '';
+    update();
+    onChange();
+  });
+  logout.addEventListener('click', () => {
+    localStorage.removeItem(tokenStorageKey);
+    update();
+    onChange();
+  });
+  update();
+}
+
+function formatSize(bytes) {
+  if (bytes < 1024) return bytes + ' B';
+  if (bytes < 1024 * 1024) return (bytes / 1024).toFixed(1) + ' KB';
+  return (bytes / 1024 / 1024).toFixed(1) + ' MB';
+}
+
+function el(tag, props = {}, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, props);
+  node.append(...children);
+  return node;
+}
@@ -0,0 +1,336 @@
+'use strict';
+
+// reminderInterval is the time between reminders, the same as the desktop
+// app's.
+const reminderInterval = 15 * 1000;
+
+// Progress is kept in local storage so that reminders can resume offline,
+// along with the updates that have not yet been synced to the server.
+const progressStorageKey = 'remindme.progress';
+const pendingStorageKey = 'remindme.pendingProgress';
+
+const state = {
+  // library maps category names to their items.
+  library: new Map(),
+  // progress maps active categories to the index of the last item shown.
+  progress: {},
+  // active maps active categories to their timer and list entry.
+  active: new Map(),
+  syncing: false,
+};
+
+const $ = (id) => document.getElementById(id);
+
+function showStatus(message, isError) {
+  const status = $('status');
+  status.textContent = message;
+  status.className = isError ? 'error' : '';
+  status.hidden = !message;
+}
+
+async function run(action) {
+  try {
+    showStatus('');
+    await action();
+  } catch (err) {
+    showStatus(err.message, true);
+  }
+}
+
+// loadLibrary downloads all categories and items. The service worker serves
+// the last downloaded library when offline.
+async function loadLibrary() {
+  const categories = await apiJSON('/items');
+  state.library = new Map(categories.map((cat) => [cat.name, cat.items]));
+  const select = $('category');
+  select.replaceChildren(el('option', { value: '', textContent: 'Select a category' }));
+  for (const name of state.library.keys()) {
+    select.append(el('option', { value: name, textContent: name }));
+  }
+}
+
+function loadStored(key, fallback) {
+  try {
+    return JSON.parse(localStorage.getItem(key)) || fallback;
+  } catch (err) {
+    return fallback;
+  }
+}
+
+// loadProgress fetches the progress saved on the server, after sending any
+// progress made offline, or uses the locally saved progress if the server
+// cannot be reached.
+async function loadProgress() {
+  await syncProgress();
+  try {
+    const records = await apiJSON('/progress');
+    if (loadStored(pendingStorageKey, []).length > 0) {
+      throw new Error('progress not synced');
+    }
+    state.progress = {};
+    for (const record of records) {
+      state.progress[record.category] = record.lastIndex;
+    }
+  } catch (err) {
+    if (err instanceof UnauthorizedError) throw err;
+    state.progress = loadStored(progressStorageKey, {});
+  }
+  localStorage.setItem(progressStorageKey, JSON.stringify(state.progress));
+}
+
+// setProgress records the progress for a category, or clears it if
+// lastIndex is null, and syncs it to the server.
+function setProgress(category, lastIndex) {
+  if (lastIndex === null) {
+    delete state.progress[category];
+  } else {
+    state.progress[category] = lastIndex;
+  }
+  localStorage.setItem(progressStorageKey, JSON.stringify(state.progress));
+
+  const pending = loadStored(pendingStorageKey, []).filter((p) => p.category !== category);
+  pending.push({ category, lastIndex, updatedAt: new Date().toISOString() });
+  localStorage.setItem(pendingStorageKey, JSON.stringify(pending));
+  syncProgress();
+}
+
+// syncProgress sends pending progress updates to the server in order. It
+// stops at the first failure and is retried when the browser is back online.
+async function syncProgress() {
+  if (state.syncing) return;
+  state.syncing = true;
+  try {
+    for (;;) {
+      const pending = loadStored(pendingStorageKey, []);
+      if (pending.length === 0) break;
+      const update = pending[0];
+      const path = '/progress/' + encodeURIComponent(update.category);
+      if (update.lastIndex === null) {
+        await api(path, { method: 'DELETE' });
+      } else {
+        await api(path, {
+          method: 'PUT',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({ lastIndex: update.lastIndex, updatedAt: update.updatedAt }),
+        });
+      }
+      const remaining = loadStored(pendingStorageKey, []).filter((p) =>
+        p.category !== update.category || p.updatedAt !== update.updatedAt);
+      localStorage.setItem(pendingStorageKey, JSON.stringify(remaining));
+    }
+  } catch (err) {
+    // Offline or the server is unavailable, try again later.
+  } finally {
+    state.syncing = false;
+  }
+}
+
+// startTimer shows the category's items one at a time, every
+// reminderInterval, starting after the last item shown previously.
+function startTimer(immediateDisplay, category) {
+  const items = state.library.get(category);
+  if (!items || items.length === 0) {
+    return;
+  }
+  const lastIndex = category in state.progress ? state.progress[category] : -1;
+  const remaining = items.length - lastIndex - 1;
+  if (remaining <= 0) {
+    setProgress(category, null);
+    return;
+  }
+
+  const label = el('span', { textContent: category + ' (' + remaining + ')' });
+  const stop = el('button', { textContent: 'X', title: 'Stop reminders' });
+  const entry = el('li', { className: 'active-reminder' }, label, stop);
+  const reminder = { label, entry, timer: null };
+  state.active.set(category, reminder);
+  stop.addEventListener('click', () => killReminder(category));
+  $('active').append(entry);
+
+  if (immediateDisplay && !showReminder(category)) {
+    killReminder(category);
+    return;
+  }
+  reminder.timer = setInterval(() => {
+    if (!showReminder(category)) {
+      killReminder(category);
+    }
+  }, reminderInterval);
+}
+
+// killReminder stops a category's reminders and clears its progress.
+function killReminder(category) {
+  const reminder = state.active.get(category);
+  if (reminder) {
+    clearInterval(reminder.timer);
+    reminder.entry.remove();
+    state.active.delete(category);
+  }
+  setProgress(category, null);
+}
+
+// showReminder shows the next item of the category and returns whether
+// there are more items to show.
+function showReminder(category) {
+  const items = state.library.get(category);
+  if (!items || items.length === 0) {
+    return false;
+  }
+  const lastIndex = category in state.progress ? state.progress[category] : -1;
+  const nextIndex = lastIndex + 1;
+  if (nextIndex >= items.length) {
+    return false;
+  }
+
+  setProgress(category, nextIndex);
+  displayItem(category, items[nextIndex]);
+
+  const remaining = items.length - nextIndex - 1;
+  state.active.get(category).label.textContent = category + ' (' + remaining + ')';
+  return remaining > 0;
+}
+
+function decodeContent(encoded) {
+  const binary = atob(encoded || '');
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return bytes;
+}
+
+// displayItem adds a card for the item to the reminder panel and, if the
+// user allows notifications, shows a notification for it.
+function displayItem(category, item) {
+  const bytes = decodeContent(item.Content);
+  const title = category + ': ' + item.name;
+  const close = el('button', { textContent: 'Close' });
+  const card = el('article', { className: 'reminder' },
+    el('div', { className: 'title-row' }, el('h3', { textContent: title }), close));
+  let objectURL = null;
+  let notificationBody = '';
+
+  switch (item.type.toLowerCase()) {
+    case 'text': {
+      notificationBody = new TextDecoder().decode(bytes);
+      card.append(el('p', { className: 'text', textContent: notificationBody }));
+      break;
+    }
+    case 'image':
+    case 'video': {
+      objectURL = URL.createObjectURL(new Blob([bytes]));
+      card.append(item.type === 'image'
+        ? el('img', { src: objectURL, alt: item.name })
+        : el('video', { src: objectURL, controls: true }));
+      notificationBody = 'New ' + item.type.toLowerCase();
+      break;
+    }
+    case 'link': {
+      const link = new TextDecoder().decode(bytes).trim();
+      card.append(el('a', { href: link, textContent: link, target: '_blank', rel: 'noopener' }));
+      notificationBody = link;
+      break;
+    }
+    default:
+      card.append(el('p', { className: 'muted', textContent: 'This is a/an ' + item.type }));
+  }
+
+  close.addEventListener('click', () => {
+    if (objectURL) URL.revokeObjectURL(objectURL);
+    card.remove();
+    $('no-reminders').hidden = $('reminder-panel').children.length > 0;
+  });
+  $('reminder-panel').prepend(card);
+  $('no-reminders').hidden = true;
+
+  notify(title, notificationBody, item.type.toLowerCase() === 'image' ? objectURL : null);
+}
+
+function notificationsAllowed() {
+  return 'Notification' in window && Notification.permission === 'granted';
+}
+
+async function notify(title, body, image) {
+  if (!notificationsAllowed()) {
+    return;
+  }
+  const options = { body, tag: title };
+  if (image) {
+    options.image = image;
+  }
+  try {
+    // Notifications shown through the service worker stay visible after
+    // the page is closed and can focus the page when clicked.
+    const registration = 'serviceWorker' in navigator ? await navigator.serviceWorker.getRegistration() : null;
+    if (registration) {
+      await registration.showNotification(title, options);
+    } else {
+      new Notification(title, options);
+    }
+  } catch (err) {
+    console.error('notification error', err);
+  }
+}
+
+function setupNotificationsButton() {
+  const button = $('enable-notifications');
+  button.hidden = !('Notification' in window) || Notification.permission !== 'default';
+  button.addEventListener('click', async () => {
+    await Notification.requestPermission();
+    button.hidden = Notification.permission !== 'default';
+  });
+}
+
+function stopAll() {
+  for (const reminder of state.active.values()) {
+    clearInterval(reminder.timer);
+    reminder.entry.remove();
+  }
+  state.active.clear();
+}
+
+// init loads the library and resumes the reminders that were active.
+async function init() {
+  stopAll();
+  await loadLibrary();
+  await loadProgress();
+  for (const category of Object.keys(state.progress)) {
+    if (state.library.has(category)) {
+      startTimer(false, category);
+    } else {
+      setProgress(category, null);
+    }
+  }
+}
+
+setupLogin($('login'), () => run(init));
+setupNotificationsButton();
+
+$('refresh').addEventListener('click', () => run(async () => {
+  showStatus('Refreshing...');
+  await loadLibrary();
+  showStatus('');
+}));
+
+$('start').addEventListener('click', () => {
+  const category = $('category').value;
+  if (!category) {
+    showStatus('Please select a reminder category', true);
+    return;
+  }
+  if (state.active.has(category)) {
+    showStatus('Already running reminders for ' + category, true);
+    return;
+  }
+  showStatus('');
+  startTimer($('no-delay').checked, category);
+  $('category').value = '';
+});
+
+window.addEventListener('online', syncProgress);
+
+if ('serviceWorker' in navigator) {
+  navigator.serviceWorker.register('/sw.js').catch((err) => console.error('service worker error', err));
+}
+
+run(init);
@@ -0,0 +1,62 @@
+'use strict';
+
+// Service worker for the reminder player. It keeps copies of the player and
+// the last downloaded library, so that reminders keep playing when the server
+// cannot be reached. Progress is kept in local storage by the player itself.
+
+const cacheName = 'remindme-player-v1';
+const playerFiles = ['/player.html', '/common.js', '/player.js', '/style.css'];
+const cachedAPIPaths = ['/api/items'];
+
+self.addEventListener('install', (event) => {
+  event.waitUntil(caches.open(cacheName).then((cache) => cache.addAll(playerFiles)));
+  self.skipWaiting();
+});
+
+self.addEventListener('activate', (event) => {
+  event.waitUntil((async () => {
+    for (const name of await caches.keys()) {
+      if (name !== cacheName) await caches.delete(name);
+    }
+    await self.clients.claim();
+  })());
+});
+
+// Cached requests go to the network first so that the player always has the
+// latest files and library while online, and fall back to the cache.
+self.addEventListener('fetch', (event) => {
+  const url = new URL(event.request.url);
+  if (event.request.method !== 'GET' || url.origin !== self.location.origin) {
+    return;
+  }
+  if (!playerFiles.includes(url.pathname) && !cachedAPIPaths.includes(url.pathname)) {
+    return;
+  }
+  event.respondWith((async () => {
+    const cache = await caches.open(cacheName);
+    try {
+      const resp = await fetch(event.request);
+      if (resp.ok) {
+        await cache.put(url.pathname, resp.clone());
+      }
+      return resp;
+    } catch (err) {
+      const cached = await cache.match(url.pathname);
+      if (cached) return cached;
+      throw err;
+    }
+  })());
+});
+
+self.addEventListener('notificationclick', (event) => {
+  event.notification.close();
+  event.waitUntil((async () => {
+    const windows = await self.clients.matchAll({ type: 'window' });
+    const player = windows.find((w) => new URL(w.url).pathname === '/player.html');
+    if (player) {
+      await player.focus();
+    } else {
+      await self.clients.openWindow('/player.html');
+    }
+  })());
+});
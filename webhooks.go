@@ -0,0 +1,749 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/itswisdomagain/remindme/client"
+	"go.etcd.io/bbolt"
+)
+
+// Webhook event types. Library change events share the names of the change
+// log operations.
+const (
+	eventItemCreated     = client.OpItemCreated
+	eventItemUpdated     = client.OpItemUpdated
+	eventItemDeleted     = client.OpItemDeleted
+	eventCategoryUpdated = client.OpCategoryUpdated
+	eventCategoryDeleted = client.OpCategoryDeleted
+	eventReminderDue     = "reminder.due"
+	eventPing            = "ping"
+)
+
+var webhookEvents = map[string]bool{
+	eventItemCreated:     true,
+	eventItemUpdated:     true,
+	eventItemDeleted:     true,
+	eventCategoryUpdated: true,
+	eventCategoryDeleted: true,
+	eventReminderDue:     true,
+}
+
+var (
+	webhooksBkt     = []byte("webhooks")
+	webhookQueueBkt = []byte("webhook_queue")
+	webhookLogsBkt  = []byte("webhook_logs")
+)
+
+const (
+	webhookTimeout       = 10 * time.Second
+	webhookMaxAttempts   = 10
+	webhookRetryBase     = 5 * time.Second
+	webhookRetryMax      = time.Hour
+	webhookLogsPerHook   = 100
+	webhookBatchSize     = 20
+	minReminderInterval  = time.Minute
+	webhookSignatureHdr  = "X-RemindMe-Signature"
+	webhookEventHdr      = "X-RemindMe-Event"
+	webhookDeliveryIDHdr = "X-RemindMe-Delivery"
+)
+
+// webhook is a registered receiver of event notifications.
+type webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Category limits the webhook to events for a single category. It is
+	// required for reminder.due events.
+	Category string `json:"category,omitempty"`
+	// ReminderInterval is how often a reminder.due event is sent, in the
+	// format accepted by time.ParseDuration, e.g. "1h30m".
+	ReminderInterval string `json:"reminderInterval,omitempty"`
+	// Secret is the key used to sign payloads. It is only ever returned to
+	// the client that registered the webhook.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+
+	// NextReminder and ReminderIndex track the progress through the
+	// category's items for reminder.due events.
+	NextReminder  *time.Time `json:"nextReminder,omitempty"`
+	ReminderIndex int        `json:"reminderIndex"`
+}
+
+func (hook *webhook) wants(event, category string) bool {
+	if hook.Category != "" && hook.Category != category {
+		return false
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookDelivery is a queued notification for a single webhook.
+type webhookDelivery struct {
+	ID          uint64          `json:"id"`
+	HookID      string          `json:"hookId"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	CreatedAt   time.Time       `json:"createdAt"`
+}
+
+// webhookDeliveryLog records the outcome of a single delivery attempt.
+type webhookDeliveryLog struct {
+	DeliveryID uint64    `json:"deliveryId"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+	Delivered  bool      `json:"delivered"`
+	// NextAttempt is set if the delivery failed and will be retried.
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// webhookPayload is the JSON body posted to webhook URLs.
+type webhookPayload struct {
+	Event     string       `json:"event"`
+	Timestamp time.Time    `json:"timestamp"`
+	Category  string       `json:"category,omitempty"`
+	Item      *webhookItem `json:"item,omitempty"`
+}
+
+// webhookItem describes an item in a webhook payload. Content is only
+// included for text-based items, media is described by its size alone.
+type webhookItem struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content,omitempty"`
+	Size    int    `json:"size"`
+}
+
+func newWebhookPayload(event, category string, item *Item) ([]byte, error) {
+	payload := &webhookPayload{
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Category:  category,
+	}
+	if item != nil {
+		payload.Item = &webhookItem{
+			Name: item.Name,
+			Type: item.Type,
+			Size: len(item.Content),
+		}
+		if item.Type != "image" && item.Type != "video" {
+			payload.Item.Content = string(item.Content)
+		}
+	}
+	return json.Marshal(payload)
+}
+
+// queueWebhookEvent queues a delivery of the event for every webhook that is
+// subscribed to it. It is meant to be called from the db transaction that
+// makes the change being notified, so that the notification is persisted if
+// and only if the change is.
+func queueWebhookEvent(tx *bbolt.Tx, event, category string, item *Item) error {
+	hooksBucket := tx.Bucket(webhooksBkt)
+	if hooksBucket == nil {
+		return nil
+	}
+	var payload []byte
+	return hooksBucket.ForEach(func(_, v []byte) error {
+		hook := new(webhook)
+		if err := json.Unmarshal(v, hook); err != nil {
+			return fmt.Errorf("failed to decode webhook record: %w", err)
+		}
+		if !hook.wants(event, category) {
+			return nil
+		}
+		if payload == nil {
+			var err error
+			if payload, err = newWebhookPayload(event, category, item); err != nil {
+				return err
+			}
+		}
+		return queueWebhookDelivery(tx, hook.ID, event, payload)
+	})
+}
+
+func queueWebhookDelivery(tx *bbolt.Tx, hookID, event string, payload []byte) error {
+	queue, err := tx.CreateBucketIfNotExists(webhookQueueBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open webhook queue: %w", err)
+	}
+	id, err := queue.NextSequence()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	delivery, err := json.Marshal(&webhookDelivery{
+		ID:          id,
+		HookID:      hookID,
+		Event:       event,
+		Payload:     payload,
+		NextAttempt: now,
+		CreatedAt:   now,
+	})
+	if err != nil {
+		return err
+	}
+	return queue.Put(uint64Bytes(id), delivery)
+}
+
+// webhookDispatcher delivers queued webhook notifications, retrying failed
+// deliveries with exponential backoff, and queues reminder.due events as
+// they fall due.
+type webhookDispatcher struct {
+	db     *bbolt.DB
+	client *http.Client
+	wakeCh chan struct{}
+}
+
+func newWebhookDispatcher(db *bbolt.DB) *webhookDispatcher {
+	return &webhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: webhookTimeout},
+		wakeCh: make(chan struct{}, 1),
+	}
+}
+
+// wake signals the dispatcher to check the queue without waiting for the
+// next tick. It should be called after queueing new deliveries.
+func (d *webhookDispatcher) wake() {
+	select {
+	case d.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes the delivery queue until the context is canceled.
+func (d *webhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		if err := d.queueDueReminders(); err != nil {
+			webhooksLog.Errorf("Error queueing due reminders: %v", err)
+		}
+		d.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wakeCh:
+		}
+	}
+}
+
+// queueDueReminders queues a reminder.due delivery for every webhook whose
+// reminder interval has elapsed. Reminders cycle through the items of the
+// webhook's category in listing order.
+func (d *webhookDispatcher) queueDueReminders() error {
+	now := time.Now()
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		hooksBucket := tx.Bucket(webhooksBkt)
+		if hooksBucket == nil {
+			return nil
+		}
+		var dueHooks []*webhook
+		err := hooksBucket.ForEach(func(_, v []byte) error {
+			hook := new(webhook)
+			if err := json.Unmarshal(v, hook); err != nil {
+				return fmt.Errorf("failed to decode webhook record: %w", err)
+			}
+			if hook.wants(eventReminderDue, hook.Category) && hook.NextReminder != nil && !hook.NextReminder.After(now) {
+				dueHooks = append(dueHooks, hook)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, hook := range dueHooks {
+			interval, err := time.ParseDuration(hook.ReminderInterval)
+			if err != nil {
+				return fmt.Errorf("invalid reminder interval for webhook %s: %w", hook.ID, err)
+			}
+			var items []*Item
+			if catBucket := categoryBucket(tx, hook.Category); catBucket != nil {
+				items = readCategoryItems(hook.Category, catBucket)
+			}
+			if len(items) > 0 {
+				item := items[hook.ReminderIndex%len(items)]
+				payload, err := newWebhookPayload(eventReminderDue, hook.Category, item)
+				if err != nil {
+					return err
+				}
+				if err = queueWebhookDelivery(tx, hook.ID, eventReminderDue, payload); err != nil {
+					return err
+				}
+				hook.ReminderIndex = (hook.ReminderIndex + 1) % len(items)
+			}
+			next := now.Add(interval)
+			hook.NextReminder = &next
+			if err = putWebhook(tx, hook); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// deliverDue attempts every queued delivery whose next attempt is due.
+func (d *webhookDispatcher) deliverDue(ctx context.Context) {
+	now := time.Now()
+	var due []*webhookDelivery
+	hooks := make(map[string]*webhook)
+	err := d.db.View(func(tx *bbolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBkt)
+		if queue == nil {
+			return nil
+		}
+		deliveries := queue.Cursor()
+		for k, v := deliveries.First(); k != nil && len(due) < webhookBatchSize; k, v = deliveries.Next() {
+			delivery := new(webhookDelivery)
+			if err := json.Unmarshal(v, delivery); err != nil {
+				return fmt.Errorf("failed to decode webhook delivery: %w", err)
+			}
+			if delivery.NextAttempt.After(now) {
+				continue
+			}
+			if _, found := hooks[delivery.HookID]; !found {
+				hook, err := getWebhook(tx, delivery.HookID)
+				if err != nil {
+					return err
+				}
+				hooks[delivery.HookID] = hook // nil if the webhook was deleted
+			}
+			due = append(due, delivery)
+		}
+		return nil
+	})
+	if err != nil {
+		webhooksLog.Errorf("Error reading webhook queue: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range due {
+		hook := hooks[delivery.HookID]
+		if hook == nil {
+			if err := d.finishDelivery(delivery, nil); err != nil {
+				webhooksLog.Errorf("Error dropping delivery %d for deleted webhook: %v", delivery.ID, err)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(hook *webhook, delivery *webhookDelivery) {
+			defer wg.Done()
+			logEntry := d.deliver(ctx, hook, delivery)
+			if err := d.finishDelivery(delivery, logEntry); err != nil {
+				webhooksLog.Errorf("Error recording webhook delivery %d: %v", delivery.ID, err)
+			}
+		}(hook, delivery)
+	}
+	wg.Wait()
+}
+
+// deliver makes a single attempt at posting the delivery's payload to the
+// webhook's URL.
+func (d *webhookDispatcher) deliver(ctx context.Context, hook *webhook, delivery *webhookDelivery) *webhookDeliveryLog {
+	delivery.Attempts++
+	logEntry := &webhookDeliveryLog{
+		DeliveryID: delivery.ID,
+		Event:      delivery.Event,
+		Attempt:    delivery.Attempts,
+		Time:       time.Now().UTC(),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		logEntry.Error = err.Error()
+		return logEntry
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RemindMe-Webhook/1")
+	req.Header.Set(webhookEventHdr, delivery.Event)
+	req.Header.Set(webhookDeliveryIDHdr, fmt.Sprint(delivery.ID))
+	req.Header.Set(webhookSignatureHdr, signWebhookPayload(hook.Secret, delivery.Payload))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	logEntry.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		logEntry.Error = err.Error()
+		return logEntry
+	}
+	// Drain a little of the body so the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	logEntry.StatusCode = resp.StatusCode
+	logEntry.Delivered = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !logEntry.Delivered {
+		logEntry.Error = resp.Status
+	}
+	return logEntry
+}
+
+// finishDelivery records the outcome of a delivery attempt and removes the
+// delivery from the queue, or reschedules it if it failed and the maximum
+// number of attempts has not been reached. A nil logEntry drops the delivery
+// without logging.
+func (d *webhookDispatcher) finishDelivery(delivery *webhookDelivery, logEntry *webhookDeliveryLog) error {
+	return d.db.Update(func(tx *bbolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBkt)
+		if queue == nil {
+			return nil
+		}
+		key := uint64Bytes(delivery.ID)
+		if logEntry == nil {
+			return queue.Delete(key)
+		}
+
+		if !logEntry.Delivered && delivery.Attempts < webhookMaxAttempts {
+			delivery.NextAttempt = time.Now().Add(webhookRetryDelay(delivery.Attempts))
+			next := delivery.NextAttempt.UTC()
+			logEntry.NextAttempt = &next
+			v, err := json.Marshal(delivery)
+			if err != nil {
+				return err
+			}
+			if err = queue.Put(key, v); err != nil {
+				return err
+			}
+		} else if err := queue.Delete(key); err != nil {
+			return err
+		}
+
+		return appendWebhookLog(tx, delivery.HookID, logEntry)
+	})
+}
+
+// webhookRetryDelay is the backoff before the next attempt after the given
+// number of failed attempts.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= webhookRetryMax {
+			return webhookRetryMax
+		}
+	}
+	return delay
+}
+
+// appendWebhookLog adds an entry to the webhook's delivery log, discarding
+// the oldest entries once there are more than webhookLogsPerHook.
+func appendWebhookLog(tx *bbolt.Tx, hookID string, logEntry *webhookDeliveryLog) error {
+	logsBucket, err := tx.CreateBucketIfNotExists(webhookLogsBkt)
+	if err != nil {
+		return err
+	}
+	hookLogs, err := logsBucket.CreateBucketIfNotExists([]byte(hookID))
+	if err != nil {
+		return err
+	}
+	seq, err := hookLogs.NextSequence()
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(logEntry)
+	if err != nil {
+		return err
+	}
+	if err = hookLogs.Put(uint64Bytes(seq), v); err != nil {
+		return err
+	}
+	return trimLog(hookLogs, seq, webhookLogsPerHook)
+}
+
+// signWebhookPayload returns the value of the signature header for the
+// payload, a hex encoded HMAC-SHA256 of the payload keyed with the webhook's
+// secret.
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func getWebhook(tx *bbolt.Tx, id string) (*webhook, error) {
+	hooksBucket := tx.Bucket(webhooksBkt)
+	if hooksBucket == nil {
+		return nil, nil
+	}
+	v := hooksBucket.Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	hook := new(webhook)
+	if err := json.Unmarshal(v, hook); err != nil {
+		return nil, fmt.Errorf("failed to decode webhook record: %w", err)
+	}
+	return hook, nil
+}
+
+func putWebhook(tx *bbolt.Tx, hook *webhook) error {
+	hooksBucket, err := tx.CreateBucketIfNotExists(webhooksBkt)
+	if err != nil {
+		return fmt.Errorf("failed to open db record for webhooks: %w", err)
+	}
+	v, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	return hooksBucket.Put([]byte(hook.ID), v)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type webhookRequest struct {
+	URL              string   `json:"url"`
+	Events           []string `json:"events"`
+	Category         string   `json:"category"`
+	ReminderInterval string   `json:"reminderInterval"`
+	Secret           string   `json:"secret"`
+}
+
+func (api *apiServer) createWebhook(w http.ResponseWriter, r *http.Request) {
+	req := new(webhookRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeError(w, "invalid webhook request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hookURL, err := url.Parse(req.URL)
+	if err != nil || (hookURL.Scheme != "http" && hookURL.Scheme != "https") || hookURL.Host == "" {
+		writeError(w, "webhook url must be an absolute http or https url", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		writeError(w, "no webhook events specified", http.StatusBadRequest)
+		return
+	}
+	var wantsReminders bool
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			writeError(w, "unknown webhook event "+event, http.StatusBadRequest)
+			return
+		}
+		wantsReminders = wantsReminders || event == eventReminderDue
+	}
+
+	now := time.Now().UTC()
+	hook := &webhook{
+		URL:       hookURL.String(),
+		Events:    req.Events,
+		Category:  req.Category,
+		Secret:    req.Secret,
+		CreatedAt: now,
+	}
+	if wantsReminders {
+		if req.Category == "" {
+			writeError(w, "reminder.due webhooks require a category", http.StatusBadRequest)
+			return
+		}
+		interval, err := time.ParseDuration(req.ReminderInterval)
+		if err != nil || interval < minReminderInterval {
+			writeError(w, fmt.Sprintf("reminder.due webhooks require a reminderInterval of at least %v", minReminderInterval),
+				http.StatusBadRequest)
+			return
+		}
+		hook.ReminderInterval = interval.String()
+		next := now.Add(interval)
+		hook.NextReminder = &next
+	}
+
+	if hook.ID, err = randomHex(8); err == nil && hook.Secret == "" {
+		hook.Secret, err = randomHex(32)
+	}
+	if err != nil {
+		reqLog(r).Errorf("Error generating webhook id or secret: %v", err)
+		writeError(w, "error creating webhook", http.StatusInternalServerError)
+		return
+	}
+
+	err = api.db.Update(func(tx *bbolt.Tx) error {
+		if err := putWebhook(tx, hook); err != nil {
+			return err
+		}
+		return recordAudit(tx, requestActor(r), &auditEntry{
+			Action: client.AuditWebhookCreated,
+			Target: hook.ID,
+			Detail: hook.URL,
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error saving webhook: %v", err)
+		writeError(w, "error creating webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// The secret is returned this one time so the receiver can verify
+	// signatures.
+	writeJSONWithStatus(w, hook, http.StatusCreated)
+}
+
+func (api *apiServer) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	hooks := make([]*webhook, 0)
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		hooksBucket := tx.Bucket(webhooksBkt)
+		if hooksBucket == nil {
+			return nil
+		}
+		return hooksBucket.ForEach(func(_, v []byte) error {
+			hook := new(webhook)
+			if err := json.Unmarshal(v, hook); err != nil {
+				return fmt.Errorf("failed to decode webhook record: %w", err)
+			}
+			hook.Secret = ""
+			hooks = append(hooks, hook)
+			return nil
+		})
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching webhooks from db: %v", err)
+		writeError(w, "error fetching webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, hooks)
+}
+
+func (api *apiServer) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := []byte(chi.URLParam(r, "id"))
+	var found bool
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		hooksBucket := tx.Bucket(webhooksBkt)
+		if hooksBucket == nil || hooksBucket.Get(id) == nil {
+			return nil
+		}
+		found = true
+		if err := hooksBucket.Delete(id); err != nil {
+			return err
+		}
+		err := recordAudit(tx, requestActor(r), &auditEntry{
+			Action: client.AuditWebhookDeleted,
+			Target: string(id),
+		})
+		if err != nil {
+			return err
+		}
+		// Queued deliveries are dropped by the dispatcher once it finds
+		// that their webhook no longer exists.
+		if logsBucket := tx.Bucket(webhookLogsBkt); logsBucket != nil && logsBucket.Bucket(id) != nil {
+			return logsBucket.DeleteBucket(id)
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error deleting webhook: %v", err)
+		writeError(w, "error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pingWebhook queues a ping event for the webhook so that receivers can be
+// tested without waiting for a library change.
+func (api *apiServer) pingWebhook(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	var found bool
+	err := api.db.Update(func(tx *bbolt.Tx) error {
+		hook, err := getWebhook(tx, id)
+		if err != nil || hook == nil {
+			return err
+		}
+		found = true
+		payload, err := newWebhookPayload(eventPing, hook.Category, nil)
+		if err != nil {
+			return err
+		}
+		return queueWebhookDelivery(tx, hook.ID, eventPing, payload)
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error queueing webhook ping: %v", err)
+		writeError(w, "error pinging webhook", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	api.webhooks.wake()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// webhookDeliveries lists the logged delivery attempts for a webhook, most
+// recent first.
+func (api *apiServer) webhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	logs := make([]*webhookDeliveryLog, 0)
+	var found bool
+	err := api.db.View(func(tx *bbolt.Tx) error {
+		hook, err := getWebhook(tx, id)
+		if err != nil || hook == nil {
+			return err
+		}
+		found = true
+		logsBucket := tx.Bucket(webhookLogsBkt)
+		if logsBucket == nil {
+			return nil
+		}
+		hookLogs := logsBucket.Bucket([]byte(id))
+		if hookLogs == nil {
+			return nil
+		}
+		entries := hookLogs.Cursor()
+		for k, v := entries.Last(); k != nil; k, v = entries.Prev() {
+			logEntry := new(webhookDeliveryLog)
+			if err := json.Unmarshal(v, logEntry); err != nil {
+				return fmt.Errorf("failed to decode webhook delivery log: %w", err)
+			}
+			logs = append(logs, logEntry)
+		}
+		return nil
+	})
+	if err != nil {
+		reqLog(r).Errorf("Error fetching webhook deliveries from db: %v", err)
+		writeError(w, "error fetching webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "webhook not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, logs)
+}
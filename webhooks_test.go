@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// openTestDB opens the db at path, creating it if needed, and brings it up
+// to the current layout. The db is closed when the test ends.
+func openTestDB(t *testing.T, path string) *bbolt.DB {
+	t.Helper()
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = upgradeDB(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func queuedWebhookDeliveries(t *testing.T, db *bbolt.DB) []*webhookDelivery {
+	t.Helper()
+	var deliveries []*webhookDelivery
+	err := db.View(func(tx *bbolt.Tx) error {
+		queue := tx.Bucket(webhookQueueBkt)
+		if queue == nil {
+			return nil
+		}
+		return queue.ForEach(func(_, v []byte) error {
+			delivery := new(webhookDelivery)
+			deliveries = append(deliveries, delivery)
+			return json.Unmarshal(v, delivery)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func webhookLogEntries(t *testing.T, db *bbolt.DB, hookID string) []*webhookDeliveryLog {
+	t.Helper()
+	var entries []*webhookDeliveryLog
+	err := db.View(func(tx *bbolt.Tx) error {
+		logsBucket := tx.Bucket(webhookLogsBkt)
+		if logsBucket == nil || logsBucket.Bucket([]byte(hookID)) == nil {
+			return nil
+		}
+		return logsBucket.Bucket([]byte(hookID)).ForEach(func(_, v []byte) error {
+			entry := new(webhookDeliveryLog)
+			entries = append(entries, entry)
+			return json.Unmarshal(v, entry)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	const secret = "s3cret"
+	var mtx sync.Mutex
+	var payloads [][]byte
+	requests := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(payloads)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(webhookSignatureHdr) != want {
+			t.Errorf("wrong signature %q, want %q", r.Header.Get(webhookSignatureHdr), want)
+		}
+		if event := r.Header.Get(webhookEventHdr); event != eventItemCreated {
+			t.Errorf("wrong event header %q", event)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		payloads = append(payloads, body)
+		// Fail the first attempt so that the delivery is retried.
+		if len(payloads) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	db := openTestDB(t, dbPath)
+	hook := &webhook{
+		ID:        "hook",
+		URL:       srv.URL,
+		Events:    []string{eventItemCreated},
+		Category:  "todo",
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if err := putWebhook(tx, hook); err != nil {
+			return err
+		}
+		item := &Item{Name: "milk", Type: "text", Content: []byte("buy milk")}
+		if err := queueWebhookEvent(tx, eventItemCreated, "todo", item); err != nil {
+			return err
+		}
+		// Neither of these is wanted by the webhook.
+		if err := queueWebhookEvent(tx, eventItemDeleted, "todo", item); err != nil {
+			return err
+		}
+		return queueWebhookEvent(tx, eventItemCreated, "other", item)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued deliveries survive a restart.
+	db.Close()
+	db = openTestDB(t, dbPath)
+	if queued := queuedWebhookDeliveries(t, db); len(queued) != 1 {
+		t.Fatalf("%d deliveries queued, want 1", len(queued))
+	}
+
+	d := newWebhookDispatcher(db)
+	before := time.Now()
+	d.deliverDue(context.Background())
+	queued := queuedWebhookDeliveries(t, db)
+	if len(queued) != 1 {
+		t.Fatalf("failed delivery not requeued, %d deliveries queued", len(queued))
+	}
+	retry := queued[0]
+	if retry.Attempts != 1 {
+		t.Errorf("%d attempts recorded, want 1", retry.Attempts)
+	}
+	if earliest := before.Add(webhookRetryDelay(1)); retry.NextAttempt.Before(earliest) {
+		t.Errorf("retry at %v, want after %v", retry.NextAttempt, earliest)
+	}
+	logs := webhookLogEntries(t, db, hook.ID)
+	if len(logs) != 1 || logs[0].Delivered || logs[0].StatusCode != http.StatusServiceUnavailable || logs[0].NextAttempt == nil {
+		t.Fatalf("wrong log of failed delivery: %+v", logs)
+	}
+
+	// The retry is not attempted before it is due.
+	d.deliverDue(context.Background())
+	if n := requests(); n != 1 {
+		t.Fatalf("retry attempted early, %d requests", n)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		retry.NextAttempt = time.Now()
+		v, err := json.Marshal(retry)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(webhookQueueBkt).Put(uint64Bytes(retry.ID), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.deliverDue(context.Background())
+	if queued = queuedWebhookDeliveries(t, db); len(queued) != 0 {
+		t.Fatalf("%d deliveries left in the queue after success", len(queued))
+	}
+	logs = webhookLogEntries(t, db, hook.ID)
+	if len(logs) != 2 || !logs[1].Delivered || logs[1].Attempt != 2 || logs[1].NextAttempt != nil {
+		t.Fatalf("wrong log of successful delivery: %+v", logs[1:])
+	}
+
+	if n := requests(); n != 2 {
+		t.Fatalf("%d requests, want 2", n)
+	}
+	payload := new(webhookPayload)
+	if err = json.Unmarshal(payloads[1], payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != eventItemCreated || payload.Category != "todo" || payload.Item == nil ||
+		payload.Item.Name != "milk" || payload.Item.Content != "buy milk" {
+		t.Errorf("wrong payload %s", payloads[1])
+	}
+}
+
+func TestWebhookDeliveryGivesUp(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer srv.Close()
+
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	hook := &webhook{ID: "hook", URL: srv.URL, Events: []string{eventPing}, Secret: "key"}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		if err := putWebhook(tx, hook); err != nil {
+			return err
+		}
+		return queueWebhookDelivery(tx, hook.ID, eventPing, []byte(`{}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newWebhookDispatcher(db)
+	delivery := queuedWebhookDeliveries(t, db)[0]
+	delivery.Attempts = webhookMaxAttempts - 1
+	logEntry := d.deliver(context.Background(), hook, delivery)
+	if err = d.finishDelivery(delivery, logEntry); err != nil {
+		t.Fatal(err)
+	}
+	if queued := queuedWebhookDeliveries(t, db); len(queued) != 0 {
+		t.Errorf("delivery still queued after %d attempts", webhookMaxAttempts)
+	}
+	logs := webhookLogEntries(t, db, hook.ID)
+	if len(logs) != 1 || logs[0].Delivered || logs[0].NextAttempt != nil {
+		t.Errorf("wrong log of abandoned delivery: %+v", logs)
+	}
+}
+
+func TestWebhookDeliveryToDeletedHook(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	err := db.Update(func(tx *bbolt.Tx) error {
+		return queueWebhookDelivery(tx, "deleted", eventPing, []byte(`{}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWebhookDispatcher(db).deliverDue(context.Background())
+	if queued := queuedWebhookDeliveries(t, db); len(queued) != 0 {
+		t.Errorf("delivery for a deleted webhook still queued")
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, webhookRetryBase},
+		{2, 2 * webhookRetryBase},
+		{3, 4 * webhookRetryBase},
+		{10, 512 * webhookRetryBase},
+		{11, webhookRetryMax},
+		{100, webhookRetryMax},
+	}
+	for _, test := range tests {
+		if delay := webhookRetryDelay(test.attempts); delay != test.delay {
+			t.Errorf("delay after %d attempts is %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+}
+
+func TestWebhookLogTrimmed(t *testing.T) {
+	db := openTestDB(t, filepath.Join(t.TempDir(), "test.db"))
+	const extra = 5
+	err := db.Update(func(tx *bbolt.Tx) error {
+		for i := 1; i <= webhookLogsPerHook+extra; i++ {
+			if err := appendWebhookLog(tx, "hook", &webhookDeliveryLog{DeliveryID: uint64(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := webhookLogEntries(t, db, "hook")
+	if len(logs) != webhookLogsPerHook {
+		t.Fatalf("%d log entries kept, want %d", len(logs), webhookLogsPerHook)
+	}
+	if first, last := logs[0].DeliveryID, logs[len(logs)-1].DeliveryID; first != extra+1 || last != webhookLogsPerHook+extra {
+		t.Errorf("kept entries %d to %d, want the newest", first, last)
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	// The example from RFC 4231, test case 2.
+	sig := signWebhookPayload("Jefe", []byte("what do ya want for nothing?"))
+	want := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if sig != want {
+		t.Errorf("signature %s, want %s", sig, want)
+	}
+}